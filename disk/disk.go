@@ -186,6 +186,8 @@ func (d *Disk) CreateFilesystem(spec FilesystemSpec) (filesystem.FileSystem, err
 		return fat32.Create(d.File, size, start, d.LogicalBlocksize, spec.VolumeLabel)
 	case filesystem.TypeISO9660:
 		return iso9660.Create(d.File, size, start, d.LogicalBlocksize, spec.WorkDir)
+	case filesystem.TypeExt4:
+		return ext4.Create(d.File, size, start, d.LogicalBlocksize, &ext4.Params{VolumeName: spec.VolumeLabel})
 	default:
 		return nil, errors.New("Unknown filesystem type requested")
 	}
@@ -224,7 +226,11 @@ func (d *Disk) GetFilesystem(partition int) (filesystem.FileSystem, error) {
 
 	// just try each type
 	log.Debug("trying ext4")
-	ext4FS, err := ext4.Read(d.File, size, start, d.LogicalBlocksize)
+	readExt4 := ext4.Read
+	if !d.Writable {
+		readExt4 = ext4.ReadOnly
+	}
+	ext4FS, err := readExt4(d.File, size, start, d.LogicalBlocksize)
 	if err == nil {
 		return ext4FS, nil
 	}
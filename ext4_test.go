@@ -40,7 +40,10 @@ func TestGetInode(t *testing.T) {
 	inode := fs.(*ext4.FileSystem).GetInode(2) // root /
 	t.Logf("inode 2:[%#v]\n", inode)
 
-	dirContents := inode.ReadDirectory()
+	dirContents, err := inode.ReadDirectory()
+	if err != nil {
+		t.Fatal(err)
+	}
 	for i, e := range dirContents {
 		t.Logf("%d: [%#v]\n", i, e)
 	}
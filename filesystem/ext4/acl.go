@@ -0,0 +1,256 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// tags of POSIX ACL entries
+const (
+	ACL_USER_OBJ  = 0x01
+	ACL_USER      = 0x02
+	ACL_GROUP_OBJ = 0x04
+	ACL_GROUP     = 0x08
+	ACL_MASK      = 0x10
+	ACL_OTHER     = 0x20
+)
+
+// names of the extended attributes holding ACLs and file capabilities
+const (
+	PosixACLAccessName  = "system.posix_acl_access"
+	PosixACLDefaultName = "system.posix_acl_default"
+	CapabilityXattrName = "security.capability"
+)
+
+// ACL_UNDEFINED_ID is the id of ACL entries that are not for a particular user or group
+const ACL_UNDEFINED_ID = 0xFFFFFFFF
+
+// versions of the ACL formats of setxattr(2) and of ext4 on disk
+const (
+	aclXattrVersion = 2
+	aclDiskVersion  = 1
+)
+
+// ACLEntry is a single entry of a POSIX access control list
+type ACLEntry struct {
+	// Tag is what the entry applies to, one of the ACL_ constants
+	Tag uint16
+	// Perm holds the read, write and execute permissions as 4, 2 and 1
+	Perm uint16
+	// ID is the uid or gid of ACL_USER and ACL_GROUP entries
+	ID uint32
+}
+
+// EncodePosixACL encodes acl as the value of system.posix_acl_access or
+// system.posix_acl_default for SetXattr, in the form used by setxattr(2)
+func EncodePosixACL(acl []ACLEntry) []byte {
+	b := make([]byte, 4+8*len(acl))
+	binary.LittleEndian.PutUint32(b, aclXattrVersion)
+	for i, e := range acl {
+		p := b[4+8*i:]
+		id := e.ID
+		if e.Tag != ACL_USER && e.Tag != ACL_GROUP {
+			id = ACL_UNDEFINED_ID
+		}
+		binary.LittleEndian.PutUint16(p[0:], e.Tag)
+		binary.LittleEndian.PutUint16(p[2:], e.Perm)
+		binary.LittleEndian.PutUint32(p[4:], id)
+	}
+	return b
+}
+
+// DecodePosixACL decodes the value of system.posix_acl_access or system.posix_acl_default as
+// returned by GetXattr
+func DecodePosixACL(b []byte) ([]ACLEntry, error) {
+	if len(b) < 4 || (len(b)-4)%8 != 0 {
+		return nil, fmt.Errorf("invalid POSIX ACL of %d bytes", len(b))
+	}
+	if v := binary.LittleEndian.Uint32(b); v != aclXattrVersion {
+		return nil, fmt.Errorf("unsupported POSIX ACL version %d", v)
+	}
+	acl := []ACLEntry{}
+	for p := b[4:]; len(p) > 0; p = p[8:] {
+		e := ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(p[0:]),
+			Perm: binary.LittleEndian.Uint16(p[2:]),
+		}
+		if e.Tag == ACL_USER || e.Tag == ACL_GROUP {
+			e.ID = binary.LittleEndian.Uint32(p[4:])
+		}
+		acl = append(acl, e)
+	}
+	return acl, nil
+}
+
+// aclToDisk converts an ACL in the form used by setxattr(2) to the more compact one of ext4, in
+// which only the entries for a particular user or group have an id
+func aclToDisk(b []byte) ([]byte, error) {
+	acl, err := DecodePosixACL(b)
+	if err != nil {
+		return nil, err
+	}
+	d := make([]byte, 4, 4+8*len(acl))
+	binary.LittleEndian.PutUint32(d, aclDiskVersion)
+	for _, e := range acl {
+		p := make([]byte, 8)
+		binary.LittleEndian.PutUint16(p[0:], e.Tag)
+		binary.LittleEndian.PutUint16(p[2:], e.Perm)
+		switch e.Tag {
+		case ACL_USER, ACL_GROUP:
+			binary.LittleEndian.PutUint32(p[4:], e.ID)
+		case ACL_USER_OBJ, ACL_GROUP_OBJ, ACL_MASK, ACL_OTHER:
+			p = p[:4]
+		default:
+			return nil, fmt.Errorf("invalid POSIX ACL entry tag %#x", e.Tag)
+		}
+		d = append(d, p...)
+	}
+	return d, nil
+}
+
+// aclFromDisk converts an ACL as stored by ext4 to the form used by getxattr(2)
+func aclFromDisk(d []byte) ([]byte, error) {
+	if len(d) < 4 || binary.LittleEndian.Uint32(d) != aclDiskVersion {
+		return nil, fmt.Errorf("invalid ext4 POSIX ACL")
+	}
+	acl := []ACLEntry{}
+	for p := d[4:]; len(p) > 0; {
+		if len(p) < 4 {
+			return nil, fmt.Errorf("truncated ext4 POSIX ACL entry")
+		}
+		e := ACLEntry{
+			Tag:  binary.LittleEndian.Uint16(p[0:]),
+			Perm: binary.LittleEndian.Uint16(p[2:]),
+		}
+		switch e.Tag {
+		case ACL_USER, ACL_GROUP:
+			if len(p) < 8 {
+				return nil, fmt.Errorf("truncated ext4 POSIX ACL entry")
+			}
+			e.ID = binary.LittleEndian.Uint32(p[4:])
+			p = p[8:]
+		case ACL_USER_OBJ, ACL_GROUP_OBJ, ACL_MASK, ACL_OTHER:
+			p = p[4:]
+		default:
+			return nil, fmt.Errorf("invalid ext4 POSIX ACL entry tag %#x", e.Tag)
+		}
+		acl = append(acl, e)
+	}
+	return EncodePosixACL(acl), nil
+}
+
+// capabilities, as bit numbers in the sets of Capabilities
+const (
+	CAP_CHOWN              = 0
+	CAP_DAC_OVERRIDE       = 1
+	CAP_DAC_READ_SEARCH    = 2
+	CAP_FOWNER             = 3
+	CAP_FSETID             = 4
+	CAP_KILL               = 5
+	CAP_SETGID             = 6
+	CAP_SETUID             = 7
+	CAP_SETPCAP            = 8
+	CAP_LINUX_IMMUTABLE    = 9
+	CAP_NET_BIND_SERVICE   = 10
+	CAP_NET_BROADCAST      = 11
+	CAP_NET_ADMIN          = 12
+	CAP_NET_RAW            = 13
+	CAP_IPC_LOCK           = 14
+	CAP_IPC_OWNER          = 15
+	CAP_SYS_MODULE         = 16
+	CAP_SYS_RAWIO          = 17
+	CAP_SYS_CHROOT         = 18
+	CAP_SYS_PTRACE         = 19
+	CAP_SYS_PACCT          = 20
+	CAP_SYS_ADMIN          = 21
+	CAP_SYS_BOOT           = 22
+	CAP_SYS_NICE           = 23
+	CAP_SYS_RESOURCE       = 24
+	CAP_SYS_TIME           = 25
+	CAP_SYS_TTY_CONFIG     = 26
+	CAP_MKNOD              = 27
+	CAP_LEASE              = 28
+	CAP_AUDIT_WRITE        = 29
+	CAP_AUDIT_CONTROL      = 30
+	CAP_SETFCAP            = 31
+	CAP_MAC_OVERRIDE       = 32
+	CAP_MAC_ADMIN          = 33
+	CAP_SYSLOG             = 34
+	CAP_WAKE_ALARM         = 35
+	CAP_BLOCK_SUSPEND      = 36
+	CAP_AUDIT_READ         = 37
+	CAP_PERFMON            = 38
+	CAP_BPF                = 39
+	CAP_CHECKPOINT_RESTORE = 40
+)
+
+// revisions and flags of the value of security.capability
+const (
+	vfsCapRevisionMask   = 0xFF000000
+	vfsCapRevision1      = 0x01000000
+	vfsCapRevision2      = 0x02000000
+	vfsCapRevision3      = 0x03000000
+	vfsCapFlagsEffective = 0x000001
+	vfsCapRevision1Size  = 4 + 8
+	vfsCapRevision2Size  = 4 + 16
+	vfsCapRevision3Size  = 4 + 16 + 4
+)
+
+// Capabilities are the file capabilities of an executable, as in security.capability
+type Capabilities struct {
+	// Permitted and Inheritable are sets of capabilities, with bit n for capability n
+	Permitted   uint64
+	Inheritable uint64
+	// Effective raises the permitted capabilities into the effective set on execution
+	Effective bool
+	// RootID is the uid of root in the user namespace the capabilities are for, 0 for the
+	// initial one
+	RootID uint32
+}
+
+// Encode returns c as the value of security.capability, as setcap(8) would write it
+func (c Capabilities) Encode() []byte {
+	size, magic := vfsCapRevision2Size, uint32(vfsCapRevision2)
+	if c.RootID != 0 {
+		size, magic = vfsCapRevision3Size, vfsCapRevision3
+	}
+	if c.Effective {
+		magic |= vfsCapFlagsEffective
+	}
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint32(b[0:], magic)
+	binary.LittleEndian.PutUint32(b[4:], uint32(c.Permitted))
+	binary.LittleEndian.PutUint32(b[8:], uint32(c.Inheritable))
+	binary.LittleEndian.PutUint32(b[12:], uint32(c.Permitted>>32))
+	binary.LittleEndian.PutUint32(b[16:], uint32(c.Inheritable>>32))
+	if c.RootID != 0 {
+		binary.LittleEndian.PutUint32(b[20:], c.RootID)
+	}
+	return b
+}
+
+// DecodeCapabilities decodes the value of security.capability
+func DecodeCapabilities(b []byte) (Capabilities, error) {
+	c := Capabilities{}
+	if len(b) < 4 {
+		return c, fmt.Errorf("invalid file capabilities of %d bytes", len(b))
+	}
+	magic := binary.LittleEndian.Uint32(b)
+	c.Effective = magic&vfsCapFlagsEffective != 0
+	revision := magic & vfsCapRevisionMask
+	switch {
+	case revision == vfsCapRevision1 && len(b) == vfsCapRevision1Size:
+	case revision == vfsCapRevision2 && len(b) == vfsCapRevision2Size:
+	case revision == vfsCapRevision3 && len(b) == vfsCapRevision3Size:
+		c.RootID = binary.LittleEndian.Uint32(b[20:])
+	default:
+		return c, fmt.Errorf("unsupported file capabilities revision %#x of %d bytes", revision>>24, len(b))
+	}
+	c.Permitted = uint64(binary.LittleEndian.Uint32(b[4:]))
+	c.Inheritable = uint64(binary.LittleEndian.Uint32(b[8:]))
+	if revision != vfsCapRevision1 {
+		c.Permitted |= uint64(binary.LittleEndian.Uint32(b[12:])) << 32
+		c.Inheritable |= uint64(binary.LittleEndian.Uint32(b[16:])) << 32
+	}
+	return c, nil
+}
@@ -0,0 +1,287 @@
+package ext4
+
+import (
+	"fmt"
+)
+
+// The allocator follows the kernel. New directories are placed Orlov-style: those at the top of
+// the tree are spread out over the filesystem, to the least used part of it, and those below
+// are kept near their parent unless that part is getting crowded. Files go with their
+// directory. Blocks are taken near a goal, right after those the file already has, and in runs
+// as long as the write that needs them where possible. With flex_bg the groups of a flex group
+// are treated as one, as their metadata is packed together anyway.
+
+// allocStats are the free inodes, free blocks and directories of a group, or of all the groups
+// of a flex group
+type allocStats struct {
+	freeInodes, freeBlocks, dirs int64
+}
+
+// allocUnit returns how many groups the allocator treats as one: those of a flex group with
+// flex_bg, otherwise a single one
+func (sb *Superblock) allocUnit() int64 {
+	if sb.FeatureIncompatFlex_bg() {
+		return sb.GetGroupsPerFlex()
+	}
+	return 1
+}
+
+// allocStats returns the stats of each unit of allocation
+func (fs *FileSystem) allocStats() []allocStats {
+	sb := fs.sb
+	unit := sb.allocUnit()
+	groups := sb.BlockGroupCount()
+	stats := make([]allocStats, (groups+unit-1)/unit)
+	for g := int64(0); g < groups; g++ {
+		bgd := fs.getBlockGroupDescriptor(g)
+		s := &stats[g/unit]
+		s.freeInodes += bgd.GetFreeInodesCount()
+		s.freeBlocks += bgd.GetFreeBlocksCount()
+		s.dirs += bgd.GetUsedDirsCount()
+	}
+	return stats
+}
+
+// newInode allocates an inode for a new file under directory parent, or for a new directory if
+// dir is set; the inode is placed as if under the root if parent is nil
+func (fs *FileSystem) newInode(parent *Inode, dir bool) (*Inode, error) {
+	sb := fs.sb
+	stats := fs.allocStats()
+	var u int64
+	if dir {
+		u = fs.orlovUnit(parent, stats)
+	} else {
+		u = fs.otherUnit(parent, stats)
+	}
+	if u < 0 {
+		return nil, fmt.Errorf("no free inodes left")
+	}
+	groups := sb.BlockGroupCount()
+	for i := int64(0); i < groups; i++ {
+		bgd := fs.getBlockGroupDescriptor((u*sb.allocUnit() + i) % groups)
+		if bgd.GetFreeInodesCount() == 0 {
+			continue
+		}
+		if inode := bgd.GetFreeInode(); inode != nil {
+			return inode, nil
+		}
+	}
+	return nil, fmt.Errorf("no free inodes left")
+}
+
+// parentUnit returns the unit of allocation holding the inode of directory parent
+func (fs *FileSystem) parentUnit(parent *Inode) int64 {
+	if parent == nil {
+		return 0
+	}
+	return (parent.num - 1) / int64(fs.sb.InodePer_group) / fs.sb.allocUnit()
+}
+
+// orlovUnit picks the unit of allocation for a new directory under parent, or -1 if there are
+// no free inodes left
+func (fs *FileSystem) orlovUnit(parent *Inode, stats []allocStats) int64 {
+	sb := fs.sb
+	n := int64(len(stats))
+	total := allocStats{}
+	for _, s := range stats {
+		total.freeInodes += s.freeInodes
+		total.freeBlocks += s.freeBlocks
+		total.dirs += s.dirs
+	}
+	avefreei, avefreeb := total.freeInodes/n, total.freeBlocks/n
+	pu := fs.parentUnit(parent)
+
+	if parent == nil || parent.num == ROOT_INO || parent.Flags&TOPDIR_FL != 0 {
+		// the unit with the fewest directories among those with more free space than average;
+		// the kernel starts looking at random, starting after as many units as there are
+		// directories spreads them just as well and repeatably
+		best, bestDirs := int64(-1), int64(0)
+		for i := int64(0); i < n; i++ {
+			u := (total.dirs + i) % n
+			s := stats[u]
+			if s.freeInodes == 0 || s.freeInodes < avefreei || s.freeBlocks < avefreeb {
+				continue
+			}
+			if best < 0 || s.dirs < bestDirs {
+				best, bestDirs = u, s.dirs
+			}
+		}
+		if best >= 0 {
+			return best
+		}
+	} else {
+		// the first unit from the parent on that is neither crowded with directories nor short
+		// of free space
+		inodes := int64(sb.InodePer_group) * sb.allocUnit()
+		blocks := int64(sb.BlockPer_group) * sb.allocUnit()
+		maxDirs := total.dirs/n + inodes/16
+		minInodes := avefreei - inodes/4
+		if minInodes < 1 {
+			minInodes = 1
+		}
+		minBlocks := avefreeb - blocks/4
+		for i := int64(0); i < n; i++ {
+			u := (pu + i) % n
+			s := stats[u]
+			if s.dirs >= maxDirs || s.freeInodes < minInodes || s.freeBlocks < minBlocks {
+				continue
+			}
+			return u
+		}
+	}
+
+	// any unit with at least the average of free inodes, then any at all with one
+	for i := int64(0); i < n; i++ {
+		if u := (pu + i) % n; stats[u].freeInodes > 0 && stats[u].freeInodes >= avefreei {
+			return u
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		if u := (pu + i) % n; stats[u].freeInodes > 0 {
+			return u
+		}
+	}
+	return -1
+}
+
+// otherUnit picks the unit of allocation for a new file under parent, or -1 if there are no
+// free inodes left: the unit of the parent itself if it has room, otherwise one found by
+// quadratic probing from a unit that depends on the parent, so that files of the same directory
+// overflow to the same place
+func (fs *FileSystem) otherUnit(parent *Inode, stats []allocStats) int64 {
+	n := int64(len(stats))
+	pu := fs.parentUnit(parent)
+	if s := stats[pu]; s.freeInodes > 0 && s.freeBlocks > 0 {
+		return pu
+	}
+	num := int64(ROOT_INO)
+	if parent != nil {
+		num = parent.num
+	}
+	u := (pu + num) % n
+	for i := int64(1); i < n; i <<= 1 {
+		u = (u + i) % n
+		if s := stats[u]; s.freeInodes > 0 && s.freeBlocks > 0 {
+			return u
+		}
+	}
+	for i := int64(0); i < n; i++ {
+		if u := (pu + i) % n; stats[u].freeInodes > 0 {
+			return u
+		}
+	}
+	return -1
+}
+
+// dataGoal returns where to look first for blocks of the inode that have nothing to follow on
+// from: the start of its group, or with flex_bg of its flex group, where as in the kernel a
+// regular file starts looking a group further, leaving the first group to directories
+func (inode *Inode) dataGoal() int64 {
+	sb := inode.fs.sb
+	g := (inode.num - 1) / int64(sb.InodePer_group)
+	if unit := sb.allocUnit(); unit >= 4 {
+		g -= g % unit
+		if inode.Mode&S_IFMT == S_IFREG && g+1 < sb.BlockGroupCount() {
+			g++
+		}
+	}
+	return sb.groupFirstBlock(g)
+}
+
+// allocBlocks allocates up to n blocks in a single run near goal. The blocks from goal itself
+// are taken if it is free, for a file to grow contiguously; otherwise the first run of n free
+// blocks from goal on, or as many as a group holds, and only if there is none anywhere the
+// first free blocks from goal on. It returns the first block allocated and how many were,
+// which is 0 when there is no space left.
+func (fs *FileSystem) allocBlocks(goal, n int64) (int64, int64, error) {
+	sb := fs.sb
+	if goal < int64(sb.First_data_block) || goal >= sb.GetBlockCount() {
+		goal = int64(sb.First_data_block)
+	}
+	bpg := int64(sb.BlockPer_group)
+	want := n
+	if want > bpg {
+		want = bpg
+	}
+	groups := sb.BlockGroupCount()
+	goalGroup, goalOffset := fs.blockGroupOf(goal)
+	for _, min := range []int64{want, 1} {
+		// the group of the goal comes around again at the end, for the part before the goal
+		for i := int64(0); i <= groups; i++ {
+			g := (goalGroup + i) % groups
+			bgd := fs.getBlockGroupDescriptor(g)
+			if bgd.GetFreeBlocksCount() < min {
+				continue
+			}
+			bitmap, err := bgd.blockBitmap()
+			if err != nil {
+				return 0, 0, err
+			}
+			from := int64(0)
+			if i == 0 {
+				from = goalOffset
+				if min == want && bitmap[from/8]&(1<<uint(from%8)) == 0 {
+					return bgd.takeBlocks(bitmap, from, n)
+				}
+			}
+			if start := freeRun(bitmap, from, bpg, min); start >= 0 {
+				return bgd.takeBlocks(bitmap, start, n)
+			}
+		}
+	}
+	return 0, 0, nil
+}
+
+// freeRun returns the index of the first run of at least min clear bits in bitmap from index
+// from up to end, or -1 if there is none
+func freeRun(bitmap []byte, from, end, min int64) int64 {
+	start, length := int64(-1), int64(0)
+	for i := from; i < end; i++ {
+		if bitmap[i/8]&(1<<uint(i%8)) != 0 {
+			length = 0
+			continue
+		}
+		if length == 0 {
+			start = i
+		}
+		if length++; length >= min {
+			return start
+		}
+	}
+	return -1
+}
+
+// blockBitmap reads the block bitmap of the group, or builds it if the group is BLOCK_UNINIT
+func (bgd *GroupDescriptor) blockBitmap() ([]byte, error) {
+	if bgd.Flags&BG_BLOCK_UNINIT != 0 {
+		return bgd.initBlockBitmap(), nil
+	}
+	return bgd.fs.readBlock(bgd.GetBlockBitmapLoc())
+}
+
+// takeBlocks allocates the run of up to n free blocks at index i of the group, given its block
+// bitmap, returning the first block and how many were allocated. The bitmap is written back,
+// and so the group is no longer BLOCK_UNINIT.
+func (bgd *GroupDescriptor) takeBlocks(bitmap []byte, i, n int64) (int64, int64, error) {
+	sb := bgd.fs.sb
+	bpg := int64(sb.BlockPer_group)
+	count := int64(0)
+	for ; count < n && i+count < bpg; count++ {
+		j := i + count
+		if bitmap[j/8]&(1<<uint(j%8)) != 0 {
+			break
+		}
+		bitmap[j/8] |= 1 << uint(j%8)
+	}
+	if err := bgd.fs.writeBlock(bgd.GetBlockBitmapLoc(), bitmap); err != nil {
+		return 0, 0, err
+	}
+	bgd.Flags &^= BG_BLOCK_UNINIT
+	bgd.setBlockBitmapCsum(bitmap)
+	bgd.setFreeBlocksCount(bgd.GetFreeBlocksCount() - count)
+	bgd.UpdateCsumAndWriteback()
+
+	sb.setFreeBlockCount(sb.GetFreeBlockCount() - count)
+	sb.UpdateCsumAndWriteback()
+	return sb.groupFirstBlock(bgd.num) + i, count, nil
+}
@@ -0,0 +1,159 @@
+package ext4
+
+import (
+	"fmt"
+	"time"
+)
+
+// blockRange is a run of contiguous filesystem blocks
+type blockRange struct {
+	start int64
+	count int64
+}
+
+// appendRange adds the run of blocks to ranges, merging it with the last run when contiguous
+func appendRange(ranges []blockRange, start, count int64) []blockRange {
+	if n := len(ranges); n > 0 && ranges[n-1].start+ranges[n-1].count == start {
+		ranges[n-1].count += count
+		return ranges
+	}
+	return append(ranges, blockRange{start: start, count: count})
+}
+
+// readBlock reads filesystem block n
+func (fs *FileSystem) readBlock(n int64) ([]byte, error) {
+	b := make([]byte, fs.sb.GetBlockSize())
+	if _, err := fs.dev.ReadAt(b, fs.start+n*fs.sb.GetBlockSize()); err != nil {
+		return nil, fmt.Errorf("unable to read ext4 block %d: %v", n, err)
+	}
+	return b, nil
+}
+
+// writeBlock writes b to filesystem block n
+func (fs *FileSystem) writeBlock(n int64, b []byte) error {
+	if _, err := fs.dev.WriteAt(b, fs.start+n*fs.sb.GetBlockSize()); err != nil {
+		return fmt.Errorf("unable to write ext4 block %d: %v", n, err)
+	}
+	return nil
+}
+
+// blockGroupOf returns the block group holding block b and the index of b within the group
+func (fs *FileSystem) blockGroupOf(b int64) (int64, int64) {
+	b -= int64(fs.sb.First_data_block)
+	return b / int64(fs.sb.BlockPer_group), b % int64(fs.sb.BlockPer_group)
+}
+
+// freeBlocks returns the given blocks to the free pool, clearing them in the block bitmaps and
+// updating the free counts of their groups and of the superblock
+func (fs *FileSystem) freeBlocks(ranges []blockRange) error {
+	type groupBitmap struct {
+		bgd    *GroupDescriptor
+		bitmap []byte
+		freed  int64
+	}
+	groups := map[int64]*groupBitmap{}
+	order := []int64{}
+	total := int64(0)
+
+	for _, r := range ranges {
+		for b := r.start; b < r.start+r.count; b++ {
+			if b < int64(fs.sb.First_data_block) || b >= fs.sb.GetBlockCount() {
+				return fmt.Errorf("cannot free block %d outside of the filesystem", b)
+			}
+			g, bit := fs.blockGroupOf(b)
+			gb, ok := groups[g]
+			if !ok {
+				bgd := fs.getBlockGroupDescriptor(g)
+				if bgd.Flags&BG_BLOCK_UNINIT != 0 {
+					return fmt.Errorf("cannot free block %d in uninitialized block group %d", b, g)
+				}
+				bitmap, err := fs.readBlock(bgd.GetBlockBitmapLoc())
+				if err != nil {
+					return err
+				}
+				gb = &groupBitmap{bgd: bgd, bitmap: bitmap}
+				groups[g] = gb
+				order = append(order, g)
+			}
+			mask := byte(1) << uint(bit%8)
+			if gb.bitmap[bit/8]&mask == 0 {
+				// already free, do not count it twice
+				continue
+			}
+			gb.bitmap[bit/8] &^= mask
+			gb.freed++
+			total++
+		}
+	}
+
+	for _, g := range order {
+		gb := groups[g]
+		if err := fs.writeBlock(gb.bgd.GetBlockBitmapLoc(), gb.bitmap); err != nil {
+			return err
+		}
+		gb.bgd.setBlockBitmapCsum(gb.bitmap)
+		gb.bgd.setFreeBlocksCount(gb.bgd.GetFreeBlocksCount() + gb.freed)
+		gb.bgd.UpdateCsumAndWriteback()
+	}
+	fs.sb.setFreeBlockCount(fs.sb.GetFreeBlockCount() + total)
+	fs.sb.UpdateCsumAndWriteback()
+	return nil
+}
+
+// freeInode releases an inode that has no links left: all of its blocks and its extended
+// attribute block are freed, it is marked deleted, and it is cleared in the inode bitmap
+func (fs *FileSystem) freeInode(inode *Inode) error {
+	ranges, err := inode.ownedBlocks()
+	if err != nil {
+		return err
+	}
+	if err := fs.freeBlocks(ranges); err != nil {
+		return err
+	}
+	if acl := inode.getFileACL(); acl != 0 {
+		if err := fs.releaseXattrBlock(acl); err != nil {
+			return err
+		}
+	}
+
+	isDir := inode.Mode&S_IFMT == S_IFDIR
+	inode.Links_count = 0
+	inode.Dtime = uint32(time.Now().Unix())
+	inode.SetSize(0)
+	inode.Blocks_lo = 0
+	inode.Blocks_high = 0
+	inode.File_acl_lo = 0
+	inode.File_acl_high = 0
+	if inode.UsesExtents() {
+		inode.setLeafExtents(nil)
+	} else if inode.hasBlockMap() {
+		inode.BlockOrExtents = [60]byte{}
+	}
+	inode.UpdateCsumAndWriteback()
+
+	ipg := int64(fs.sb.InodePer_group)
+	bgd := fs.getBlockGroupDescriptor((inode.num - 1) / ipg)
+	index := (inode.num - 1) % ipg
+	bitmap, err := fs.readBlock(bgd.GetInodeBitmapLoc())
+	if err != nil {
+		return err
+	}
+	mask := byte(1) << uint(index%8)
+	if bitmap[index/8]&mask == 0 {
+		return fmt.Errorf("inode %d is already free", inode.num)
+	}
+	bitmap[index/8] &^= mask
+	if err := fs.writeBlock(bgd.GetInodeBitmapLoc(), bitmap); err != nil {
+		return err
+	}
+	bgd.setInodeBitmapCsum(bitmap)
+	bgd.setFreeInodesCount(bgd.GetFreeInodesCount() + 1)
+	if isDir {
+		bgd.setUsedDirsCount(bgd.GetUsedDirsCount() - 1)
+	}
+	bgd.UpdateCsumAndWriteback()
+
+	fs.sb.Free_inodeCount++
+	fs.sb.UpdateCsumAndWriteback()
+	return nil
+}
@@ -0,0 +1,239 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// the block map of ext2 and ext3 inodes without extents: i_block holds 12 direct block numbers,
+// followed by those of a single, a double and a triple indirect block
+const (
+	directBlocks   = 12
+	indirectLevels = 3
+)
+
+// indirectPath returns the positions leading to logical block num in the block map: first in
+// i_block, then in each indirect block down to the one holding the block number
+func (inode *Inode) indirectPath(num int64) ([]int, error) {
+	if num < directBlocks {
+		return []int{int(num)}, nil
+	}
+	per := inode.fs.sb.GetBlockSize() / 4
+	num -= directBlocks
+	span := int64(1)
+	for level := 1; level <= indirectLevels; level++ {
+		span *= per
+		if num < span {
+			path := []int{directBlocks + level - 1}
+			for l := level - 1; l >= 0; l-- {
+				div := int64(1)
+				for i := 0; i < l; i++ {
+					div *= per
+				}
+				path = append(path, int(num/div%per))
+			}
+			return path, nil
+		}
+		num -= span
+	}
+	return nil, fmt.Errorf("block %d is beyond the block map of inode %d", num, inode.num)
+}
+
+// indirectBlockPtr returns the block number mapped to logical block num, 0 for a hole
+func (inode *Inode) indirectBlockPtr(num int64) (int64, error) {
+	path, err := inode.indirectPath(num)
+	if err != nil {
+		return 0, err
+	}
+	ptr := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*path[0]:]))
+	for _, i := range path[1:] {
+		if ptr == 0 {
+			return 0, nil
+		}
+		ptr = inode.getIndirectBlockPtr(ptr, int64(i))
+	}
+	return ptr, nil
+}
+
+// mapIndirect allocates up to n blocks for the hole at logical block lblk and enters them in the
+// block map, adding indirect blocks where needed. It returns the first block allocated and how
+// many were, never more than the hole.
+func (inode *Inode) mapIndirect(lblk, n int64) (int64, int64, error) {
+	// every block is looked up and entered on its own, so take no more than an indirect block
+	// maps at a time
+	if per := inode.fs.sb.GetBlockSize() / 4; n > per {
+		n = per
+	}
+	holes := int64(0)
+	for ; holes < n; holes++ {
+		ptr, err := inode.indirectBlockPtr(lblk + holes)
+		if err != nil {
+			return 0, 0, err
+		}
+		if ptr != 0 {
+			break
+		}
+	}
+	if holes == 0 {
+		return 0, 0, fmt.Errorf("block %d of inode %d is already mapped", lblk, inode.num)
+	}
+	if max := int64(1) << 32; lblk+holes > max {
+		holes = max - lblk
+	}
+	// the blocks best follow on from the one before them
+	goal := inode.dataGoal()
+	if lblk > 0 {
+		prev, err := inode.indirectBlockPtr(lblk - 1)
+		if err != nil {
+			return 0, 0, err
+		}
+		if prev != 0 {
+			goal = prev + 1
+		}
+	}
+	blockNum, count, err := inode.fs.allocBlocks(goal, holes)
+	if err != nil {
+		return 0, 0, err
+	}
+	if count == 0 {
+		return 0, 0, fmt.Errorf("no space left for inode %d", inode.num)
+	}
+	inode.addBlockCount(count)
+	for i := int64(0); i < count; i++ {
+		if err := inode.setIndirectBlockPtr(lblk+i, blockNum+i); err != nil {
+			return 0, 0, err
+		}
+	}
+	inode.UpdateCsumAndWriteback()
+	return blockNum, count, nil
+}
+
+// setIndirectBlockPtr enters ptr in the block map for logical block num, allocating the indirect
+// blocks leading to it if there are none yet. The inode still has to be written back.
+func (inode *Inode) setIndirectBlockPtr(num, ptr int64) error {
+	path, err := inode.indirectPath(num)
+	if err != nil {
+		return err
+	}
+	fs := inode.fs
+	slot := inode.BlockOrExtents[4*path[0]:]
+	var b []byte
+	var block int64
+	for _, i := range path[1:] {
+		next := int64(binary.LittleEndian.Uint32(slot))
+		var child []byte
+		if next == 0 {
+			// next to the data it leads to
+			var count int64
+			if next, count, err = fs.allocBlocks(ptr, 1); err != nil {
+				return err
+			}
+			if count == 0 {
+				return fmt.Errorf("no space left for indirect blocks of inode %d", inode.num)
+			}
+			inode.addBlockCount(1)
+			binary.LittleEndian.PutUint32(slot, uint32(next))
+			if b != nil {
+				if err := fs.writeBlock(block, b); err != nil {
+					return err
+				}
+			}
+			child = make([]byte, fs.sb.GetBlockSize())
+		} else if child, err = fs.readBlock(next); err != nil {
+			return err
+		}
+		b, block = child, next
+		slot = b[4*i:]
+	}
+	binary.LittleEndian.PutUint32(slot, uint32(ptr))
+	if b != nil {
+		return fs.writeBlock(block, b)
+	}
+	return nil
+}
+
+// unmapIndirect frees the blocks the block map of the inode has for logical blocks from up to to,
+// along with the indirect blocks this leaves empty
+func (inode *Inode) unmapIndirect(from, to int64) error {
+	freed := []blockRange{}
+	for i := int64(0); i < directBlocks; i++ {
+		ptr := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*i:]))
+		if ptr != 0 && i >= from && i < to {
+			freed = appendRange(freed, ptr, 1)
+			binary.LittleEndian.PutUint32(inode.BlockOrExtents[4*i:], 0)
+		}
+	}
+	per := inode.fs.sb.GetBlockSize() / 4
+	base, span := int64(directBlocks), int64(1)
+	for level := 1; level <= indirectLevels; level++ {
+		span *= per
+		slot := inode.BlockOrExtents[4*(directBlocks+level-1):]
+		ptr := int64(binary.LittleEndian.Uint32(slot))
+		if ptr != 0 && base < to && base+span > from {
+			empty, err := inode.unmapIndirectBlock(ptr, level, base, from, to, &freed)
+			if err != nil {
+				return err
+			}
+			if empty {
+				freed = appendRange(freed, ptr, 1)
+				binary.LittleEndian.PutUint32(slot, 0)
+			}
+		}
+		base += span
+	}
+	if err := inode.fs.freeBlocks(freed); err != nil {
+		return err
+	}
+	for _, r := range freed {
+		inode.addBlockCount(-r.count)
+	}
+	inode.UpdateCsumAndWriteback()
+	return nil
+}
+
+// unmapIndirectBlock is unmapIndirect for the indirect block ptr of the given level, which maps
+// logical blocks from base on. The blocks to free are added to freed, and it reports whether
+// the indirect block is left empty, in which case it is not written back.
+func (inode *Inode) unmapIndirectBlock(ptr int64, level int, base, from, to int64, freed *[]blockRange) (bool, error) {
+	fs := inode.fs
+	b, err := fs.readBlock(ptr)
+	if err != nil {
+		return false, err
+	}
+	per := int64(len(b) / 4)
+	span := int64(1)
+	for l := 1; l < level; l++ {
+		span *= per
+	}
+	changed, empty := false, true
+	for i := int64(0); i < per; i++ {
+		child := int64(binary.LittleEndian.Uint32(b[4*i:]))
+		if child == 0 {
+			continue
+		}
+		start := base + i*span
+		if start+span <= from || start >= to {
+			empty = false
+			continue
+		}
+		if level > 1 {
+			childEmpty, err := inode.unmapIndirectBlock(child, level-1, start, from, to, freed)
+			if err != nil {
+				return false, err
+			}
+			if !childEmpty {
+				empty = false
+				continue
+			}
+		}
+		*freed = appendRange(*freed, child, 1)
+		binary.LittleEndian.PutUint32(b[4*i:], 0)
+		changed = true
+	}
+	if changed && !empty {
+		if err := fs.writeBlock(ptr, b); err != nil {
+			return false, err
+		}
+	}
+	return empty, nil
+}
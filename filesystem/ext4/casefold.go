@@ -0,0 +1,111 @@
+package ext4
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Directories flagged CASEFOLD_FL on a filesystem with the casefold feature look names up
+// without regard to case, as the kernel does: names are compared, and hashed in an index, in
+// their casefolded form, which is their full Unicode case folding in canonical decomposition
+// (NFD). A name that is not valid UTF-8 has no casefolded form and is taken as it is; with the
+// strict flag of the encoding such names cannot be created at all.
+
+// checkEncoding returns an error if the filesystem uses casefolding with a filename encoding
+// it does not know, in which case directories could not be searched the way they were made
+func (sb *Superblock) checkEncoding() error {
+	if sb.FeatureIncompatCasefold() && sb.Encoding != ENC_UTF8_12_1 {
+		return fmt.Errorf("unknown ext4 filename encoding %d", sb.Encoding)
+	}
+	return nil
+}
+
+// isCasefolded reports whether names in the directory are looked up ignoring case
+func (dir *directory) isCasefolded() bool {
+	return dir.sb.FeatureIncompatCasefold() && dir.f.inode.Flags&CASEFOLD_FL != 0
+}
+
+// casefold returns the casefolded form of name, or false if it is not valid UTF-8
+func casefold(name []byte) ([]byte, bool) {
+	if !utf8.Valid(name) {
+		return nil, false
+	}
+	return norm.NFD.Bytes(cases.Fold().Bytes(norm.NFD.Bytes(name))), true
+}
+
+// hashName returns the name the directory hashes for its index: the casefolded form of name in
+// a casefolded directory, where it has one, otherwise name itself
+func (dir *directory) hashName(name string) []byte {
+	if dir.isCasefolded() {
+		if folded, ok := casefold([]byte(name)); ok {
+			return folded
+		}
+	}
+	return []byte(name)
+}
+
+// nameMatches reports whether the directory entry called entry is the one called name: the
+// two are the same, or in a casefolded directory the same once casefolded. As in the kernel,
+// names that are not valid UTF-8 only match exactly.
+func (dir *directory) nameMatches(entry, name string) bool {
+	if entry == name {
+		return true
+	}
+	if !dir.isCasefolded() || len(entry) == 0 || len(name) == 0 {
+		return false
+	}
+	a, ok := casefold([]byte(entry))
+	if !ok {
+		return false
+	}
+	b, ok := casefold([]byte(name))
+	return ok && bytes.Equal(a, b)
+}
+
+// checkName returns an error if name cannot be added to the directory: one that is not valid
+// UTF-8 in a casefolded directory of a filesystem with a strict encoding
+func (dir *directory) checkName(name string) error {
+	if dir.isCasefolded() && dir.sb.Encoding_flags&ENC_STRICT_MODE_FL != 0 && !utf8.ValidString(name) {
+		return fmt.Errorf("name %q is not valid UTF-8", name)
+	}
+	return nil
+}
+
+// SetCasefold makes the empty directory p look up names without regard to case, or with regard
+// to it again if on is false, like chattr +F and -F. The filesystem must have the casefold
+// feature. Directories created in a casefolded directory are casefolded too.
+func (fs *FileSystem) SetCasefold(p string, on bool) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	if !fs.sb.FeatureIncompatCasefold() {
+		return fmt.Errorf("ext4 filesystem does not have the casefold feature")
+	}
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return err
+	}
+	if inode.Mode&S_IFMT != S_IFDIR {
+		return fmt.Errorf("%s is not a directory", p)
+	}
+	if (inode.Flags&CASEFOLD_FL != 0) == on {
+		return nil
+	}
+	empty, err := NewDirectory(inode).IsEmpty()
+	if err != nil {
+		return err
+	}
+	if !empty {
+		return fmt.Errorf("directory %s is not empty", p)
+	}
+	return fs.transaction(func() error {
+		inode.Flags ^= CASEFOLD_FL
+		inode.touch(timeChange)
+		inode.UpdateCsumAndWriteback()
+		return nil
+	})
+}
@@ -0,0 +1,675 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ProblemKind classifies the problems found by Check
+type ProblemKind int
+
+const (
+	// ProblemChecksum is metadata whose checksum does not match its contents
+	ProblemChecksum ProblemKind = iota
+	// ProblemBlockBitmap is a block in use but free in its bitmap, or marked in use but not
+	ProblemBlockBitmap
+	// ProblemInodeBitmap is an inode in use but free in its bitmap, or marked in use but not
+	ProblemInodeBitmap
+	// ProblemFreeCount is a wrong count of free blocks, free inodes or directories in a group
+	// descriptor or the superblock
+	ProblemFreeCount
+	// ProblemLinkCount is an inode whose link count is not the number of entries referring to it
+	ProblemLinkCount
+	// ProblemOrphanedInode is an inode in use that no directory refers to, or one left on the
+	// orphan list
+	ProblemOrphanedInode
+	// ProblemMultiplyClaimed is a block claimed by more than one inode, or by an inode as well as
+	// the filesystem metadata
+	ProblemMultiplyClaimed
+	// ProblemDirectory is a corrupt directory block or an entry referring to an inode not in use
+	ProblemDirectory
+	// ProblemInode is an inode whose blocks cannot be found or lie outside of the filesystem
+	ProblemInode
+)
+
+var problemKindNames = []string{"checksum", "block bitmap", "inode bitmap", "free count", "link count", "orphaned inode", "multiply-claimed blocks", "directory", "inode"}
+
+func (k ProblemKind) String() string {
+	if k < 0 || int(k) >= len(problemKindNames) {
+		return fmt.Sprintf("ProblemKind(%d)", int(k))
+	}
+	return problemKindNames[k]
+}
+
+// Problem is a single inconsistency found by Check
+type Problem struct {
+	Kind ProblemKind
+	// Group, Inode and Block locate the problem, each -1 when it is not about one in particular
+	Group int64
+	Inode int64
+	Block int64
+	// Description says what is wrong, in the words of e2fsck where it has them
+	Description string
+}
+
+func (p Problem) String() string {
+	return p.Description
+}
+
+// CheckReport lists everything Check found wrong with a filesystem
+type CheckReport struct {
+	Problems []Problem
+}
+
+// Clean reports whether the filesystem is consistent
+func (r *CheckReport) Clean() bool {
+	return len(r.Problems) == 0
+}
+
+// Has reports whether any of the problems found is of the given kind
+func (r *CheckReport) Has(kind ProblemKind) bool {
+	for _, p := range r.Problems {
+		if p.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *CheckReport) String() string {
+	lines := make([]string, 0, len(r.Problems))
+	for _, p := range r.Problems {
+		lines = append(lines, p.Description)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// checkedInode is what Check learns about an inode in use
+type checkedInode struct {
+	used  bool
+	dir   bool
+	links uint16
+	// refs counts the directory entries referring to the inode, "." and ".." included
+	refs uint32
+}
+
+// checker holds the state of a run of Check
+type checker struct {
+	fs     *FileSystem
+	report *CheckReport
+	// inodes is indexed by inode number
+	inodes []checkedInode
+	// blocks is a bitmap of the blocks found in use
+	blocks []byte
+	// dups are the blocks claimed more than once
+	dups map[int64]bool
+	// owned are the blocks claimed by each inode, with 0 standing for the filesystem metadata,
+	// kept to tell who shares multiply-claimed blocks
+	owned    map[int64][]blockRange
+	orphans  map[int64]bool
+	xattrs   map[int64]bool
+	dirsUsed []int64
+}
+
+// Check examines the whole filesystem without changing it, much like e2fsck -n does, and
+// reports every inconsistency found: block and inode bitmaps that do not match what is in use,
+// checksums that do not match under metadata_csum or uninit_bg, link counts that do not match the
+// directory entries, inodes in use that no directory refers to, blocks claimed more than once,
+// and wrong free counts in the group descriptors and the superblock.
+//
+// The error is only for when the filesystem cannot be examined at all; a filesystem that is
+// merely inconsistent gives a report with problems.
+func (fs *FileSystem) Check() (*CheckReport, error) {
+	sb := fs.sb
+	if sb == nil {
+		return nil, fmt.Errorf("filesystem is closed")
+	}
+	// mismatched checksums are reported as problems rather than failing the reads, which a view
+	// of the filesystem of its own does without changing how anyone else reads it
+	view := *fs
+	view.ignoreChecksums = true
+	fs = &view
+	c := &checker{
+		fs:      fs,
+		report:  &CheckReport{Problems: []Problem{}},
+		inodes:  make([]checkedInode, int64(sb.InodeCount)+1),
+		blocks:  make([]byte, (sb.GetBlockCount()+7)/8),
+		dups:    map[int64]bool{},
+		owned:   map[int64][]blockRange{},
+		orphans: map[int64]bool{},
+		xattrs:  map[int64]bool{},
+	}
+	groups := sb.BlockGroupCount()
+	c.dirsUsed = make([]int64, groups)
+
+	c.checkSuperblock()
+	bgds := make([]*GroupDescriptor, groups)
+	for g := range bgds {
+		bgd := fs.getBlockGroupDescriptor(int64(g))
+		bgds[g] = bgd
+		c.checkGroupDescriptor(bgd)
+		for _, r := range bgd.metadataBlocks() {
+			c.claim(0, r.start, r.count)
+		}
+	}
+	c.readOrphans()
+	for _, bgd := range bgds {
+		c.checkInodeTable(bgd)
+	}
+	for num := int64(1); num < int64(len(c.inodes)); num++ {
+		if c.inodes[num].used && c.inodes[num].dir {
+			c.checkDirectory(fs.getInode(num))
+		}
+	}
+	c.checkLinkCounts()
+	c.reportMultiplyClaimed()
+
+	freeBlocks, freeInodes := int64(0), int64(0)
+	for _, bgd := range bgds {
+		b, err := c.checkBlockBitmap(bgd)
+		if err != nil {
+			return nil, err
+		}
+		i, err := c.checkInodeBitmap(bgd)
+		if err != nil {
+			return nil, err
+		}
+		freeBlocks += b
+		freeInodes += i
+	}
+	// unlike those of the group descriptors, the count of the superblock is in blocks
+	freeBlocks <<= sb.clusterBits()
+	if n := sb.GetFreeBlockCount(); n != freeBlocks {
+		c.problem(ProblemFreeCount, -1, -1, -1, "Free blocks count wrong (%d, counted=%d)", n, freeBlocks)
+	}
+	if n := int64(sb.Free_inodeCount); n != freeInodes {
+		c.problem(ProblemFreeCount, -1, -1, -1, "Free inodes count wrong (%d, counted=%d)", n, freeInodes)
+	}
+	return c.report, nil
+}
+
+// problem adds a problem to the report
+func (c *checker) problem(kind ProblemKind, group, inode, block int64, format string, args ...interface{}) {
+	c.report.Problems = append(c.report.Problems, Problem{
+		Kind:        kind,
+		Group:       group,
+		Inode:       inode,
+		Block:       block,
+		Description: fmt.Sprintf(format, args...),
+	})
+}
+
+// claim records count blocks from start as in use by inode owner, 0 for the filesystem metadata
+func (c *checker) claim(owner, start, count int64) {
+	sb := c.fs.sb
+	for b := start; b < start+count; b++ {
+		if b < int64(sb.First_data_block) || b >= sb.GetBlockCount() {
+			c.problem(ProblemInode, -1, owner, b, "Inode %d has illegal block %d", owner, b)
+			return
+		}
+		if c.blocks[b/8]&(1<<uint(b%8)) != 0 {
+			c.dups[b] = true
+		}
+		c.blocks[b/8] |= 1 << uint(b%8)
+	}
+	c.owned[owner] = append(c.owned[owner], blockRange{start: start, count: count})
+}
+
+// inUse reports whether block b was found in use
+func (c *checker) inUse(b int64) bool {
+	return c.blocks[b/8]&(1<<uint(b%8)) != 0
+}
+
+// clusterInUse reports whether any block of the cluster beginning with block b was found in use
+func (c *checker) clusterInUse(b int64) bool {
+	sb := c.fs.sb
+	for end := b + 1<<sb.clusterBits(); b < end && b < sb.GetBlockCount(); b++ {
+		if c.inUse(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *checker) checkSuperblock() {
+	sb := c.fs.sb
+	if !sb.FeatureRoCompatMetadata_csum() {
+		return
+	}
+	if stored, computed := sb.checksums(); stored != computed {
+		c.problem(ProblemChecksum, -1, -1, -1, "Superblock checksum does not match superblock")
+	}
+}
+
+// checkGroupDescriptor verifies the checksums of a group descriptor and of its bitmaps
+func (c *checker) checkGroupDescriptor(bgd *GroupDescriptor) {
+	sb := c.fs.sb
+	if sb.FeatureRoCompatMetadata_csum() || sb.FeatureRoCompatGdt_csum() {
+		if stored, computed := bgd.checksums(); stored != computed {
+			c.problem(ProblemChecksum, bgd.num, -1, -1, "Group descriptor %d checksum is %#04x, should be %#04x", bgd.num, stored, computed)
+		}
+	}
+	if !sb.FeatureRoCompatMetadata_csum() {
+		return
+	}
+	check := func(what string, loc int64, size uint32, lo, hi uint16) {
+		bitmap, err := c.fs.readBlock(loc)
+		if err != nil {
+			c.problem(ProblemChecksum, bgd.num, -1, loc, "%s bitmap for group %d cannot be read: %v", what, bgd.num, err)
+			return
+		}
+		crc := sb.bitmapCsum(bitmap[:size/8])
+		stored := uint32(lo)
+		if sb.descSize() < 64 {
+			crc &= 0xFFFF
+		} else {
+			stored |= uint32(hi) << 16
+		}
+		if crc != stored {
+			c.problem(ProblemChecksum, bgd.num, -1, loc, "%s bitmap for group %d checksum does not match bitmap", what, bgd.num)
+		}
+	}
+	if bgd.Flags&BG_BLOCK_UNINIT == 0 {
+		check("Block", bgd.GetBlockBitmapLoc(), sb.ClusterPer_group, bgd.Block_bitmap_csum_lo, bgd.Block_bitmap_csum_hi)
+	}
+	if bgd.Flags&BG_INODE_UNINIT == 0 {
+		check("Inode", bgd.GetInodeBitmapLoc(), sb.InodePer_group, bgd.Inode_bitmap_csum_lo, bgd.Inode_bitmap_csum_hi)
+	}
+}
+
+// readOrphans follows the orphan list from the superblock, whose inodes are linked through
+// their deletion time
+func (c *checker) readOrphans() {
+	sb := c.fs.sb
+	for num := int64(sb.Last_orphan); num != 0; {
+		if num < int64(sb.First_ino) || num > int64(sb.InodeCount) || c.orphans[num] {
+			c.problem(ProblemOrphanedInode, -1, num, -1, "Illegal inode %d in orphaned inode list", num)
+			return
+		}
+		c.orphans[num] = true
+		num = int64(c.fs.getInode(num).Dtime)
+	}
+}
+
+// checkInodeTable looks at every inode of the group that may be in use, claiming the blocks of
+// those that are
+func (c *checker) checkInodeTable(bgd *GroupDescriptor) {
+	sb := c.fs.sb
+	ipg := int64(sb.InodePer_group)
+	limit := ipg
+	if bgd.Flags&BG_INODE_UNINIT != 0 {
+		limit = 0
+	} else if sb.FeatureRoCompatMetadata_csum() || sb.FeatureRoCompatGdt_csum() {
+		// the kernel never looks past the inodes ever used either
+		limit = ipg - bgd.GetItableUnused()
+	}
+	for i := int64(0); i < limit; i++ {
+		num := bgd.num*ipg + i + 1
+		inode := c.fs.getInode(num)
+		reserved := num < int64(sb.First_ino)
+		if !reserved && inode.Links_count == 0 && !c.orphans[num] {
+			continue
+		}
+		ci := &c.inodes[num]
+		ci.used = true
+		ci.dir = inode.Mode&S_IFMT == S_IFDIR && (num == ROOT_INO || !reserved)
+		ci.links = inode.Links_count
+		if ci.dir {
+			c.dirsUsed[bgd.num]++
+		}
+		if reserved && num != ROOT_INO && inode.Mode == 0 && inode.BlockOrExtents == [60]byte{} {
+			continue
+		}
+		c.checkInode(inode)
+	}
+}
+
+// checkInode verifies the checksums of an inode in use and of its extent tree, and claims its
+// blocks
+func (c *checker) checkInode(inode *Inode) {
+	fs, sb := c.fs, c.fs.sb
+	num := inode.num
+	if sb.FeatureRoCompatMetadata_csum() {
+		if stored, computed := inode.checksums(); stored != computed {
+			c.problem(ProblemChecksum, -1, num, -1, "Inode %d checksum does not match inode", num)
+		}
+	}
+
+	if num == RESIZE_INO && sb.FeatureCompatResize_inode() {
+		// the blocks it maps are the reserved group descriptor blocks, already claimed as
+		// metadata, only its double indirect block is its own
+		if dind := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*(directBlocks+1):])); dind != 0 {
+			c.claim(num, dind, 1)
+		}
+	} else {
+		ranges, err := inode.ownedBlocks()
+		if err != nil {
+			c.problem(ProblemInode, -1, num, -1, "Inode %d has a corrupt block map: %v", num, err)
+		}
+		for _, r := range ranges {
+			c.claim(num, r.start, r.count)
+		}
+		if inode.UsesExtents() && inode.hasBlockMap() && sb.FeatureRoCompatMetadata_csum() && err == nil {
+			c.checkExtentTree(inode)
+		}
+	}
+
+	if acl := inode.getFileACL(); acl != 0 && !c.xattrs[acl] {
+		// shared blocks are claimed once
+		c.xattrs[acl] = true
+		c.claim(num, acl, 1)
+		if acl < sb.GetBlockCount() {
+			b, err := fs.readBlock(acl)
+			switch {
+			case err != nil || binary.LittleEndian.Uint32(b) != XattrMagic:
+				c.problem(ProblemInode, -1, num, acl, "Inode %d has a bad extended attribute block %d", num, acl)
+			case sb.FeatureRoCompatMetadata_csum() && binary.LittleEndian.Uint32(b[16:]) != fs.xattrBlockCsum(acl, b):
+				c.problem(ProblemChecksum, -1, num, acl, "Extended attribute block %d checksum for inode %d does not match block", acl, num)
+			}
+		}
+	}
+}
+
+// checkExtentTree verifies the checksums of the nodes of the extent tree of the inode below the
+// root
+func (c *checker) checkExtentTree(inode *Inode) {
+	root, err := inode.extentRoot()
+	if err != nil {
+		return
+	}
+	nodes := []int64{}
+	if err := inode.walkExtentTree(root, func(Extent) {}, func(b int64) { nodes = append(nodes, b) }); err != nil {
+		return
+	}
+	for _, block := range nodes {
+		b, err := c.fs.readBlock(block)
+		if err != nil {
+			continue
+		}
+		tail := extentHeaderSize * (int(binary.LittleEndian.Uint16(b[4:])) + 1)
+		if tail+4 > len(b) || binary.LittleEndian.Uint32(b[tail:]) != inode.extentNodeCsum(b) {
+			c.problem(ProblemChecksum, -1, inode.num, block, "Inode %d extent block %d checksum does not match extent block", inode.num, block)
+		}
+	}
+}
+
+// checkDirectory verifies the blocks of a directory and counts the references of its entries
+func (c *checker) checkDirectory(inode *Inode) {
+	sb := c.fs.sb
+	num := inode.num
+	dir := NewDirectory(inode)
+	if inode.isInline() {
+		c.reference(num, ".", num)
+		c.reference(num, "..", int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[:])))
+	}
+
+	// index nodes hold no entries other than "." and ".." in the root, and have checksums of
+	// their own
+	index := map[int64]bool{}
+	if dir.isHashed() && !inode.isInline() {
+		if err := c.checkDxTree(dir, index); err != nil {
+			c.problem(ProblemDirectory, -1, num, -1, "Problem in HTREE directory inode %d: %v", num, err)
+		}
+	}
+
+	first := true
+	err := dir.walkBlocks(func(phys int64, b []byte) (bool, error) {
+		if phys >= 0 && sb.hasDirCsum() && !index[phys] {
+			if !hasCsumTail(b) {
+				c.problem(ProblemChecksum, -1, num, phys, "Directory inode %d, block %d has no checksum", num, phys)
+			} else if binary.LittleEndian.Uint32(b[len(b)-4:]) != dirBlockCsum(inode, b) {
+				c.problem(ProblemChecksum, -1, num, phys, "Directory inode %d, block %d does not match checksum", num, phys)
+			}
+		}
+		entries, err := parseDirBlock(b)
+		if err != nil {
+			c.problem(ProblemDirectory, -1, num, phys, "Directory inode %d, block %d: %v", num, phys, err)
+			return true, nil
+		}
+		for i, e := range entries {
+			if first && phys >= 0 && i == 0 && (e.name != "." || int64(e.inode) != num) {
+				c.problem(ProblemDirectory, -1, num, phys, "First entry '%s' (inode=%d) in directory inode %d should be '.'", e.name, e.inode, num)
+			}
+			if e.inode != 0 {
+				c.reference(num, e.name, int64(e.inode))
+			}
+		}
+		first = false
+		return true, nil
+	})
+	if err != nil {
+		c.problem(ProblemDirectory, -1, num, -1, "Directory inode %d cannot be read: %v", num, err)
+	}
+}
+
+// checkDxTree verifies the index nodes of a hashed directory, adding their blocks to index
+func (c *checker) checkDxTree(dir *directory, index map[int64]bool) error {
+	root, tree, err := dir.dxRoot()
+	if err != nil {
+		return err
+	}
+	level := []*dxNode{root}
+	for depth := 0; ; depth++ {
+		next := []*dxNode{}
+		for _, n := range level {
+			index[n.phys] = true
+			if c.fs.sb.FeatureRoCompatMetadata_csum() {
+				tail := n.offset + 8*n.limit()
+				if tail+8 > len(n.b) || binary.LittleEndian.Uint32(n.b[tail+4:]) != dir.dxNodeCsum(n) {
+					c.problem(ProblemChecksum, -1, dir.f.inode.num, n.phys, "Directory inode %d, block %d: index node does not match checksum", dir.f.inode.num, n.phys)
+				}
+			}
+			if depth == tree.levels {
+				continue
+			}
+			for i := 0; i < n.count(); i++ {
+				child, err := dir.readDxNode(n.block(i), dxNodeEntries)
+				if err != nil {
+					return err
+				}
+				next = append(next, child)
+			}
+		}
+		if len(next) == 0 {
+			return nil
+		}
+		level = next
+	}
+}
+
+// reference counts the entry name in directory dir referring to inode num
+func (c *checker) reference(dir int64, name string, num int64) {
+	if num < 1 || num >= int64(len(c.inodes)) {
+		c.problem(ProblemDirectory, -1, dir, -1, "Entry '%s' in directory inode %d has bad inode #: %d", name, dir, num)
+		return
+	}
+	ci := &c.inodes[num]
+	if !ci.used {
+		c.problem(ProblemDirectory, -1, dir, -1, "Entry '%s' in directory inode %d has deleted/unused inode %d", name, dir, num)
+		return
+	}
+	ci.refs++
+}
+
+// checkLinkCounts compares the link count of every inode in use with the entries referring to it
+func (c *checker) checkLinkCounts() {
+	sb := c.fs.sb
+	for num := int64(1); num < int64(len(c.inodes)); num++ {
+		ci := c.inodes[num]
+		if !ci.used || (num < int64(sb.First_ino) && num != ROOT_INO) {
+			continue
+		}
+		switch {
+		case c.orphans[num]:
+			c.problem(ProblemOrphanedInode, -1, num, -1, "Inode %d is on the orphan list", num)
+		case ci.refs == 0 && num != ROOT_INO:
+			c.problem(ProblemOrphanedInode, -1, num, -1, "Unattached inode %d", num)
+		case uint32(ci.links) == ci.refs:
+		case ci.dir && ci.links == 1 && sb.FeatureRoCompatDir_nlink():
+			// too many subdirectories to count
+		default:
+			c.problem(ProblemLinkCount, -1, num, -1, "Inode %d ref count is %d, should be %d", num, ci.links, ci.refs)
+		}
+	}
+}
+
+// reportMultiplyClaimed finds who claims each block claimed more than once, and reports every
+// inode sharing blocks with another, as well as metadata blocks claimed by an inode
+func (c *checker) reportMultiplyClaimed() {
+	if len(c.dups) == 0 {
+		return
+	}
+	claimants := map[int64][]int64{}
+	owners := make([]int64, 0, len(c.owned))
+	for owner := range c.owned {
+		owners = append(owners, owner)
+	}
+	sort.Slice(owners, func(a, b int) bool { return owners[a] < owners[b] })
+	for _, owner := range owners {
+		for _, r := range c.owned[owner] {
+			for b := r.start; b < r.start+r.count; b++ {
+				if c.dups[b] {
+					claimants[b] = append(claimants[b], owner)
+				}
+			}
+		}
+	}
+
+	for _, owner := range owners {
+		blocks := 0
+		shared := map[int64]bool{}
+		for _, r := range c.owned[owner] {
+			for b := r.start; b < r.start+r.count; b++ {
+				if !c.dups[b] {
+					continue
+				}
+				blocks++
+				for _, other := range claimants[b] {
+					if other != owner {
+						shared[other] = true
+					}
+				}
+			}
+		}
+		if blocks == 0 {
+			continue
+		}
+		with := []string{}
+		for other := range shared {
+			if other == 0 {
+				with = append(with, "<filesystem metadata>")
+			} else {
+				with = append(with, fmt.Sprintf("inode %d", other))
+			}
+		}
+		sort.Strings(with)
+		what := fmt.Sprintf("Inode %d", owner)
+		if owner == 0 {
+			what = "The filesystem metadata"
+		}
+		c.problem(ProblemMultiplyClaimed, -1, owner, -1, "%s has %d multiply-claimed block(s), shared with %s", what, blocks, strings.Join(with, ", "))
+	}
+}
+
+// reportDifferences reports the runs of items of a group that are in use but not marked in the
+// bitmap, or marked but not in use, as e2fsck does. Item i is numbered base+i<<shift, so that
+// the clusters of a block bitmap are given by their first block.
+func (c *checker) reportDifferences(kind ProblemKind, group, base, n int64, shift uint, marked, used func(i int64) bool) {
+	what := "Block"
+	if kind == ProblemInodeBitmap {
+		what = "Inode"
+	}
+	for i := int64(0); i < n; {
+		m, u := marked(i), used(i)
+		if m == u {
+			i++
+			continue
+		}
+		j := i + 1
+		for j < n && marked(j) == m && used(j) == u && marked(j) != used(j) {
+			j++
+		}
+		sign := "+"
+		if m {
+			sign = "-"
+		}
+		from, to := base+i<<shift, base+(j-1)<<shift
+		desc := fmt.Sprintf("%s bitmap differences: %s%d", what, sign, from)
+		if j-i > 1 {
+			desc = fmt.Sprintf("%s bitmap differences: %s(%d--%d)", what, sign, from, to)
+		}
+		block, inode := from, int64(-1)
+		if kind == ProblemInodeBitmap {
+			block, inode = -1, from
+		}
+		c.problem(kind, group, inode, block, "%s", desc)
+		i = j
+	}
+}
+
+// checkBlockBitmap compares the block bitmap and free block count of the group with the blocks
+// found in use, returning how many of its blocks are free. With bigalloc these are clusters, a
+// cluster being in use if any of its blocks is.
+func (c *checker) checkBlockBitmap(bgd *GroupDescriptor) (int64, error) {
+	sb := c.fs.sb
+	first := sb.groupFirstBlock(bgd.num)
+	bits := sb.clusterBits()
+	n := sb.groupClusters(bgd.num)
+	var bitmap []byte
+	if bgd.Flags&BG_BLOCK_UNINIT != 0 {
+		bitmap = bgd.initBlockBitmap()
+	} else {
+		var err error
+		if bitmap, err = c.fs.readBlock(bgd.GetBlockBitmapLoc()); err != nil {
+			return 0, err
+		}
+	}
+	c.reportDifferences(ProblemBlockBitmap, bgd.num, first, n, bits,
+		func(i int64) bool { return bitmap[i/8]&(1<<uint(i%8)) != 0 },
+		func(i int64) bool { return c.clusterInUse(first + i<<bits) })
+
+	free := int64(0)
+	for i := int64(0); i < n; i++ {
+		if !c.clusterInUse(first + i<<bits) {
+			free++
+		}
+	}
+	if stored := bgd.GetFreeBlocksCount(); stored != free {
+		c.problem(ProblemFreeCount, bgd.num, -1, -1, "Free blocks count wrong for group #%d (%d, counted=%d)", bgd.num, stored, free)
+	}
+	return free, nil
+}
+
+// checkInodeBitmap compares the inode bitmap, free inode count and directory count of the group
+// with the inodes found in use, returning how many of its inodes are free
+func (c *checker) checkInodeBitmap(bgd *GroupDescriptor) (int64, error) {
+	sb := c.fs.sb
+	ipg := int64(sb.InodePer_group)
+	first := bgd.num*ipg + 1
+	bitmap := make([]byte, sb.GetBlockSize())
+	if bgd.Flags&BG_INODE_UNINIT == 0 {
+		var err error
+		if bitmap, err = c.fs.readBlock(bgd.GetInodeBitmapLoc()); err != nil {
+			return 0, err
+		}
+	}
+	c.reportDifferences(ProblemInodeBitmap, bgd.num, first, ipg, 0,
+		func(i int64) bool { return bitmap[i/8]&(1<<uint(i%8)) != 0 },
+		func(i int64) bool { return c.inodes[first+i].used })
+
+	free := int64(0)
+	for i := int64(0); i < ipg; i++ {
+		if !c.inodes[first+i].used {
+			free++
+		}
+	}
+	if stored := bgd.GetFreeInodesCount(); stored != free {
+		c.problem(ProblemFreeCount, bgd.num, -1, -1, "Free inodes count wrong for group #%d (%d, counted=%d)", bgd.num, stored, free)
+	}
+	if stored := bgd.GetUsedDirsCount(); stored != c.dirsUsed[bgd.num] {
+		c.problem(ProblemFreeCount, bgd.num, -1, -1, "Directories count wrong for group #%d (%d, counted=%d)", bgd.num, stored, c.dirsUsed[bgd.num])
+	}
+	return free, nil
+}
@@ -38,6 +38,7 @@ const EA_INODE_FL = 0x00200000
 const EOFBLOCKS_FL = 0x00400000
 const INLINE_DATA_FL = 0x10000000
 const PROJINHERIT_FL = 0x20000000
+const CASEFOLD_FL = 0x40000000
 const RESERVED_FL = 0x80000000
 
 const FL_USER_VISIBLE = 0x304BDFFF
@@ -106,4 +107,75 @@ const FEATURE_INCOMPAT_DIRDATA = 0x1000
 const FEATURE_INCOMPAT_CSUM_SEED = 0x2000
 const FEATURE_INCOMPAT_LARGEDIR = 0x4000
 const FEATURE_INCOMPAT_INLINE_DATA = 0x8000
-const FEATURE_INCOMPAT_ENCRYPT = 0x10000
\ No newline at end of file
+const FEATURE_INCOMPAT_ENCRYPT = 0x10000
+const FEATURE_INCOMPAT_CASEFOLD = 0x20000
+const EXT_MAGIC = 0xF30A
+
+// Inode mode file types
+const S_IFMT = 0xF000
+const S_IFSOCK = 0xC000
+const S_IFLNK = 0xA000
+const S_IFREG = 0x8000
+const S_IFBLK = 0x6000
+const S_IFDIR = 0x4000
+const S_IFCHR = 0x2000
+const S_IFIFO = 0x1000
+
+// Inode mode permission bits beyond rwx
+const S_ISUID = 0x800
+const S_ISGID = 0x400
+const S_ISVTX = 0x200
+
+// Directory entry file types
+const FT_UNKNOWN = 0
+const FT_REG_FILE = 1
+const FT_DIR = 2
+const FT_CHRDEV = 3
+const FT_BLKDEV = 4
+const FT_FIFO = 5
+const FT_SOCK = 6
+const FT_SYMLINK = 7
+const FT_DIR_CSUM = 0xDE
+
+// Superblock state
+const STATE_VALID_FS = 0x0001
+const STATE_ERROR_FS = 0x0002
+const STATE_ORPHAN_FS = 0x0004
+
+// Superblock behaviour when detecting errors
+const ERRORS_CONTINUE = 1
+const ERRORS_RO = 2
+const ERRORS_PANIC = 3
+
+// Superblock flags
+const FLAGS_SIGNED_HASH = 0x0001
+const FLAGS_UNSIGNED_HASH = 0x0002
+const FLAGS_TEST_FILESYS = 0x0004
+
+// Directory hash versions
+const HASH_LEGACY = 0
+const HASH_HALF_MD4 = 1
+const HASH_TEA = 2
+const HASH_LEGACY_UNSIGNED = 3
+const HASH_HALF_MD4_UNSIGNED = 4
+const HASH_TEA_UNSIGNED = 5
+
+// Default mount options
+const DEFM_DEBUG = 0x0001
+const DEFM_BSDGROUPS = 0x0002
+const DEFM_XATTR_USER = 0x0004
+const DEFM_ACL = 0x0008
+const DEFM_UID16 = 0x0010
+const DEFM_JMODE_DATA = 0x0020
+const DEFM_JMODE_ORDERED = 0x0040
+const DEFM_JMODE_WBACK = 0x0060
+const DEFM_NOBARRIER = 0x0100
+const DEFM_BLOCK_VALIDITY = 0x0200
+const DEFM_DISCARD = 0x0400
+const DEFM_NODELALLOC = 0x0800
+
+// Filename encodings of casefolded directories, and their flags
+const ENC_UTF8_12_1 = 1
+const ENC_STRICT_MODE_FL = 0x0001
+
+const CRC32C_CHKSUM = 1
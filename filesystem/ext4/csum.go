@@ -42,4 +42,45 @@ func (cs *checksummer) Get() uint32 {
 		return 0
 	}
 	return ^cs.val
-}
\ No newline at end of file
+}
+// csumSeed returns the seed that all metadata_csum checksums start from: either the seed
+// stored in the superblock, or the crc32c of the filesystem UUID
+func (sb *Superblock) csumSeed() uint32 {
+	if sb.FeatureIncompatCsum_seed() {
+		return sb.Checksum_seed
+	}
+	return ^crc32.Update(0, crc32.MakeTable(crc32.Castagnoli), sb.Uuid[:])
+}
+
+// newMetadataChecksummer returns a Checksummer that has already consumed the filesystem seed
+func newMetadataChecksummer(sb *Superblock) Checksummer {
+	return &checksummer{
+		sb:    sb,
+		val:   ^sb.csumSeed(),
+		table: crc32.MakeTable(crc32.Castagnoli),
+	}
+}
+
+// crc16Table is the table for the reflected 0x8005 (ANSI) polynomial used by uninit_bg
+var crc16Table = func() [256]uint16 {
+	var t [256]uint16
+	for i := range t {
+		crc := uint16(i)
+		for j := 0; j < 8; j++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xA001
+			} else {
+				crc >>= 1
+			}
+		}
+		t[i] = crc
+	}
+	return t
+}()
+
+func crc16(crc uint16, b []byte) uint16 {
+	for _, c := range b {
+		crc = (crc >> 8) ^ crc16Table[byte(crc)^c]
+	}
+	return crc
+}
@@ -0,0 +1,255 @@
+package ext4
+
+import (
+	"fmt"
+	"path"
+)
+
+// DefragmentResult reports how Defragment changed a file
+type DefragmentResult struct {
+	// Path of the file
+	Path string
+	// ExtentsBefore and ExtentsAfter are how many extents held the data of the file before and
+	// after, the same if it was left alone
+	ExtentsBefore, ExtentsAfter int
+}
+
+// Defragment moves the data of the regular file p into as few contiguous runs of blocks as
+// free space allows, much like e4defrag does on a mounted filesystem. New blocks are allocated
+// for the whole file, the data is copied into them, the extent tree swapped for one mapping
+// them, and the old blocks freed, all in a single transaction. A file whose data cannot be held
+// in fewer extents than it already is, is left as it is.
+//
+// Only files with extents can be defragmented.
+func (fs *FileSystem) Defragment(p string) (DefragmentResult, error) {
+	result := DefragmentResult{Path: path.Clean("/" + p)}
+	if fs.readOnly() {
+		return result, fs.errReadOnly()
+	}
+	inode, err := fs.lookup(result.Path)
+	if err != nil {
+		return result, err
+	}
+	if inode.Mode&S_IFMT != S_IFREG {
+		return result, fmt.Errorf("%s is not a regular file", p)
+	}
+	if !inode.UsesExtents() || inode.isInline() {
+		return result, fmt.Errorf("%s has no extents to defragment", p)
+	}
+	err = fs.transaction(func() error {
+		result.ExtentsBefore, result.ExtentsAfter, err = inode.defragment()
+		return err
+	})
+	return result, err
+}
+
+// DefragmentAll defragments every regular file with extents on the filesystem, as Defragment
+// does, and returns the results for all of them, those left alone included
+func (fs *FileSystem) DefragmentAll() ([]DefragmentResult, error) {
+	if fs.readOnly() {
+		return nil, fs.errReadOnly()
+	}
+	root, err := fs.readInode(ROOT_INO)
+	if err != nil {
+		return nil, err
+	}
+	results := []DefragmentResult{}
+	var walk func(dir *Inode, p string) error
+	walk = func(dir *Inode, p string) error {
+		entries, err := NewDirectory(dir).entries()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.Name == "." || e.Name == ".." {
+				continue
+			}
+			inode, err := fs.readInode(int64(e.Inode))
+			if err != nil {
+				return err
+			}
+			child := path.Join(p, e.Name)
+			switch {
+			case inode.Mode&S_IFMT == S_IFDIR:
+				err = walk(inode, child)
+			case inode.Mode&S_IFMT == S_IFREG && inode.UsesExtents() && !inode.isInline():
+				result := DefragmentResult{Path: child}
+				err = fs.transaction(func() error {
+					result.ExtentsBefore, result.ExtentsAfter, err = inode.defragment()
+					return err
+				})
+				results = append(results, result)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return results, walk(root, "/")
+}
+
+// defragment moves the data of the inode into newly allocated blocks if they hold it in fewer
+// extents, returning how many extents it had before and has after
+func (inode *Inode) defragment() (int, int, error) {
+	fs := inode.fs
+	extents, err := inode.extents()
+	if err != nil {
+		return 0, 0, err
+	}
+	before := len(extents)
+	total := int64(0)
+	for _, e := range extents {
+		total += e.length()
+	}
+	// what the extents would come to if all of the blocks were in one run
+	if len(donorExtents(extents, []blockRange{{start: 0, count: total}})) >= before {
+		return before, before, nil
+	}
+
+	// the donor: new blocks for the same logical blocks, in as few runs as can be had
+	runs := []blockRange{}
+	goal := inode.dataGoal()
+	for allocated := int64(0); allocated < total; {
+		start, count, err := fs.allocBlocks(goal, total-allocated)
+		if err == nil && count == 0 {
+			err = fmt.Errorf("no space left to defragment inode %d", inode.num)
+		}
+		if err != nil {
+			if ferr := fs.freeBlocks(runs); ferr != nil {
+				return before, before, ferr
+			}
+			return before, before, err
+		}
+		runs = appendRange(runs, start, count)
+		allocated += count
+		goal = start + count
+	}
+	donor := donorExtents(extents, runs)
+	if len(donor) >= before {
+		return before, before, fs.freeBlocks(runs)
+	}
+
+	// like EXT4_IOC_MOVE_EXT with a donor file fallocated at the same offsets
+	old := []blockRange{}
+	for _, e := range extents {
+		me := &MoveExtent{Orig_start: uint64(e.Block), Donor_start: uint64(e.Block), Len: uint64(e.length())}
+		if err := inode.moveExtent(e, donor, me); err != nil {
+			return before, before, err
+		}
+		old = appendRange(old, e.start(), e.length())
+	}
+	if err := inode.setExtents(donor); err != nil {
+		return before, before, err
+	}
+	if err := fs.freeBlocks(old); err != nil {
+		return before, before, err
+	}
+	return before, len(donor), nil
+}
+
+// moveExtent copies the data of me.Len blocks of the inode from me.Orig_start, all within
+// extent e, to the same blocks of the donor from me.Donor_start, counting them in me.Moved_len.
+// Uninitialized blocks read as zeros wherever they are and are not copied.
+func (inode *Inode) moveExtent(e Extent, donor []Extent, me *MoveExtent) error {
+	fs := inode.fs
+	bs := fs.sb.GetBlockSize()
+	for me.Moved_len < me.Len {
+		from := int64(me.Orig_start + me.Moved_len)
+		to := int64(me.Donor_start + me.Moved_len)
+		var d *Extent
+		for i := range donor {
+			if int64(donor[i].Block) <= to && to < int64(donor[i].Block)+donor[i].length() {
+				d = &donor[i]
+				break
+			}
+		}
+		if d == nil {
+			return fmt.Errorf("block %d of the donor for inode %d is not mapped", to, inode.num)
+		}
+		n := int64(d.Block) + d.length() - to
+		if left := int64(me.Len - me.Moved_len); n > left {
+			n = left
+		}
+		if !e.uninitialized() {
+			b := make([]byte, n*bs)
+			src := e.start() + from - int64(e.Block)
+			if _, err := fs.dev.ReadAt(b, fs.start+src*bs); err != nil {
+				return fmt.Errorf("unable to read block %d of inode %d: %v", from, inode.num, err)
+			}
+			dst := d.start() + to - int64(d.Block)
+			if _, err := fs.writeData(b, fs.start+dst*bs); err != nil {
+				return fmt.Errorf("unable to write block %d of inode %d: %v", to, inode.num, err)
+			}
+		}
+		me.Moved_len += uint64(n)
+	}
+	return nil
+}
+
+// donorExtents maps the logical blocks of extents, which must be in logical order, to the
+// blocks of runs in turn, with as few extents as that takes
+func donorExtents(extents []Extent, runs []blockRange) []Extent {
+	next := append([]blockRange{}, runs...)
+	donor := []Extent{}
+	for _, e := range extents {
+		for lblk, end := int64(e.Block), int64(e.Block)+e.length(); lblk < end; {
+			n := end - lblk
+			if n > next[0].count {
+				n = next[0].count
+			}
+			max := int64(maxInitExtentLen)
+			if e.uninitialized() {
+				max--
+			}
+			if n > max {
+				n = max
+			}
+			d := Extent{Block: uint32(lblk), Len: uint16(n), Start_hi: uint16(next[0].start >> 32), Start_lo: uint32(next[0].start)}
+			if e.uninitialized() {
+				d.Len += maxInitExtentLen
+			}
+			donor = append(donor, d)
+			lblk += n
+			next[0].start += n
+			next[0].count -= n
+			if next[0].count == 0 {
+				next = next[1:]
+			}
+		}
+	}
+	return mergeExtents(donor)
+}
+
+// mergeExtents returns extents, which must be in logical order, with those that follow on from
+// one another both logically and physically and are alike in being initialized or not merged
+// as far as the length of an extent allows
+func mergeExtents(extents []Extent) []Extent {
+	merged := []Extent{}
+	for _, e := range extents {
+		if n := len(merged); n > 0 {
+			last := merged[n-1]
+			max := int64(maxInitExtentLen)
+			if last.uninitialized() {
+				max--
+			}
+			if last.uninitialized() == e.uninitialized() &&
+				int64(last.Block)+last.length() == int64(e.Block) &&
+				last.start()+last.length() == e.start() {
+				if room := max - last.length(); room > 0 {
+					take := e.length()
+					if take > room {
+						take = room
+					}
+					merged[n-1] = last.slice(int64(last.Block), int64(last.Block)+last.length()+take)
+					if take == e.length() {
+						continue
+					}
+					e = e.slice(int64(e.Block)+take, int64(e.Block)+e.length())
+				}
+			}
+		}
+		merged = append(merged, e)
+	}
+	return merged
+}
@@ -1,9 +1,9 @@
 package ext4
 
 import (
-	"github.com/lunixbochs/struc"
+	"bytes"
+	"encoding/binary"
 	"fmt"
-	"log"
 )
 
 type directory struct {
@@ -25,102 +25,370 @@ func NewDirectory(inode *Inode) *directory {
 }
 
 func (dir *directory) AddEntry(entry *DirectoryEntry2) error {
-	entrySize, _ := struc.Sizeof(entry)
-	entry.Rec_len = uint16(entrySize)
-
-	pos, _ := dir.f.Seek(0, 2)   //the position of the end of the directory
-	if pos % dir.sb.GetBlockSize() != 0 {
-		return fmt.Errorf("Unexpected size of directory file: %d", pos)
-	} else if pos == 0 {
-		return fmt.Errorf("Unexpected empty directory")
-	}
-	dir.f.Seek(pos - dir.sb.GetBlockSize(), 0)
-
-	//log.Println("AddEntry", pos)
-
-	checksummer := NewChecksummer(dir.sb)
-	checksummer.Write(dir.f.inode.fs.sb.Uuid[:])
-	checksummer.WriteUint32(uint32(dir.f.inode.num))
-	checksummer.WriteUint32(uint32(dir.f.inode.Generation))
-
-	totalLen := int64(0)
-	modified := false
-	for totalLen < dir.sb.GetBlockSize() {
-		//log.Println("AddEntry loop ", totalLen)
-		if totalLen == dir.sb.GetBlockSize() - 12 {
-			//log.Println("AddEntry found checksum", modified)
-			if modified {
-				dirSum := DirectoryEntryCsum{
-					FakeInodeZero: 0,
-					Rec_len:  uint16(12),
-					FakeName_len: 0,
-					FakeFileType:    0xDE,
-					Checksum:     checksummer.Get(),
-				}
-				struc.Pack(dir.f, &dirSum)
-			}
+	if err := dir.checkName(entry.Name); err != nil {
+		return err
+	}
+	if dir.isHashed() {
+		return dir.dxAddEntry(entry)
+	}
+	if dir.f.inode.isInline() {
+		added, err := dir.inlineAddEntry(entry)
+		if added || err != nil {
+			return err
+		}
+		if err := dir.f.inode.uninline(); err != nil {
+			return err
+		}
+	}
+
+	// the first block with room for the entry, in an unused entry or the slack after one in use
+	inode := dir.f.inode
+	added := false
+	err := dir.walkBlocks(func(phys int64, b []byte) (bool, error) {
+		ok, err := addToDirBlock(inode, b, entry)
+		if err != nil || !ok {
+			return err == nil, err
+		}
+		added = true
+		return false, dir.writeBlock(phys, b)
+	})
+	if err != nil || added {
+		return err
+	}
+
+	// all blocks are full, the entry gets a new one
+	_, phys, err := dir.appendBlock()
+	if err != nil {
+		return err
+	}
+	inode.UpdateCsumAndWriteback()
+	return dir.writeBlock(phys, packDirBlock(inode, []*DirectoryEntry2{entry}))
+}
+
+// maxLinks is the most links an inode can have, as in the kernel. With dir_nlink a directory
+// with more subdirectories than that has a link count of 1 instead.
+const maxLinks = 65000
+
+// dirEntryLen returns the minimal record length of a directory entry with a name of n bytes
+func dirEntryLen(n int) int {
+	return (8 + n + 3) &^ 3
+}
+
+// hasDirCsum reports whether directory leaf blocks end with a checksum tail
+func (sb *Superblock) hasDirCsum() bool {
+	return sb.FeatureRoCompatMetadata_csum()
+}
+
+// packDirBlock lays out entries in a single directory block, the last entry absorbing all
+// remaining space. When metadata_csum is enabled the block ends with a checksum tail computed
+// for the directory inode.
+func packDirBlock(inode *Inode, entries []*DirectoryEntry2) []byte {
+	sb := inode.fs.sb
+	blockSize := int(sb.GetBlockSize())
+	b := make([]byte, blockSize)
+	end := blockSize
+	if sb.hasDirCsum() {
+		end -= 12
+	}
+
+	pos := 0
+	for i, e := range entries {
+		recLen := dirEntryLen(len(e.Name))
+		if i == len(entries)-1 {
+			recLen = end - pos
+		}
+		putDirEntry(sb, b, pos, recLen, e)
+		pos += recLen
+	}
+	if len(entries) == 0 {
+		binary.LittleEndian.PutUint16(b[4:], uint16(end))
+	}
+
+	setDirBlockCsum(inode, b)
+	return b
+}
+
+// setDirBlockCsum fills in the checksum tail of a directory leaf block, if there is one
+func setDirBlockCsum(inode *Inode, b []byte) {
+	sb := inode.fs.sb
+	if !sb.hasDirCsum() {
+		return
+	}
+	tail := b[len(b)-12:]
+	binary.LittleEndian.PutUint32(tail[0:], 0)
+	binary.LittleEndian.PutUint16(tail[4:], 12)
+	tail[6] = 0
+	tail[7] = FT_DIR_CSUM
+	binary.LittleEndian.PutUint32(tail[8:], dirBlockCsum(inode, b))
+}
+
+// dirBlockCsum computes the checksum of a directory leaf block with a checksum tail
+func dirBlockCsum(inode *Inode, b []byte) uint32 {
+	cs := newMetadataChecksummer(inode.fs.sb)
+	cs.WriteUint32(uint32(inode.num))
+	cs.WriteUint32(inode.Generation)
+	cs.Write(b[:len(b)-12])
+	return cs.Get()
+}
+
+// hasCsumTail reports whether the directory leaf block b ends with a checksum tail
+func hasCsumTail(b []byte) bool {
+	t := b[len(b)-12:]
+	return binary.LittleEndian.Uint32(t[0:]) == 0 && binary.LittleEndian.Uint16(t[4:]) == 12 && t[6] == 0 && t[7] == FT_DIR_CSUM
+}
+
+// dirBlockEntry is a single directory entry within a directory block
+type dirBlockEntry struct {
+	pos    int
+	inode  uint32
+	recLen int
+	ftype  uint8
+	name   string
+}
+
+// parseDirBlock returns all entries of a directory block in order, including unused ones
+func parseDirBlock(b []byte) ([]dirBlockEntry, error) {
+	end := len(b)
+	if hasCsumTail(b) {
+		end -= 12
+	}
+	ret := []dirBlockEntry{}
+	for pos := 0; pos < end; {
+		if pos+8 > end {
+			return nil, fmt.Errorf("directory entry at %d overruns block", pos)
+		}
+		recLen := int(binary.LittleEndian.Uint16(b[pos+4:]))
+		nameLen := int(b[pos+6])
+		if recLen < 8 || recLen%4 != 0 || pos+recLen > end || 8+nameLen > recLen {
+			return nil, fmt.Errorf("corrupt directory entry at %d with record length %d", pos, recLen)
+		}
+		ret = append(ret, dirBlockEntry{
+			pos:    pos,
+			inode:  binary.LittleEndian.Uint32(b[pos:]),
+			recLen: recLen,
+			ftype:  b[pos+7],
+			name:   string(b[pos+8 : pos+8+nameLen]),
+		})
+		pos += recLen
+	}
+	return ret, nil
+}
+
+// walkBlocks calls fn with each block of the directory in logical order, stopping early when fn
+// returns false. Holes are skipped. An inline directory is walked as its regions of entries, with
+// a negative phys; changes fn makes to them are saved in the inode.
+func (dir *directory) walkBlocks(fn func(phys int64, b []byte) (bool, error)) error {
+	inode := dir.f.inode
+	if inode.isInline() {
+		return dir.walkInline(fn)
+	}
+	blockSize := dir.sb.GetBlockSize()
+	count := (inode.GetSize() + blockSize - 1) / blockSize
+	for lblk := int64(0); lblk < count; lblk++ {
+		phys, _, found := inode.GetBlockPtr(lblk)
+		if !found || phys == 0 {
+			continue
+		}
+		b, err := inode.fs.readBlock(phys)
+		if err != nil {
+			return err
+		}
+		if err := dir.verifyBlock(lblk, phys, b); err != nil {
+			return err
+		}
+		more, err := fn(phys, b)
+		if err != nil {
+			return fmt.Errorf("directory inode %d block %d: %v", inode.num, lblk, err)
+		}
+		if !more {
 			break
 		}
+	}
+	return nil
+}
 
-		dirEntry := &DirectoryEntry2{}
-		err := struc.Unpack(dir.f, dirEntry)
+// walkInline is walkBlocks for an inline directory
+func (dir *directory) walkInline(fn func(phys int64, b []byte) (bool, error)) error {
+	inode := dir.f.inode
+	data, err := inode.inlineData()
+	if err != nil {
+		return err
+	}
+	if size := inode.GetSize(); size < inlineBlockSize || size > int64(len(data)) {
+		return fmt.Errorf("inline directory inode %d has size %d for %d bytes of inline data", inode.num, size, len(data))
+	}
+	data = data[:inode.GetSize()]
+	orig := append([]byte{}, data...)
+	for i, region := range inlineDirRegions(data) {
+		more, err := fn(int64(-1-i), region)
 		if err != nil {
+			return fmt.Errorf("inline directory inode %d: %v", inode.num, err)
+		}
+		if !more {
+			break
+		}
+	}
+	if !bytes.Equal(data, orig) {
+		if err := inode.setInlineData(data); err != nil {
 			return err
 		}
+		inode.UpdateCsumAndWriteback()
+	}
+	return nil
+}
 
-		//log.Println("AddEntry found entry", dirEntry.Rec_len, dirEntry.Name)
-
-		if dirEntry.Rec_len == 0 {
-			log.Fatalf("Invalid")
-		}
-
-		deSize, _ := struc.Sizeof(dirEntry)
-		if !modified && int64(dirEntry.Rec_len) >= int64(deSize) + int64(entrySize) {
-			//log.Println("Found a hole", dirEntry.Rec_len, deSize, entrySize)
-			dir.f.Seek(pos - dir.sb.GetBlockSize() + int64(totalLen), 0)
-			newDeSize := (deSize + 3) & ^3
-			entry.Rec_len = dirEntry.Rec_len - uint16(newDeSize)
-			dirEntry.Rec_len = uint16(newDeSize)
-			struc.Pack(dir.f, dirEntry)
-			struc.Pack(checksummer, dirEntry)
-			pad1 := make([]byte, newDeSize - deSize)
-			dir.f.Write(pad1)
-			checksummer.Write(pad1)
-			struc.Pack(dir.f, entry)
-			struc.Pack(checksummer, entry)
-			pad := make([]byte, int(entry.Rec_len) - entrySize)
-			dir.f.Write(pad)
-			checksummer.Write(pad)
-			totalLen += int64(dirEntry.Rec_len) + int64(entry.Rec_len)
-			modified = true
-		} else {
-			struc.Pack(checksummer, dirEntry)
-			skip := int64(dirEntry.Rec_len) - int64(deSize)
-			dir.f.Seek(skip, 1)
-			checksummer.Write(make([]byte, skip))
-			totalLen += int64(dirEntry.Rec_len)
+// writeBlock writes back a block of the directory passed to fn by walkBlocks
+func (dir *directory) writeBlock(phys int64, b []byte) error {
+	if phys < 0 {
+		// inline, walkBlocks saves it
+		return nil
+	}
+	return dir.f.inode.fs.writeBlock(phys, b)
+}
+
+// FindEntry looks up the named entry in the directory, returning its inode number or 0 if there
+// is no such entry
+func (dir *directory) FindEntry(name string) (uint32, error) {
+	if dir.isHashed() {
+		return dir.dxFindEntry(name)
+	}
+	if inode := dir.f.inode; inode.isInline() && (name == "." || name == "..") {
+		// an inline directory has no entries for these, just the inode number of its parent
+		if name == "." {
+			return uint32(inode.num), nil
 		}
+		return binary.LittleEndian.Uint32(inode.BlockOrExtents[:]), nil
 	}
+	var found uint32
+	err := dir.walkBlocks(func(phys int64, b []byte) (bool, error) {
+		entries, err := parseDirBlock(b)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range entries {
+			if e.inode != 0 && dir.nameMatches(e.name, name) {
+				found = e.inode
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	return found, err
+}
 
-	if !modified {
-		log.Println("No hole found, adding new block")
-		checksummer := NewChecksummer(dir.sb)
-		checksummer.Write(dir.f.inode.fs.sb.Uuid[:])
-		checksummer.WriteUint32(uint32(dir.f.inode.num))
-		checksummer.WriteUint32(uint32(dir.f.inode.Generation))
+// entries returns the entries of the directory in use, in the order they are stored. Those of
+// an inline directory start with "." and "..", which it only has implicitly.
+func (dir *directory) entries() ([]DirectoryEntry2, error) {
+	inode := dir.f.inode
+	ret := []DirectoryEntry2{}
+	if inode.isInline() {
+		ret = append(ret,
+			DirectoryEntry2{Inode: uint32(inode.num), Name_len: 1, Flags: FT_DIR, Name: "."},
+			DirectoryEntry2{Inode: binary.LittleEndian.Uint32(inode.BlockOrExtents[:]), Name_len: 2, Flags: FT_DIR, Name: ".."},
+		)
+	}
+	err := dir.walkBlocks(func(phys int64, b []byte) (bool, error) {
+		entries, err := parseDirBlock(b)
+		if err != nil {
+			return false, err
+		}
+		for _, e := range entries {
+			if e.inode != 0 {
+				ret = append(ret, DirectoryEntry2{Inode: e.inode, Rec_len: uint16(e.recLen), Name_len: uint8(len(e.name)), Flags: e.ftype, Name: e.name})
+			}
+		}
+		return true, nil
+	})
+	return ret, err
+}
 
-		entry.Rec_len = uint16(dir.sb.GetBlockSize() - 12)
-		struc.Pack(dir.f, entry)
-		struc.Pack(checksummer, entry)
-		dirSum := DirectoryEntryCsum{
-			FakeInodeZero: 0,
-			Rec_len:  uint16(12),
-			FakeName_len: 0,
-			FakeFileType:    0xDE,
-			Checksum:     checksummer.Get(),
+// IsEmpty reports whether the directory holds nothing but "." and ".."
+func (dir *directory) IsEmpty() (bool, error) {
+	empty := true
+	err := dir.walkBlocks(func(phys int64, b []byte) (bool, error) {
+		entries, err := parseDirBlock(b)
+		if err != nil {
+			return false, err
 		}
-		struc.Pack(dir.f, &dirSum)
+		for _, e := range entries {
+			if e.inode != 0 && e.name != "." && e.name != ".." {
+				empty = false
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	return empty, err
+}
+
+// RemoveEntry unlinks the named entry from the directory, returning the inode number it pointed
+// to. The space of the entry is merged into the entry before it, or, for the first entry of a
+// block, the entry is marked unused.
+func (dir *directory) RemoveEntry(name string) (uint32, error) {
+	var removed uint32
+	err := dir.walkBlocks(func(phys int64, b []byte) (bool, error) {
+		entries, err := parseDirBlock(b)
+		if err != nil {
+			return false, err
+		}
+		for i, e := range entries {
+			if e.inode == 0 || !dir.nameMatches(e.name, name) {
+				continue
+			}
+			if i > 0 {
+				prev := entries[i-1]
+				binary.LittleEndian.PutUint16(b[prev.pos+4:], uint16(prev.recLen+e.recLen))
+			} else {
+				binary.LittleEndian.PutUint32(b[e.pos:], 0)
+			}
+			if hasCsumTail(b) {
+				setDirBlockCsum(dir.f.inode, b)
+			}
+			removed = e.inode
+			return false, dir.writeBlock(phys, b)
+		}
+		return true, nil
+	})
+	if err == nil && removed == 0 {
+		err = fmt.Errorf("no such directory entry %s", name)
 	}
+	return removed, err
+}
 
-	return nil
-}
\ No newline at end of file
+// putDirEntry writes a directory entry with the given record length at pos in b
+func putDirEntry(sb *Superblock, b []byte, pos, recLen int, e *DirectoryEntry2) {
+	binary.LittleEndian.PutUint32(b[pos:], e.Inode)
+	binary.LittleEndian.PutUint16(b[pos+4:], uint16(recLen))
+	b[pos+6] = uint8(len(e.Name))
+	b[pos+7] = 0
+	if sb.FeatureIncompatFiletype() {
+		b[pos+7] = e.Flags
+	}
+	copy(b[pos+8:], e.Name)
+}
+
+// addToDirBlock places e in the directory leaf block b, either in an unused entry or in the slack
+// at the end of an entry in use, and updates the checksum tail. It returns false if there is not
+// enough room in the block.
+func addToDirBlock(inode *Inode, b []byte, e *DirectoryEntry2) (bool, error) {
+	entries, err := parseDirBlock(b)
+	if err != nil {
+		return false, err
+	}
+	need := dirEntryLen(len(e.Name))
+	for _, de := range entries {
+		if de.inode == 0 && de.recLen >= need {
+			putDirEntry(inode.fs.sb, b, de.pos, de.recLen, e)
+		} else if used := dirEntryLen(len(de.name)); de.inode != 0 && de.recLen-used >= need {
+			binary.LittleEndian.PutUint16(b[de.pos+4:], uint16(used))
+			putDirEntry(inode.fs.sb, b, de.pos+used, de.recLen-used, e)
+		} else {
+			continue
+		}
+		if hasCsumTail(b) {
+			setDirBlockCsum(inode, b)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -1,13 +1,13 @@
 package ext4
 
 import (
+	"bytes"
 	"fmt"
 	"io"
 	"log"
 	"os"
 	"path"
 	"strings"
-	"time"
 
 	"github.com/diskfs/go-diskfs/filesystem"
 	"github.com/diskfs/go-diskfs/util"
@@ -15,40 +15,155 @@ import (
 )
 
 type FileSystem struct {
-	sb  *Superblock
-	dev *os.File
+	sb    *Superblock
+	dev   util.File
 	start int64
+	// ignoreChecksums reads metadata even if it does not match its checksum
+	ignoreChecksums bool
+	// mmp keeps the MMP block updated while the filesystem is open for writing
+	mmp *mmp
 }
 
+// ReadOptions adjusts how ReadWithOptions reads a filesystem
+type ReadOptions struct {
+	// ReadOnly never writes to the device, as with ReadOnly
+	ReadOnly bool
+	// IgnoreChecksums reads metadata that does not match its checksum instead of failing with a
+	// *CorruptionError, to get what can be got out of a damaged image
+	IgnoreChecksums bool
+}
+
+// Read reads a filesystem from a given disk.
+//
+// requires the util.File where to read the filesystem, size is the size of the filesystem in bytes,
+// start is how far in bytes from the beginning of the util.File the filesystem is expected to begin,
+// and blocksize is the logical blocksize of the underlying device.
+//
+// All access to the device goes through ReadAt and WriteAt, so any util.File will do, and files
+// of the filesystem can be read concurrently.
+//
+// If the filesystem was not cleanly unmounted, the committed transactions in its journal are
+// replayed into it before anything else is read, just as the kernel would on mount. Then the
+// deletions and truncations left pending in its orphan list are completed.
+//
+// With the mmp feature, Read refuses a filesystem whose MMP block shows it is in use elsewhere
+// or being checked, and otherwise keeps the block updated until Close.
+//
+// Under metadata_csum, or gdt_csum for the group descriptors, the superblock, group
+// descriptors, inodes, extent blocks and directory blocks are verified against their checksums
+// as they are read, failing with a *CorruptionError on any mismatch.
+//
+// Like the kernel, Read refuses a filesystem with incompatible features it does not understand.
+// One with features it can read but not keep consistent when writing, such as bigalloc or
+// quota, is read as with ReadOnly, and any attempt to change it fails saying so. So is one with
+// the read-only feature, which is there to keep it from being written at all. With the encrypt
+// feature, encrypted directories and files cannot be changed, as that takes their keys.
 func Read(file util.File, size int64, start int64, blocksize int64) (*FileSystem, error) {
-	var (
-		err  error
-	)
+	return read(file, start, ReadOptions{})
+}
 
-	_, err = file.Seek(start + Superblock0Offset, io.SeekStart)
+// ReadOnly reads a filesystem like Read does, but never writes to file: a journal that needs
+// recovery is replayed in memory only, and any attempt to change the filesystem fails.
+func ReadOnly(file util.File, size int64, start int64, blocksize int64) (*FileSystem, error) {
+	return read(file, start, ReadOptions{ReadOnly: true})
+}
+
+// ReadWithOptions reads a filesystem like Read does, adjusted by opts
+func ReadWithOptions(file util.File, size int64, start int64, blocksize int64, opts ReadOptions) (*FileSystem, error) {
+	return read(file, start, opts)
+}
+
+func read(file util.File, start int64, opts ReadOptions) (*FileSystem, error) {
+	writable := !opts.ReadOnly
+	sb, err := readSuperblock(file, start)
 	if err != nil {
 		return nil, err
 	}
 
-	sb := &Superblock{
-		address: Superblock0Offset,
+	fs := &FileSystem{
+		sb:              sb,
+		dev:             file,
+		start:           start,
+		ignoreChecksums: opts.IgnoreChecksums,
 	}
-	err = struc.Unpack(file, sb)
-	if err != nil {
+	sb.fs = fs
+	if err := sb.verify(); err != nil {
 		return nil, err
 	}
+	if err := sb.checkEncoding(); err != nil {
+		return nil, err
+	}
+	if f := sb.unreadableFeatures(); !f.empty() {
+		return nil, fmt.Errorf("cannot read ext4 filesystem with unsupported features %v", f.names())
+	}
+	var roErr error
+	if f := sb.unwritableFeatures(); writable && !f.empty() {
+		writable = false
+		roErr = fmt.Errorf("ext4 filesystem with features %v can only be read", f.names())
+	}
+	if !writable {
+		fs.dev = &readOnlyFile{
+			dev:    file,
+			err:    roErr,
+			start:  start,
+			size:   sb.GetBlockSize(),
+			blocks: map[int64][]byte{},
+		}
+	}
 
-	//sb.numBlockGroups = sb.BlockGroupCount()
-
-	fs := &FileSystem{
-		sb: sb,
-		dev: file.(*os.File),
-		start: start,
+	// like the kernel, take the MMP block before anything is written, journal recovery included
+	if writable && sb.FeatureIncompatMmp() {
+		if err := fs.startMMP(file); err != nil {
+			return nil, err
+		}
+	}
+	if sb.FeatureIncompatRecover() {
+		if err := fs.recoverJournal(writable); err != nil {
+			fs.releaseMMP()
+			return nil, err
+		}
+	}
+	if writable {
+		jf := &journalFile{fs: fs, dev: file}
+		if fs.sb.FeatureCompatHas_journal() {
+			jf.j, jf.err = fs.openJournal()
+		}
+		fs.dev = jf
+	}
+	if writable && fs.sb.Last_orphan != 0 {
+		if err := fs.processOrphans(); err != nil {
+			fs.releaseMMP()
+			return nil, err
+		}
 	}
 
 	return fs, nil
 }
 
+// readSuperblock reads the primary superblock of the filesystem that begins start bytes into file
+func readSuperblock(file util.File, start int64) (*Superblock, error) {
+	b := make([]byte, SuperblockSize)
+	n, err := file.ReadAt(b, start+Superblock0Offset)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("Could not read ext4 superblock: %v", err)
+	}
+	if n < len(b) {
+		return nil, fmt.Errorf("Only could read %d bytes of ext4 superblock", n)
+	}
+
+	sb := &Superblock{
+		address: Superblock0Offset,
+	}
+	err = struc.Unpack(bytes.NewReader(b), sb)
+	if err != nil {
+		return nil, err
+	}
+	if sb.Magic != Ext4Magic {
+		return nil, fmt.Errorf("Invalid ext4 superblock magic %#x", sb.Magic)
+	}
+	return sb, nil
+}
+
 func (fs *FileSystem) Superblock() *Superblock {
 	return fs.sb
 }
@@ -61,8 +176,41 @@ func (fs *FileSystem) Label() string {
 //
 // * It will make the entire tree path if it does not exist
 // * It will not return an error if the path already exists
-func (fs *FileSystem) Mkdir(path string) error {
-	return fs.mkDir(path, 0775)
+//
+// It returns an error if anything on the path exists but is not a directory.
+func (fs *FileSystem) Mkdir(p string) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	return fs.transaction(func() error {
+		parent, err := fs.lookup("/")
+		if err != nil {
+			return err
+		}
+		dir := "/"
+		for _, part := range strings.Split(path.Clean("/"+p), "/") {
+			if part == "" {
+				continue
+			}
+			dir = path.Join(dir, part)
+			num, err := NewDirectory(parent).FindEntry(part)
+			if err != nil {
+				return err
+			}
+			if num == 0 {
+				if err := fs.mkDir(dir, 0775); err != nil {
+					return err
+				}
+			}
+			if parent, err = fs.lookup(dir); err != nil {
+				return err
+			}
+			if parent.Mode&S_IFMT != S_IFDIR {
+				return fmt.Errorf("%s exists and is not a directory", dir)
+			}
+		}
+		return nil
+	})
 }
 
 // OpenFile returns an io.ReadWriter from which you can read the contents of a file
@@ -71,7 +219,14 @@ func (fs *FileSystem) Mkdir(path string) error {
 // accepts os.OpenFile flags: O_CREATE, O_APPEND, and always O_RDWR
 //
 // returns an error if the file does not exist
+//
+// symbolic links are followed, like os.OpenFile does
 func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
+	return fs.openFile(p, flag, 0)
+}
+
+// openFile is OpenFile for p, which was reached by following the given number of symbolic links
+func (fs *FileSystem) openFile(p string, flag int, links int) (filesystem.File, error) {
 	// get the path
 	dir := path.Dir(p)
 	filename := path.Base(p)
@@ -80,44 +235,37 @@ func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 		return nil, fmt.Errorf("Cannot open directory %s as file", p)
 	}
 
-	inodeNum := int64(ROOT_INO)
-	var inode *Inode
-	parts := strings.Split(dir, "/")
-	for _, part := range parts {
-		if len(part) == 0 {
-			continue
-		}
-
-		inode = fs.getInode(inodeNum)
-		dirContents := inode.ReadDirectory()
-		found := false
-		for i := 0; i < len(dirContents); i++ {
-			//log.Println(string(dirContents[i].Name), part, dirContents[i].Flags, dirContents[i].Inode)
-			if string(dirContents[i].Name) == part {
-				found = true
-				inodeNum = int64(dirContents[i].Inode)
-				break
-			}
-		}
-
-		if !found {
-			return nil, fmt.Errorf("No such directory %s", dir)
-		}
+	parent, err := fs.lookup(dir)
+	if err != nil {
+		return nil, err
 	}
-
-	fileExists := false
-	inode = fs.getInode(inodeNum)
-	lastDirContents := inode.ReadDirectory()
-	for i := 0; i < len(lastDirContents); i++ {
-		if string(lastDirContents[i].Name) == filename {
-			fileExists = true
-			inodeNum = int64(lastDirContents[i].Inode)
-			break
-		}
+	if parent.Mode&S_IFMT != S_IFDIR {
+		return nil, fmt.Errorf("No such directory %s", dir)
+	}
+	// FindEntry goes through the hash index of indexed directories
+	fileInode, err := NewDirectory(parent).FindEntry(filename)
+	if err != nil {
+		return nil, err
 	}
 
-	if fileExists {
-		inode = fs.getInode(inodeNum)
+	if fileInode != 0 {
+		inode, err := fs.readInode(int64(fileInode))
+		if err != nil {
+			return nil, err
+		}
+		if inode.Mode&S_IFMT == S_IFLNK {
+			if links >= maxSymlinkFollow {
+				return nil, fmt.Errorf("too many levels of symbolic links opening %s", p)
+			}
+			target, err := inode.readlink()
+			if err != nil {
+				return nil, err
+			}
+			if !path.IsAbs(target) {
+				target = path.Join(dir, target)
+			}
+			return fs.openFile(target, flag, links+1)
+		}
 
 		pos := int64(0)
 		if flag&os.O_APPEND == os.O_APPEND {
@@ -136,17 +284,31 @@ func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 	if flag&os.O_CREATE == 0 {
 		return nil, fmt.Errorf("Target file %s does not exist and was not asked to create", p)
 	}
+	if fs.readOnly() {
+		return nil, fs.errReadOnly()
+	}
+	if err := parent.checkUnencrypted(); err != nil {
+		return nil, err
+	}
 
-	newFile := fs.CreateNewFile(0777)
-	log.Printf("Creating new file with inode %d and perms %x", newFile.inode.num, newFile.inode.Mode)
-	newFile.inode.Mode |= 0x8000   //const EXTENTS_FL = 0x00080000
-	newFile.inode.UpdateCsumAndWriteback()
-
-	NewDirectory(inode).AddEntry(&DirectoryEntry2{
-		Inode: uint32(newFile.inode.num),
-		Flags: 0,
-		Name:  filename,
+	var newFile *File
+	err = fs.transaction(func() error {
+		if newFile, err = fs.newFile(parent, 0777, false); err != nil {
+			return err
+		}
+		log.Printf("Creating new file with inode %d and perms %x", newFile.inode.num, newFile.inode.Mode)
+		newFile.inode.Mode |= 0x8000 // S_IFREG
+		newFile.inode.UpdateCsumAndWriteback()
+
+		return NewDirectory(parent).AddEntry(&DirectoryEntry2{
+			Inode: uint32(newFile.inode.num),
+			Flags: fs.sb.dirEntryType(newFile.inode.Mode),
+			Name:  filename,
+		})
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	return newFile, nil
 }
@@ -157,62 +319,52 @@ func (fs *FileSystem) OpenFile(p string, flag int) (filesystem.File, error) {
 //
 // Will return an error if the directory does not exist or is a regular file and not a directory
 func (fs *FileSystem) ReadDir(dir string) ([]os.FileInfo, error) {
-	
-	inodeNum := int64(ROOT_INO)
-	var inode *Inode
-	parts := strings.Split(dir, "/")
-	//if len(parts) == 0
-
-	for _, part := range parts[1:] {
-		if len(part) == 0 {
-			continue
-		}
-
-		inode = fs.getInode(inodeNum)
-		dirContents := inode.ReadDirectory()
-		found := false
-		for i := 0; i < len(dirContents); i++ {
-			//log.Println(string(dirContents[i].Name), part, dirContents[i].Flags, dirContents[i].Inode)
-			if string(dirContents[i].Name) == part {
-				found = true
-				inodeNum = int64(dirContents[i].Inode)
-				break
-			}
-		}
-
-		if !found {
-			return nil, fmt.Errorf("No such directory %s", dir)
-		}
+	inode, err := fs.lookup(dir)
+	if err != nil {
+		return nil, err
+	}
+	if inode.Mode&S_IFMT != S_IFDIR {
+		return nil, fmt.Errorf("No such directory %s", dir)
+	}
+	lastDirContents, err := NewDirectory(inode).entries()
+	if err != nil {
+		return nil, err
 	}
-
-	inode = fs.getInode(inodeNum)
-	lastDirContents := inode.ReadDirectory()
 	count := len(lastDirContents)
 	ret := make([]os.FileInfo, count, count)
 	for i := 0; i < len(lastDirContents); i++ {
-		inodeNum = int64(lastDirContents[i].Inode)
-		inode = fs.getInode(inodeNum)
-
-		isDir := false
-		if inode.Mode&0x4000 == 0x4000 {
-			isDir = true
-		}
-
-		ret[i] = FileInfo{
-			modTime: time.Unix(int64(inode.Mtime), 0),
-			//mode: os.FileMode(inode.Mode),
-			name:  lastDirContents[i].Name,
-			size:  inode.GetSize(),
-			isDir: isDir,
+		inode, err = fs.readInode(int64(lastDirContents[i].Inode))
+		if err != nil {
+			return nil, err
 		}
+		ret[i] = inode.fileInfo(lastDirContents[i].Name)
 	}
 
 	return ret, nil
 }
 
-// Type returns the type code for the filesystem. Always returns filesystem.TypeFat32
+// ext3Incompat and ext3RoCompat are the features an ext3 filesystem, or an ext2 one, may have;
+// any other makes it ext4
+const (
+	ext3Incompat = FEATURE_INCOMPAT_FILETYPE | FEATURE_INCOMPAT_RECOVER | FEATURE_INCOMPAT_META_BG
+	ext3RoCompat = FEATURE_RO_COMPAT_SPARSE_SUPER | FEATURE_RO_COMPAT_LARGE_FILE | FEATURE_RO_COMPAT_BTREE_DIR
+)
+
+// Type returns the type code for the filesystem, going by its features like blkid does: ext2
+// and ext3 are told apart by the journal, and anything using a feature they lack is ext4.
+// Without a superblock it is ext4.
 func (fs *FileSystem) Type() filesystem.Type {
-	return filesystem.TypeExt4
+	sb := fs.sb
+	switch {
+	case sb == nil:
+		return filesystem.TypeExt4
+	case sb.Feature_incompat&^ext3Incompat != 0 || sb.Feature_ro_compat&^ext3RoCompat != 0:
+		return filesystem.TypeExt4
+	case sb.FeatureCompatHas_journal():
+		return filesystem.TypeExt3
+	default:
+		return filesystem.TypeExt2
+	}
 }
 
 func (fs *FileSystem) create(path string) (*File, error) {
@@ -226,7 +378,10 @@ func (fs *FileSystem) create(path string) (*File, error) {
 			continue
 		}
 
-		dirContents := inode.ReadDirectory()
+		dirContents, err := inode.ReadDirectory()
+		if err != nil {
+			return nil, err
+		}
 		found := false
 		for i := 0; i < len(dirContents); i++ {
 			//log.Println(string(dirContents[i].Name), part, dirContents[i].Flags, dirContents[i].Inode)
@@ -244,7 +399,10 @@ func (fs *FileSystem) create(path string) (*File, error) {
 
 	name := parts[len(parts)-1]
 
-	newFile := fs.CreateNewFile(0777)
+	newFile, err := fs.newFile(inode, 0777, false)
+	if err != nil {
+		return nil, err
+	}
 	log.Printf("Creating new file with inode %d and perms %d", newFile.inode.num, newFile.inode.Mode)
 	newFile.inode.Mode |= 0x8000
 	newFile.inode.UpdateCsumAndWriteback()
@@ -269,7 +427,10 @@ func (fs *FileSystem) open(name string) (*File, error) {
 		}
 
 		inode = fs.getInode(inodeNum)
-		dirContents := inode.ReadDirectory()
+		dirContents, err := inode.ReadDirectory()
+		if err != nil {
+			return nil, err
+		}
 		found := false
 		for i := 0; i < len(dirContents); i++ {
 			//log.Println(string(dirContents[i].Name), part, dirContents[i].Flags, dirContents[i].Inode)
@@ -294,110 +455,197 @@ func (fs *FileSystem) open(name string) (*File, error) {
 	}}, nil
 }
 
-func (fs *FileSystem) Remove(name string) error {
-	return nil
+// Remove removes the named file or empty directory, like os.Remove.
+//
+// The directory entry is unlinked and the link count of its inode dropped; once no links are
+// left, the inode and all of its blocks are freed. Removing a directory that is not empty
+// returns an error.
+func (fs *FileSystem) Remove(p string) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	return fs.transaction(func() error {
+		return fs.remove(p)
+	})
 }
 
-func (fs *FileSystem) mkDir(path string, perm os.FileMode) error {
-	log.Println("MKDIR", path)
-	parts := strings.Split(path, "/")
-
-	inode := fs.getInode(int64(ROOT_INO))
+func (fs *FileSystem) remove(p string) error {
+	p = path.Clean("/" + p)
+	dirName, name := path.Split(p)
+	if name == "" || name == "." || name == ".." {
+		return fmt.Errorf("cannot remove %s", p)
+	}
+	parent, err := fs.lookup(dirName)
+	if err != nil {
+		return err
+	}
+	if parent.Mode&S_IFMT != S_IFDIR {
+		return fmt.Errorf("%s is not a directory", dirName)
+	}
+	if err := parent.checkUnencrypted(); err != nil {
+		return err
+	}
+	dir := NewDirectory(parent)
+	num, err := dir.FindEntry(name)
+	if err != nil {
+		return err
+	}
+	if num == 0 {
+		return fmt.Errorf("no such file or directory %s", p)
+	}
 
-	for _, part := range parts[:len(parts)-1] {
-		if len(part) == 0 {
-			continue
+	inode, err := fs.readInode(int64(num))
+	if err != nil {
+		return err
+	}
+	isDir := inode.Mode&S_IFMT == S_IFDIR
+	if isDir {
+		empty, err := NewDirectory(inode).IsEmpty()
+		if err != nil {
+			return err
 		}
-
-		dirContents := inode.ReadDirectory()
-		found := false
-		for i := 0; i < len(dirContents); i++ {
-			//log.Println(string(dirContents[i].Name), part, dirContents[i].Flags, dirContents[i].Inode)
-			if string(dirContents[i].Name) == part {
-				found = true
-				inode = fs.getInode(int64(dirContents[i].Inode))
-				break
-			}
+		if !empty {
+			return fmt.Errorf("directory %s is not empty", p)
 		}
+	}
 
-		if !found {
-			return fmt.Errorf("No such file or directory")
-		}
+	if _, err := dir.RemoveEntry(name); err != nil {
+		return err
 	}
 
-	name := parts[len(parts)-1]
+	parent.touch(timeModify, timeChange)
+	if isDir {
+		// the ".." of the removed directory no longer refers to the parent; a count of 1 means
+		// the parent has too many subdirectories to count
+		if parent.Links_count > 2 {
+			parent.Links_count--
+		}
+		// a directory is linked from its parent and from its own "."
+		inode.Links_count = 0
+	} else if inode.Links_count > 0 {
+		inode.Links_count--
+	}
+	parent.UpdateCsumAndWriteback()
 
-	newFile := fs.CreateNewFile(perm)
-	log.Printf("Creating new directory with inode %d and perms %d", newFile.inode.num, newFile.inode.Mode)
-	newFile.inode.Mode |= 0x4000
-	newFile.inode.UpdateCsumAndWriteback()
+	if inode.Links_count > 0 {
+		inode.touch(timeChange)
+		inode.UpdateCsumAndWriteback()
+		return nil
+	}
+	return fs.freeInode(inode)
+}
 
-	{
-		checksummer := NewChecksummer(inode.fs.sb)
-		checksummer.Write(inode.fs.sb.Uuid[:])
-		checksummer.WriteUint32(uint32(newFile.inode.num))
-		checksummer.WriteUint32(uint32(newFile.inode.Generation))
-
-		dirEntryDot := DirectoryEntry2{
-			Inode:   uint32(newFile.inode.num),
-			Flags:   2,
-			Rec_len: 12,
-			Name:    ".",
+// lookup returns the inode at the given absolute path
+func (fs *FileSystem) lookup(p string) (*Inode, error) {
+	inode, err := fs.readInode(ROOT_INO)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == "" {
+			continue
 		}
-		recLenDot, _ := struc.Sizeof(&dirEntryDot)
-		struc.Pack(checksummer, dirEntryDot)
-		struc.Pack(newFile, dirEntryDot)
-		{
-			blank1 := make([]byte, 12-recLenDot)
-			checksummer.Write(blank1)
-			newFile.Write(blank1)
+		if inode.Mode&S_IFMT != S_IFDIR {
+			return nil, fmt.Errorf("not a directory in path %s", p)
 		}
-
-		dirEntryDotDot := DirectoryEntry2{
-			Inode: uint32(inode.num),
-			Flags: 2,
-			Name:  "..",
+		num, err := NewDirectory(inode).FindEntry(part)
+		if err != nil {
+			return nil, err
+		}
+		if num == 0 {
+			return nil, fmt.Errorf("no such file or directory %s", p)
 		}
-		recLenDotDot, _ := struc.Sizeof(&dirEntryDotDot)
-		dirEntryDotDot.Rec_len = uint16(1024 - 12 - 12)
-		struc.Pack(checksummer, dirEntryDotDot)
-		struc.Pack(newFile, dirEntryDotDot)
-
-		blank := make([]byte, 1024-12-12-recLenDotDot)
-		checksummer.Write(blank)
-		newFile.Write(blank)
-
-		dirSum := DirectoryEntryCsum{
-			FakeInodeZero: 0,
-			Rec_len:       uint16(12),
-			FakeName_len:  0,
-			FakeFileType:  0xDE,
-			Checksum:      checksummer.Get(),
+		if inode, err = fs.readInode(int64(num)); err != nil {
+			return nil, err
 		}
-		struc.Pack(newFile, &dirSum)
 	}
+	return inode, nil
+}
 
-	NewDirectory(inode).AddEntry(&DirectoryEntry2{
+func (fs *FileSystem) mkDir(p string, perm os.FileMode) error {
+	log.Println("MKDIR", p)
+	p = path.Clean("/" + p)
+	dirName, name := path.Split(p)
+	if name == "" {
+		return fmt.Errorf("cannot create directory %s", p)
+	}
+	inode, err := fs.lookup(dirName)
+	if err != nil {
+		return err
+	}
+	if inode.Mode&S_IFMT != S_IFDIR {
+		return fmt.Errorf("%s is not a directory", dirName)
+	}
+	if err := inode.checkUnencrypted(); err != nil {
+		return err
+	}
+	dir := NewDirectory(inode)
+	if num, err := dir.FindEntry(name); err != nil {
+		return err
+	} else if num != 0 {
+		return fmt.Errorf("file exists %s", p)
+	}
+
+	newFile, err := fs.newFile(inode, perm, true)
+	if err != nil {
+		return err
+	}
+	log.Printf("Creating new directory with inode %d and perms %d", newFile.inode.num, newFile.inode.Mode)
+	newFile.inode.Mode |= S_IFDIR
+	// like the kernel, subdirectories of a casefolded directory are casefolded too
+	newFile.inode.Flags |= inode.Flags & CASEFOLD_FL
+
+	// a single block of whatever size blocks are, holding "." and ".."
+	ftype := fs.sb.dirEntryType(S_IFDIR)
+	_, phys, err := NewDirectory(newFile.inode).appendBlock()
+	if err != nil {
+		return err
+	}
+	b := packDirBlock(newFile.inode, []*DirectoryEntry2{
+		{Inode: uint32(newFile.inode.num), Flags: ftype, Name: "."},
+		{Inode: uint32(inode.num), Flags: ftype, Name: ".."},
+	})
+	if err := fs.writeBlock(phys, b); err != nil {
+		return err
+	}
+
+	if err := dir.AddEntry(&DirectoryEntry2{
 		Inode: uint32(newFile.inode.num),
-		Flags: 0,
+		Flags: ftype,
 		Name:  name,
-	})
+	}); err != nil {
+		return err
+	}
 
 	newFile.inode.Links_count++
 	newFile.inode.UpdateCsumAndWriteback()
 
-	inode.Links_count++
+	// with dir_nlink, a directory with too many subdirectories to count has a count of 1
+	if inode.Links_count != 1 {
+		inode.Links_count++
+		if inode.Links_count >= maxLinks && fs.sb.FeatureRoCompatDir_nlink() {
+			inode.Links_count = 1
+		}
+	}
+	inode.touch(timeModify, timeChange)
 	inode.UpdateCsumAndWriteback()
 
 	bgd := fs.getBlockGroupDescriptor((newFile.inode.num - 1) / int64(inode.fs.sb.InodePer_group))
-	bgd.Used_dirs_count_lo++
+	bgd.setUsedDirsCount(bgd.GetUsedDirsCount() + 1)
 	bgd.UpdateCsumAndWriteback()
 
 	return nil
 }
 
+// Close releases the filesystem, marking its MMP block clean if it has one. The underlying
+// device is closed too if it is an io.Closer, such as an *os.File.
 func (fs *FileSystem) Close() error {
-	err := fs.dev.Close()
+	err := fs.releaseMMP()
+	if c, ok := fs.dev.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil {
+			return cerr
+		}
+	}
 	if err != nil {
 		return err
 	}
@@ -412,17 +660,47 @@ func (fs *FileSystem) GetInode(inodeAddress int64) *Inode {
 }
 
 func (fs *FileSystem) getInode(inodeAddress int64) *Inode {
-	bgd := fs.getBlockGroupDescriptor((inodeAddress - 1) / int64(fs.sb.InodePer_group))
+	return fs.inodeIn(fs.getBlockGroupDescriptor((inodeAddress-1)/int64(fs.sb.InodePer_group)), inodeAddress)
+}
+
+// readInode reads an inode like getInode does, verifying its checksum and that of the
+// descriptor of its group
+func (fs *FileSystem) readInode(num int64) (*Inode, error) {
+	if num < 1 || num > int64(fs.sb.InodeCount) {
+		return nil, fmt.Errorf("invalid inode number %d", num)
+	}
+	bgd, err := fs.readGroupDescriptor((num - 1) / int64(fs.sb.InodePer_group))
+	if err != nil {
+		return nil, err
+	}
+	inode := fs.inodeIn(bgd, num)
+	if err := inode.verify(); err != nil {
+		return nil, err
+	}
+	return inode, nil
+}
+
+// inodeIn reads inode inodeAddress from the inode table of its group
+func (fs *FileSystem) inodeIn(bgd *GroupDescriptor, inodeAddress int64) *Inode {
 	index := (inodeAddress - 1) % int64(fs.sb.InodePer_group)
 	pos := bgd.GetInodeTableLoc()*fs.sb.GetBlockSize() + index*int64(fs.sb.Inode_size)
 	//log.Printf("%d %d %d %d", bgd.GetInodeTableLoc(), fs.sb.GetBlockSize(), index, fs.sb.Inode_size)
-	fs.dev.Seek(fs.start + pos, io.SeekStart)
+	raw := make([]byte, fs.sb.Inode_size)
+	fs.dev.ReadAt(raw, fs.start+pos)
 
 	inode := &Inode{
 		fs:      fs,
 		address: pos,
-		num:     inodeAddress}
-	struc.Unpack(fs.dev, &inode)
+		num:     inodeAddress,
+		raw:     raw,
+	}
+	// the struct always covers the extra fields, even where the inode is too small to hold them
+	padded := make([]byte, 160)
+	copy(padded, raw)
+	struc.Unpack(bytes.NewReader(padded), inode)
+	if fs.sb.Inode_size == 128 || inode.Extra_isize < 32 {
+		inode.clearExtraFields()
+	}
 	//log.Printf("Read inode %d, contents:\n%+v\n", inodeAddress, inode)
 	return inode
 }
@@ -432,61 +710,65 @@ func (fs *FileSystem) GetBlockGroupDescriptor(blockGroupNum int64) *GroupDescrip
 }
 
 func (fs *FileSystem) getBlockGroupDescriptor(blockGroupNum int64) *GroupDescriptor {
-	blockSize := fs.sb.GetBlockSize()
-	bgdtLocation := 1024/blockSize + 1
-
-	size := int64(32)
-	if fs.sb.FeatureIncompat64bit() {
-		size = int64(64)
-	}
-	addr := bgdtLocation*blockSize + size*blockGroupNum
+	sb := fs.sb
+	size := sb.descSize()
+	dpb := sb.descPerBlock()
+	addr := sb.descBlockLoc(blockGroupNum/dpb)*sb.GetBlockSize() + size*(blockGroupNum%dpb)
 	bgd := &GroupDescriptor{
 		fs:      fs,
 		address: addr,
 		num:     blockGroupNum,
 	}
-	fs.dev.Seek(fs.start + addr, 0)
-	struc.Unpack(io.LimitReader(fs.dev, size), &bgd)
+	b := make([]byte, 64)
+	if size > 64 {
+		b = make([]byte, size)
+	}
+	fs.dev.ReadAt(b[:size], fs.start+addr)
+	struc.Unpack(bytes.NewReader(b), bgd)
 	//log.Printf("Read block group %d, contents:\n%+v\n", blockGroupNum, bgd)
 	return bgd
 }
 
-func (fs *FileSystem) CreateNewFile(perm os.FileMode) *File {
-	var inode *Inode
-
-	numBlockGroups := fs.sb.BlockGroupCount()
-	for i := int64(0); i < numBlockGroups; i++ {
-		bgd := fs.getBlockGroupDescriptor(i)
-		inode = bgd.GetFreeInode()
-		if inode != nil {
-			break
-		}
+// readGroupDescriptor reads a group descriptor like getBlockGroupDescriptor does, verifying its
+// checksum
+func (fs *FileSystem) readGroupDescriptor(num int64) (*GroupDescriptor, error) {
+	bgd := fs.getBlockGroupDescriptor(num)
+	if err := bgd.verify(); err != nil {
+		return nil, err
 	}
+	return bgd, nil
+}
 
-	if inode == nil {
-		log.Fatalln("Couldn't get free inode with numBlockGroups:", numBlockGroups, "Free_inodeCount:", fs.sb.Free_inodeCount)
+func (fs *FileSystem) CreateNewFile(perm os.FileMode) *File {
+	f, err := fs.newFile(nil, perm, false)
+	if err != nil {
+		log.Fatalln("Couldn't get free inode:", err, "Free_inodeCount:", fs.sb.Free_inodeCount)
 		return nil
 	}
+	return f
+}
 
+// newFile allocates the inode of a new file, or of a new directory if dir is set, in directory
+// parent with permissions perm. The type of the inode is left to the caller.
+func (fs *FileSystem) newFile(parent *Inode, perm os.FileMode, dir bool) (*File, error) {
+	inode, err := fs.newInode(parent, dir)
+	if err != nil {
+		return nil, err
+	}
 	inode.Mode = uint16(perm & 0x1FF)
+	inode.touch(timeAccess, timeModify, timeChange, timeCreate)
 	inode.UpdateCsumAndWriteback()
 
 	return &File{extFile{
 		fs:    fs,
 		inode: inode,
-	}}
+	}}, nil
 }
 
 func (fs *FileSystem) GetFreeBlocks(n int) (int64, int64) {
-	numBlockGroups := fs.sb.BlockGroupCount()
-
-	for i := int64(0); i < numBlockGroups; i++ {
-		bgd := fs.getBlockGroupDescriptor(i)
-		blockNum, numBlocks := bgd.GetFreeBlocks(int64(n))
-		if blockNum > 0 {
-			return blockNum + i*int64(fs.sb.BlockPer_group), numBlocks
-		}
+	blockNum, numBlocks, err := fs.allocBlocks(int64(fs.sb.First_data_block), int64(n))
+	if err != nil || numBlocks == 0 {
+		log.Fatalf("Failed to find free block")
 	}
-	log.Fatalf("Failed to find free block")
-	return 0, 0
+	return blockNum, numBlocks
 }
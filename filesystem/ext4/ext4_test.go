@@ -0,0 +1,2910 @@
+package ext4_test
+
+/*
+ These tests the exported functions
+ We want to do full-in tests with files
+*/
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/diskfs/go-diskfs/filesystem"
+	"github.com/diskfs/go-diskfs/filesystem/ext4"
+	"github.com/diskfs/go-diskfs/testhelper"
+	"github.com/google/uuid"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	keepTmpFiles = os.Getenv("KEEPTESTFILES")
+)
+
+// tmpExt4 creates a temporary image file of size bytes, with pre bytes of padding before the
+// filesystem, and creates an ext4 filesystem in it
+func tmpExt4(t *testing.T, size, pre int64, p *ext4.Params) (*os.File, *ext4.FileSystem) {
+	t.Helper()
+	f, err := ioutil.TempFile("", "ext4_test")
+	if err != nil {
+		t.Fatalf("Failed to create tempfile: %v", err)
+	}
+	if keepTmpFiles == "" {
+		t.Cleanup(func() {
+			f.Close()
+			os.Remove(f.Name())
+		})
+	} else {
+		fmt.Println(f.Name())
+	}
+	if err := f.Truncate(size + pre); err != nil {
+		t.Fatalf("Failed to size tempfile %s: %v", f.Name(), err)
+	}
+	fs, err := ext4.Create(f, size, pre, 512, p)
+	if err != nil {
+		t.Fatalf("Error creating ext4 filesystem in %s: %v", f.Name(), err)
+	}
+	return f, fs
+}
+
+// fsck runs e2fsck -fn over the filesystem that starts pre bytes into f, failing the test if it
+// reports any problem. It is skipped when e2fsck is not installed.
+func fsck(t *testing.T, f *os.File, pre int64) {
+	t.Helper()
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Log("e2fsck not installed, skipping filesystem check")
+		return
+	}
+	name := f.Name()
+	if pre != 0 {
+		name = fmt.Sprintf("%s?offset=%d", name, pre)
+	}
+	out, err := exec.Command(e2fsck, "-fn", name).CombinedOutput()
+	if err != nil {
+		t.Errorf("e2fsck reported problems with %s: %v\n%s", f.Name(), err, out)
+	}
+}
+
+func TestExt4Type(t *testing.T) {
+	fs := &ext4.FileSystem{}
+	fstype := fs.Type()
+	expected := filesystem.TypeExt4
+	if fstype != expected {
+		t.Errorf("Type() returns %v instead of expected %v", fstype, expected)
+	}
+}
+
+func TestExt4Create(t *testing.T) {
+	id := uuid.New()
+	var noReserved uint8
+	tests := []struct {
+		name string
+		size int64
+		pre  int64
+		p    *ext4.Params
+		err  bool
+	}{
+		{"defaults", 10 * 1024 * 1024, 0, nil, false},
+		{"label and uuid", 10 * 1024 * 1024, 0, &ext4.Params{VolumeName: "mylabel", UUID: &id}, false},
+		{"offset", 10 * 1024 * 1024, 1024 * 1024, nil, false},
+		{"partial last group", (3*8192 + 300) * 1024, 0, nil, false},
+		{"4k blocks", 64 * 1024 * 1024, 0, &ext4.Params{BlockSize: 4096}, false},
+		{"large", 2 * 1024 * 1024 * 1024, 0, nil, false},
+		{"no flex_bg", 40 * 1024 * 1024, 0, &ext4.Params{Features: "^flex_bg"}, false},
+		{"uninit_bg", 40 * 1024 * 1024, 0, &ext4.Params{Features: "^metadata_csum,uninit_bg"}, false},
+		{"ext2 like", 40 * 1024 * 1024, 0, &ext4.Params{Features: "^metadata_csum,^64bit,^extent,^flex_bg,^huge_file,^dir_nlink,^extra_isize", InodeSize: 128}, false},
+		{"inode count", 40 * 1024 * 1024, 0, &ext4.Params{InodeCount: 100, ReservedBlocksPercent: &noReserved}, false},
+		{"too small", 32 * 1024, 0, nil, true},
+		{"bad block size", 10 * 1024 * 1024, 0, &ext4.Params{BlockSize: 3000}, true},
+		{"bad feature", 10 * 1024 * 1024, 0, &ext4.Params{Features: "nosuchfeature"}, true},
+		{"unsupported feature", 10 * 1024 * 1024, 0, &ext4.Params{Features: "bigalloc"}, true},
+		{"64bit without extents", 10 * 1024 * 1024, 0, &ext4.Params{Features: "^extent"}, true},
+		{"long label", 10 * 1024 * 1024, 0, &ext4.Params{VolumeName: "a label that is too long"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ioutil.TempFile("", "ext4_test")
+			if err != nil {
+				t.Fatalf("Failed to create tempfile: %v", err)
+			}
+			defer os.Remove(f.Name())
+			defer f.Close()
+			if err := f.Truncate(tt.size + tt.pre); err != nil {
+				t.Fatal(err)
+			}
+
+			fs, err := ext4.Create(f, tt.size, tt.pre, 512, tt.p)
+			switch {
+			case tt.err && err == nil:
+				t.Fatalf("expected error, got none")
+			case tt.err:
+				return
+			case err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := filesystem.TypeExt4
+			if tt.name == "ext2 like" {
+				// without a journal or any ext4 feature it is ext2
+				expected = filesystem.TypeExt2
+			}
+			if fs.Type() != expected {
+				t.Errorf("Type() returned %v instead of %v", fs.Type(), expected)
+			}
+			if tt.p != nil && tt.p.VolumeName != "" {
+				if label := fs.Label(); label[:len(tt.p.VolumeName)] != tt.p.VolumeName {
+					t.Errorf("Label() returned %q instead of %q", label, tt.p.VolumeName)
+				}
+			}
+			if tt.p != nil && tt.p.UUID != nil && fs.Superblock().Uuid != *tt.p.UUID {
+				t.Errorf("UUID is %x instead of %x", fs.Superblock().Uuid, *tt.p.UUID)
+			}
+			entries, err := fs.ReadDir("/")
+			if err != nil {
+				t.Fatalf("error reading root directory: %v", err)
+			}
+			found := false
+			for _, e := range entries {
+				if e.Name() == "lost+found" && e.IsDir() {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("lost+found missing from root directory")
+			}
+			fsck(t, f, tt.pre)
+		})
+	}
+}
+
+// debugfs runs debugfs in write mode with the given requests against the filesystem in f,
+// skipping the test when debugfs is not installed
+func debugfs(t *testing.T, f *os.File, requests ...string) string {
+	t.Helper()
+	bin, err := exec.LookPath("debugfs")
+	if err != nil {
+		t.Skip("debugfs not installed")
+	}
+	cmds, err := ioutil.TempFile("", "ext4_test_debugfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(cmds.Name())
+	for _, r := range requests {
+		fmt.Fprintln(cmds, r)
+	}
+	cmds.Close()
+	out, err := exec.Command(bin, "-w", "-f", cmds.Name(), f.Name()).CombinedOutput()
+	if err != nil {
+		t.Fatalf("debugfs failed: %v\n%s", err, out)
+	}
+	return string(out)
+}
+
+// hostFile writes content to a temporary file for debugfs to copy into an image
+func hostFile(t *testing.T, content []byte) string {
+	t.Helper()
+	f, err := ioutil.TempFile("", "ext4_test_content")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	if _, err := f.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	return f.Name()
+}
+
+// reread opens the filesystem in f again, after it was changed behind its back
+func reread(t *testing.T, f *os.File) *ext4.FileSystem {
+	t.Helper()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs, err := ext4.Read(f, info.Size(), 0, 512)
+	if err != nil {
+		t.Fatalf("error reading ext4 filesystem: %v", err)
+	}
+	return fs
+}
+
+func TestExt4Remove(t *testing.T) {
+	for _, p := range []*ext4.Params{nil, {Features: "^metadata_csum,^64bit,^extent,^flex_bg", InodeSize: 128}} {
+		f, _ := tmpExt4(t, 20*1024*1024, 0, p)
+		big := hostFile(t, bytes.Repeat([]byte("0123456789abcdef"), 300*1024/16))
+		small := hostFile(t, []byte("hello world\n"))
+		debugfs(t, f,
+			"mkdir /dir",
+			"mkdir /dir/sub",
+			"mkdir /empty",
+			"write "+big+" /big",
+			"write "+small+" /dir/small",
+			"write "+small+" /linked",
+			"ln /linked /dir/link",
+			"sif /linked links_count 2",
+			"symlink /sym /dir/small",
+		)
+		fs := reread(t, f)
+		freeBlocks := fs.Superblock().GetFreeBlockCount()
+
+		tests := []struct {
+			path string
+			err  bool
+		}{
+			{"/", true},
+			{"/nonexistent", true},
+			{"/dir", true},
+			{"/dir/nonexistent", true},
+			{"/big", false},
+			{"/empty", false},
+			{"/dir/small", false},
+			{"/dir/sub", false},
+			{"/linked", false},
+			{"/sym", false},
+		}
+		for _, tt := range tests {
+			err := fs.Remove(tt.path)
+			switch {
+			case tt.err && err == nil:
+				t.Errorf("Remove(%s): expected error, got none", tt.path)
+			case !tt.err && err != nil:
+				t.Errorf("Remove(%s): unexpected error: %v", tt.path, err)
+			}
+		}
+		if freed := fs.Superblock().GetFreeBlockCount() - freeBlocks; freed < 300 {
+			t.Errorf("only %d blocks were freed", freed)
+		}
+
+		entries, err := fs.ReadDir("/")
+		if err != nil {
+			t.Fatalf("error reading root directory: %v", err)
+		}
+		for _, e := range entries {
+			switch e.Name() {
+			case "big", "empty", "linked", "sym":
+				t.Errorf("removed entry %s still in root directory", e.Name())
+			}
+		}
+		// the second link keeps the file alive
+		if _, err := fs.OpenFile("/dir/link", os.O_RDONLY); err != nil {
+			t.Errorf("error opening remaining link: %v", err)
+		}
+		if err := fs.Remove("/dir/link"); err != nil {
+			t.Errorf("error removing last link: %v", err)
+		}
+		if err := fs.Remove("/dir"); err != nil {
+			t.Errorf("error removing emptied directory: %v", err)
+		}
+		fsck(t, f, 0)
+	}
+}
+
+// memFile returns a testhelper.FileImpl backed by b
+func memFile(b []byte) *testhelper.FileImpl {
+	return &testhelper.FileImpl{
+		Reader: func(p []byte, offset int64) (int, error) {
+			if offset >= int64(len(b)) {
+				return 0, io.EOF
+			}
+			n := copy(p, b[offset:])
+			if n < len(p) {
+				return n, io.EOF
+			}
+			return n, nil
+		},
+		Writer: func(p []byte, offset int64) (int, error) {
+			if offset+int64(len(p)) > int64(len(b)) {
+				return 0, fmt.Errorf("write past end of device")
+			}
+			return copy(b[offset:], p), nil
+		},
+	}
+}
+
+func TestExt4ReadFileImpl(t *testing.T) {
+	const pre = 4096
+	f, _ := tmpExt4(t, 10*1024*1024, pre, nil)
+	contents := map[string][]byte{
+		"/a": bytes.Repeat([]byte("first file\n"), 20000),
+		"/b": bytes.Repeat([]byte("the second\n"), 30000),
+	}
+	// debugfs does not know about the padding, so work on the filesystem alone first
+	img, err := ioutil.ReadAll(io.NewSectionReader(f, pre, 10*1024*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(f.Name(), img, 0600); err != nil {
+		t.Fatal(err)
+	}
+	requests := []string{}
+	for name, c := range contents {
+		requests = append(requests, "write "+hostFile(t, c)+" "+name)
+	}
+	debugfs(t, f, requests...)
+	if img, err = ioutil.ReadFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	dev := append(make([]byte, pre), img...)
+
+	t.Run("not ext4", func(t *testing.T) {
+		if _, err := ext4.Read(memFile(make([]byte, len(dev))), int64(len(img)), pre, 512); err == nil {
+			t.Errorf("expected error reading zeroed device, got none")
+		}
+	})
+
+	fs, err := ext4.Read(memFile(dev), int64(len(img)), pre, 512)
+	if err != nil {
+		t.Fatalf("error reading ext4 filesystem from memory: %v", err)
+	}
+
+	// read both files at the same time
+	var wg sync.WaitGroup
+	for name, c := range contents {
+		wg.Add(1)
+		go func(name string, expected []byte) {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				file, err := fs.OpenFile(name, os.O_RDONLY)
+				if err != nil {
+					t.Errorf("error opening %s: %v", name, err)
+					return
+				}
+				b, err := ioutil.ReadAll(file)
+				if err != nil {
+					t.Errorf("error reading %s: %v", name, err)
+					return
+				}
+				if !bytes.Equal(b, expected) {
+					t.Errorf("mismatched contents of %s, read %d bytes instead of %d", name, len(b), len(expected))
+					return
+				}
+			}
+		}(name, c)
+	}
+	wg.Wait()
+
+	// changes go to the in-memory device only
+	if err := fs.Remove("/a"); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	if err := ioutil.WriteFile(f.Name(), dev[pre:], 0600); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f, 0)
+}
+
+func TestExt4ExtentTree(t *testing.T) {
+	for _, p := range []*ext4.Params{nil, {BlockSize: 4096}} {
+		f, fs := tmpExt4(t, 64*1024*1024, 0, p)
+		blockSize := fs.Superblock().GetBlockSize()
+		// writing a block at a time to two files in turn leaves both of them with an extent per
+		// block, enough to need a tree two levels deep
+		const blocks = 800
+		names := []string{"/a", "/b"}
+		files := []filesystem.File{}
+		for _, name := range names {
+			file, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatalf("error creating %s: %v", name, err)
+			}
+			files = append(files, file)
+		}
+		content := func(name string, i int) []byte {
+			return bytes.Repeat([]byte(fmt.Sprintf("%s%07d", name, i)), int(blockSize))[:blockSize]
+		}
+		for i := 0; i < blocks; i++ {
+			for j, file := range files {
+				if _, err := file.Write(content(names[j], i)); err != nil {
+					t.Fatalf("error writing block %d of %s: %v", i, names[j], err)
+				}
+			}
+		}
+
+		fs = reread(t, f)
+		for _, name := range names {
+			file, err := fs.OpenFile(name, os.O_RDONLY)
+			if err != nil {
+				t.Fatalf("error opening %s: %v", name, err)
+			}
+			b, err := ioutil.ReadAll(file)
+			if err != nil {
+				t.Fatalf("error reading %s: %v", name, err)
+			}
+			if int64(len(b)) != blocks*blockSize {
+				t.Fatalf("read %d bytes of %s instead of %d", len(b), name, blocks*blockSize)
+			}
+			for i := 0; i < blocks; i++ {
+				if !bytes.Equal(b[int64(i)*blockSize:int64(i+1)*blockSize], content(name, i)) {
+					t.Fatalf("mismatched block %d of %s", i, name)
+				}
+			}
+		}
+		out := debugfs(t, f, "stat /a")
+		if blockSize == 1024 && !strings.Contains(out, "(ETB1)") {
+			t.Errorf("expected extent tree of depth 2, got:\n%s", out)
+		}
+		fsck(t, f, 0)
+
+		if err := fs.Remove("/a"); err != nil {
+			t.Errorf("error removing file: %v", err)
+		}
+		fsck(t, f, 0)
+	}
+}
+
+func TestExt4HashedDirectory(t *testing.T) {
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Skip("e2fsck not installed")
+	}
+	f, _ := tmpExt4(t, 64*1024*1024, 0, &ext4.Params{InodeCount: 16384})
+	name := func(i int) string {
+		return fmt.Sprintf("/big/file%05d", i)
+	}
+	requests := []string{"mkdir /big", "cd /big"}
+	for i := 0; i < 200; i++ {
+		requests = append(requests, "mknod "+path.Base(name(i))+" p")
+	}
+	debugfs(t, f, requests...)
+	var fs *ext4.FileSystem
+	create := func(from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if _, err := fs.OpenFile(name(i), os.O_CREATE|os.O_RDWR); err != nil {
+				t.Fatalf("error creating %s: %v", name(i), err)
+			}
+		}
+	}
+	// have e2fsck index the directory, the kernel would have done so as it grew
+	if out, err := exec.Command(e2fsck, "-fyD", f.Name()).CombinedOutput(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != 1 {
+			t.Fatalf("e2fsck -D failed: %v\n%s", err, out)
+		}
+	}
+	if out := debugfs(t, f, "htree /big"); !strings.Contains(out, "Number of entries") {
+		t.Fatalf("directory was not indexed:\n%s", out)
+	}
+
+	// enough entries for the root of the index to fill up and the tree to grow a level
+	fs = reread(t, f)
+	const count = 6000
+	create(200, count)
+	out := debugfs(t, f, "htree /big")
+	if !strings.Contains(out, "Indirect levels: 1") {
+		t.Errorf("expected two level index, got:\n%.2000s", out)
+	}
+	fsck(t, f, 0)
+
+	fs = reread(t, f)
+	entries, err := fs.ReadDir("/big")
+	if err != nil {
+		t.Fatalf("error reading directory: %v", err)
+	}
+	if len(entries) != count+2 {
+		t.Errorf("read %d directory entries instead of %d", len(entries), count+2)
+	}
+	// removing looks up each entry through the index
+	for i := 0; i < count; i += 3 {
+		if err := fs.Remove(name(i)); err != nil {
+			t.Fatalf("error removing %s: %v", name(i), err)
+		}
+	}
+	if err := fs.Remove(name(count)); err == nil {
+		t.Errorf("expected error removing nonexistent entry")
+	}
+	fsck(t, f, 0)
+}
+
+// addJournal gives the filesystem in f a journal with tune2fs, skipping the test when tune2fs is
+// not installed
+func addJournal(t *testing.T, f *os.File) {
+	t.Helper()
+	bin, err := exec.LookPath("tune2fs")
+	if err != nil {
+		t.Skip("tune2fs not installed")
+	}
+	if out, err := exec.Command(bin, "-j", f.Name()).CombinedOutput(); err != nil {
+		t.Fatalf("tune2fs failed: %v\n%s", err, out)
+	}
+}
+
+// readBlocks reads count blocks of size bs from f, starting at block n
+func readBlocks(t *testing.T, f *os.File, n, count, bs int64) []byte {
+	t.Helper()
+	b := make([]byte, count*bs)
+	if _, err := f.ReadAt(b, n*bs); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestExt4JournalReplay(t *testing.T) {
+	// debugfs journal_open -c makes a journal with v3 checksums, without -c there are none
+	for _, open := range []string{"jo", "jo -c"} {
+		t.Run(open, func(t *testing.T) {
+			f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+			addJournal(t, f)
+			bs := fs.Superblock().GetBlockSize()
+			last := fs.Superblock().GetBlockCount() - 8
+
+			before := bytes.Repeat([]byte("before replay "), int(bs))[:bs]
+			// starting with the journal magic, the logged copy has to be escaped
+			after := append([]byte{0xc0, 0x3b, 0x39, 0x98}, bytes.Repeat([]byte("after replay "), int(bs))...)[:bs]
+			debugfs(t, f, "write "+hostFile(t, before)+" hello")
+			out := debugfs(t, f, "bmap /hello 0")
+			var block int64
+			if _, err := fmt.Sscan(out[strings.LastIndex(strings.TrimSpace(out), "\n")+1:], &block); err != nil {
+				t.Fatalf("unable to parse bmap output %q: %v", out, err)
+			}
+
+			// the second block of the second transaction is revoked by the third one, and the
+			// last transaction never commits
+			other := bytes.Repeat([]byte{0x5a}, int(2*bs))
+			debugfs(t, f,
+				open,
+				fmt.Sprintf("jw -b %d %s", block, hostFile(t, after)),
+				fmt.Sprintf("jw -b %d,%d %s", last, last+1, hostFile(t, other)),
+				fmt.Sprintf("jw -r %d", last+1),
+				fmt.Sprintf("jw -b %d -c %s", last+2, hostFile(t, other)),
+				"jc",
+			)
+			untouched := readBlocks(t, f, last, 3, bs)
+
+			// e2fsck replays a copy, to compare with
+			image, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ref, err := os.Open(hostFile(t, image))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ref.Close()
+			if e2fsck, err := exec.LookPath("e2fsck"); err == nil {
+				if out, err := exec.Command(e2fsck, "-fy", ref.Name()).CombinedOutput(); err != nil {
+					t.Fatalf("e2fsck failed to replay the journal: %v\n%s", err, out)
+				}
+				if !bytes.Equal(readBlocks(t, ref, last, 1, bs), other[:bs]) || !bytes.Equal(readBlocks(t, ref, last+1, 2, bs), untouched[bs:]) {
+					t.Fatal("e2fsck did not replay the journal as expected")
+				}
+			}
+
+			readFile := func(fs *ext4.FileSystem) []byte {
+				t.Helper()
+				file, err := fs.OpenFile("/hello", os.O_RDONLY)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, err := ioutil.ReadAll(file)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return b
+			}
+
+			// read-only, the replay happens in memory
+			ro, err := os.Open(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ro.Close()
+			fs, err = ext4.ReadOnly(ro, int64(len(image)), 0, 512)
+			if err != nil {
+				t.Fatalf("error reading ext4 filesystem read-only: %v", err)
+			}
+			if fs.Superblock().FeatureIncompatRecover() {
+				t.Error("journal still needs recovery in read-only view")
+			}
+			if b := readFile(fs); !bytes.Equal(b, after) {
+				t.Errorf("read-only view of /hello has %q, expected the replayed %q", b[:16], after[:16])
+			}
+			if _, err := fs.OpenFile("/new", os.O_CREATE|os.O_RDWR); err == nil {
+				t.Error("creating a file in a read-only filesystem succeeded")
+			}
+			now, err := ioutil.ReadFile(f.Name())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(now, image) {
+				t.Fatal("reading the filesystem read-only changed the image")
+			}
+
+			fs = reread(t, f)
+			if fs.Superblock().FeatureIncompatRecover() {
+				t.Error("journal still needs recovery after replay")
+			}
+			if b := readFile(fs); !bytes.Equal(b, after) {
+				t.Errorf("/hello has %q after replay, expected %q", b[:16], after[:16])
+			}
+			if !bytes.Equal(readBlocks(t, f, last, 3, bs), append(other[:bs:bs], untouched[bs:]...)) {
+				t.Error("blocks outside of the filesystem tree were not replayed as e2fsck does")
+			}
+			fsck(t, f, 0)
+			if b := readFile(reread(t, f)); !bytes.Equal(b, after) {
+				t.Errorf("/hello has %q after reopening, expected %q", b[:16], after[:16])
+			}
+		})
+	}
+}
+
+func TestExt4JournaledWrites(t *testing.T) {
+	f, _ := tmpExt4(t, 16*1024*1024, 0, nil)
+	addJournal(t, f)
+	fs := reread(t, f)
+
+	content := bytes.Repeat([]byte("journaled "), 500)
+	for _, dir := range []string{"/dir", "/dir/sub"} {
+		if err := fs.Mkdir(dir); err != nil {
+			t.Fatalf("error creating directory %s: %v", dir, err)
+		}
+	}
+	file, err := fs.OpenFile("/dir/sub/file", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if _, err := file.Write(content); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+	if _, err := fs.OpenFile("/dir/gone", os.O_CREATE|os.O_RDWR); err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if err := fs.Remove("/dir/gone"); err != nil {
+		t.Fatalf("error removing file: %v", err)
+	}
+	if fs.Superblock().FeatureIncompatRecover() {
+		t.Error("filesystem needs recovery after all transactions completed")
+	}
+	fsck(t, f, 0)
+
+	// every operation went through the journal as a transaction of its own, and the journal is
+	// empty again
+	out := debugfs(t, f, "logdump -O")
+	var next int
+	if i := strings.Index(out, "Journal starts at block 0, transaction "); i < 0 {
+		t.Errorf("journal is not empty:\n%s", out)
+	} else if fmt.Sscan(out[i+len("Journal starts at block 0, transaction "):], &next); next < 7 {
+		t.Errorf("expected at least 6 transactions, the next one is %d:\n%s", next, out)
+	}
+	if !strings.Contains(out, "(commit block)") {
+		t.Errorf("no transaction found in the journal:\n%s", out)
+	}
+
+	file, err = reread(t, f).OpenFile("/dir/sub/file", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("error opening file: %v", err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("file has %d bytes, expected %d: %v", len(b), len(content), err)
+	}
+}
+
+func TestExt4JournalCrash(t *testing.T) {
+	f, _ := tmpExt4(t, 8*1024*1024, 0, nil)
+	addJournal(t, f)
+	image, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// remember every write, to crash after each of them in turn below
+	type write struct {
+		offset int64
+		b      []byte
+	}
+	writes := []write{}
+	live := append([]byte{}, image...)
+	dev := memFile(live)
+	dev.Writer = func(p []byte, offset int64) (int, error) {
+		writes = append(writes, write{offset, append([]byte{}, p...)})
+		return copy(live[offset:], p), nil
+	}
+	fs, err := ext4.Read(dev, int64(len(image)), 0, 512)
+	if err != nil {
+		t.Fatalf("error reading ext4 filesystem: %v", err)
+	}
+	content := bytes.Repeat([]byte("crash "), 600)
+	file, err := fs.OpenFile("/crash", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatalf("error creating file: %v", err)
+	}
+	if _, err := file.Write(content); err != nil {
+		t.Fatalf("error writing file: %v", err)
+	}
+
+	for k := 0; k <= len(writes); k++ {
+		crashed := append([]byte{}, image...)
+		for _, w := range writes[:k] {
+			copy(crashed[w.offset:], w.b)
+		}
+		if _, err := f.WriteAt(crashed, 0); err != nil {
+			t.Fatal(err)
+		}
+		fs := reread(t, f)
+		fsck(t, f, 0)
+		file, err := fs.OpenFile("/crash", os.O_RDONLY)
+		if err != nil {
+			continue
+		}
+		b, err := ioutil.ReadAll(file)
+		if err != nil || (len(b) != 0 && !bytes.Equal(b, content)) {
+			t.Errorf("after a crash following %d of %d writes, the file holds %d bytes: %v", k, len(writes), len(b), err)
+		}
+	}
+}
+
+func TestExt4Symlink(t *testing.T) {
+	f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+	long := strings.Repeat("long/", 30) + "target"
+	content := []byte("the target file")
+	file, err := fs.OpenFile("/target", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Symlink("target", "/fast"); err != nil {
+		t.Fatalf("error creating fast symlink: %v", err)
+	}
+	if err := fs.Symlink(long, "/slow"); err != nil {
+		t.Fatalf("error creating slow symlink: %v", err)
+	}
+	if err := fs.Symlink("/fast", "/chain"); err != nil {
+		t.Fatalf("error creating symlink: %v", err)
+	}
+	if err := fs.Symlink("target", "/fast"); err == nil {
+		t.Error("creating a symlink over an existing one succeeded")
+	}
+	if err := fs.Symlink(strings.Repeat("x", 1024), "/toolong"); err == nil {
+		t.Error("creating a symlink with a target of a whole block succeeded")
+	}
+	fsck(t, f, 0)
+
+	if out := debugfs(t, f, "stat /fast"); !strings.Contains(out, `Fast link dest: "target"`) {
+		t.Errorf("/fast is not a fast symlink:\n%s", out)
+	}
+	debugfs(t, f, "symlink /debugfs /some/where/else")
+
+	fs = reread(t, f)
+	for name, expected := range map[string]string{"/fast": "target", "/slow": long, "/chain": "/fast", "/debugfs": "/some/where/else"} {
+		target, err := fs.Readlink(name)
+		if err != nil || target != expected {
+			t.Errorf("Readlink(%s) = %q, %v; expected %q", name, target, err, expected)
+		}
+	}
+	if _, err := fs.Readlink("/target"); err == nil {
+		t.Error("Readlink of a regular file succeeded")
+	}
+
+	// opening a symlink opens what it points to
+	file, err = fs.OpenFile("/chain", os.O_RDONLY)
+	if err != nil {
+		t.Fatalf("error opening through symlinks: %v", err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("read %q through symlinks, expected %q: %v", b, content, err)
+	}
+
+	infos, err := fs.ReadDir("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{}
+	for _, info := range infos {
+		modes[info.Name()] = info.Mode()
+	}
+	for name, mode := range map[string]os.FileMode{"fast": os.ModeSymlink | 0777, "slow": os.ModeSymlink | 0777, "lost+found": os.ModeDir | 0700} {
+		if modes[name] != mode {
+			t.Errorf("mode of %s is %v, expected %v", name, modes[name], mode)
+		}
+	}
+}
+
+func TestExt4LinkMknod(t *testing.T) {
+	f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+	content := []byte("linked content")
+	file, err := fs.OpenFile("/file", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/dev"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Link("/file", "/dev/hardlink"); err != nil {
+		t.Fatalf("error linking: %v", err)
+	}
+	if err := fs.Link("/file", "/dev/hardlink"); err == nil {
+		t.Error("linking over an existing file succeeded")
+	}
+	if err := fs.Link("/dev", "/devlink"); err == nil {
+		t.Error("linking to a directory succeeded")
+	}
+	// a handle opened before the link was made keeps the new link count
+	more := []byte(", written after linking")
+	if _, err := file.Write(more); err != nil {
+		t.Fatal(err)
+	}
+	content = append(content, more...)
+	nodes := []struct {
+		name string
+		mode uint32
+		dev  uint64
+		stat string
+	}{
+		{"console", ext4.S_IFCHR | 0600, unix.Mkdev(5, 1), "Device major/minor number: 05:01"},
+		{"null", ext4.S_IFCHR | 0666, unix.Mkdev(1, 3), "Device major/minor number: 01:03"},
+		{"sda", ext4.S_IFBLK | 0660, unix.Mkdev(8, 0), "Device major/minor number: 08:00"},
+		{"big", ext4.S_IFCHR | 0600, unix.Mkdev(300, 70000), "Device major/minor number: 300:70000"},
+		{"fifo", ext4.S_IFIFO | 0644, 0, "Type: FIFO"},
+		{"socket", ext4.S_IFSOCK | 0755, 0, "Type: socket"},
+	}
+	for _, n := range nodes {
+		if err := fs.Mknod("/dev/"+n.name, n.mode, n.dev); err != nil {
+			t.Fatalf("error creating %s: %v", n.name, err)
+		}
+	}
+	if err := fs.Mknod("/dev/null", ext4.S_IFCHR|0666, unix.Mkdev(1, 3)); err == nil {
+		t.Error("creating an existing node succeeded")
+	}
+	if err := fs.Mknod("/dev/reg", ext4.S_IFREG|0644, 0); err == nil {
+		t.Error("creating a regular file with Mknod succeeded")
+	}
+	fsck(t, f, 0)
+
+	for _, n := range nodes {
+		if out := debugfs(t, f, "stat /dev/"+n.name); !strings.Contains(out, n.stat) {
+			t.Errorf("stat of %s does not show %q:\n%s", n.name, n.stat, out)
+		}
+	}
+	if out := debugfs(t, f, "stat /file"); !strings.Contains(out, "Links: 2") {
+		t.Errorf("/file does not have 2 links:\n%s", out)
+	}
+
+	fs = reread(t, f)
+	infos, err := fs.ReadDir("/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	modes := map[string]os.FileMode{}
+	for _, info := range infos {
+		modes[info.Name()] = info.Mode()
+	}
+	for name, mode := range map[string]os.FileMode{
+		"console": os.ModeDevice | os.ModeCharDevice | 0600,
+		"sda":     os.ModeDevice | 0660,
+		"fifo":    os.ModeNamedPipe | 0644,
+		"socket":  os.ModeSocket | 0755,
+	} {
+		if modes[name] != mode {
+			t.Errorf("mode of %s is %v, expected %v", name, modes[name], mode)
+		}
+	}
+
+	// the data stays until the last link is gone
+	if err := fs.Remove("/file"); err != nil {
+		t.Fatal(err)
+	}
+	file, err = fs.OpenFile("/dev/hardlink", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("read %q through the remaining link, expected %q: %v", b, content, err)
+	}
+	for _, name := range []string{"hardlink", "console", "null", "sda", "big", "fifo", "socket"} {
+		if err := fs.Remove("/dev/" + name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := file.Write(more); err == nil {
+		t.Error("writing to a removed file succeeded")
+	}
+	if err := fs.Remove("/dev"); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f, 0)
+	if report, err := reread(t, f).Check(); err != nil || !report.Clean() {
+		t.Errorf("problems found: %v\n%s", err, report)
+	}
+}
+
+func TestExt4ChmodChownChtimes(t *testing.T) {
+	atime := time.Date(2100, 3, 4, 5, 6, 7, 123456789, time.UTC)
+	mtime := time.Date(1950, 1, 2, 3, 4, 5, 987654321, time.UTC)
+	for _, inodeSize := range []uint16{256, 128} {
+		t.Run(fmt.Sprintf("%d", inodeSize), func(t *testing.T) {
+			f, fs := tmpExt4(t, 16*1024*1024, 0, &ext4.Params{InodeSize: inodeSize})
+			before := time.Now().Add(-time.Second)
+			// a handle kept open across the changes must not undo them
+			handle, err := fs.OpenFile("/file", os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := handle.Write([]byte("hi")); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Symlink("file", "/link"); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Chmod("/file", 0640|os.ModeSetgid|os.ModeSticky); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Chmod("/link", 0600); err == nil {
+				t.Error("changing the mode of a symlink succeeded")
+			}
+			if err := fs.Chown("/file", 100000, 70000); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Chown("/link", 1000, -1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := handle.Write([]byte(" there")); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Chtimes("/file", atime, mtime); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := handle.Seek(0, 0); err != nil {
+				t.Fatal(err)
+			}
+			if b, err := ioutil.ReadAll(handle); err != nil || string(b) != "hi there" {
+				t.Errorf("read %q through the handle: %v", b, err)
+			}
+			if err := fs.Chown("/missing", 0, 0); err == nil {
+				t.Error("changing the owner of a missing file succeeded")
+			}
+			fsck(t, f, 0)
+			if out := debugfs(t, f, "stat /file"); !strings.Contains(out, "User: 100000   Group: 70000") {
+				t.Errorf("debugfs shows the wrong owner:\n%s", out)
+			}
+
+			infos, err := reread(t, f).ReadDir("/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats := map[string]*ext4.StatT{}
+			modes := map[string]os.FileMode{}
+			for _, info := range infos {
+				stats[info.Name()], modes[info.Name()] = info.Sys().(*ext4.StatT), info.Mode()
+			}
+			if mode := modes["file"]; mode != 0640|os.ModeSetgid|os.ModeSticky {
+				t.Errorf("mode of file is %v", mode)
+			}
+			file, link := stats["file"], stats["link"]
+			if file.Uid != 100000 || file.Gid != 70000 || link.Uid != 1000 || link.Gid != 0 {
+				t.Errorf("owners are %d:%d and %d:%d", file.Uid, file.Gid, link.Uid, link.Gid)
+			}
+			if file.Nlink != 1 || file.Ino == 0 {
+				t.Errorf("file has %d links and inode %d", file.Nlink, file.Ino)
+			}
+			wantA, wantM := atime, mtime
+			if inodeSize == 128 {
+				// to the second, and in the range of a signed 32-bit count
+				wantA, wantM = time.Unix(int64(int32(atime.Unix())), 0), mtime.Truncate(time.Second)
+			}
+			if !file.Atime.Equal(wantA) || !file.Mtime.Equal(wantM) {
+				t.Errorf("times are %v and %v, expected %v and %v", file.Atime, file.Mtime, wantA, wantM)
+			}
+			if file.Ctime.Before(before) {
+				t.Errorf("change time %v not updated", file.Ctime)
+			}
+			if inodeSize == 256 && file.Crtime.Before(before) {
+				t.Errorf("creation time %v not set", file.Crtime)
+			}
+			if inodeSize == 128 && !file.Crtime.IsZero() {
+				t.Errorf("creation time %v without room for it", file.Crtime)
+			}
+		})
+	}
+}
+
+func TestExt4Tune(t *testing.T) {
+	// stats returns the superblock as shown by debugfs, that of the backup in block group 1 too
+	stats := func(t *testing.T, f *os.File, fs *ext4.FileSystem) (string, string) {
+		t.Helper()
+		sb := fs.Superblock()
+		backup := int64(sb.BlockPer_group) + int64(sb.First_data_block)
+		bin, err := exec.LookPath("debugfs")
+		if err != nil {
+			t.Skip("debugfs not installed")
+		}
+		out, err := exec.Command(bin, "-s", fmt.Sprint(backup), "-b", fmt.Sprint(sb.GetBlockSize()), "-R", "stats -h", f.Name()).CombinedOutput()
+		if err != nil {
+			t.Fatalf("debugfs failed: %v\n%s", err, out)
+		}
+		return debugfs(t, f, "stats -h"), string(out)
+	}
+	id := uuid.MustParse("01234567-89ab-cdef-0123-456789abcdef")
+	name := "tuned"
+	reserved := uint8(10)
+	mounts, maxMounts := uint16(3), int16(-1)
+	interval := 7 * 24 * time.Hour
+	opts := ext4.TuneOptions{
+		VolumeName:            &name,
+		UUID:                  &id,
+		ReservedBlocksPercent: &reserved,
+		MountCount:            &mounts,
+		MaxMountCount:         &maxMounts,
+		CheckInterval:         &interval,
+		DefaultMountOptions:   "^acl,journal_data_writeback,nodelalloc",
+		Features:              "large_dir",
+	}
+	expected := []string{
+		"Filesystem volume name:   tuned",
+		"Filesystem UUID:          01234567-89ab-cdef-0123-456789abcdef",
+		"Default mount options:    journal_data_writeback user_xattr nodelalloc",
+		"Mount count:              3",
+		"Maximum mount count:      -1",
+		"Check interval:           604800 (1 week)",
+		"large_dir",
+	}
+
+	for _, tt := range []struct {
+		name     string
+		features string
+		expected string
+	}{
+		{"metadata_csum", "", "metadata_csum_seed"},
+		{"uninit_bg", "^metadata_csum,uninit_bg", "uninit_bg"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, fs := tmpExt4(t, 32*1024*1024, 0, &ext4.Params{Features: tt.features})
+			if _, err := fs.OpenFile("/file", os.O_CREATE|os.O_RDWR); err != nil {
+				t.Fatal(err)
+			}
+			if err := fs.Tune(opts); err != nil {
+				t.Fatal(err)
+			}
+			fsck(t, f, 0)
+			fs = reread(t, f)
+			if got := fs.Superblock().GetReservedBlockCount(); got != fs.Superblock().GetBlockCount()/10 {
+				t.Errorf("%d blocks reserved instead of 10%%", got)
+			}
+			primary, backup := stats(t, f, fs)
+			for _, out := range []string{primary, backup} {
+				for _, line := range append(expected, tt.expected) {
+					if !strings.Contains(out, line) {
+						t.Errorf("superblock does not show %q:\n%s", line, out)
+					}
+				}
+			}
+			if _, err := fs.OpenFile("/file", os.O_RDONLY); err != nil {
+				t.Errorf("file not found after changing the UUID: %v", err)
+			}
+			if report, err := fs.Check(); err != nil || !report.Clean() {
+				t.Errorf("problems found: %v\n%s", err, report)
+			}
+		})
+	}
+
+	t.Run("refused", func(t *testing.T) {
+		_, fs := tmpExt4(t, 16*1024*1024, 0, &ext4.Params{InodeSize: 128})
+		long := "a label too long for ext4"
+		tooMany := uint8(60)
+		for _, opts := range []ext4.TuneOptions{
+			{VolumeName: &long},
+			{ReservedBlocksPercent: &tooMany},
+			{Features: "^extent"},
+			{Features: "has_journal"},
+			{Features: "^metadata_csum"},
+			{Features: "extra_isize"},
+			{Features: "no_such_feature"},
+			{DefaultMountOptions: "no_such_option"},
+		} {
+			if err := fs.Tune(opts); err == nil {
+				t.Errorf("Tune(%+v) succeeded", opts)
+			}
+		}
+	})
+}
+
+func TestExt4Defragment(t *testing.T) {
+	f, fs := tmpExt4(t, 32*1024*1024, 0, nil)
+	// two files written a block at a time in turn end up interleaved
+	contents := map[string][]byte{"/a": {}, "/b": {}}
+	files := map[string]*ext4.File{}
+	for name := range contents {
+		file, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[name] = file.(*ext4.File)
+	}
+	for i := 0; i < 64; i++ {
+		for _, name := range []string{"/a", "/b"} {
+			chunk := bytes.Repeat([]byte{byte(i), name[1]}, 512)
+			if _, err := files[name].Write(chunk); err != nil {
+				t.Fatal(err)
+			}
+			contents[name] = append(contents[name], chunk...)
+		}
+	}
+	// preallocated blocks past the end of /a are moved along with the rest
+	if err := files["/a"].Fallocate(64*1024, 16*1024); err != nil {
+		t.Fatal(err)
+	}
+	contents["/a"] = append(contents["/a"], make([]byte, 16*1024)...)
+	if err := fs.Remove("/b"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := fs.Defragment("/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ExtentsBefore < 32 || result.ExtentsAfter != 2 {
+		t.Errorf("defragmenting went from %d to %d extents, expected many to 2", result.ExtentsBefore, result.ExtentsAfter)
+	}
+	if _, err := fs.Defragment("/"); err == nil {
+		t.Error("defragmenting a directory succeeded")
+	}
+	fsck(t, f, 0)
+
+	fs = reread(t, f)
+	file, err := fs.OpenFile("/a", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, contents["/a"]) {
+		t.Errorf("contents changed by defragmenting: %v", err)
+	}
+	results, err := fs.DefragmentAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Path != "/a" || results[0].ExtentsBefore != 2 || results[0].ExtentsAfter != 2 {
+		t.Errorf("defragmenting all files returned %+v", results)
+	}
+	if report, err := fs.Check(); err != nil || !report.Clean() {
+		t.Errorf("problems found: %v\n%s", err, report)
+	}
+}
+
+func TestExt4Casefold(t *testing.T) {
+	f, fs := tmpExt4(t, 32*1024*1024, 0, &ext4.Params{Features: "casefold", InodeCount: 8192})
+	for _, d := range []string{"/ci", "/exact"} {
+		if err := fs.Mkdir(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.SetCasefold("/ci", true); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"Hello.TXT", "Straße", "caf\u00e9"}
+	for _, name := range append(names, "Sub") {
+		if _, err := fs.OpenFile("/ci/"+name, os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fs.OpenFile("/exact/"+name, os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := fs.Mkdir("/ci/Dir"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetCasefold("/ci", false); err == nil {
+		t.Error("changing casefolding of a directory that is not empty succeeded")
+	}
+	// the same names in other case, after full case folding and in decomposed form
+	for _, name := range []string{"/ci/hello.txt", "/ci/HELLO.txt", "/ci/STRASSE", "/ci/strasse", "/ci/CAFE\u0301", "/ci/dir"} {
+		if _, err := fs.OpenFile(name, os.O_RDONLY); err != nil {
+			t.Errorf("%s not found in casefolded directory: %v", name, err)
+		}
+		if _, err := fs.OpenFile("/exact"+name[3:], os.O_RDONLY); err == nil {
+			t.Errorf("%s found in a directory that is not casefolded", "/exact"+name[3:])
+		}
+	}
+	// a file created under another case is the one already there
+	if _, err := fs.OpenFile("/ci/HELLO.TXT", os.O_CREATE|os.O_RDWR); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/ci/SUB"); err == nil {
+		t.Error("creating a directory of the same name in other case succeeded")
+	}
+	if err := fs.Remove("/ci/hello.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// subdirectories are casefolded too
+	if _, err := fs.OpenFile("/ci/Dir/File", os.O_CREATE|os.O_RDWR); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.OpenFile("/ci/DIR/file", os.O_RDONLY); err != nil {
+		t.Errorf("not found in casefolded subdirectory: %v", err)
+	}
+	infos, err := fs.ReadDir("/ci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 6 {
+		t.Errorf("casefolded directory has %d entries instead of 6", len(infos))
+	}
+	fsck(t, f, 0)
+
+	// an indexed casefolded directory hashes the casefolded names
+	e2fsck, err := exec.LookPath("e2fsck")
+	if err != nil {
+		t.Skip("e2fsck not installed")
+	}
+	if err := fs.Mkdir("/ci/big"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 300; i++ {
+		if _, err := fs.OpenFile(fmt.Sprintf("/ci/big/Name-%d-Ä", i), os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if out, err := exec.Command(e2fsck, "-fyD", f.Name()).CombinedOutput(); err != nil {
+		t.Fatalf("e2fsck -D failed: %v\n%s", err, out)
+	}
+	fs = reread(t, f)
+	for i := 0; i < 300; i++ {
+		if _, err := fs.OpenFile(fmt.Sprintf("/ci/big/nAME-%d-a\u0308", i), os.O_RDONLY); err != nil {
+			t.Fatalf("not found in indexed casefolded directory: %v", err)
+		}
+	}
+	for i := 300; i < 600; i++ {
+		if _, err := fs.OpenFile(fmt.Sprintf("/ci/big/NAME-%d-Ä", i), os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 300; i < 600; i++ {
+		if _, err := fs.OpenFile(fmt.Sprintf("/ci/big/name-%d-ä", i), os.O_RDONLY); err != nil {
+			t.Fatalf("not found in indexed casefolded directory: %v", err)
+		}
+	}
+	fsck(t, f, 0)
+}
+
+func TestExt4InlineData(t *testing.T) {
+	f, _ := tmpExt4(t, 16*1024*1024, 0, &ext4.Params{Features: "inline_data"})
+	small := []byte("small enough to live in the inode")
+	medium := bytes.Repeat([]byte("0123456789"), 10)
+	debugfs(t, f,
+		"write "+hostFile(t, small)+" small",
+		"write "+hostFile(t, medium)+" medium",
+		"mkdir dir",
+		"write "+hostFile(t, small)+" dir/file",
+	)
+	for _, name := range []string{"small", "medium", "dir"} {
+		if out := debugfs(t, f, "stat "+name); !strings.Contains(out, "Size of inline data") {
+			t.Fatalf("debugfs did not create %s inline:\n%s", name, out)
+		}
+	}
+
+	fs := reread(t, f)
+	for name, expected := range map[string][]byte{"/small": small, "/medium": medium, "/dir/file": small} {
+		file, err := fs.OpenFile(name, os.O_RDONLY)
+		if err != nil {
+			t.Fatalf("error opening %s: %v", name, err)
+		}
+		if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, expected) {
+			t.Errorf("read %q from %s, expected %q: %v", b, name, expected, err)
+		}
+	}
+	infos, err := fs.ReadDir("/dir")
+	if err != nil || len(infos) != 3 {
+		t.Fatalf("ReadDir of inline directory returned %d entries: %v", len(infos), err)
+	}
+
+	// a write that still fits stays inline
+	file, err := fs.OpenFile("/small", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("SMALL")); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f, 0)
+
+	// one that does not moves the file out to a block
+	long := bytes.Repeat([]byte("abcdefgh"), 300)
+	file, err = fs.OpenFile("/medium", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(int64(len(medium)), 0); err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(long); err != nil {
+		t.Fatalf("error growing inline file: %v", err)
+	}
+	fsck(t, f, 0)
+	if out := debugfs(t, f, "stat medium"); !strings.Contains(out, "EXTENTS") {
+		t.Errorf("grown file was not moved to extents:\n%s", out)
+	}
+	fs = reread(t, f)
+	for name, expected := range map[string][]byte{"/small": []byte("SMALL enough to live in the inode"), "/medium": append(medium, long...)} {
+		file, err := fs.OpenFile(name, os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, expected) {
+			t.Errorf("read %d bytes from %s after writing, expected %d: %v", len(b), name, len(expected), err)
+		}
+	}
+
+	// entries fill the inline directory until it has to move to a block
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("/dir/entry%02d", i)
+		if _, err := fs.OpenFile(name, os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatalf("error creating %s: %v", name, err)
+		}
+		if i == 0 {
+			fsck(t, f, 0)
+			if out := debugfs(t, f, "stat dir"); !strings.Contains(out, "Size of inline data") {
+				t.Errorf("directory with room left was moved out of the inode:\n%s", out)
+			}
+		}
+	}
+	fsck(t, f, 0)
+	if out := debugfs(t, f, "stat dir"); !strings.Contains(out, "EXTENTS") {
+		t.Errorf("full directory was not moved to extents:\n%s", out)
+	}
+	fs = reread(t, f)
+	infos, err = fs.ReadDir("/dir")
+	if err != nil || len(infos) != 23 {
+		t.Errorf("ReadDir of grown directory returned %d entries: %v", len(infos), err)
+	}
+
+	// removing entries from an inline directory
+	debugfs(t, f, "mkdir other", "write "+hostFile(t, small)+" other/a", "write "+hostFile(t, small)+" other/b")
+	fs = reread(t, f)
+	if err := fs.Remove("/other/a"); err != nil {
+		t.Fatalf("error removing from inline directory: %v", err)
+	}
+	if err := fs.Remove("/other"); err == nil {
+		t.Error("removing a non-empty inline directory succeeded")
+	}
+	if err := fs.Remove("/other/b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove("/other"); err != nil {
+		t.Fatalf("error removing empty inline directory: %v", err)
+	}
+	fsck(t, f, 0)
+
+	// a sparse file larger than its inline data, as mke2fs -d makes, reads as zeros past it
+	const sparseSize = 20 * 1024 * 1024
+	debugfs(t, f, "write "+hostFile(t, small)+" sparse", fmt.Sprintf("sif sparse size %d", sparseSize))
+	fsck(t, f, 0)
+	fs = reread(t, f)
+	expected := append(append([]byte{}, small...), make([]byte, sparseSize-len(small))...)
+	file, err = fs.OpenFile("/sparse", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, expected) {
+		t.Errorf("read %d bytes of a sparse inline file, expected %d: %v", len(b), len(expected), err)
+	}
+	// writing moves only the inline data out, the rest stays a hole
+	if _, err := file.Seek(4, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("WRITTEN")); err != nil {
+		t.Fatal(err)
+	}
+	copy(expected[4:], "WRITTEN")
+	fsck(t, f, 0)
+	file, err = reread(t, f).OpenFile("/sparse", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, expected) {
+		t.Errorf("read %d bytes of a sparse file moved out of the inode, expected %d: %v", len(b), len(expected), err)
+	}
+	if out := debugfs(t, f, "stat sparse"); !strings.Contains(out, "Blockcount: 2\n") {
+		t.Errorf("sparse file moved out of the inode is not sparse:\n%s", out)
+	}
+}
+
+func TestExt4Xattr(t *testing.T) {
+	f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+	file, err := fs.OpenFile("/bin", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("#!/bin/sh\n")); err != nil {
+		t.Fatal(err)
+	}
+	acl := []ext4.ACLEntry{
+		{Tag: ext4.ACL_USER_OBJ, Perm: 7},
+		{Tag: ext4.ACL_USER, Perm: 5, ID: 1000},
+		{Tag: ext4.ACL_GROUP_OBJ, Perm: 5},
+		{Tag: ext4.ACL_MASK, Perm: 5},
+		{Tag: ext4.ACL_OTHER, Perm: 4},
+	}
+	caps := ext4.Capabilities{Permitted: 1 << ext4.CAP_NET_BIND_SERVICE, Effective: true}
+	big := bytes.Repeat([]byte("x"), 600)
+	values := map[string][]byte{
+		"user.comment":           []byte("hello"),
+		"security.selinux":       []byte("system_u:object_r:bin_t:s0\x00"),
+		ext4.CapabilityXattrName: caps.Encode(),
+		ext4.PosixACLAccessName:  ext4.EncodePosixACL(acl),
+		"trusted.big":            big,
+	}
+	for name, value := range values {
+		if err := fs.SetXattr("/bin", name, value); err != nil {
+			t.Fatalf("error setting %s: %v", name, err)
+		}
+	}
+	if err := fs.SetXattr("/bin", "user.comment", []byte("replaced")); err != nil {
+		t.Fatal(err)
+	}
+	values["user.comment"] = []byte("replaced")
+	if err := fs.SetXattr("/bin", "bogus.name", nil); err == nil {
+		t.Error("setting an attribute in an unknown namespace succeeded")
+	}
+	fsck(t, f, 0)
+
+	out := debugfs(t, f, "ea_list /bin", "stat /bin")
+	for _, expected := range []string{"user.comment (8) = \"replaced\"", "trusted.big (600)", "security.capability (20)", "system.posix_acl_access", "File ACL: "} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("debugfs output does not contain %q:\n%s", expected, out)
+		}
+	}
+	if strings.Contains(out, "File ACL: 0") {
+		t.Errorf("large attribute was not stored in a block:\n%s", out)
+	}
+
+	debugfs(t, f, "ea_set /bin user.debugfs from-debugfs")
+	fs = reread(t, f)
+	values["user.debugfs"] = []byte("from-debugfs")
+	names, err := fs.ListXattr("/bin")
+	if err != nil || len(names) != len(values) {
+		t.Errorf("ListXattr returned %v, %v", names, err)
+	}
+	for name, expected := range values {
+		value, err := fs.GetXattr("/bin", name)
+		if err != nil || !bytes.Equal(value, expected) {
+			t.Errorf("GetXattr(%s) = %q, %v; expected %q", name, value, err, expected)
+		}
+	}
+	value, _ := fs.GetXattr("/bin", ext4.CapabilityXattrName)
+	if c, err := ext4.DecodeCapabilities(value); err != nil || c != caps {
+		t.Errorf("decoded capabilities %+v, %v; expected %+v", c, err, caps)
+	}
+	value, _ = fs.GetXattr("/bin", ext4.PosixACLAccessName)
+	if decoded, err := ext4.DecodePosixACL(value); err != nil || !reflect.DeepEqual(decoded, acl) {
+		t.Errorf("decoded ACL %+v, %v; expected %+v", decoded, err, acl)
+	}
+
+	if err := fs.RemoveXattr("/bin", "trusted.big"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.RemoveXattr("/bin", "trusted.big"); err == nil {
+		t.Error("removing a missing attribute succeeded")
+	}
+	if _, err := fs.GetXattr("/bin", "trusted.big"); err == nil {
+		t.Error("removed attribute is still there")
+	}
+	fsck(t, f, 0)
+	for name := range values {
+		if name != "trusted.big" {
+			if err := fs.RemoveXattr("/bin", name); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	fsck(t, f, 0)
+	if out := debugfs(t, f, "stat /bin"); !strings.Contains(out, "File ACL: 0") {
+		t.Errorf("extended attribute block was not released:\n%s", out)
+	}
+
+	// attributes set by path are kept by a handle open on the file, in the inode or in a block
+	f, fs = tmpExt4(t, 16*1024*1024, 0, &ext4.Params{BlockSize: 4096})
+	file, err = fs.OpenFile("/file", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := bytes.Repeat([]byte("l"), 2000)
+	if err := fs.SetXattr("/file", "user.small", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetXattr("/file", "user.large", large); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.(*ext4.File).Truncate(1); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f, 0)
+	fs = reread(t, f)
+	for name, expected := range map[string][]byte{"user.small": []byte("small"), "user.large": large} {
+		if value, err := fs.GetXattr("/file", name); err != nil || !bytes.Equal(value, expected) {
+			t.Errorf("GetXattr(%s) = %d bytes, %v; expected %d", name, len(value), err, len(expected))
+		}
+	}
+}
+
+func TestExt4TruncatePunchFallocate(t *testing.T) {
+	f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+	expected := make([]byte, 100*1024)
+	for i := range expected {
+		expected[i] = byte(i % 251)
+	}
+	file, err := fs.OpenFile("/file", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(expected); err != nil {
+		t.Fatal(err)
+	}
+	ef := file.(*ext4.File)
+	check := func(step string) {
+		t.Helper()
+		fsck(t, f, 0)
+		file, err := reread(t, f).OpenFile("/file", os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(file)
+		if err != nil || !bytes.Equal(b, expected) {
+			t.Fatalf("after %s read %d bytes, expected %d: %v", step, len(b), len(expected), err)
+		}
+	}
+	writeAt := func(off int64, p []byte) {
+		t.Helper()
+		if _, err := ef.Seek(off, 0); err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if _, err := ef.Write(p); err != nil {
+			t.Fatal(err)
+		}
+		if end := off + int64(len(p)); end > int64(len(expected)) {
+			expected = append(expected, make([]byte, end-int64(len(expected)))...)
+		}
+		copy(expected[off:], p)
+	}
+
+	if err := ef.Truncate(50000); err != nil {
+		t.Fatal(err)
+	}
+	expected = expected[:50000]
+	check("shrinking")
+	if err := ef.Truncate(70000); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, make([]byte, 20000)...)
+	check("growing")
+
+	if err := ef.PunchHole(10000, 20000); err != nil {
+		t.Fatal(err)
+	}
+	copy(expected[10000:30000], make([]byte, 20000))
+	check("punching a hole")
+	if out := debugfs(t, f, "blocks /file"); strings.Contains(out, " 0 ") {
+		t.Errorf("hole still has blocks: %s", out)
+	}
+	writeAt(15000, []byte("into the hole"))
+	check("writing into a hole")
+
+	if err := ef.Fallocate(200000, 50000); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, make([]byte, 250000-len(expected))...)
+	check("preallocating")
+	if out := debugfs(t, f, "ex /file"); !strings.Contains(out, "Uninit") {
+		t.Errorf("preallocated blocks are not uninitialized:\n%s", out)
+	}
+	writeAt(220500, bytes.Repeat([]byte("w"), 3000))
+	check("writing into preallocated blocks")
+
+	// every other block punched makes enough extents for a tree of more than one level
+	for off := int64(100000); off < 200000; off += 2048 {
+		if err := ef.PunchHole(off, 1024); err != nil {
+			t.Fatal(err)
+		}
+		copy(expected[off:off+1024], make([]byte, 1024))
+	}
+	check("punching many holes")
+	if out := debugfs(t, f, "ex /file"); !strings.Contains(out, " 1/ 1 ") {
+		t.Errorf("extent tree did not grow a level:\n%s", out)
+	}
+	if err := ef.Truncate(0); err != nil {
+		t.Fatal(err)
+	}
+	expected = expected[:0]
+	check("truncating to nothing")
+	if out := debugfs(t, f, "stat /file"); !strings.Contains(out, "Blockcount: 0") {
+		t.Errorf("blocks left after truncating to nothing:\n%s", out)
+	}
+
+	// what is changed by path while the file is open is kept by changes through the handle
+	if err := fs.Chmod("/file", 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.SetXattr("/file", "user.kept", []byte("yes")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ef.Fallocate(0, 5000); err != nil {
+		t.Fatal(err)
+	}
+	if err := ef.PunchHole(1000, 2000); err != nil {
+		t.Fatal(err)
+	}
+	if err := ef.Truncate(4000); err != nil {
+		t.Fatal(err)
+	}
+	expected = make([]byte, 4000)
+	check("changing the handle after a chmod")
+	if out := debugfs(t, f, "stat /file"); !strings.Contains(out, "Mode:  0600") {
+		t.Errorf("mode not kept:\n%s", out)
+	}
+	if v, err := reread(t, f).GetXattr("/file", "user.kept"); err != nil || string(v) != "yes" {
+		t.Errorf("extended attribute not kept: %q, %v", v, err)
+	}
+
+	// inline files
+	debugfs(t, f, "feature inline_data", "write "+hostFile(t, []byte("a small inline file"))+" inline")
+	fs = reread(t, f)
+	file, err = fs.OpenFile("/inline", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := file.(*ext4.File).Truncate(7); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f, 0)
+	file, _ = reread(t, f).OpenFile("/inline", os.O_RDONLY)
+	if b, err := ioutil.ReadAll(file); err != nil || string(b) != "a small" {
+		t.Errorf("read %q from truncated inline file: %v", b, err)
+	}
+}
+
+// tmpMke2fs creates a temporary image file of size bytes with an ext2, ext3 or ext4 filesystem
+// made by mke2fs, skipping the test when mke2fs is not installed
+func tmpMke2fs(t *testing.T, size int64, fstype string, args ...string) *os.File {
+	t.Helper()
+	bin, err := exec.LookPath("mke2fs")
+	if err != nil {
+		t.Skip("mke2fs not installed")
+	}
+	f, err := ioutil.TempFile("", "ext4_test")
+	if err != nil {
+		t.Fatalf("Failed to create tempfile: %v", err)
+	}
+	if keepTmpFiles == "" {
+		t.Cleanup(func() {
+			f.Close()
+			os.Remove(f.Name())
+		})
+	} else {
+		fmt.Println(f.Name())
+	}
+	if err := f.Truncate(size); err != nil {
+		t.Fatalf("Failed to size tempfile %s: %v", f.Name(), err)
+	}
+	args = append([]string{"-q", "-F", "-t", fstype}, append(args, f.Name())...)
+	if out, err := exec.Command(bin, args...).CombinedOutput(); err != nil {
+		t.Fatalf("mke2fs failed: %v\n%s", err, out)
+	}
+	return f
+}
+
+func TestExt4Ext2(t *testing.T) {
+	for _, tt := range []struct {
+		fstype   string
+		expected filesystem.Type
+	}{
+		{"ext2", filesystem.TypeExt2},
+		{"ext3", filesystem.TypeExt3},
+		{"ext4", filesystem.TypeExt4},
+	} {
+		t.Run(tt.fstype, func(t *testing.T) {
+			f := tmpMke2fs(t, 16*1024*1024, tt.fstype, "-b", "1024")
+			if fstype := reread(t, f).Type(); fstype != tt.expected {
+				t.Errorf("Type() returned %v instead of %v", fstype, tt.expected)
+			}
+		})
+	}
+
+	f := tmpMke2fs(t, 200*1024*1024, "ext2", "-b", "1024")
+	// big enough for a double indirect block
+	big := make([]byte, 300*1024)
+	for i := range big {
+		big[i] = byte(i % 253)
+	}
+	debugfs(t, f, "write "+hostFile(t, big)+" big")
+	fs := reread(t, f)
+	file, err := fs.OpenFile("/big", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, big) {
+		t.Fatalf("read %d bytes of a file with indirect blocks, expected %d: %v", len(b), len(big), err)
+	}
+
+	file, err = fs.OpenFile("/new", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(big); err != nil {
+		t.Fatal(err)
+	}
+	// past the double indirect blocks, into the triple indirect ones
+	far := int64(12+256+256*256+10) * 1024
+	if _, err := file.Seek(far, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("far away")); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f, 0)
+	if out := debugfs(t, f, "stat /new"); strings.Contains(out, "EXTENTS") || strings.Contains(out, "Extents") {
+		t.Errorf("new file on ext2 uses extents:\n%s", out)
+	}
+	check := func(step string, size int64) {
+		t.Helper()
+		file, err := reread(t, f).OpenFile("/new", os.O_RDONLY)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(file)
+		if err != nil || int64(len(b)) != size {
+			t.Fatalf("after %s read %d bytes, expected %d: %v", step, len(b), size, err)
+		}
+		n := int64(len(big))
+		if size < n {
+			n = size
+		}
+		if !bytes.Equal(b[:n], big[:n]) {
+			t.Errorf("after %s the start of the file differs", step)
+		}
+		if size > far && string(b[far:]) != "far away" {
+			t.Errorf("after %s read %q at the end of the file", step, b[far:])
+		}
+	}
+	check("writing", far+8)
+
+	if err := file.(*ext4.File).Truncate(100 * 1024); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f, 0)
+	check("truncating", 100*1024)
+
+	if err := fs.Mkdir("/dir"); err != nil {
+		t.Fatal(err)
+	}
+	fsck(t, f, 0)
+	if _, err := reread(t, f).ReadDir("/dir"); err != nil {
+		t.Errorf("error reading new directory: %v", err)
+	}
+}
+
+func TestExt4Check(t *testing.T) {
+	check := func(t *testing.T, f *os.File) *ext4.CheckReport {
+		t.Helper()
+		report, err := reread(t, f).Check()
+		if err != nil {
+			t.Fatalf("error checking filesystem: %v", err)
+		}
+		return report
+	}
+	populate := func(t *testing.T, fs *ext4.FileSystem) {
+		t.Helper()
+		for _, dir := range []string{"/dir", "/dir/sub"} {
+			if err := fs.Mkdir(dir); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i, p := range []string{"/file", "/dir/file", "/dir/sub/big"} {
+			file, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.Write(bytes.Repeat([]byte("x"), 1000+i*100000)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := fs.SetXattr("/file", "user.a", []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		for _, p := range []*ext4.Params{nil, {Features: "^metadata_csum,uninit_bg"}, {Features: "^metadata_csum,^64bit,^extent,^flex_bg,^huge_file,^dir_nlink,^extra_isize", InodeSize: 128}} {
+			f, fs := tmpExt4(t, 16*1024*1024, 0, p)
+			populate(t, fs)
+			fsck(t, f, 0)
+			if report := check(t, f); !report.Clean() {
+				t.Errorf("problems found in a consistent filesystem made with %+v:\n%s", p, report)
+			}
+		}
+		for _, fstype := range []string{"ext2", "ext3", "ext4"} {
+			f := tmpMke2fs(t, 32*1024*1024, fstype)
+			debugfs(t, f, "mkdir dir", "write "+hostFile(t, make([]byte, 300*1024))+" dir/big", "symlink link dir/big")
+			if report := check(t, f); !report.Clean() {
+				t.Errorf("problems found in a consistent %s filesystem made by mke2fs:\n%s", fstype, report)
+			}
+		}
+		// the MMP block is in use too; debugfs would wait out the MMP interval, so it stays empty
+		f := tmpMke2fs(t, 32*1024*1024, "ext4", "-O", "mmp")
+		if report := check(t, f); !report.Clean() {
+			t.Errorf("problems found in a consistent filesystem with an MMP block made by mke2fs:\n%s", report)
+		}
+	})
+
+	for _, tt := range []struct {
+		name     string
+		params   *ext4.Params
+		requests []string
+		expected []ext4.ProblemKind
+	}{
+		{"link count", nil, []string{"sif /file links_count 5"}, []ext4.ProblemKind{ext4.ProblemLinkCount}},
+		{"unattached inode", nil, []string{"unlink /dir/file"}, []ext4.ProblemKind{ext4.ProblemOrphanedInode}},
+		{"block bitmap", nil, []string{"setb 12000 10"}, []ext4.ProblemKind{ext4.ProblemBlockBitmap}},
+		{"inode bitmap", nil, []string{"freei /dir/file"}, []ext4.ProblemKind{ext4.ProblemInodeBitmap}},
+		{"free count", nil, []string{"set_bg 1 free_blocks_count 7", "set_bg 1 checksum calc"}, []ext4.ProblemKind{ext4.ProblemFreeCount}},
+		{"group descriptor checksum", nil, []string{"set_bg 1 checksum 0x1234"}, []ext4.ProblemKind{ext4.ProblemChecksum}},
+		{"gdt_csum checksum", &ext4.Params{Features: "^metadata_csum,uninit_bg"}, []string{"set_bg 1 checksum 0x1234"}, []ext4.ProblemKind{ext4.ProblemChecksum}},
+		{"inode checksum", nil, []string{"sif /file checksum 0x1234"}, []ext4.ProblemKind{ext4.ProblemChecksum}},
+		{"multiply-claimed", &ext4.Params{Features: "^metadata_csum,^64bit,^extent,^flex_bg,^huge_file,^dir_nlink,^extra_isize", InodeSize: 128}, []string{"sif /file block[0] 2"}, []ext4.ProblemKind{ext4.ProblemMultiplyClaimed, ext4.ProblemBlockBitmap}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, fs := tmpExt4(t, 16*1024*1024, 0, tt.params)
+			populate(t, fs)
+			debugfs(t, f, tt.requests...)
+			report := check(t, f)
+			for _, kind := range tt.expected {
+				if !report.Has(kind) {
+					t.Errorf("no %s problem found:\n%s", kind, report)
+				}
+			}
+			if e2fsck, err := exec.LookPath("e2fsck"); err == nil {
+				// some problems e2fsck -n only mentions as ignored, without failing
+				out, err := exec.Command(e2fsck, "-fn", f.Name()).CombinedOutput()
+				if err == nil && !strings.Contains(string(out), "IGNORED") {
+					t.Errorf("e2fsck found no problem where Check found:\n%s", report)
+				}
+			}
+		})
+	}
+
+	t.Run("directory checksum", func(t *testing.T) {
+		f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+		populate(t, fs)
+		out := debugfs(t, f, "blocks /dir")
+		var block int64
+		if _, err := fmt.Sscan(out[strings.LastIndex(strings.TrimSpace(out), "\n")+1:], &block); err != nil {
+			t.Fatalf("no block in %q: %v", out, err)
+		}
+		// the name of "." is the 9th byte of the block
+		if _, err := f.WriteAt([]byte{'x'}, block*1024+8); err != nil {
+			t.Fatal(err)
+		}
+		report := check(t, f)
+		if !report.Has(ext4.ProblemChecksum) || !report.Has(ext4.ProblemDirectory) {
+			t.Errorf("damaged directory block not found:\n%s", report)
+		}
+	})
+}
+
+func TestExt4Grow(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 200*1024/16)
+	open := func(t *testing.T, fs *ext4.FileSystem, p string, flag int) filesystem.File {
+		t.Helper()
+		file, err := fs.OpenFile(p, flag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+	grow := func(t *testing.T, f *os.File, sizes ...int64) {
+		t.Helper()
+		for _, size := range sizes {
+			if err := f.Truncate(size); err != nil {
+				t.Fatal(err)
+			}
+			fs := reread(t, f)
+			free := fs.Superblock().GetFreeBlockCount()
+			if err := fs.Grow(size); err != nil {
+				t.Fatalf("error growing filesystem to %d bytes: %v", size, err)
+			}
+			fsck(t, f, 0)
+			fs = reread(t, f)
+			if report, err := fs.Check(); err != nil || !report.Clean() {
+				t.Fatalf("problems found after growing to %d bytes: %v\n%s", size, err, report)
+			}
+			if fs.Superblock().GetFreeBlockCount() <= free {
+				t.Errorf("growing to %d bytes left %d free blocks, had %d", size, fs.Superblock().GetFreeBlockCount(), free)
+			}
+			b, err := ioutil.ReadAll(open(t, fs, "/file", os.O_RDONLY))
+			if err != nil || !bytes.Equal(b, content) {
+				t.Errorf("file content changed by growing to %d bytes: %v", size, err)
+			}
+		}
+		// the new space is usable
+		fs := reread(t, f)
+		file := open(t, fs, "/filler", os.O_CREATE|os.O_RDWR)
+		chunk := make([]byte, 1024*1024)
+		for fs.Superblock().GetFreeBlockCount()*fs.Superblock().GetBlockSize() > int64(2*len(chunk)) {
+			if _, err := file.Write(chunk); err != nil {
+				t.Fatalf("error filling grown filesystem: %v", err)
+			}
+		}
+		fsck(t, f, 0)
+	}
+
+	for _, p := range []*ext4.Params{nil, {Features: "^metadata_csum,uninit_bg"}, {Features: "^metadata_csum,^64bit,^extent,^flex_bg,^huge_file,^dir_nlink,^extra_isize", InodeSize: 128}} {
+		t.Run(fmt.Sprintf("%+v", p), func(t *testing.T) {
+			f, fs := tmpExt4(t, 16*1024*1024, 0, p)
+			file := open(t, fs, "/file", os.O_CREATE|os.O_RDWR)
+			if _, err := file.Write(content); err != nil {
+				t.Fatal(err)
+			}
+			// a partial last group, filled up by the next step; then enough groups for
+			// the descriptor table to need more blocks than were reserved
+			grow(t, f, 21*1024*1024, 40*1024*1024, 300*1024*1024)
+		})
+	}
+
+	for _, fstype := range []string{"ext2", "ext4"} {
+		t.Run(fstype, func(t *testing.T) {
+			f := tmpMke2fs(t, 32*1024*1024, fstype)
+			debugfs(t, f, "write "+hostFile(t, content)+" file")
+			// using reserved group descriptor blocks kept by the resize inode
+			grow(t, f, 100*1024*1024, 600*1024*1024)
+		})
+	}
+
+	t.Run("shrink", func(t *testing.T) {
+		_, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+		if err := fs.Grow(8 * 1024 * 1024); err == nil {
+			t.Error("shrinking the filesystem did not fail")
+		}
+	})
+}
+
+func TestExt4Checksums(t *testing.T) {
+	// block returns the block debugfs lists last for request, or the one tagged tag
+	block := func(t *testing.T, f *os.File, request, tag string) int64 {
+		t.Helper()
+		out := strings.TrimSpace(debugfs(t, f, request))
+		s := out[strings.LastIndex(out, "\n")+1:]
+		if tag != "" {
+			s = out[strings.Index(out, tag)+len(tag):]
+		}
+		var b int64
+		if _, err := fmt.Sscan(s, &b); err != nil {
+			t.Fatalf("no block in %q: %v", out, err)
+		}
+		return b
+	}
+	corrupt := func(t *testing.T, f *os.File, off int64) {
+		t.Helper()
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, off); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.WriteAt([]byte{^b[0]}, off); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readFile := func(fs *ext4.FileSystem, p string) error {
+		file, err := fs.OpenFile(p, os.O_RDONLY)
+		if err == nil {
+			_, err = ioutil.ReadAll(file)
+		}
+		return err
+	}
+
+	for _, tt := range []struct {
+		name      string
+		structure string
+		damage    func(t *testing.T, f *os.File)
+		read      func(fs *ext4.FileSystem) error
+	}{
+		{"superblock", "superblock", func(t *testing.T, f *os.File) { corrupt(t, f, 1024+0x3FC) }, nil},
+		{"group descriptor", "group descriptor", func(t *testing.T, f *os.File) { debugfs(t, f, "set_bg 0 checksum 0x1234") },
+			func(fs *ext4.FileSystem) error { return readFile(fs, "/file") }},
+		{"inode", "inode", func(t *testing.T, f *os.File) { debugfs(t, f, "sif /file checksum 0x1234") },
+			func(fs *ext4.FileSystem) error { return readFile(fs, "/file") }},
+		{"directory block", "directory block", func(t *testing.T, f *os.File) { corrupt(t, f, block(t, f, "blocks /dir", "")*1024+20) },
+			func(fs *ext4.FileSystem) error { _, err := fs.ReadDir("/dir"); return err }},
+		{"extent block", "extent block", func(t *testing.T, f *os.File) { corrupt(t, f, block(t, f, "stat /a", "(ETB0):")*1024+1020) },
+			func(fs *ext4.FileSystem) error { return readFile(fs, "/a") }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+			if err := fs.Mkdir("/dir"); err != nil {
+				t.Fatal(err)
+			}
+			// files written a block at a time in turn have too many extents for the inode
+			files := []filesystem.File{}
+			for _, p := range []string{"/file", "/a", "/b"} {
+				file, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+				if err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, file)
+			}
+			for i := 0; i < 20; i++ {
+				for _, file := range files {
+					if _, err := file.Write(bytes.Repeat([]byte{byte(i)}, 1024)); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			tt.damage(t, f)
+
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			fs, err = ext4.Read(f, info.Size(), 0, 512)
+			if err == nil && tt.read != nil {
+				err = tt.read(fs)
+			}
+			cerr, ok := err.(*ext4.CorruptionError)
+			if !ok {
+				t.Fatalf("damaged %s read with error %v instead of a corruption error", tt.name, err)
+			}
+			if cerr.Structure != tt.structure || cerr.Stored == cerr.Computed {
+				t.Errorf("unexpected corruption error %+v", cerr)
+			}
+
+			if fs != nil && tt.read != nil {
+				// Check reads past mismatches, but not for anyone reading alongside it
+				done := make(chan error)
+				go func() {
+					_, err := fs.Check()
+					done <- err
+				}()
+				for checking := true; checking; {
+					select {
+					case err := <-done:
+						if err != nil {
+							t.Fatal(err)
+						}
+						checking = false
+					default:
+					}
+					if _, ok := tt.read(fs).(*ext4.CorruptionError); !ok {
+						t.Fatalf("damaged %s read without a corruption error while checking", tt.name)
+					}
+				}
+			}
+
+			fs, err = ext4.ReadWithOptions(f, info.Size(), 0, 512, ext4.ReadOptions{ReadOnly: true, IgnoreChecksums: true})
+			if err == nil && tt.read != nil {
+				err = tt.read(fs)
+			}
+			if err != nil {
+				t.Errorf("damaged %s could not be read ignoring checksums: %v", tt.name, err)
+			}
+		})
+	}
+}
+
+func TestExt4Allocator(t *testing.T) {
+	// group returns the block group of the inode at p
+	group := func(t *testing.T, f *os.File, fs *ext4.FileSystem, p string) int64 {
+		t.Helper()
+		out := debugfs(t, f, "stat "+p)
+		var num int64
+		if _, err := fmt.Sscan(out[strings.Index(out, "Inode:")+len("Inode:"):], &num); err != nil {
+			t.Fatalf("no inode number for %s in %q", p, out)
+		}
+		return (num - 1) / int64(fs.Superblock().InodePer_group)
+	}
+	// extents returns how many extents hold the data of the file at p
+	extents := func(t *testing.T, f *os.File, p string) int {
+		t.Helper()
+		out := debugfs(t, f, "ex "+p)
+		n := 0
+		for _, line := range strings.Split(out, "\n") {
+			if strings.Contains(line, " 0/") && !strings.Contains(line, "Level") {
+				n++
+			}
+		}
+		return n
+	}
+	write := func(t *testing.T, fs *ext4.FileSystem, p string, size, chunk int) {
+		t.Helper()
+		file, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for size > 0 {
+			if chunk > size {
+				chunk = size
+			}
+			if _, err := file.Write(make([]byte, chunk)); err != nil {
+				t.Fatal(err)
+			}
+			size -= chunk
+		}
+	}
+
+	t.Run("orlov", func(t *testing.T) {
+		f, fs := tmpExt4(t, 64*1024*1024, 0, &ext4.Params{Features: "^flex_bg"})
+		top := map[int64]bool{}
+		for _, d := range []string{"/a", "/b", "/c", "/d"} {
+			if err := fs.Mkdir(d); err != nil {
+				t.Fatal(err)
+			}
+			top[group(t, f, fs, d)] = true
+		}
+		if len(top) < 4 {
+			t.Errorf("top-level directories not spread over the groups: %v", top)
+		}
+		if err := fs.Mkdir("/b/sub"); err != nil {
+			t.Fatal(err)
+		}
+		write(t, fs, "/c/file", 4096, 4096)
+		if g, want := group(t, f, fs, "/b/sub"), group(t, f, fs, "/b"); g != want {
+			t.Errorf("subdirectory in group %d away from its parent in group %d", g, want)
+		}
+		if g, want := group(t, f, fs, "/c/file"), group(t, f, fs, "/c"); g != want {
+			t.Errorf("file in group %d away from its directory in group %d", g, want)
+		}
+		fsck(t, f, 0)
+	})
+
+	t.Run("contiguous", func(t *testing.T) {
+		f, fs := tmpExt4(t, 32*1024*1024, 0, nil)
+		for _, d := range []string{"/frag", "/data"} {
+			if err := fs.Mkdir(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// free space broken up into holes smaller than the big write to come
+		for i := 0; i < 32; i++ {
+			write(t, fs, fmt.Sprintf("/frag/small%d", i), 32*1024, 32*1024)
+		}
+		for i := 0; i < 32; i += 2 {
+			if err := fs.Remove(fmt.Sprintf("/frag/small%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		write(t, fs, "/data/big", 1024*1024, 1024*1024)
+		// appended to a little at a time, a file still grows in place
+		write(t, fs, "/data/appended", 256*1024, 4096)
+		fsck(t, f, 0)
+		for _, p := range []string{"/data/big", "/data/appended"} {
+			if n := extents(t, f, p); n != 1 {
+				t.Errorf("%s written in %d extents instead of 1", p, n)
+			}
+		}
+	})
+
+	t.Run("uninit", func(t *testing.T) {
+		f, fs := tmpExt4(t, 16*1024*1024, 0, &ext4.Params{Features: "^flex_bg"})
+		if err := f.Truncate(64 * 1024 * 1024); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Grow(64 * 1024 * 1024); err != nil {
+			t.Fatal(err)
+		}
+		fs = reread(t, f)
+		uninit := fs.GetBlockGroupDescriptor(4).Flags
+		if uninit&(ext4.BG_BLOCK_UNINIT|ext4.BG_INODE_UNINIT) != ext4.BG_BLOCK_UNINIT|ext4.BG_INODE_UNINIT {
+			t.Fatalf("new group not uninitialized, flags %#x", uninit)
+		}
+		// top-level directories spread out into the empty new groups
+		for i := 0; i < 6; i++ {
+			d := fmt.Sprintf("/dir%d", i)
+			if err := fs.Mkdir(d); err != nil {
+				t.Fatal(err)
+			}
+			write(t, fs, d+"/file", 100*1024, 100*1024)
+		}
+		used := 0
+		for g := int64(2); g < fs.Superblock().BlockGroupCount(); g++ {
+			if flags := fs.GetBlockGroupDescriptor(g).Flags; flags&ext4.BG_INODE_UNINIT == 0 {
+				used++
+				if flags&ext4.BG_BLOCK_UNINIT != 0 {
+					t.Errorf("group %d has inodes in use but is still BLOCK_UNINIT", g)
+				}
+			}
+		}
+		if used == 0 {
+			t.Error("no new group was used")
+		}
+		fsck(t, f, 0)
+		if report, err := reread(t, f).Check(); err != nil || !report.Clean() {
+			t.Errorf("problems found: %v\n%s", err, report)
+		}
+	})
+}
+
+func TestExt4LargeDirectory(t *testing.T) {
+	for _, bs := range []int64{1024, 4096} {
+		t.Run(fmt.Sprintf("%d", bs), func(t *testing.T) {
+			f, fs := tmpExt4(t, 32*1024*1024, 0, &ext4.Params{BlockSize: bs})
+			if err := fs.Mkdir("/big"); err != nil {
+				t.Fatal(err)
+			}
+			const count = 2000
+			for i := 0; i < count; i++ {
+				if _, err := fs.OpenFile(fmt.Sprintf("/big/file-with-a-longish-name-%d", i), os.O_CREATE|os.O_RDWR); err != nil {
+					t.Fatalf("creating file %d: %v", i, err)
+				}
+			}
+			if err := fs.Mkdir("/big/sub"); err != nil {
+				t.Fatal(err)
+			}
+			// the space of removed entries is used again before the directory grows
+			stat := func() int64 {
+				t.Helper()
+				infos, err := fs.ReadDir("/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, info := range infos {
+					if info.Name() == "big" {
+						return info.Size()
+					}
+				}
+				t.Fatal("/big not found")
+				return 0
+			}
+			size := stat()
+			for i := 0; i < count; i += 10 {
+				if err := fs.Remove(fmt.Sprintf("/big/file-with-a-longish-name-%d", i)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := 0; i < count; i += 10 {
+				if _, err := fs.OpenFile(fmt.Sprintf("/big/new%d", i), os.O_CREATE|os.O_RDWR); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if grown := stat(); grown != size {
+				t.Errorf("directory grew from %d to %d bytes instead of reusing removed entries", size, grown)
+			}
+
+			fs = reread(t, f)
+			infos, err := fs.ReadDir("/big")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the files, sub, "." and ".."
+			if len(infos) != count+3 {
+				t.Errorf("%d entries read back instead of %d", len(infos), count+3)
+			}
+			fsck(t, f, 0)
+			if report, err := fs.Check(); err != nil || !report.Clean() {
+				t.Errorf("problems found: %v\n%s", err, report)
+			}
+		})
+	}
+}
+
+func TestExt4ReadFeatures(t *testing.T) {
+	content := make([]byte, 300*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	for _, tt := range []struct {
+		name     string
+		args     []string
+		writable bool
+	}{
+		{"bigalloc", []string{"-b", "4096", "-O", "bigalloc", "-C", "65536"}, false},
+		{"bigalloc 1k blocks", []string{"-b", "1024", "-O", "bigalloc,^metadata_csum,uninit_bg", "-C", "8192"}, false},
+		{"meta_bg", []string{"-b", "1024", "-O", "meta_bg,^resize_inode"}, true},
+		{"meta_bg 64bit", []string{"-b", "1024", "-O", "meta_bg,^resize_inode,64bit,^metadata_csum", "-E", "desc_size=128"}, true},
+		{"meta_bg bigalloc", []string{"-b", "1024", "-O", "meta_bg,^resize_inode,bigalloc", "-C", "4096"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f := tmpMke2fs(t, 256*1024*1024, "ext4", tt.args...)
+			debugfs(t, f, "write "+hostFile(t, content)+" file", "mkdir dir", "write "+hostFile(t, []byte("hello"))+" dir/hello")
+			fs := reread(t, f)
+			for p, expected := range map[string][]byte{"/file": content, "/dir/hello": []byte("hello")} {
+				file, err := fs.OpenFile(p, os.O_RDONLY)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, expected) {
+					t.Errorf("read %d bytes of %s, expected %d: %v", len(b), p, len(expected), err)
+				}
+			}
+			if report, err := fs.Check(); err != nil || !report.Clean() {
+				t.Fatalf("Check of a clean filesystem: %v\n%v", err, report)
+			}
+
+			_, err := fs.OpenFile("/new", os.O_CREATE|os.O_RDWR)
+			switch {
+			case tt.writable && err != nil:
+				t.Fatal(err)
+			case tt.writable:
+				fsck(t, f, 0)
+			case err == nil || !strings.Contains(err.Error(), "bigalloc"):
+				t.Fatalf("creating a file with bigalloc returned %v, expected it refused", err)
+			}
+			if tt.writable {
+				return
+			}
+
+			// a freed cluster of the file shows in the bitmap, reported by its first block
+			var block int64
+			out := debugfs(t, f, "bmap file 0")
+			if _, err := fmt.Sscan(out[strings.LastIndex(strings.TrimSpace(out), "\n")+1:], &block); err != nil {
+				t.Fatal(err)
+			}
+			debugfs(t, f, fmt.Sprintf("freeb %d", block))
+			report, err := reread(t, f).Check()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !report.Has(ext4.ProblemBlockBitmap) || !strings.Contains(report.String(), fmt.Sprintf("+%d", block)) {
+				t.Errorf("Check did not report freed block %d:\n%v", block, report)
+			}
+		})
+	}
+
+	t.Run("read-only", func(t *testing.T) {
+		f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+		if err := fs.Tune(ext4.TuneOptions{Features: "read-only"}); err != nil {
+			t.Fatal(err)
+		}
+		before, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reread(t, f).Mkdir("/x"); err == nil || !strings.Contains(err.Error(), "read-only") {
+			t.Errorf("creating a directory with the read-only feature returned %v, expected it refused", err)
+		}
+		if after, err := ioutil.ReadFile(f.Name()); err != nil || !bytes.Equal(before, after) {
+			t.Errorf("filesystem with the read-only feature was changed: %v", err)
+		}
+	})
+
+	t.Run("unknown incompat", func(t *testing.T) {
+		f := tmpMke2fs(t, 16*1024*1024, "ext4")
+		debugfs(t, f, "feature dirdata")
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ext4.ReadOnly(f, info.Size(), 0, 512); err == nil || !strings.Contains(err.Error(), "dirdata") {
+			t.Errorf("reading a filesystem with dirdata returned %v, expected it refused", err)
+		}
+	})
+}
+
+func TestExt4Orphans(t *testing.T) {
+	f := tmpMke2fs(t, 32*1024*1024, "ext4")
+	content := make([]byte, 300*1024)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	// as left by a crash: /a unlinked and /b truncated while still open
+	debugfs(t, f, "write "+hostFile(t, content)+" a", "write "+hostFile(t, content)+" b",
+		"unlink /a", "sif <12> links_count 0", "sif <12> dtime 13", "sif /b size 1000", "ssv last_orphan 12")
+
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ro, err := ext4.ReadOnly(f, info.Size(), 0, 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, err := ro.Check(); err != nil || !report.Has(ext4.ProblemOrphanedInode) {
+		t.Errorf("orphan list was processed reading read-only: %v\n%v", err, report)
+	}
+
+	fs := reread(t, f)
+	if fs.Superblock().Last_orphan != 0 {
+		t.Errorf("orphan list still starts at inode %d", fs.Superblock().Last_orphan)
+	}
+	fsck(t, f, 0)
+	if out := debugfs(t, f, "testi <12>"); !strings.Contains(out, "not in use") {
+		t.Errorf("unlinked orphan was not freed:\n%s", out)
+	}
+	if out := debugfs(t, f, "blocks /b"); len(strings.Fields(out[strings.LastIndex(strings.TrimSpace(out), "\n")+1:])) != 1 {
+		t.Errorf("truncated orphan kept blocks past its end:\n%s", out)
+	}
+	file, err := reread(t, f).OpenFile("/b", os.O_RDONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || !bytes.Equal(b, content[:1000]) {
+		t.Errorf("read %d bytes of the truncated orphan, expected 1000: %v", len(b), err)
+	}
+}
+
+func TestExt4MMP(t *testing.T) {
+	const seqClean = 0xFF4D4D50
+	// mmp reads the sequence number and update time from the MMP block
+	mmp := func(t *testing.T, f *os.File) (uint32, time.Time) {
+		t.Helper()
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		fs, err := ext4.ReadOnly(f, info.Size(), 0, 512)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sb := fs.Superblock()
+		b := make([]byte, 16)
+		if _, err := f.ReadAt(b, int64(sb.Mmp_block)*sb.GetBlockSize()); err != nil {
+			t.Fatal(err)
+		}
+		return binary.LittleEndian.Uint32(b[4:]), time.Unix(int64(binary.LittleEndian.Uint64(b[8:])), 0)
+	}
+	open := func(t *testing.T, f *os.File) (*ext4.FileSystem, error) {
+		t.Helper()
+		info, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ext4.Read(f, info.Size(), 0, 512)
+	}
+	// reopen opens the image again after a Close of the filesystem closed it
+	reopen := func(t *testing.T, f *os.File) *os.File {
+		t.Helper()
+		f, err := os.OpenFile(f.Name(), os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+
+	t.Run("held", func(t *testing.T) {
+		f := tmpMke2fs(t, 32*1024*1024, "ext4", "-O", "mmp", "-E", "mmp_update_interval=1")
+		fs, err := open(t, f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		seq, updated := mmp(t, f)
+		if seq == seqClean || time.Since(updated) > time.Minute {
+			t.Fatalf("MMP block not taken: sequence %#x updated %v", seq, updated)
+		}
+		if _, err := open(t, f); err == nil || !strings.Contains(err.Error(), "in use") {
+			t.Errorf("opening a filesystem in use returned %v", err)
+		}
+		if _, err := fs.OpenFile("/file", os.O_CREATE|os.O_RDWR); err != nil {
+			t.Fatal(err)
+		}
+		// the superblock rewritten meanwhile does not get in the way of the updates
+		for start := time.Now(); time.Since(start) < 2500*time.Millisecond; time.Sleep(100 * time.Millisecond) {
+			id := uuid.New()
+			if err := fs.Tune(ext4.TuneOptions{UUID: &id}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if now, _ := mmp(t, f); now == seq {
+			t.Errorf("MMP block not updated while held, sequence still %#x", seq)
+		}
+		if err := fs.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		f = reopen(t, f)
+		if seq, _ := mmp(t, f); seq != seqClean {
+			t.Errorf("MMP block sequence %#x after Close, expected clean", seq)
+		}
+		fsck(t, f, 0)
+		fs, err = open(t, f)
+		if err != nil {
+			t.Fatalf("reopening after Close: %v", err)
+		}
+		if err := fs.Close(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		seq     uint32
+		age     time.Duration
+		refused string
+	}{
+		{"active", 0x1234, 0, "in use"},
+		{"stale", 0x1234, time.Hour, ""},
+		{"fsck", 0xE24D4D50, time.Hour, "e2fsck"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// without metadata_csum the MMP block can be changed with no checksum to fix
+			f := tmpMke2fs(t, 32*1024*1024, "ext4", "-O", "mmp,^metadata_csum")
+			info, err := f.Stat()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ro, err := ext4.ReadOnly(f, info.Size(), 0, 512)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sb := ro.Superblock()
+			b := make([]byte, 12)
+			binary.LittleEndian.PutUint32(b[0:], tt.seq)
+			binary.LittleEndian.PutUint64(b[4:], uint64(time.Now().Add(-tt.age).Unix()))
+			if _, err := f.WriteAt(b, int64(sb.Mmp_block)*sb.GetBlockSize()+4); err != nil {
+				t.Fatal(err)
+			}
+
+			fs, err := open(t, f)
+			switch {
+			case tt.refused == "" && err != nil:
+				t.Fatalf("MMP block not taken over: %v", err)
+			case tt.refused == "":
+				if err := fs.Close(); err != nil {
+					t.Fatal(err)
+				}
+			case err == nil || !strings.Contains(err.Error(), tt.refused):
+				t.Fatalf("opening returned %v, expected it refused as %s", err, tt.refused)
+			}
+		})
+	}
+}
+
+func TestExt4ExtentsInspect(t *testing.T) {
+	const pre = 64 * 1024
+	f, fs := tmpExt4(t, 16*1024*1024, pre, nil)
+	bs := fs.Superblock().GetBlockSize()
+	expected := make([]byte, 100*bs)
+	for i := range expected {
+		expected[i] = byte(i % 251)
+	}
+	file, err := fs.OpenFile("/file", os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write(expected); err != nil {
+		t.Fatal(err)
+	}
+	ef := file.(*ext4.File)
+	if err := ef.PunchHole(10*bs, 10*bs); err != nil {
+		t.Fatal(err)
+	}
+	copy(expected[10*bs:20*bs], make([]byte, 10*bs))
+	if err := ef.Fallocate(100*bs, 5*bs); err != nil {
+		t.Fatal(err)
+	}
+	expected = append(expected, make([]byte, 5*bs)...)
+
+	// the runs must cover the file and read back as its contents straight from the device
+	checkExtents := func(fs *ext4.FileSystem, p string, expected []byte) []ext4.FileExtent {
+		t.Helper()
+		extents, err := fs.Extents(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		end := int64(0)
+		for _, e := range extents {
+			if e.Logical != end {
+				t.Fatalf("run at %d of %s after one ending at %d: %+v", e.Logical, p, end, extents)
+			}
+			end += e.Length
+			b := make([]byte, e.Length)
+			if !e.Hole && !e.Unwritten {
+				if _, err := f.ReadAt(b, e.Physical); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if e.Logical+e.Length > int64(len(expected)) {
+				b = b[:int64(len(expected))-e.Logical]
+			}
+			if !bytes.Equal(b, expected[e.Logical:e.Logical+int64(len(b))]) {
+				t.Errorf("run %+v of %s does not hold its contents", e, p)
+			}
+		}
+		if end < int64(len(expected)) {
+			t.Errorf("runs of %s end at %d, before its end at %d", p, end, len(expected))
+		}
+		return extents
+	}
+	extents := checkExtents(fs, "/file", expected)
+	var holes, unwritten int
+	for _, e := range extents {
+		if e.Hole {
+			holes++
+			if e.Logical != 10*bs || e.Length != 10*bs {
+				t.Errorf("hole %+v, expected blocks 10 to 20", e)
+			}
+		}
+		if e.Unwritten {
+			unwritten++
+		}
+		if !e.Hole && e.Physical < pre {
+			t.Errorf("run %+v is not past the start of the filesystem", e)
+		}
+	}
+	if holes != 1 || unwritten != 1 {
+		t.Errorf("%d holes and %d unwritten runs, expected one each: %+v", holes, unwritten, extents)
+	}
+
+	// every other block punched makes enough extents for a tree of more than one level
+	for off := 30 * bs; off < 90*bs; off += 2 * bs {
+		if err := ef.PunchHole(off, bs); err != nil {
+			t.Fatal(err)
+		}
+		copy(expected[off:off+bs], make([]byte, bs))
+	}
+	extents = checkExtents(fs, "/file", expected)
+	in, err := fs.Inspect("/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(in.ExtentNodes) < 2 || in.ExtentNodes[0].Block != 0 || in.ExtentNodes[0].Header.Depth == 0 {
+		t.Fatalf("extent tree did not grow a level: %+v", in.ExtentNodes)
+	}
+	var leaves []ext4.Extent
+	for _, n := range in.ExtentNodes[1:] {
+		if n.Block == 0 || n.Header.Magic != 0xF30A || int(n.Header.Entries) != len(n.Extents)+len(n.Index) {
+			t.Errorf("bad extent node %+v", n)
+		}
+		leaves = append(leaves, n.Extents...)
+	}
+	var runs int
+	for _, e := range extents {
+		if !e.Hole {
+			runs++
+		}
+	}
+	if runs != len(leaves) {
+		t.Errorf("%d extents in the leaves, %d runs", len(leaves), runs)
+	}
+	if in.Address < pre || int64(len(in.Raw)) != int64(fs.Superblock().Inode_size) || in.Inode.GetSize() != int64(len(expected)) {
+		t.Errorf("inspected inode %d at %d with %d raw bytes, size %d", in.Num, in.Address, len(in.Raw), in.Inode.GetSize())
+	}
+	raw := make([]byte, len(in.Raw))
+	if _, err := f.ReadAt(raw, in.Address); err != nil || !bytes.Equal(raw, in.Raw) {
+		t.Errorf("raw inode is not what is stored at %d: %v", in.Address, err)
+	}
+	if s := in.String(); !strings.Contains(s, "index to block") || !strings.Contains(s, "[uninit]") {
+		t.Errorf("inspection does not show the extent tree:\n%s", s)
+	}
+
+	in, err = fs.Inspect("/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := map[string]uint32{}
+	for _, e := range in.Entries {
+		if e.Inode != 0 {
+			names[e.Name] = e.Inode
+		}
+	}
+	if names["."] != 2 || names[".."] != 2 || names["lost+found"] == 0 || names["file"] == 0 {
+		t.Errorf("root directory entries %v", names)
+	}
+	if byNum, err := fs.InspectInode(int64(names["file"])); err != nil || byNum.Inode.GetSize() != int64(len(expected)) {
+		t.Errorf("inspecting inode %d of /file: %v", names["file"], err)
+	}
+
+	// by number, an inode is inspected as it is stored, whether or not its checksum matches
+	f = tmpMke2fs(t, 16*1024*1024, "ext4")
+	debugfs(t, f, "write "+hostFile(t, expected[:5000])+" file", "sif file checksum 0x1234")
+	fs = reread(t, f)
+	if _, err := fs.Inspect("/file"); err == nil {
+		t.Error("inspected /file with a wrong checksum by path")
+	}
+	if byNum, err := fs.InspectInode(12); err != nil || byNum.Inode.GetSize() != 5000 {
+		t.Errorf("inspecting inode 12 of /file with a wrong checksum: %v", err)
+	}
+	if _, err := fs.InspectInode(int64(fs.Superblock().InodeCount) + 1); err == nil {
+		t.Error("inspected an inode past the last one")
+	}
+
+	// block maps
+	f = tmpMke2fs(t, 16*1024*1024, "ext2", "-b", "1024")
+	big := make([]byte, 300*1024)
+	for i := range big {
+		big[i] = byte(i % 253)
+	}
+	debugfs(t, f, "write "+hostFile(t, big)+" big")
+	fs = reread(t, f)
+	file, err = fs.OpenFile("/big", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Seek(400*1024, 0); err != nil && err != io.EOF {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte("after a hole")); err != nil {
+		t.Fatal(err)
+	}
+	big = append(append(big, make([]byte, 100*1024)...), "after a hole"...)
+	extents = checkExtents(fs, "/big", big)
+	// the indirect blocks between break up the runs
+	if len(extents) < 4 || !extents[len(extents)-2].Hole {
+		t.Errorf("runs of a file with a block map: %+v", extents)
+	}
+	if in, err := fs.Inspect("/big"); err != nil || len(in.ExtentNodes) != 0 {
+		t.Errorf("inspecting a file with a block map: %v", err)
+	}
+}
+
+func TestExt4Encrypted(t *testing.T) {
+	f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+	if err := fs.Tune(ext4.TuneOptions{Features: "encrypt"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Mkdir("/enc"); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/enc/file", "/plain"} {
+		file, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := file.Write([]byte("ciphertext")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// debugfs cannot encrypt, but the flag is all that is checked
+	debugfs(t, f, "set_inode_field /enc flags 0x80800", "set_inode_field /enc/file flags 0x80800")
+	before, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs = reread(t, f)
+	file, err := fs.OpenFile("/enc/file", os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(file); err != nil || string(b) != "ciphertext" {
+		t.Errorf("read %q from an encrypted file: %v", b, err)
+	}
+	ef := file.(*ext4.File)
+	for name, fn := range map[string]func() error{
+		"creating a file":    func() error { _, err := fs.OpenFile("/enc/new", os.O_CREATE|os.O_RDWR); return err },
+		"making a directory": func() error { return fs.Mkdir("/enc/dir") },
+		"linking":            func() error { return fs.Link("/plain", "/enc/link") },
+		"making a symlink":   func() error { return fs.Symlink("file", "/enc/symlink") },
+		"making a node":      func() error { return fs.Mknod("/enc/fifo", ext4.S_IFIFO|0644, 0) },
+		"removing":           func() error { return fs.Remove("/enc/file") },
+		"writing":            func() error { _, err := file.Write([]byte("plaintext")); return err },
+		"truncating":         func() error { return ef.Truncate(1) },
+		"punching a hole":    func() error { return ef.PunchHole(0, 1) },
+		"preallocating":      func() error { return ef.Fallocate(0, 4096) },
+	} {
+		if err := fn(); err == nil || !strings.Contains(err.Error(), "encrypted") {
+			t.Errorf("%s in an encrypted directory returned %v, expected it refused", name, err)
+		}
+	}
+	if after, err := ioutil.ReadFile(f.Name()); err != nil || !bytes.Equal(before, after) {
+		t.Errorf("encrypted directory was changed: %v", err)
+	}
+	if err := fs.Link("/enc/file", "/link"); err != nil {
+		t.Errorf("linking to an encrypted file from outside: %v", err)
+	}
+}
+
+// fill writes to a new file at p until the filesystem has no blocks left
+func fill(t *testing.T, fs *ext4.FileSystem, p string) {
+	t.Helper()
+	file, err := fs.OpenFile(p, os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs := fs.Superblock().GetBlockSize()
+	for _, chunk := range []int64{256 * bs, bs} {
+		for {
+			if _, err := file.Write(make([]byte, chunk)); err != nil {
+				break
+			}
+		}
+	}
+	if free := fs.Superblock().GetFreeBlockCount(); free != 0 {
+		t.Fatalf("%d blocks left after filling the filesystem", free)
+	}
+}
+
+func TestExt4FullFilesystem(t *testing.T) {
+	for _, fstype := range []string{"ext4", "ext2"} {
+		t.Run(fstype, func(t *testing.T) {
+			f := tmpMke2fs(t, 8*1024*1024, fstype)
+			fs := reread(t, f)
+			fill(t, fs, "/fill")
+			sb := *fs.Superblock()
+
+			// a failed change leaves nothing behind, the inode it took first included
+			if err := fs.Symlink(strings.Repeat("x", 200), "/slow"); err == nil {
+				t.Fatal("creating a slow symlink on a full filesystem succeeded")
+			}
+			if free := fs.Superblock().Free_inodeCount; free != sb.Free_inodeCount {
+				t.Errorf("%d inodes free after a failed symlink, expected %d", free, sb.Free_inodeCount)
+			}
+			fsck(t, f, 0)
+
+			// entries go in until the directory needs a block of its own
+			var err error
+			for i := 0; i < 1000 && err == nil; i++ {
+				_, err = fs.OpenFile(fmt.Sprintf("/file-%d", i), os.O_CREATE|os.O_RDWR)
+			}
+			if err == nil {
+				t.Fatal("creating files in a full directory on a full filesystem succeeded")
+			}
+			if err := fs.Mkdir("/dir"); err == nil {
+				t.Error("creating a directory in a full directory on a full filesystem succeeded")
+			}
+			fsck(t, f, 0)
+
+			// a write running out of space partway keeps, and reports, what it wrote
+			size := func(name string) int64 {
+				t.Helper()
+				infos, err := reread(t, f).ReadDir("/")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, info := range infos {
+					if info.Name() == name {
+						return info.Size()
+					}
+				}
+				t.Fatalf("no %s", name)
+				return 0
+			}
+			bs := fs.Superblock().GetBlockSize()
+			file, err := fs.OpenFile("/fill", os.O_RDWR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := file.(*ext4.File).Truncate(size("fill") - 10*bs); err != nil {
+				t.Fatal(err)
+			}
+			file, err = fs.OpenFile("/partial", os.O_CREATE|os.O_RDWR)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := file.Write(make([]byte, 20*bs))
+			if err == nil || n == 0 || int64(n) >= 20*bs {
+				t.Errorf("writing more than there is room for wrote %d bytes: %v", n, err)
+			}
+			if got := size("partial"); got != int64(n) {
+				t.Errorf("size after a partial write of %d bytes is %d", n, got)
+			}
+			fsck(t, f, 0)
+			if report, err := reread(t, f).Check(); err != nil || !report.Clean() {
+				t.Errorf("problems found: %v\n%s", err, report)
+			}
+		})
+	}
+}
+
+func TestExt4Mkdir(t *testing.T) {
+	f, fs := tmpExt4(t, 16*1024*1024, 0, nil)
+	// like mkdir -p, the directories on the way are made and those already there are fine
+	for _, p := range []string{"/EFI/BOOT", "/EFI/BOOT", "/EFI", "/EFI/other/", "/"} {
+		if err := fs.Mkdir(p); err != nil {
+			t.Fatalf("error making %s: %v", p, err)
+		}
+	}
+	if _, err := fs.OpenFile("/EFI/BOOT/file", os.O_CREATE|os.O_RDWR); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"/EFI/BOOT/file", "/EFI/BOOT/file/sub"} {
+		if err := fs.Mkdir(p); err == nil {
+			t.Errorf("making %s over a file succeeded", p)
+		}
+	}
+	fsck(t, f, 0)
+	infos, err := reread(t, f).ReadDir("/EFI")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	if !reflect.DeepEqual(names, []string{".", "..", "BOOT", "other"}) {
+		t.Errorf("directories in /EFI are %v", names)
+	}
+}
@@ -0,0 +1,580 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// extentHeaderSize is the size of the header of every extent tree node, and of every entry
+	extentHeaderSize = 12
+	// maxInitExtentLen is the longest an initialized extent can be; longer lengths mark the
+	// extent as uninitialized
+	maxInitExtentLen = 32768
+)
+
+// extentNode is a node of an extent tree: either the root, stored in the i_block of the inode,
+// or a node of a block of its own
+type extentNode struct {
+	// block is where the node is stored, 0 for the root
+	block int64
+	b     []byte
+}
+
+func (n *extentNode) entries() int {
+	return int(binary.LittleEndian.Uint16(n.b[2:]))
+}
+
+func (n *extentNode) setEntries(e int) {
+	binary.LittleEndian.PutUint16(n.b[2:], uint16(e))
+}
+
+func (n *extentNode) max() int {
+	return int(binary.LittleEndian.Uint16(n.b[4:]))
+}
+
+func (n *extentNode) depth() int {
+	return int(binary.LittleEndian.Uint16(n.b[6:]))
+}
+
+func (n *extentNode) full() bool {
+	return n.entries() >= n.max()
+}
+
+// entry returns the bytes of entry i
+func (n *extentNode) entry(i int) []byte {
+	return n.b[extentHeaderSize*(i+1) : extentHeaderSize*(i+2)]
+}
+
+// extent returns leaf entry i
+func (n *extentNode) extent(i int) Extent {
+	e := n.entry(i)
+	return Extent{
+		Block:    binary.LittleEndian.Uint32(e[0:]),
+		Len:      binary.LittleEndian.Uint16(e[4:]),
+		Start_hi: binary.LittleEndian.Uint16(e[6:]),
+		Start_lo: binary.LittleEndian.Uint32(e[8:]),
+	}
+}
+
+func (n *extentNode) setExtent(i int, ext Extent) {
+	e := n.entry(i)
+	binary.LittleEndian.PutUint32(e[0:], ext.Block)
+	binary.LittleEndian.PutUint16(e[4:], ext.Len)
+	binary.LittleEndian.PutUint16(e[6:], ext.Start_hi)
+	binary.LittleEndian.PutUint32(e[8:], ext.Start_lo)
+}
+
+// index returns index entry i
+func (n *extentNode) index(i int) ExtentInternal {
+	e := n.entry(i)
+	return ExtentInternal{
+		Block:     binary.LittleEndian.Uint32(e[0:]),
+		Leaf_low:  binary.LittleEndian.Uint32(e[4:]),
+		Leaf_high: binary.LittleEndian.Uint16(e[8:]),
+	}
+}
+
+func (n *extentNode) setIndex(i int, idx ExtentInternal) {
+	e := n.entry(i)
+	binary.LittleEndian.PutUint32(e[0:], idx.Block)
+	binary.LittleEndian.PutUint32(e[4:], idx.Leaf_low)
+	binary.LittleEndian.PutUint16(e[8:], idx.Leaf_high)
+	binary.LittleEndian.PutUint16(e[10:], 0)
+}
+
+func (e Extent) start() int64 {
+	return int64(e.Start_hi)<<32 | int64(e.Start_lo)
+}
+
+// length returns the number of blocks covered by the extent, initialized or not
+func (e Extent) length() int64 {
+	if e.Len > maxInitExtentLen {
+		return int64(e.Len) - maxInitExtentLen
+	}
+	return int64(e.Len)
+}
+
+func (e Extent) uninitialized() bool {
+	return e.Len > maxInitExtentLen
+}
+
+func (idx ExtentInternal) leaf() int64 {
+	return int64(idx.Leaf_high)<<32 | int64(idx.Leaf_low)
+}
+
+// initExtentNode writes an empty node header of the given depth into b
+func initExtentNode(b []byte, depth int) {
+	for i := range b {
+		b[i] = 0
+	}
+	binary.LittleEndian.PutUint16(b[0:], EXT_MAGIC)
+	binary.LittleEndian.PutUint16(b[4:], uint16((len(b)-extentHeaderSize)/extentHeaderSize))
+	binary.LittleEndian.PutUint16(b[6:], uint16(depth))
+}
+
+// extentBlockMax is how many entries fit in an extent tree node of its own block, which leaves
+// room for the checksum tail
+func (sb *Superblock) extentBlockMax() int {
+	return int(sb.GetBlockSize()-extentHeaderSize) / extentHeaderSize
+}
+
+// extentNodeCsum returns the checksum of an extent tree block, covering the header and all
+// entries up to the tail
+func (inode *Inode) extentNodeCsum(b []byte) uint32 {
+	max := int(binary.LittleEndian.Uint16(b[4:]))
+	cs := newMetadataChecksummer(inode.fs.sb)
+	cs.WriteUint32(uint32(inode.num))
+	cs.WriteUint32(inode.Generation)
+	cs.Write(b[:extentHeaderSize*(max+1)])
+	return cs.Get()
+}
+
+// readExtentNode reads the extent tree node in the given block, verifying its checksum
+func (inode *Inode) readExtentNode(block int64) (*extentNode, error) {
+	b, err := inode.fs.readBlock(block)
+	if err != nil {
+		return nil, err
+	}
+	if magic := binary.LittleEndian.Uint16(b[0:]); magic != EXT_MAGIC {
+		return nil, fmt.Errorf("invalid extent header magic %#x in block %d of inode %d", magic, block, inode.num)
+	}
+	n := &extentNode{block: block, b: b}
+	if n.max() > inode.fs.sb.extentBlockMax() || n.entries() > n.max() {
+		return nil, fmt.Errorf("corrupt extent header in block %d of inode %d", block, inode.num)
+	}
+	if inode.fs.sb.FeatureRoCompatMetadata_csum() {
+		tail := extentHeaderSize * (n.max() + 1)
+		if stored, computed := binary.LittleEndian.Uint32(b[tail:]), inode.extentNodeCsum(b); stored != computed {
+			if err := inode.fs.corrupted("extent block", -1, inode.num, block, stored, computed); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// writeExtentNode writes a node back where it belongs, the root into the inode and any other
+// node, with a fresh checksum tail, into its block
+func (inode *Inode) writeExtentNode(n *extentNode) error {
+	if n.block == 0 {
+		copy(inode.BlockOrExtents[:], n.b)
+		inode.UpdateCsumAndWriteback()
+		return nil
+	}
+	if inode.fs.sb.FeatureRoCompatMetadata_csum() {
+		tail := extentHeaderSize * (n.max() + 1)
+		binary.LittleEndian.PutUint32(n.b[tail:], inode.extentNodeCsum(n.b))
+	}
+	return inode.fs.writeBlock(n.block, n.b)
+}
+
+// extentRoot returns the root node of the extent tree of the inode. Its bytes are a copy of
+// i_block, so changes only take effect through writeExtentNode.
+func (inode *Inode) extentRoot() (*extentNode, error) {
+	n := &extentNode{b: make([]byte, len(inode.BlockOrExtents))}
+	copy(n.b, inode.BlockOrExtents[:])
+	if magic := binary.LittleEndian.Uint16(n.b[0:]); magic != EXT_MAGIC {
+		return nil, fmt.Errorf("invalid extent header magic %#x in inode %d", magic, inode.num)
+	}
+	if n.entries() > n.max() || n.max() > 4 {
+		return nil, fmt.Errorf("corrupt extent header in inode %d", inode.num)
+	}
+	return n, nil
+}
+
+// rightmostExtentPath returns the nodes from the root of the extent tree down to its last leaf,
+// following the last index entry at every level
+func (inode *Inode) rightmostExtentPath() ([]*extentNode, error) {
+	root, err := inode.extentRoot()
+	if err != nil {
+		return nil, err
+	}
+	path := []*extentNode{root}
+	for n := root; n.depth() > 0; {
+		if n.entries() == 0 {
+			return nil, fmt.Errorf("empty extent index node at depth %d of inode %d", n.depth(), inode.num)
+		}
+		child, err := inode.readExtentNode(n.index(n.entries() - 1).leaf())
+		if err != nil {
+			return nil, err
+		}
+		if child.depth() != n.depth()-1 {
+			return nil, fmt.Errorf("extent node in block %d of inode %d has depth %d under depth %d", child.block, inode.num, child.depth(), n.depth())
+		}
+		path = append(path, child)
+		n = child
+	}
+	return path, nil
+}
+
+// lookupExtent returns the leaf extent that maps logical block num, if any
+func (inode *Inode) lookupExtent(num int64) (Extent, bool, error) {
+	n, err := inode.extentRoot()
+	if err != nil {
+		return Extent{}, false, err
+	}
+	for {
+		if n.depth() == 0 {
+			for i := 0; i < n.entries(); i++ {
+				e := n.extent(i)
+				if int64(e.Block) <= num && num < int64(e.Block)+e.length() {
+					return e, true, nil
+				}
+			}
+			return Extent{}, false, nil
+		}
+		// the child covering num is the last one starting at or before it
+		child := -1
+		for i := 0; i < n.entries(); i++ {
+			if int64(n.index(i).Block) <= num {
+				child = i
+			}
+		}
+		if child < 0 {
+			return Extent{}, false, nil
+		}
+		depth := n.depth()
+		if n, err = inode.readExtentNode(n.index(child).leaf()); err != nil {
+			return Extent{}, false, err
+		}
+		if n.depth() != depth-1 {
+			return Extent{}, false, fmt.Errorf("extent node in block %d of inode %d has depth %d under depth %d", n.block, inode.num, n.depth(), depth)
+		}
+	}
+}
+
+// extentEnd returns the logical block just past the last extent of the inode
+func (inode *Inode) extentEnd() (int64, error) {
+	path, err := inode.rightmostExtentPath()
+	if err != nil {
+		return 0, err
+	}
+	leaf := path[len(path)-1]
+	if leaf.entries() == 0 {
+		return 0, nil
+	}
+	e := leaf.extent(leaf.entries() - 1)
+	return int64(e.Block) + e.length(), nil
+}
+
+// allocExtentNode allocates a block for a new extent tree node of the inode
+func (inode *Inode) allocExtentNode(depth int) (*extentNode, error) {
+	block, count, err := inode.fs.allocBlocks(inode.dataGoal(), 1)
+	if err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("no space left for extent tree of inode %d", inode.num)
+	}
+	inode.addBlockCount(1)
+	n := &extentNode{block: block, b: make([]byte, inode.fs.sb.GetBlockSize())}
+	initExtentNode(n.b, depth)
+	binary.LittleEndian.PutUint16(n.b[4:], uint16(inode.fs.sb.extentBlockMax()))
+	return n, nil
+}
+
+// appendExtent adds ext to the end of the extent tree of the inode, past all existing extents.
+// It is merged into the last extent when the two are contiguous. Otherwise full nodes get a new
+// sibling to their right, and when the root itself is full the tree grows a level: the root's
+// entries move into a block of their own, to which the root then points.
+func (inode *Inode) appendExtent(ext Extent) error {
+	path, err := inode.rightmostExtentPath()
+	if err != nil {
+		return err
+	}
+	leaf := path[len(path)-1]
+
+	if i := leaf.entries() - 1; i >= 0 {
+		last := leaf.extent(i)
+		if !last.uninitialized() && !ext.uninitialized() &&
+			int64(last.Block)+last.length() == int64(ext.Block) &&
+			last.start()+last.length() == ext.start() &&
+			last.length()+ext.length() <= maxInitExtentLen {
+			last.Len += ext.Len
+			leaf.setExtent(i, last)
+			return inode.writeExtentNode(leaf)
+		}
+	}
+
+	// find the lowest node that has room for one more entry
+	level := len(path) - 1
+	for level >= 0 && path[level].full() {
+		level--
+	}
+	if level < 0 {
+		root := path[0]
+		moved, err := inode.allocExtentNode(root.depth())
+		if err != nil {
+			return err
+		}
+		copy(moved.b[extentHeaderSize:], root.b[extentHeaderSize:extentHeaderSize*(root.entries()+1)])
+		moved.setEntries(root.entries())
+		first := uint32(0)
+		if root.entries() > 0 {
+			first = binary.LittleEndian.Uint32(root.entry(0))
+		}
+		if err := inode.writeExtentNode(moved); err != nil {
+			return err
+		}
+
+		depth := root.depth() + 1
+		initExtentNode(root.b, depth)
+		root.setEntries(1)
+		root.setIndex(0, ExtentInternal{Block: first, Leaf_low: uint32(moved.block), Leaf_high: uint16(moved.block >> 32)})
+		path = append([]*extentNode{root, moved}, path[1:]...)
+		level = 1
+	}
+
+	// below the node with room, start a new branch down to a new, empty leaf
+	for l := level; l < len(path)-1; l++ {
+		n, err := inode.allocExtentNode(path[l].depth() - 1)
+		if err != nil {
+			return err
+		}
+		parent := path[l]
+		parent.setIndex(parent.entries(), ExtentInternal{Block: ext.Block, Leaf_low: uint32(n.block), Leaf_high: uint16(n.block >> 32)})
+		parent.setEntries(parent.entries() + 1)
+		path[l+1] = n
+	}
+
+	leaf = path[len(path)-1]
+	leaf.setExtent(leaf.entries(), ext)
+	leaf.setEntries(leaf.entries() + 1)
+
+	// children first, so that the tree on disk never points at a node not yet written
+	for l := len(path) - 1; l >= level; l-- {
+		if err := inode.writeExtentNode(path[l]); err != nil {
+			return err
+		}
+	}
+	if level > 0 {
+		return inode.writeExtentNode(path[0])
+	}
+	return nil
+}
+
+// slice returns the part of the extent covering logical blocks from up to to, which must lie
+// within it
+func (e Extent) slice(from, to int64) Extent {
+	start := e.start() + from - int64(e.Block)
+	ext := Extent{
+		Block:    uint32(from),
+		Len:      uint16(to - from),
+		Start_hi: uint16(start >> 32),
+		Start_lo: uint32(start),
+	}
+	if e.uninitialized() {
+		ext.Len += maxInitExtentLen
+	}
+	return ext
+}
+
+// walkExtentTree calls leaf with every extent below node n in logical order, and node with the
+// block of every node below n
+func (inode *Inode) walkExtentTree(n *extentNode, leaf func(Extent), node func(int64)) error {
+	for i := 0; i < n.entries(); i++ {
+		if n.depth() == 0 {
+			leaf(n.extent(i))
+			continue
+		}
+		child, err := inode.readExtentNode(n.index(i).leaf())
+		if err != nil {
+			return err
+		}
+		if child.depth() != n.depth()-1 {
+			return fmt.Errorf("extent node in block %d of inode %d has depth %d under depth %d", child.block, inode.num, child.depth(), n.depth())
+		}
+		node(child.block)
+		if err := inode.walkExtentTree(child, leaf, node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extents returns all extents of the inode in logical order
+func (inode *Inode) extents() ([]Extent, error) {
+	root, err := inode.extentRoot()
+	if err != nil {
+		return nil, err
+	}
+	extents := []Extent{}
+	err = inode.walkExtentTree(root, func(e Extent) { extents = append(extents, e) }, func(int64) {})
+	return extents, err
+}
+
+// setExtents replaces the extent tree of the inode with one mapping exactly extents, which must
+// be in logical order. The nodes of the old tree are freed, but not the blocks they map.
+func (inode *Inode) setExtents(extents []Extent) error {
+	root, err := inode.extentRoot()
+	if err != nil {
+		return err
+	}
+	nodes := []blockRange{}
+	if err := inode.walkExtentTree(root, func(Extent) {}, func(b int64) { nodes = appendRange(nodes, b, 1) }); err != nil {
+		return err
+	}
+	if err := inode.fs.freeBlocks(nodes); err != nil {
+		return err
+	}
+	for _, r := range nodes {
+		inode.addBlockCount(-r.count)
+	}
+	inode.setLeafExtents(nil)
+	for _, e := range extents {
+		if err := inode.appendExtent(e); err != nil {
+			return err
+		}
+	}
+	inode.UpdateCsumAndWriteback()
+	return nil
+}
+
+// mapBlocks allocates up to n blocks for the hole at logical block lblk and maps them there, as
+// an uninitialized extent if uninit is set. Inodes without extents get them in their block map. It returns the first block allocated and how many
+// were, which may be fewer than asked for but never more than the hole.
+func (inode *Inode) mapBlocks(lblk, n int64, uninit bool) (int64, int64, error) {
+	if !inode.UsesExtents() {
+		if uninit {
+			return 0, 0, fmt.Errorf("cannot preallocate blocks for inode %d without extents", inode.num)
+		}
+		return inode.mapIndirect(lblk, n)
+	}
+	extents, err := inode.extents()
+	if err != nil {
+		return 0, 0, err
+	}
+	pos := len(extents)
+	for i, e := range extents {
+		if int64(e.Block)+e.length() <= lblk {
+			continue
+		}
+		if int64(e.Block) <= lblk {
+			return 0, 0, fmt.Errorf("block %d of inode %d is already mapped", lblk, inode.num)
+		}
+		if hole := int64(e.Block) - lblk; n > hole {
+			n = hole
+		}
+		pos = i
+		break
+	}
+	max := int64(maxInitExtentLen)
+	if uninit {
+		max--
+	}
+	if n > max {
+		n = max
+	}
+	// the blocks best follow on from those mapped before them
+	goal := inode.dataGoal()
+	if pos > 0 {
+		prev := extents[pos-1]
+		goal = prev.start() + lblk - int64(prev.Block)
+	}
+	blockNum, count, err := inode.fs.allocBlocks(goal, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	if count == 0 {
+		return 0, 0, fmt.Errorf("no space left for inode %d", inode.num)
+	}
+	inode.addBlockCount(count)
+	ext := Extent{
+		Block:    uint32(lblk),
+		Len:      uint16(count),
+		Start_hi: uint16(blockNum >> 32),
+		Start_lo: uint32(blockNum),
+	}
+	if uninit {
+		ext.Len += maxInitExtentLen
+	}
+	if pos == len(extents) {
+		err = inode.appendExtent(ext)
+	} else {
+		extents = append(extents[:pos], append([]Extent{ext}, extents[pos:]...)...)
+		err = inode.setExtents(extents)
+	}
+	return blockNum, count, err
+}
+
+// unmapBlocks removes logical blocks from up to to from the extent tree or block map of the inode
+// and frees them
+func (inode *Inode) unmapBlocks(from, to int64) error {
+	if !inode.UsesExtents() {
+		return inode.unmapIndirect(from, to)
+	}
+	extents, err := inode.extents()
+	if err != nil {
+		return err
+	}
+	kept := []Extent{}
+	freed := []blockRange{}
+	for _, e := range extents {
+		start, end := int64(e.Block), int64(e.Block)+e.length()
+		if end <= from || start >= to {
+			kept = append(kept, e)
+			continue
+		}
+		if start < from {
+			kept = append(kept, e.slice(start, from))
+			start = from
+		}
+		if end > to {
+			kept = append(kept, e.slice(to, end))
+			end = to
+		}
+		freed = appendRange(freed, e.start()+start-int64(e.Block), end-start)
+	}
+	if len(freed) == 0 {
+		return nil
+	}
+	if err := inode.setExtents(kept); err != nil {
+		return err
+	}
+	if err := inode.fs.freeBlocks(freed); err != nil {
+		return err
+	}
+	for _, r := range freed {
+		inode.addBlockCount(-r.count)
+	}
+	inode.UpdateCsumAndWriteback()
+	return nil
+}
+
+// initBlocks marks logical blocks from up to to as initialized where they are part of an
+// uninitialized extent
+func (inode *Inode) initBlocks(from, to int64) error {
+	extents, err := inode.extents()
+	if err != nil {
+		return err
+	}
+	changed := false
+	result := []Extent{}
+	for _, e := range extents {
+		start, end := int64(e.Block), int64(e.Block)+e.length()
+		if !e.uninitialized() || end <= from || start >= to {
+			result = append(result, e)
+			continue
+		}
+		if start < from {
+			result = append(result, e.slice(start, from))
+			start = from
+		}
+		mid := end
+		if mid > to {
+			mid = to
+		}
+		ext := e.slice(start, mid)
+		ext.Len -= maxInitExtentLen
+		result = append(result, ext)
+		if end > to {
+			result = append(result, e.slice(to, end))
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return inode.setExtents(result)
+}
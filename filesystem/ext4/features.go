@@ -0,0 +1,185 @@
+package ext4
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// featureFlags holds the three superblock feature words
+type featureFlags struct {
+	compat   uint32
+	incompat uint32
+	roCompat uint32
+}
+
+type feature struct {
+	name  string
+	flags featureFlags
+}
+
+// featureList maps the feature names used by mke2fs(8) and tune2fs(8) to their superblock bits
+var featureList = []feature{
+	{"dir_prealloc", featureFlags{compat: FEATURE_COMPAT_DIR_PREALLOC}},
+	{"imagic_inodes", featureFlags{compat: FEATURE_COMPAT_IMAGIC_INODES}},
+	{"has_journal", featureFlags{compat: FEATURE_COMPAT_HAS_JOURNAL}},
+	{"ext_attr", featureFlags{compat: FEATURE_COMPAT_EXT_ATTR}},
+	{"resize_inode", featureFlags{compat: FEATURE_COMPAT_RESIZE_INODE}},
+	{"dir_index", featureFlags{compat: FEATURE_COMPAT_DIR_INDEX}},
+	{"sparse_super2", featureFlags{compat: FEATURE_COMPAT_SPARSE_SUPER2}},
+
+	{"sparse_super", featureFlags{roCompat: FEATURE_RO_COMPAT_SPARSE_SUPER}},
+	{"large_file", featureFlags{roCompat: FEATURE_RO_COMPAT_LARGE_FILE}},
+	{"huge_file", featureFlags{roCompat: FEATURE_RO_COMPAT_HUGE_FILE}},
+	{"uninit_bg", featureFlags{roCompat: FEATURE_RO_COMPAT_GDT_CSUM}},
+	{"dir_nlink", featureFlags{roCompat: FEATURE_RO_COMPAT_DIR_NLINK}},
+	{"extra_isize", featureFlags{roCompat: FEATURE_RO_COMPAT_EXTRA_ISIZE}},
+	{"quota", featureFlags{roCompat: FEATURE_RO_COMPAT_QUOTA}},
+	{"bigalloc", featureFlags{roCompat: FEATURE_RO_COMPAT_BIGALLOC}},
+	{"metadata_csum", featureFlags{roCompat: FEATURE_RO_COMPAT_METADATA_CSUM}},
+	{"read-only", featureFlags{roCompat: FEATURE_RO_COMPAT_READONLY}},
+	{"project", featureFlags{roCompat: FEATURE_RO_COMPAT_PROJECT}},
+
+	{"compression", featureFlags{incompat: FEATURE_INCOMPAT_COMPRESSION}},
+	{"filetype", featureFlags{incompat: FEATURE_INCOMPAT_FILETYPE}},
+	{"needs_recovery", featureFlags{incompat: FEATURE_INCOMPAT_RECOVER}},
+	{"journal_dev", featureFlags{incompat: FEATURE_INCOMPAT_JOURNAL_DEV}},
+	{"meta_bg", featureFlags{incompat: FEATURE_INCOMPAT_META_BG}},
+	{"extent", featureFlags{incompat: FEATURE_INCOMPAT_EXTENTS}},
+	{"64bit", featureFlags{incompat: FEATURE_INCOMPAT_64BIT}},
+	{"mmp", featureFlags{incompat: FEATURE_INCOMPAT_MMP}},
+	{"flex_bg", featureFlags{incompat: FEATURE_INCOMPAT_FLEX_BG}},
+	{"ea_inode", featureFlags{incompat: FEATURE_INCOMPAT_EA_INODE}},
+	{"dirdata", featureFlags{incompat: FEATURE_INCOMPAT_DIRDATA}},
+	{"metadata_csum_seed", featureFlags{incompat: FEATURE_INCOMPAT_CSUM_SEED}},
+	{"large_dir", featureFlags{incompat: FEATURE_INCOMPAT_LARGEDIR}},
+	{"inline_data", featureFlags{incompat: FEATURE_INCOMPAT_INLINE_DATA}},
+	{"encrypt", featureFlags{incompat: FEATURE_INCOMPAT_ENCRYPT}},
+	{"casefold", featureFlags{incompat: FEATURE_INCOMPAT_CASEFOLD}},
+}
+
+var (
+	// readFeatures are the incompatible features whose format is understood: a filesystem with
+	// any other cannot be read at all
+	readFeatures = mustParseFeatures("filetype,needs_recovery,meta_bg,extent,64bit,mmp,flex_bg,ea_inode,metadata_csum_seed,large_dir,inline_data,encrypt,casefold")
+	// writeFeatures are the incompatible and read-only compatible features kept consistent when
+	// the filesystem is changed: one with any other can only be read, as if with ReadOnly.
+	// Compatible features stand in the way of neither.
+	writeFeatures = mustParseFeatures("filetype,needs_recovery,meta_bg,extent,64bit,mmp,flex_bg,metadata_csum_seed,large_dir,inline_data,encrypt,casefold," +
+		"sparse_super,large_file,huge_file,uninit_bg,dir_nlink,extra_isize,metadata_csum")
+)
+
+// featureAliases are alternative spellings accepted by e2fsprogs
+var featureAliases = map[string]string{
+	"extents":  "extent",
+	"gdt_csum": "uninit_bg",
+	"largedir": "large_dir",
+}
+
+func lookupFeature(name string) (feature, bool) {
+	if alias, ok := featureAliases[name]; ok {
+		name = alias
+	}
+	for _, f := range featureList {
+		if f.name == name {
+			return f, true
+		}
+	}
+	return feature{}, false
+}
+
+func (f featureFlags) has(o featureFlags) bool {
+	return f.compat&o.compat == o.compat && f.incompat&o.incompat == o.incompat && f.roCompat&o.roCompat == o.roCompat
+}
+
+func (f featureFlags) set(o featureFlags) featureFlags {
+	return featureFlags{compat: f.compat | o.compat, incompat: f.incompat | o.incompat, roCompat: f.roCompat | o.roCompat}
+}
+
+func (f featureFlags) clear(o featureFlags) featureFlags {
+	return featureFlags{compat: f.compat &^ o.compat, incompat: f.incompat &^ o.incompat, roCompat: f.roCompat &^ o.roCompat}
+}
+
+func (f featureFlags) empty() bool {
+	return f.compat == 0 && f.incompat == 0 && f.roCompat == 0
+}
+
+// names returns the sorted names of all known features in f, plus a hex value for any unknown bits
+func (f featureFlags) names() []string {
+	ret := []string{}
+	known := featureFlags{}
+	for _, feat := range featureList {
+		if !feat.flags.empty() && f.has(feat.flags) {
+			ret = append(ret, feat.name)
+			known = known.set(feat.flags)
+		}
+	}
+	unknown := f.clear(known)
+	if unknown.compat != 0 {
+		ret = append(ret, fmt.Sprintf("compat_0x%x", unknown.compat))
+	}
+	if unknown.incompat != 0 {
+		ret = append(ret, fmt.Sprintf("incompat_0x%x", unknown.incompat))
+	}
+	if unknown.roCompat != 0 {
+		ret = append(ret, fmt.Sprintf("ro_compat_0x%x", unknown.roCompat))
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// parseFeatures applies a feature specification in the syntax of mke2fs -O to a starting set
+// of features. The specification is a comma or space separated list of feature names, each
+// optionally prefixed with '^' to clear it rather than set it. The special name "none"
+// clears all features.
+func parseFeatures(spec string, base featureFlags) (featureFlags, error) {
+	ret := base
+	for _, word := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		word = strings.ToLower(word)
+		disable := false
+		switch {
+		case strings.HasPrefix(word, "^"), strings.HasPrefix(word, "-"):
+			disable = true
+			word = word[1:]
+		case strings.HasPrefix(word, "+"):
+			word = word[1:]
+		}
+		if word == "none" {
+			ret = featureFlags{}
+			continue
+		}
+		f, ok := lookupFeature(word)
+		if !ok {
+			return ret, fmt.Errorf("unknown ext4 feature %q", word)
+		}
+		if disable {
+			ret = ret.clear(f.flags)
+		} else {
+			ret = ret.set(f.flags)
+		}
+	}
+	return ret, nil
+}
+
+func (sb *Superblock) features() featureFlags {
+	return featureFlags{compat: sb.Feature_compat, incompat: sb.Feature_incompat, roCompat: sb.Feature_ro_compat}
+}
+
+func (sb *Superblock) setFeatures(f featureFlags) {
+	sb.Feature_compat = f.compat
+	sb.Feature_incompat = f.incompat
+	sb.Feature_ro_compat = f.roCompat
+}
+
+// unreadableFeatures returns the incompatible features of the filesystem not in readFeatures
+func (sb *Superblock) unreadableFeatures() featureFlags {
+	return featureFlags{incompat: sb.Feature_incompat &^ readFeatures.incompat}
+}
+
+// unwritableFeatures returns the incompatible and read-only compatible features of the
+// filesystem not in writeFeatures
+func (sb *Superblock) unwritableFeatures() featureFlags {
+	f := sb.features().clear(writeFeatures)
+	f.compat = 0
+	return f
+}
@@ -0,0 +1,99 @@
+package ext4
+
+import (
+	"path"
+)
+
+// iBlockOffset is where i_block is within an inode
+const iBlockOffset = 0x28
+
+// FileExtent is a run of the bytes of a file and where they are on the device, much like an
+// extent reported by the FIEMAP ioctl
+type FileExtent struct {
+	// Logical is how far into the file the run starts, in bytes
+	Logical int64
+	// Physical is where the run starts on the device the filesystem was read from, in bytes, the
+	// start of the filesystem included; 0 for a hole
+	Physical int64
+	// Length is how many bytes the run covers, whole blocks unless the data is inline
+	Length int64
+	// Unwritten is set for blocks allocated but never written, which read as zeros
+	Unwritten bool
+	// Hole is set for a run with no blocks, which reads as zeros
+	Hole bool
+	// Inline is set for data kept in the inode itself: inline data, or the target of a short
+	// symbolic link. Physical is then where i_block is, which only holds the first 60 bytes of
+	// inline data, the rest being in an extended attribute.
+	Inline bool
+}
+
+// Extents returns where the bytes of the file p are on the device, run by run in logical order,
+// holes included, like the FIEMAP ioctl or filefrag -v do. Each extent of the extent tree is a
+// run of its own; blocks of a block map are gathered into runs where they follow on from one
+// another. The runs go to the end of the file, and past it for blocks allocated beyond.
+// A symbolic link at p is not followed. Devices, FIFOs and sockets have no runs at all.
+func (fs *FileSystem) Extents(p string) ([]FileExtent, error) {
+	inode, err := fs.lookup(path.Clean("/" + p))
+	if err != nil {
+		return nil, err
+	}
+	return inode.fileExtents()
+}
+
+// fileExtents returns the runs of the data of the inode, as Extents does
+func (inode *Inode) fileExtents() ([]FileExtent, error) {
+	fs := inode.fs
+	bs := fs.sb.GetBlockSize()
+	size := inode.GetSize()
+	ret := []FileExtent{}
+	if !inode.hasBlockMap() {
+		if (inode.isInline() || inode.Mode&S_IFMT == S_IFLNK) && size > 0 {
+			ret = append(ret, FileExtent{Physical: fs.start + inode.address + iBlockOffset, Length: size, Inline: true})
+		}
+		return ret, nil
+	}
+
+	end := int64(0)
+	add := func(lblk, count, ptr int64, unwritten bool) {
+		if lblk*bs > end {
+			ret = append(ret, FileExtent{Logical: end, Length: lblk*bs - end, Hole: true})
+		}
+		ret = append(ret, FileExtent{Logical: lblk * bs, Physical: fs.start + ptr*bs, Length: count * bs, Unwritten: unwritten})
+		end = (lblk + count) * bs
+	}
+	if inode.UsesExtents() {
+		extents, err := inode.extents()
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range extents {
+			add(int64(e.Block), e.length(), e.start(), e.uninitialized())
+		}
+	} else {
+		start, ptr, count := int64(0), int64(0), int64(0)
+		for lblk := int64(0); lblk < (size+bs-1)/bs; lblk++ {
+			p, err := inode.indirectBlockPtr(lblk)
+			if err != nil {
+				return nil, err
+			}
+			if count > 0 && (p == 0 || p != ptr+count) {
+				add(start, count, ptr, false)
+				count = 0
+			}
+			if p == 0 {
+				continue
+			}
+			if count == 0 {
+				start, ptr = lblk, p
+			}
+			count++
+		}
+		if count > 0 {
+			add(start, count, ptr, false)
+		}
+	}
+	if last := (size + bs - 1) / bs * bs; last > end {
+		ret = append(ret, FileExtent{Logical: end, Length: last - end, Hole: true})
+	}
+	return ret, nil
+}
@@ -16,6 +16,12 @@ type extFile struct {
 }
 
 func (f *File) Read(p []byte) (n int, err error) {
+	if err := f.reload(); err != nil {
+		return 0, err
+	}
+	if f.inode.isInline() {
+		return f.readInline(p)
+	}
 	//log.Println("read", len(p), f.pos, f.inode.GetSize())
 	blockNum := f.pos / f.fs.sb.GetBlockSize()
 	blockPos := f.pos % f.fs.sb.GetBlockSize()
@@ -33,28 +39,38 @@ func (f *File) Read(p []byte) (n int, err error) {
 	}
 
 	for len > 0 {
-		blockPtr, contiguousBlocks, found := f.inode.GetBlockPtr(blockNum)
+		blockPtr, contiguousBlocks, uninit, found, err := f.inode.blockMapping(blockNum)
 		//log.Printf("blockPtr[%d], contiguousBlocks[%d], found[%v] := f.inode.GetBlockPtr(blockNum[%d])\n",
 		//	blockPtr, contiguousBlocks, found, blockNum)
+		if err != nil {
+			return 0, err
+		}
 
 		if !found {
-			return int(offset), io.ErrUnexpectedEOF
+			// a hole
+			contiguousBlocks = 1
 		}
 
-		f.fs.dev.Seek(f.fs.start+blockPtr*f.fs.sb.GetBlockSize()+blockPos, 0)
-
 		blockReadLen := contiguousBlocks*f.fs.sb.GetBlockSize() - blockPos
 		if blockReadLen > len {
 			blockReadLen = len
 		}
 		//log.Println(len, blockNum, blockPos, blockPtr, blockReadLen, offset)
-		n, err := io.LimitReader(f.fs.dev, blockReadLen).Read(p[offset:])
-		if err != nil {
-			return 0, err
+		n := int(blockReadLen)
+		if !found || uninit {
+			// nothing was ever written there
+			for i := range p[offset : offset+blockReadLen] {
+				p[offset+int64(i)] = 0
+			}
+		} else {
+			n, err = f.fs.dev.ReadAt(p[offset:offset+blockReadLen], f.fs.start+blockPtr*f.fs.sb.GetBlockSize()+blockPos)
+			if err != nil && (err != io.EOF || int64(n) < blockReadLen) {
+				return 0, err
+			}
 		}
 		offset += int64(n)
+		blockNum = (f.pos + offset) / f.fs.sb.GetBlockSize()
 		blockPos = 0
-		blockNum++
 		len -= int64(n)
 	}
 	f.pos += offset
@@ -63,8 +79,50 @@ func (f *File) Read(p []byte) (n int, err error) {
 }
 
 func (f *File) Write(p []byte) (n int, err error) {
+	if f.fs.readOnly() {
+		return 0, f.fs.errReadOnly()
+	}
+	var werr error
+	err = f.fs.transaction(func() error {
+		if err := f.reload(); err != nil {
+			return err
+		}
+		if err := f.inode.checkUnencrypted(); err != nil {
+			return err
+		}
+		// what was written before a failure is kept
+		if n, werr = f.write(p); n > 0 {
+			return nil
+		}
+		return werr
+	})
+	if err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+func (f *File) write(p []byte) (n int, err error) {
 	totalLen := len(p)
 
+	if f.inode.isInline() {
+		if ok, err := f.writeInline(p); ok || err != nil {
+			return totalLen, err
+		}
+		// it has outgrown the inode
+		if err := f.inode.uninline(); err != nil {
+			return 0, err
+		}
+	}
+
+	// on failure, the file covers what was written so far
+	written := func(err error) (int, error) {
+		if f.inode.GetSize() < f.pos {
+			f.inode.SetSize(f.pos)
+		}
+		return totalLen - len(p), err
+	}
+
 	//log.Println("Doing write", totalLen, p)
 
 	for len(p) > 0 {
@@ -73,13 +131,20 @@ func (f *File) Write(p []byte) (n int, err error) {
 
 		//log.Println("Doing write", f.pos, blockNum, blockPos)
 
-		blockPtr, contiguousBlocks, found := f.inode.GetBlockPtr(blockNum)
+		blockPtr, contiguousBlocks, uninit, found, err := f.inode.blockMapping(blockNum)
 		//log.Printf("blockPtr[%d], contiguousBlocks[%d], found[%v] := f.inode.GetBlockPtr(blockNum[%d])\n",
 		//	blockPtr, contiguousBlocks, found, blockNum)
+		if err != nil {
+			return written(err)
+		}
 
 		if !found {
 			//log.Println("Not found, extending")
-			blockPtr, contiguousBlocks = f.inode.AddBlocks((int64(len(p)) + f.inode.fs.sb.GetBlockSize() - 1) / f.inode.fs.sb.GetBlockSize())
+			need := (blockPos + int64(len(p)) + f.inode.fs.sb.GetBlockSize() - 1) / f.inode.fs.sb.GetBlockSize()
+			blockPtr, contiguousBlocks, err = f.inode.mapBlocks(blockNum, need, false)
+			if err != nil {
+				return written(err)
+			}
 		}
 
 		//log.Println(blockNum, blockPos, blockPtr, contiguousBlocks, len(p))
@@ -87,26 +152,44 @@ func (f *File) Write(p []byte) (n int, err error) {
 
 		if writable == 0 {
 			//log.Fatalf("panic")
-			return 0, fmt.Errorf(`no space to write`)
+			return written(fmt.Errorf(`no space to write`))
 		}
 
 		if writable > int64(len(p)) {
 			writable = int64(len(p))
 		}
 
-		f.pos += writable
+		if uninit || !found {
+			// the blocks are about to hold data, what the write leaves of them must be zeros
+			if err := f.zeroAround(blockPtr, blockPos, writable); err != nil {
+				return written(err)
+			}
+		}
+		if uninit {
+			n := (blockPos + writable + f.fs.sb.GetBlockSize() - 1) / f.fs.sb.GetBlockSize()
+			if err := f.inode.initBlocks(blockNum, blockNum+n); err != nil {
+				return written(err)
+			}
+		}
 
 		//log.Println("seek", f.fs.start+blockPtr*f.fs.sb.GetBlockSize()+blockPos, "write", writable)
-		f.fs.dev.Seek(f.fs.start+blockPtr*f.fs.sb.GetBlockSize()+blockPos, 0)
-		n, err := f.fs.dev.Write(p[:writable])
+		// directory blocks are metadata and go through the journal, file contents do not
+		offset := f.fs.start + blockPtr*f.fs.sb.GetBlockSize() + blockPos
+		var n int
+		if f.inode.Mode&S_IFMT == S_IFDIR {
+			n, err = f.fs.dev.WriteAt(p[:writable], offset)
+		} else {
+			n, err = f.fs.writeData(p[:writable], offset)
+		}
+		f.pos += int64(n)
+		p = p[n:]
 		if err != nil {
-			return n, err
+			return written(err)
 		}
-		p = p[writable:]
 	}
 
 	if f.inode.GetSize() < f.pos {
-		f.inode.SetSize(f.inode.GetSize() + int64(totalLen))
+		f.inode.SetSize(f.pos)
 	}
 	//log.Println("Write complete")
 
@@ -114,6 +197,9 @@ func (f *File) Write(p []byte) (n int, err error) {
 }
 
 func (f *File) Seek(offset int64, whence int) (ret int64, err error) {
+	if err := f.reload(); err != nil {
+		return 0, err
+	}
 	switch whence {
 	case 0:
 		f.pos = offset
@@ -132,6 +218,206 @@ func (f *File) Seek(offset int64, whence int) (ret int64, err error) {
 	}
 }
 
+// Truncate changes the size of the file. Blocks past the new end are freed, and the file grows
+// as a hole that reads as zeros.
+func (f *File) Truncate(size int64) error {
+	if size < 0 {
+		return fmt.Errorf("invalid size %d", size)
+	}
+	return f.change(func() error {
+		inode := f.inode
+		bs := f.fs.sb.GetBlockSize()
+		if inode.isInline() {
+			if ok, err := f.truncateInline(size); ok || err != nil {
+				return err
+			}
+			if err := inode.uninline(); err != nil {
+				return err
+			}
+		}
+		if size < inode.GetSize() {
+			// what is left of the last block must read as zeros should the file grow again
+			if err := f.zeroRange(size, (size+bs-1)/bs*bs); err != nil {
+				return err
+			}
+			if err := inode.unmapBlocks((size+bs-1)/bs, 1<<32); err != nil {
+				return err
+			}
+		}
+		inode.SetSize(size)
+		return nil
+	})
+}
+
+// PunchHole frees the blocks holding bytes off to off+length of the file, which read as zeros
+// afterwards. The size of the file does not change.
+func (f *File) PunchHole(off, length int64) error {
+	if off < 0 || length <= 0 {
+		return fmt.Errorf("invalid range of %d bytes at %d", length, off)
+	}
+	return f.change(func() error {
+		inode := f.inode
+		bs := f.fs.sb.GetBlockSize()
+		end := off + length
+		if size := inode.GetSize(); end >= size {
+			end = size
+			if off >= end {
+				return nil
+			}
+			// the last block goes entirely, nothing past the end of the file is read
+			end = (end + bs - 1) / bs * bs
+		}
+		if inode.isInline() {
+			return f.zeroRange(off, end)
+		}
+		// whole blocks are freed, the rest is zeroed
+		first, last := (off+bs-1)/bs, end/bs
+		if first >= last {
+			return f.zeroRange(off, end)
+		}
+		if err := f.zeroRange(off, first*bs); err != nil {
+			return err
+		}
+		if err := f.zeroRange(last*bs, end); err != nil {
+			return err
+		}
+		return inode.unmapBlocks(first, last)
+	})
+}
+
+// Fallocate allocates blocks for bytes off to off+length of the file wherever it has none. They
+// are mapped by uninitialized extents, reading as zeros until written. The file grows to cover
+// the range.
+func (f *File) Fallocate(off, length int64) error {
+	if off < 0 || length <= 0 {
+		return fmt.Errorf("invalid range of %d bytes at %d", length, off)
+	}
+	return f.change(func() error {
+		inode := f.inode
+		bs := f.fs.sb.GetBlockSize()
+		if inode.isInline() {
+			if err := inode.uninline(); err != nil {
+				return err
+			}
+		}
+		if !inode.UsesExtents() {
+			// there is no way to mark blocks in a block map as not yet written
+			return fmt.Errorf("cannot preallocate blocks for inode %d without extents", inode.num)
+		}
+		end := (off + length + bs - 1) / bs
+		for lblk := off / bs; lblk < end; {
+			_, count, _, found, err := inode.blockMapping(lblk)
+			if err != nil {
+				return err
+			}
+			if !found {
+				if _, count, err = inode.mapBlocks(lblk, end-lblk, true); err != nil {
+					return err
+				}
+			}
+			lblk += count
+		}
+		if off+length > inode.GetSize() {
+			inode.SetSize(off + length)
+		}
+		return nil
+	})
+}
+
+// change runs fn as a transaction changing the file, and updates its modification time
+func (f *File) change(fn func() error) error {
+	if f.fs.readOnly() {
+		return f.fs.errReadOnly()
+	}
+	return f.fs.transaction(func() error {
+		if err := f.reload(); err != nil {
+			return err
+		}
+		if err := f.inode.checkUnencrypted(); err != nil {
+			return err
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		f.inode.touch(timeModify, timeChange)
+		f.inode.UpdateCsumAndWriteback()
+		return nil
+	})
+}
+
+// reload reads the inode of the file again, so that what was changed since it was opened, by
+// path or through another handle, is not undone when the inode is written back
+func (f *File) reload() error {
+	inode, err := f.fs.readInode(f.inode.num)
+	if err != nil {
+		return err
+	}
+	if inode.Links_count == 0 {
+		return fmt.Errorf("inode %d of the file was removed", inode.num)
+	}
+	f.inode = inode
+	return nil
+}
+
+// zeroRange overwrites bytes from up to to of the file with zeros where they are stored in the
+// file, leaving holes and uninitialized extents alone
+func (f *File) zeroRange(from, to int64) error {
+	if from >= to {
+		return nil
+	}
+	if f.inode.isInline() {
+		data, err := f.inode.inlineData()
+		if err != nil {
+			return err
+		}
+		for i := from; i < to && i < int64(len(data)); i++ {
+			data[i] = 0
+		}
+		if err := f.inode.setInlineData(data); err != nil {
+			return err
+		}
+		f.inode.UpdateCsumAndWriteback()
+		return nil
+	}
+	bs := f.fs.sb.GetBlockSize()
+	for from < to {
+		lblk, pos := from/bs, from%bs
+		n := bs - pos
+		if n > to-from {
+			n = to - from
+		}
+		ptr, _, uninit, found, err := f.inode.blockMapping(lblk)
+		if err != nil {
+			return err
+		}
+		if found && !uninit && ptr != 0 {
+			if _, err := f.fs.writeData(make([]byte, n), f.fs.start+ptr*bs+pos); err != nil {
+				return err
+			}
+		}
+		from += n
+	}
+	return nil
+}
+
+// zeroAround zeroes the parts of the blocks from ptr that a write of n bytes at pos within them
+// leaves untouched
+func (f *File) zeroAround(ptr, pos, n int64) error {
+	bs := f.fs.sb.GetBlockSize()
+	start := f.fs.start + ptr*bs
+	if pos > 0 {
+		if _, err := f.fs.writeData(make([]byte, pos), start); err != nil {
+			return err
+		}
+	}
+	if end := pos + n; end%bs != 0 {
+		if _, err := f.fs.writeData(make([]byte, bs-end%bs), start+end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Close close the file
 func (f *File) Close() error {
 	f.fs = nil
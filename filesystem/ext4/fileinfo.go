@@ -13,6 +13,7 @@ type FileInfo struct {
 	name      string
 	size      int64
 	isDir     bool
+	stat      StatT
 }
 
 // IsDir abbreviation for Mode().IsDir()
@@ -40,7 +41,32 @@ func (fi FileInfo) Size() int64 {
 	return fi.size
 }
 
-// Sys underlying data source - not supported yet and so will return nil
+// Sys returns a *StatT with the owner, timestamps and other details of the inode
 func (fi FileInfo) Sys() interface{} {
-	return nil
+	return &fi.stat
+}
+
+// fileInfo returns the FileInfo of the inode, found under the given name
+func (inode *Inode) fileInfo(name string) FileInfo {
+	stat := StatT{
+		Ino:    uint64(inode.num),
+		Nlink:  uint32(inode.Links_count),
+		Uid:    inode.uid(),
+		Gid:    inode.gid(),
+		Atime:  inode.getTime(timeAccess),
+		Mtime:  inode.getTime(timeModify),
+		Ctime:  inode.getTime(timeChange),
+		Crtime: inode.getTime(timeCreate),
+	}
+	if t := inode.Mode & S_IFMT; t == S_IFCHR || t == S_IFBLK {
+		stat.Rdev = inode.device()
+	}
+	return FileInfo{
+		modTime: stat.Mtime,
+		mode:    fileMode(inode.Mode),
+		name:    name,
+		size:    inode.GetSize(),
+		isDir:   inode.Mode&S_IFMT == S_IFDIR,
+		stat:    stat,
+	}
 }
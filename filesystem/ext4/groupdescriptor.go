@@ -1,8 +1,11 @@
 package ext4
 
 import (
-	"github.com/lunixbochs/struc"
+	"bytes"
+	"encoding/binary"
 	"math/bits"
+
+	"github.com/lunixbochs/struc"
 )
 
 type GroupDescriptor struct {
@@ -32,7 +35,7 @@ type GroupDescriptor struct {
 	fs                   *FileSystem
 	num                  int64
 	address              int64
-};
+}
 
 func (bgd *GroupDescriptor) GetInodeBitmapLoc() int64 {
 	if bgd.fs.sb.FeatureIncompat64bit() {
@@ -59,51 +62,38 @@ func (bgd *GroupDescriptor) GetBlockBitmapLoc() int64 {
 }
 
 func (bgd *GroupDescriptor) UpdateCsumAndWriteback() {
-	if bgd.fs.sb.Checksum_type == 0 {
-		return
-	}
-
-	cs := NewChecksummer(bgd.fs.sb)
-
-	cs.Write(bgd.fs.sb.Uuid[:])
-	cs.WriteUint32(uint32(bgd.num))
-	bgd.Checksum = 0
-	struc.Pack(cs, bgd)
-	bgd.Checksum = uint16(cs.Get() & 0xFFFF)
-
-	bgd.fs.dev.Seek(bgd.fs.start + bgd.address, 0)
-	struc.Pack(bgd.fs.dev, bgd)
+	bgd.fs.dev.WriteAt(bgd.toBytes(), bgd.fs.start+bgd.address)
 }
 
-func(bgd *GroupDescriptor) GetFreeInode() *Inode {
-	start := bgd.GetInodeBitmapLoc() * bgd.fs.sb.GetBlockSize()
-	bgd.fs.dev.Seek(bgd.fs.start + start, 0)
+func (bgd *GroupDescriptor) GetFreeInode() *Inode {
+	sb := bgd.fs.sb
+	ipg := int64(sb.InodePer_group)
+	bitmapLoc := bgd.GetInodeBitmapLoc()
+
+	var bitmap []byte
+	if bgd.Flags&BG_INODE_UNINIT != 0 {
+		// an uninitialized bitmap has no inodes in use, only the padding past the end of the group
+		bitmap = make([]byte, sb.GetBlockSize())
+		for i := ipg; i < int64(len(bitmap))*8; i++ {
+			bitmap[i/8] |= 1 << uint(i%8)
+		}
+		bgd.Flags &^= BG_INODE_UNINIT
+	} else {
+		var err error
+		bitmap, err = bgd.fs.readBlock(bitmapLoc)
+		if err != nil {
+			return nil
+		}
+	}
 
+	// Find free inode in bitmap
 	subInodeNum := int64(-1)
-
-	if bgd.Flags & BG_INODE_UNINIT != 0 {
-		b := make([]byte, bgd.fs.sb.InodePer_group/8)
-		b[0] = 1
-		bgd.fs.dev.Write(b)
-
-		bgd.Flags &= 0xFFFF ^ BG_INODE_UNINIT
-		bgd.UpdateCsumAndWriteback()
-
-		subInodeNum = 0
-	} else {
-		// Find free inode in bitmap
-		for i := 0; i < int(bgd.fs.sb.InodePer_group/8); i++ {
-			b := make([]byte, 1)
-			bgd.fs.dev.Read(b)
-			if b[0] != 0xFF {
-				//log.Println("free at ", bgd.num, start, i)
-				bitNum := bits.TrailingZeros8(^b[0])
-				subInodeNum = int64(i)*8 + int64(bitNum)
-				b[0] |= 1 << uint(bitNum)
-				bgd.fs.dev.Seek(-1, 1)
-				bgd.fs.dev.Write(b)
-				break
-			}
+	for i := int64(0); i < ipg/8; i++ {
+		if bitmap[i] != 0xFF {
+			bitNum := bits.TrailingZeros8(^bitmap[i])
+			subInodeNum = i*8 + int64(bitNum)
+			bitmap[i] |= 1 << uint(bitNum)
+			break
 		}
 	}
 
@@ -112,134 +102,250 @@ func(bgd *GroupDescriptor) GetFreeInode() *Inode {
 		return nil
 	}
 
-	if bgd.Flags & BG_INODE_ZEROED == 0 {
-		bgd.fs.dev.Seek(bgd.fs.start + bgd.GetInodeTableLoc() * bgd.fs.sb.GetBlockSize(), 0)
-		bgd.fs.dev.Write(make([]byte, int64(bgd.fs.sb.InodePer_group) / int64(bgd.fs.sb.Inode_size)))
+	tableLoc := bgd.GetInodeTableLoc() * sb.GetBlockSize()
+	firstUnused := ipg - bgd.GetItableUnused()
+	if bgd.Flags&BG_INODE_ZEROED == 0 {
+		// only the part of the table past the inodes ever used can be left over garbage; it is
+		// not worth journaling, as nothing refers to it yet
+		size := (ipg - firstUnused) * int64(sb.Inode_size)
+		if _, err := bgd.fs.writeData(make([]byte, size), bgd.fs.start+tableLoc+firstUnused*int64(sb.Inode_size)); err != nil {
+			return nil
+		}
 		bgd.Flags |= BG_INODE_ZEROED
-		bgd.UpdateCsumAndWriteback()
+	}
+	if subInodeNum >= firstUnused {
+		bgd.setItableUnused(ipg - subInodeNum - 1)
 	}
 
-	// Update inode bitmap checksum
-	checksummer := NewChecksummer(bgd.fs.sb)
-	checksummer.Write(bgd.fs.sb.Uuid[:])
-	bgd.fs.dev.Seek(bgd.fs.start + start, 0)
-	b := make([]byte, int64(bgd.fs.sb.InodePer_group) / 8)
-	bgd.fs.dev.Read(b)
-	checksummer.Write(b)
-	bgd.Inode_bitmap_csum_lo = uint16(checksummer.Get() & 0xFFFF)
-	bgd.Inode_bitmap_csum_hi = uint16(checksummer.Get() >> 16)
-
-	bgd.Free_inodes_count_lo--
-	bgd.Itable_unused_lo--
+	if err := bgd.fs.writeBlock(bitmapLoc, bitmap); err != nil {
+		return nil
+	}
+	if bgd.Flags&BG_BLOCK_UNINIT != 0 {
+		// like the kernel, a group with inodes in use has its block bitmap set up too
+		blocks := bgd.initBlockBitmap()
+		if err := bgd.fs.writeBlock(bgd.GetBlockBitmapLoc(), blocks); err != nil {
+			return nil
+		}
+		bgd.setBlockBitmapCsum(blocks)
+		bgd.Flags &^= BG_BLOCK_UNINIT
+	}
+	bgd.setInodeBitmapCsum(bitmap)
+	bgd.setFreeInodesCount(bgd.GetFreeInodesCount() - 1)
 	bgd.UpdateCsumAndWriteback()
 
-	bgd.fs.sb.Free_inodeCount--
-	bgd.fs.sb.UpdateCsumAndWriteback()
+	sb.Free_inodeCount--
+	sb.UpdateCsumAndWriteback()
 
 	// Insert in Inode table
 	inode := &Inode{
-		Mode: 0,
+		Mode:        0,
 		Links_count: 1,
-		Flags: EXTENTS_FL, //0x80000//524288, InodeFlagExtents
-		BlockOrExtents: [60]byte{0x0a, 0xf3, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00},
-		fs: bgd.fs,
-		address: bgd.GetInodeTableLoc() * bgd.fs.sb.GetBlockSize() + subInodeNum * int64(bgd.fs.sb.Inode_size),
-		num: 1 + bgd.num * int64(bgd.fs.sb.InodePer_group) + subInodeNum,
+		fs:          bgd.fs,
+		address:     tableLoc + subInodeNum*int64(sb.Inode_size),
+		num:         1 + bgd.num*ipg + subInodeNum,
+	}
+	// like the kernel, new inodes have the extra fields wanted, for timestamps to the nanosecond
+	if sb.Inode_size > 128 {
+		inode.Extra_isize = sb.Want_extra_isize
+	}
+	// without the extents feature, as on ext2 and ext3, i_block is an empty block map
+	if sb.FeatureIncompatExtents() {
+		inode.Flags = EXTENTS_FL
+		inode.setLeafExtents(nil)
 	}
 	inode.UpdateCsumAndWriteback()
 
 	return inode
 }
 
-func (bgd *GroupDescriptor) setBitRange(offset int64, start int64, n int64) {
-	if start < 0 || start > int64(bgd.fs.sb.BlockPer_group) {
-		return
+// initBlockBitmap builds the block bitmap of a group still flagged BLOCK_UNINIT, in which only the
+// group's own metadata is in use. Each bit stands for a cluster.
+func (bgd *GroupDescriptor) initBlockBitmap() []byte {
+	sb := bgd.fs.sb
+	blockSize := sb.GetBlockSize()
+	first := sb.groupFirstBlock(bgd.num)
+	bits := sb.clusterBits()
+	bitmap := make([]byte, blockSize)
+	mark := func(b, n int64) {
+		for i := b - first; i < b-first+n; i++ {
+			if c := i >> bits; i >= 0 && c < int64(sb.ClusterPer_group) {
+				bitmap[c/8] |= 1 << uint(c%8)
+			}
+		}
 	}
 
-	n = (n + bgd.fs.sb.GetBlockSize() - 1) / bgd.fs.sb.GetBlockSize()
-	for i := start; i < start + n; i++ {
-		b := make([]byte, 1)
-		bgd.fs.dev.Seek(bgd.fs.start + offset + i / 8, 0)
-		bgd.fs.dev.Read(b)
-		b[0] |= 1 << uint(i % 8)
-		bgd.fs.dev.Seek(-1, 1)
-		bgd.fs.dev.Write(b)
+	for _, r := range bgd.metadataBlocks() {
+		mark(r.start, r.count)
 	}
-	bgd.Free_blocks_count_lo-=uint16(n)
+	// with flex_bg the group may hold the bitmaps and inode tables of the others in its flex group
+	if unit := sb.allocUnit(); unit > 1 {
+		leader := bgd.num - bgd.num%unit
+		for g := leader; g < leader+unit && g < sb.BlockGroupCount(); g++ {
+			if g == bgd.num {
+				continue
+			}
+			for _, r := range bgd.fs.getBlockGroupDescriptor(g).metadataBlocks() {
+				mark(r.start, r.count)
+			}
+		}
+	}
+
+	// the padding past the end of the group, or of the filesystem for the last group
+	for i := sb.groupClusters(bgd.num); i < blockSize*8; i++ {
+		bitmap[i/8] |= 1 << uint(i%8)
+	}
+	return bitmap
 }
 
-func (bgd *GroupDescriptor) GetFreeBlocks(n int64) (int64, int64) {
-	// Find free block in bitmap
-	start := bgd.GetBlockBitmapLoc() * bgd.fs.sb.GetBlockSize()
+// metadataBlocks returns the blocks of the filesystem metadata belonging to the group: the
+// copy of the superblock and group descriptors if it has one, its bitmaps and inode table,
+// which with flex_bg may be in another group, and the MMP block if it is in the group
+func (bgd *GroupDescriptor) metadataBlocks() []blockRange {
+	sb := bgd.fs.sb
+	blockSize := sb.GetBlockSize()
+	ranges := []blockRange{}
+	if n := sb.groupSuperBlocks(bgd.num); n > 0 {
+		ranges = appendRange(ranges, sb.groupFirstBlock(bgd.num), n)
+	}
+	ranges = appendRange(ranges, bgd.GetBlockBitmapLoc(), 1)
+	ranges = appendRange(ranges, bgd.GetInodeBitmapLoc(), 1)
+	ranges = appendRange(ranges, bgd.GetInodeTableLoc(), (int64(sb.InodePer_group)*int64(sb.Inode_size)+blockSize-1)/blockSize)
+	if mmp := int64(sb.Mmp_block); sb.FeatureIncompatMmp() && mmp >= sb.groupFirstBlock(bgd.num) && mmp < sb.groupFirstBlock(bgd.num+1) {
+		ranges = appendRange(ranges, mmp, 1)
+	}
+	return ranges
+}
 
-	if bgd.Flags & BG_BLOCK_UNINIT != 0 {
-		bgd.fs.dev.Seek(bgd.fs.start + start, 0)
-		bgd.fs.dev.Write(make([]byte, bgd.fs.sb.BlockPer_group/8))
-		bgd.Free_blocks_count_lo = uint16(bgd.fs.sb.BlockPer_group)
+// GetFreeBlocks allocates the first run of up to n free blocks in the group, returning the
+// number of the first block and the length of the run, which is 0 if the group is full
+func (bgd *GroupDescriptor) GetFreeBlocks(n int64) (int64, int64) {
+	bitmap, err := bgd.blockBitmap()
+	if err != nil {
+		return 0, 0
+	}
+	start := freeRun(bitmap, 0, int64(bgd.fs.sb.BlockPer_group), 1)
+	if start < 0 {
+		return 0, 0
+	}
+	blockNum, count, err := bgd.takeBlocks(bitmap, start, n)
+	if err != nil {
+		return 0, 0
+	}
+	return blockNum, count
+}
 
-		numBlockGroups := bgd.fs.sb.BlockGroupCount()
-		if !bgd.fs.sb.FeatureRoCompatSparse_super() || bgd.num <= 1 || bgd.num % 3 == 0 || bgd.num % 5 == 0 || bgd.num % 7 == 0 {
-			bgd.setBitRange(start, 0, bgd.fs.sb.GetBlockSize()+(numBlockGroups*32)+int64(bgd.fs.sb.Reserved_gdt_blocks)*bgd.fs.sb.GetBlockSize())
-		}
-		bgd.setBitRange(start, bgd.GetInodeBitmapLoc() - bgd.num * int64(bgd.fs.sb.BlockPer_group) * bgd.fs.sb.GetBlockSize(), int64(bgd.fs.sb.InodePer_group)/8)
-		bgd.setBitRange(start, bgd.GetBlockBitmapLoc() - bgd.num * int64(bgd.fs.sb.BlockPer_group) * bgd.fs.sb.GetBlockSize(), int64(bgd.fs.sb.BlockPer_group)/8)
-		bgd.setBitRange(start, bgd.GetInodeTableLoc() - bgd.num * int64(bgd.fs.sb.BlockPer_group) * bgd.fs.sb.GetBlockSize(), int64(bgd.fs.sb.Inode_size)*int64(bgd.fs.sb.InodePer_group)/8)
-		bgd.UpdateCsumAndWriteback()
-
-		blocksFree := int64(0)
-		for i := int64(0); i < numBlockGroups; i++ {
-			blocksFree += int64(bgd.fs.getBlockGroupDescriptor(i).Free_blocks_count_lo)
+// toBytes serializes the descriptor into its on-disk form of sb.descSize() bytes, computing the
+// metadata_csum or uninit_bg checksum when enabled
+func (bgd *GroupDescriptor) toBytes() []byte {
+	sb := bgd.fs.sb
+	buf := new(bytes.Buffer)
+	bgd.Checksum = 0
+	struc.Pack(buf, bgd)
+	b := make([]byte, sb.descSize())
+	copy(b, buf.Bytes())
+
+	num := make([]byte, 4)
+	binary.LittleEndian.PutUint32(num, uint32(bgd.num))
+	switch {
+	case sb.FeatureRoCompatMetadata_csum():
+		cs := newMetadataChecksummer(sb)
+		cs.Write(num)
+		cs.Write(b)
+		bgd.Checksum = uint16(cs.Get() & 0xFFFF)
+	case sb.FeatureRoCompatGdt_csum():
+		crc := crc16(0xFFFF, sb.Uuid[:])
+		crc = crc16(crc, num)
+		crc = crc16(crc, b[:0x1E])
+		if len(b) > 0x20 {
+			crc = crc16(crc, b[0x20:])
 		}
+		bgd.Checksum = crc
+	}
+	binary.LittleEndian.PutUint16(b[0x1E:], bgd.Checksum)
+	return b
+}
 
-		bgd.fs.sb.Free_blockCount_lo = uint32(blocksFree)
-		bgd.fs.sb.UpdateCsumAndWriteback()
+// bitmapCsum returns the crc32c of a block or inode bitmap of n bytes as used by metadata_csum
+func (sb *Superblock) bitmapCsum(bitmap []byte) uint32 {
+	cs := newMetadataChecksummer(sb)
+	cs.Write(bitmap)
+	return cs.Get()
+}
 
-		bgd.Flags &= 0xFFFF ^ BG_BLOCK_UNINIT
-		bgd.UpdateCsumAndWriteback()
+// setBlockBitmapCsum records the checksum of the given block bitmap in the descriptor
+func (bgd *GroupDescriptor) setBlockBitmapCsum(bitmap []byte) {
+	sb := bgd.fs.sb
+	if !sb.FeatureRoCompatMetadata_csum() {
+		return
 	}
-
-	subBlockNum := int64(-1)
-	bgd.fs.dev.Seek(bgd.fs.start + start, 0)
-	for i := 0; i < int(bgd.fs.sb.BlockPer_group/8); i++ {
-		b := make([]byte, 1)
-		bgd.fs.dev.Read(b)
-		if b[0] != 0xFF {
-			bitNum := bits.TrailingZeros8(^b[0])
-			numFree := bits.TrailingZeros8(uint8((uint16(b[0]) | 0x100) >> uint(bitNum)))
-			//log.Println(bgd.num, i, b[0], bitNum, numFree, n)
-			if n > int64(numFree) {
-				n = int64(numFree)
-			}
-			subBlockNum = int64(i)*8 + int64(bitNum)
-			b[0] |= (1 << uint(bitNum+int(n))) - 1
-			//log.Println("Found free blocks. GD", bgd.num, subBlockNum, bitNum, b[0], n)
-			bgd.fs.dev.Seek(-1, 1)
-			bgd.fs.dev.Write(b)
-			break
-		}
+	crc := sb.bitmapCsum(bitmap[:sb.ClusterPer_group/8])
+	bgd.Block_bitmap_csum_lo = uint16(crc)
+	if sb.descSize() >= 64 {
+		bgd.Block_bitmap_csum_hi = uint16(crc >> 16)
 	}
+}
 
-	if subBlockNum < 0 {
-		return 0, 0
+// setInodeBitmapCsum records the checksum of the given inode bitmap in the descriptor
+func (bgd *GroupDescriptor) setInodeBitmapCsum(bitmap []byte) {
+	sb := bgd.fs.sb
+	if !sb.FeatureRoCompatMetadata_csum() {
+		return
 	}
+	crc := sb.bitmapCsum(bitmap[:sb.InodePer_group/8])
+	bgd.Inode_bitmap_csum_lo = uint16(crc)
+	if sb.descSize() >= 64 {
+		bgd.Inode_bitmap_csum_hi = uint16(crc >> 16)
+	}
+}
 
-	// Update block bitmap checksum
-	checksummer := NewChecksummer(bgd.fs.sb)
-	checksummer.Write(bgd.fs.sb.Uuid[:])
-	bgd.fs.dev.Seek(bgd.fs.start + start, 0)
-	b := make([]byte, int64(bgd.fs.sb.ClusterPer_group) / 8)
-	bgd.fs.dev.Read(b)
-	checksummer.Write(b)
-	bgd.Block_bitmap_csum_lo = uint16(checksummer.Get() & 0xFFFF)
-	bgd.Block_bitmap_csum_hi = uint16(checksummer.Get() >> 16)
+func (bgd *GroupDescriptor) setBlockBitmapLoc(n int64) {
+	bgd.Block_bitmap_lo = uint32(n)
+	bgd.Block_bitmap_hi = uint32(n >> 32)
+}
 
-	newFreeBlocks := ((uint32(bgd.Free_blocks_count_hi) << 16) | uint32(bgd.Free_blocks_count_lo)) - uint32(n)
-	bgd.Free_blocks_count_hi = uint16(newFreeBlocks >> 16)
-	bgd.Free_blocks_count_lo = uint16(newFreeBlocks)
-	bgd.UpdateCsumAndWriteback()
+func (bgd *GroupDescriptor) setInodeBitmapLoc(n int64) {
+	bgd.Inode_bitmap_lo = uint32(n)
+	bgd.Inode_bitmap_hi = uint32(n >> 32)
+}
 
-	bgd.fs.sb.Free_blockCount_lo-=uint32(n)
-	bgd.fs.sb.UpdateCsumAndWriteback()
+func (bgd *GroupDescriptor) setInodeTableLoc(n int64) {
+	bgd.Inode_table_lo = uint32(n)
+	bgd.Inode_table_hi = uint32(n >> 32)
+}
 
-	return bgd.address / bgd.fs.sb.GetBlockSize() + subBlockNum - 1, n
-}
\ No newline at end of file
+// GetFreeBlocksCount returns the number of free blocks of the group, clusters with bigalloc
+func (bgd *GroupDescriptor) GetFreeBlocksCount() int64 {
+	return (int64(bgd.Free_blocks_count_hi) << 16) | int64(bgd.Free_blocks_count_lo)
+}
+
+func (bgd *GroupDescriptor) setFreeBlocksCount(n int64) {
+	bgd.Free_blocks_count_lo = uint16(n)
+	bgd.Free_blocks_count_hi = uint16(n >> 16)
+}
+
+func (bgd *GroupDescriptor) GetFreeInodesCount() int64 {
+	return (int64(bgd.Free_inodes_count_hi) << 16) | int64(bgd.Free_inodes_count_lo)
+}
+
+func (bgd *GroupDescriptor) setFreeInodesCount(n int64) {
+	bgd.Free_inodes_count_lo = uint16(n)
+	bgd.Free_inodes_count_hi = uint16(n >> 16)
+}
+
+func (bgd *GroupDescriptor) GetUsedDirsCount() int64 {
+	return (int64(bgd.Used_dirs_count_hi) << 16) | int64(bgd.Used_dirs_count_lo)
+}
+
+func (bgd *GroupDescriptor) setUsedDirsCount(n int64) {
+	bgd.Used_dirs_count_lo = uint16(n)
+	bgd.Used_dirs_count_hi = uint16(n >> 16)
+}
+
+func (bgd *GroupDescriptor) GetItableUnused() int64 {
+	return (int64(bgd.Itable_unused_hi) << 16) | int64(bgd.Itable_unused_lo)
+}
+
+func (bgd *GroupDescriptor) setItableUnused(n int64) {
+	bgd.Itable_unused_lo = uint16(n)
+	bgd.Itable_unused_hi = uint16(n >> 16)
+}
@@ -0,0 +1,184 @@
+package ext4
+
+import (
+	"fmt"
+	"math/bits"
+)
+
+// defaultHashSeed is used in place of a hash seed that is all zero
+var defaultHashSeed = [4]uint32{0x67452301, 0xefcdab89, 0x98badcfe, 0x10325476}
+
+// dxHash computes the major and minor hash of a directory entry name as used by hashed directory
+// indexes. The lowest bit of the major hash is always clear, as it marks hash collisions in the
+// index.
+func dxHash(name []byte, version uint8, seed [4]uint32) (uint32, uint32, error) {
+	buf := defaultHashSeed
+	if seed != [4]uint32{} {
+		buf = seed
+	}
+
+	var hash, minor uint32
+	unsigned := false
+	switch version {
+	case HASH_LEGACY_UNSIGNED:
+		unsigned = true
+		fallthrough
+	case HASH_LEGACY:
+		hash = dxHackHash(name, unsigned)
+	case HASH_HALF_MD4_UNSIGNED:
+		unsigned = true
+		fallthrough
+	case HASH_HALF_MD4:
+		in := make([]uint32, 8)
+		for p := name; len(p) > 0; {
+			str2hashbuf(p, in, unsigned)
+			halfMD4Transform(&buf, in)
+			if len(p) <= 32 {
+				break
+			}
+			p = p[32:]
+		}
+		hash, minor = buf[1], buf[2]
+	case HASH_TEA_UNSIGNED:
+		unsigned = true
+		fallthrough
+	case HASH_TEA:
+		in := make([]uint32, 4)
+		for p := name; len(p) > 0; {
+			str2hashbuf(p, in, unsigned)
+			teaTransform(&buf, in)
+			if len(p) <= 16 {
+				break
+			}
+			p = p[16:]
+		}
+		hash, minor = buf[0], buf[1]
+	default:
+		return 0, 0, fmt.Errorf("unsupported directory hash version %d", version)
+	}
+	return hash &^ 1, minor, nil
+}
+
+// hashChar returns byte c as a char of the platform that created the filesystem would see it,
+// sign extended or not
+func hashChar(c byte, unsigned bool) uint32 {
+	if unsigned {
+		return uint32(c)
+	}
+	return uint32(int32(int8(c)))
+}
+
+// dxHackHash is the original hash of ext3 directory indexes
+func dxHackHash(name []byte, unsigned bool) uint32 {
+	var hash uint32
+	hash0, hash1 := uint32(0x12a3fe2d), uint32(0x37abe8f9)
+	for _, c := range name {
+		hash = hash1 + (hash0 ^ hashChar(c, unsigned)*7152373)
+		if hash&0x80000000 != 0 {
+			hash -= 0x7fffffff
+		}
+		hash1 = hash0
+		hash0 = hash
+	}
+	return hash0 << 1
+}
+
+// str2hashbuf packs the start of msg into buf for one round of hashing, padding with a value
+// derived from the length of msg
+func str2hashbuf(msg []byte, buf []uint32, unsigned bool) {
+	pad := uint32(len(msg)) | uint32(len(msg))<<8
+	pad |= pad << 16
+
+	val := pad
+	if len(msg) > len(buf)*4 {
+		msg = msg[:len(buf)*4]
+	}
+	i := 0
+	for j, c := range msg {
+		val = hashChar(c, unsigned) + val<<8
+		if j%4 == 3 {
+			buf[i] = val
+			i++
+			val = pad
+		}
+	}
+	if i < len(buf) {
+		buf[i] = val
+		i++
+	}
+	for ; i < len(buf); i++ {
+		buf[i] = pad
+	}
+}
+
+func teaTransform(buf *[4]uint32, in []uint32) {
+	const delta = 0x9E3779B9
+	var sum uint32
+	b0, b1 := buf[0], buf[1]
+	a, b, c, d := in[0], in[1], in[2], in[3]
+	for n := 0; n < 16; n++ {
+		sum += delta
+		b0 += ((b1 << 4) + a) ^ (b1 + sum) ^ ((b1 >> 5) + b)
+		b1 += ((b0 << 4) + c) ^ (b0 + sum) ^ ((b0 >> 5) + d)
+	}
+	buf[0] += b0
+	buf[1] += b1
+}
+
+// halfMD4Transform is the basic MD4 transform with half the rounds
+func halfMD4Transform(buf *[4]uint32, in []uint32) {
+	const (
+		k1 = 0
+		k2 = 013240474631
+		k3 = 015666365641
+	)
+	f := func(x, y, z uint32) uint32 { return z ^ (x & (y ^ z)) }
+	g := func(x, y, z uint32) uint32 { return (x & y) + ((x ^ y) & z) }
+	h := func(x, y, z uint32) uint32 { return x ^ y ^ z }
+	round := func(fn func(x, y, z uint32) uint32, a *uint32, b, c, d, x uint32, s int) {
+		*a = bits.RotateLeft32(*a+fn(b, c, d)+x, s)
+	}
+
+	a, b, c, d := buf[0], buf[1], buf[2], buf[3]
+
+	round(f, &a, b, c, d, in[0]+k1, 3)
+	round(f, &d, a, b, c, in[1]+k1, 7)
+	round(f, &c, d, a, b, in[2]+k1, 11)
+	round(f, &b, c, d, a, in[3]+k1, 19)
+	round(f, &a, b, c, d, in[4]+k1, 3)
+	round(f, &d, a, b, c, in[5]+k1, 7)
+	round(f, &c, d, a, b, in[6]+k1, 11)
+	round(f, &b, c, d, a, in[7]+k1, 19)
+
+	round(g, &a, b, c, d, in[1]+k2, 3)
+	round(g, &d, a, b, c, in[3]+k2, 5)
+	round(g, &c, d, a, b, in[5]+k2, 9)
+	round(g, &b, c, d, a, in[7]+k2, 13)
+	round(g, &a, b, c, d, in[0]+k2, 3)
+	round(g, &d, a, b, c, in[2]+k2, 5)
+	round(g, &c, d, a, b, in[4]+k2, 9)
+	round(g, &b, c, d, a, in[6]+k2, 13)
+
+	round(h, &a, b, c, d, in[3]+k3, 3)
+	round(h, &d, a, b, c, in[7]+k3, 9)
+	round(h, &c, d, a, b, in[2]+k3, 11)
+	round(h, &b, c, d, a, in[6]+k3, 15)
+	round(h, &a, b, c, d, in[1]+k3, 3)
+	round(h, &d, a, b, c, in[5]+k3, 9)
+	round(h, &c, d, a, b, in[0]+k3, 11)
+	round(h, &b, c, d, a, in[4]+k3, 15)
+
+	buf[0] += a
+	buf[1] += b
+	buf[2] += c
+	buf[3] += d
+}
+
+// dirHashVersion returns the hash version actually used for a directory index that records
+// version, which depends on whether chars were signed where the filesystem was created
+func (sb *Superblock) dirHashVersion(version uint8) uint8 {
+	if version <= HASH_TEA && sb.Flags&FLAGS_UNSIGNED_HASH != 0 {
+		return version + 3
+	}
+	return version
+}
@@ -0,0 +1,50 @@
+package ext4
+
+import (
+	"testing"
+)
+
+func TestDxHash(t *testing.T) {
+	// seed 0f1e2d3c-4b5a-6978-8796-a5b4c3d2e1f0, expected values from debugfs dx_hash
+	seed := [4]uint32{0x3c2d1e0f, 0x78695a4b, 0xb4a59687, 0xf0e1d2c3}
+	long := "a-much-longer-file-name-that-spans-more-than-32-bytes.txt"
+	tests := []struct {
+		version uint8
+		name    string
+		hash    uint32
+		minor   uint32
+	}{
+		{HASH_LEGACY, "hello", 0x32252546, 0},
+		{HASH_LEGACY, long, 0xe7e1501c, 0},
+		{HASH_LEGACY, "caf\xc3\xa9", 0x96ca5a2c, 0},
+		{HASH_LEGACY_UNSIGNED, "caf\xc3\xa9", 0x6dde4230, 0},
+		{HASH_HALF_MD4, "hello", 0x232245ac, 0xe1acc8de},
+		{HASH_HALF_MD4, "a", 0x3e64fde2, 0x42280a57},
+		{HASH_HALF_MD4, long, 0x5394e00a, 0xdde5eaef},
+		{HASH_HALF_MD4, "caf\xc3\xa9", 0xfb293d12, 0xd4240b83},
+		{HASH_HALF_MD4_UNSIGNED, "caf\xc3\xa9", 0x4bd381da, 0xece076c5},
+		{HASH_TEA, "hello", 0xf9a4dcd0, 0xd0d3e919},
+		{HASH_TEA, "a", 0xa9217068, 0xd145792f},
+		{HASH_TEA, long, 0x959b55c4, 0x52387aef},
+		{HASH_TEA, "caf\xc3\xa9", 0x45835f84, 0x9fd2c7ed},
+		{HASH_TEA_UNSIGNED, "caf\xc3\xa9", 0x663144d8, 0xe0317e12},
+	}
+	for _, tt := range tests {
+		hash, minor, err := dxHash([]byte(tt.name), tt.version, seed)
+		switch {
+		case err != nil:
+			t.Errorf("dxHash(%q, %d): unexpected error: %v", tt.name, tt.version, err)
+		case hash != tt.hash || minor != tt.minor:
+			t.Errorf("dxHash(%q, %d) = %#x, %#x; expected %#x, %#x", tt.name, tt.version, hash, minor, tt.hash, tt.minor)
+		}
+	}
+
+	// an all zero seed means the default one
+	hash, minor, _ := dxHash([]byte("hello"), HASH_HALF_MD4, [4]uint32{})
+	if hash != 0x1746da32 || minor != 0x420013b5 {
+		t.Errorf("dxHash with default seed = %#x, %#x; expected 0x1746da32, 0x420013b5", hash, minor)
+	}
+	if _, _, err := dxHash([]byte("hello"), 6, seed); err == nil {
+		t.Errorf("expected error for unknown hash version")
+	}
+}
@@ -0,0 +1,434 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+const (
+	// dxRootInfo is where the dx_root_info of a hashed directory follows the "." and ".." entries
+	dxRootInfo = 0x18
+	// dxRootEntries is where the index entries of the root start, the first of them overlaid by
+	// the count and limit of the node
+	dxRootEntries = 0x20
+	// dxNodeEntries is where the index entries of an interior node start, after a fake directory
+	// entry spanning the whole block
+	dxNodeEntries = 8
+)
+
+// dxNode is a block of a hashed directory index, the root or an interior node
+type dxNode struct {
+	lblk int64
+	phys int64
+	b    []byte
+	// offset is where the count, limit and entries start
+	offset int
+	// at is the entry followed when looking up a hash
+	at int
+}
+
+func (n *dxNode) limit() int {
+	return int(binary.LittleEndian.Uint16(n.b[n.offset:]))
+}
+
+func (n *dxNode) count() int {
+	return int(binary.LittleEndian.Uint16(n.b[n.offset+2:]))
+}
+
+func (n *dxNode) setCount(c int) {
+	binary.LittleEndian.PutUint16(n.b[n.offset+2:], uint16(c))
+}
+
+// hash returns the lowest hash covered by entry i; the first entry covers everything below the
+// second one
+func (n *dxNode) hash(i int) uint32 {
+	if i == 0 {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(n.b[n.offset+8*i:])
+}
+
+// block returns the logical directory block entry i points to
+func (n *dxNode) block(i int) int64 {
+	return int64(binary.LittleEndian.Uint32(n.b[n.offset+8*i+4:]))
+}
+
+// insertEntry inserts a new entry at position i, which must not be the first one
+func (n *dxNode) insertEntry(i int, hash uint32, block int64) {
+	start := n.offset + 8*i
+	copy(n.b[start+8:n.offset+8*(n.count()+1)], n.b[start:n.offset+8*n.count()])
+	binary.LittleEndian.PutUint32(n.b[start:], hash)
+	binary.LittleEndian.PutUint32(n.b[start+4:], uint32(block))
+	n.setCount(n.count() + 1)
+}
+
+// dxTree describes the index of a hashed directory, as found in its root
+type dxTree struct {
+	version uint8
+	levels  int
+}
+
+// dxLimit returns how many index entries fit in a node with entries starting at offset, leaving
+// room for the checksum tail
+func (sb *Superblock) dxLimit(offset int) int {
+	limit := (int(sb.GetBlockSize()) - offset) / 8
+	if sb.FeatureRoCompatMetadata_csum() {
+		limit--
+	}
+	return limit
+}
+
+// dxMaxLevels is the most levels of interior nodes below the root
+func (sb *Superblock) dxMaxLevels() int {
+	if sb.FeatureIncompatLargedir() {
+		return 2
+	}
+	return 1
+}
+
+// isHashed reports whether the directory is indexed by hash
+func (dir *directory) isHashed() bool {
+	return dir.f.inode.UsesDirectoryHashTree() && dir.sb.FeatureCompatDir_index()
+}
+
+// readLogicalBlock reads block lblk of the directory and verifies it, returning where it is
+// stored
+func (dir *directory) readLogicalBlock(lblk int64) (int64, []byte, error) {
+	inode := dir.f.inode
+	phys, _, found := inode.GetBlockPtr(lblk)
+	if !found || phys == 0 {
+		return 0, nil, fmt.Errorf("directory inode %d has no block %d", inode.num, lblk)
+	}
+	b, err := inode.fs.readBlock(phys)
+	if err != nil {
+		return 0, nil, err
+	}
+	if err := dir.verifyBlock(lblk, phys, b); err != nil {
+		return 0, nil, err
+	}
+	return phys, b, nil
+}
+
+// readDxNode reads an index node of the directory, checking that its limit is what it should be
+func (dir *directory) readDxNode(lblk int64, offset int) (*dxNode, error) {
+	phys, b, err := dir.readLogicalBlock(lblk)
+	if err != nil {
+		return nil, err
+	}
+	n := &dxNode{lblk: lblk, phys: phys, b: b, offset: offset}
+	if offset == dxNodeEntries && binary.LittleEndian.Uint32(b[0:]) != 0 {
+		return nil, fmt.Errorf("block %d of hashed directory inode %d is not an index node", lblk, dir.f.inode.num)
+	}
+	if n.limit() != dir.sb.dxLimit(offset) || n.count() == 0 || n.count() > n.limit() {
+		return nil, fmt.Errorf("corrupt index node in block %d of directory inode %d: count %d limit %d", lblk, dir.f.inode.num, n.count(), n.limit())
+	}
+	return n, nil
+}
+
+// writeDxNode writes an index node back, with a fresh checksum tail
+func (dir *directory) writeDxNode(n *dxNode) error {
+	if dir.sb.FeatureRoCompatMetadata_csum() {
+		tail := n.offset + 8*n.limit()
+		binary.LittleEndian.PutUint32(n.b[tail:], 0)
+		binary.LittleEndian.PutUint32(n.b[tail+4:], dir.dxNodeCsum(n))
+	}
+	return dir.f.inode.fs.writeBlock(n.phys, n.b)
+}
+
+// dxNodeCsum computes the checksum of an index node, which covers the entries in use and the
+// checksum tail after all the entries there is room for
+func (dir *directory) dxNodeCsum(n *dxNode) uint32 {
+	inode := dir.f.inode
+	tail := n.offset + 8*n.limit()
+	cs := newMetadataChecksummer(dir.sb)
+	cs.WriteUint32(uint32(inode.num))
+	cs.WriteUint32(inode.Generation)
+	cs.Write(n.b[:n.offset+8*n.count()])
+	// the whole tail, with the checksum itself zeroed
+	cs.Write(n.b[tail : tail+4])
+	cs.Write([]byte{0, 0, 0, 0})
+	return cs.Get()
+}
+
+// dxRoot reads the root of the directory index
+func (dir *directory) dxRoot() (*dxNode, *dxTree, error) {
+	root, err := dir.readDxNode(0, dxRootEntries)
+	if err != nil {
+		return nil, nil, err
+	}
+	info := root.b[dxRootInfo:]
+	tree := &dxTree{
+		version: dir.sb.dirHashVersion(info[4]),
+		levels:  int(info[6]),
+	}
+	if info[5] != 8 || tree.levels > dir.sb.dxMaxLevels() {
+		return nil, nil, fmt.Errorf("corrupt index root of directory inode %d", dir.f.inode.num)
+	}
+	return root, tree, nil
+}
+
+// dxHashName returns the hash of name in the directory index, of its casefolded form in a
+// casefolded directory
+func (dir *directory) dxHashName(tree *dxTree, name string) (uint32, uint32, error) {
+	return dxHash(dir.hashName(name), tree.version, dir.sb.Hash_seed)
+}
+
+// dxLookupPath returns the index nodes from the root down to the one pointing at the leaf block
+// that holds hash, each with the entry followed recorded in at
+func (dir *directory) dxLookupPath(root *dxNode, tree *dxTree, hash uint32) ([]*dxNode, error) {
+	path := []*dxNode{root}
+	for level := 0; ; level++ {
+		n := path[level]
+		// the last entry starting at or below hash
+		n.at = sort.Search(n.count(), func(i int) bool { return i > 0 && n.hash(i) > hash }) - 1
+		if level == tree.levels {
+			return path, nil
+		}
+		child, err := dir.readDxNode(n.block(n.at), dxNodeEntries)
+		if err != nil {
+			return nil, err
+		}
+		path = append(path, child)
+	}
+}
+
+// dxNextLeaf moves path on to the next leaf block, if it may hold more entries with the given
+// hash because of a collision that spans blocks
+func (dir *directory) dxNextLeaf(path []*dxNode, hash uint32) (bool, error) {
+	level := len(path) - 1
+	for level >= 0 && path[level].at+1 >= path[level].count() {
+		level--
+	}
+	if level < 0 {
+		return false, nil
+	}
+	n := path[level]
+	n.at++
+	// a continued hash has its lowest bit set
+	if n.hash(n.at)&^1 != hash {
+		return false, nil
+	}
+	for l := level + 1; l < len(path); l++ {
+		child, err := dir.readDxNode(path[l-1].block(path[l-1].at), dxNodeEntries)
+		if err != nil {
+			return false, err
+		}
+		path[l] = child
+	}
+	return true, nil
+}
+
+// dxFindEntry looks up name through the directory index
+func (dir *directory) dxFindEntry(name string) (uint32, error) {
+	root, tree, err := dir.dxRoot()
+	if err != nil {
+		return 0, err
+	}
+	hash, _, err := dir.dxHashName(tree, name)
+	if err != nil {
+		return 0, err
+	}
+	path, err := dir.dxLookupPath(root, tree, hash)
+	if err != nil {
+		return 0, err
+	}
+	for {
+		n := path[len(path)-1]
+		_, b, err := dir.readLogicalBlock(n.block(n.at))
+		if err != nil {
+			return 0, err
+		}
+		entries, err := parseDirBlock(b)
+		if err != nil {
+			return 0, fmt.Errorf("directory inode %d block %d: %v", dir.f.inode.num, n.block(n.at), err)
+		}
+		for _, e := range entries {
+			if e.inode != 0 && dir.nameMatches(e.name, name) {
+				return e.inode, nil
+			}
+		}
+		more, err := dir.dxNextLeaf(path, hash)
+		if err != nil || !more {
+			return 0, err
+		}
+	}
+}
+
+// appendBlock adds a new block to the end of the directory, returning its logical and physical
+// block numbers
+func (dir *directory) appendBlock() (int64, int64, error) {
+	inode := dir.f.inode
+	blockSize := dir.sb.GetBlockSize()
+	lblk := inode.GetSize() / blockSize
+	phys, n, err := inode.AddBlocks(1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if n == 0 {
+		return 0, 0, fmt.Errorf("no space left to grow directory inode %d", inode.num)
+	}
+	inode.SetSize((lblk + 1) * blockSize)
+	return lblk, phys, nil
+}
+
+// dxAddEntry adds an entry to a hashed directory. When its leaf block is full, the entries of
+// the block are split by hash between it and a new block, which gets an index entry of its own;
+// full index nodes are split in turn, and a full root makes the tree a level deeper.
+func (dir *directory) dxAddEntry(entry *DirectoryEntry2) error {
+	inode := dir.f.inode
+	root, tree, err := dir.dxRoot()
+	if err != nil {
+		return err
+	}
+	hash, _, err := dir.dxHashName(tree, entry.Name)
+	if err != nil {
+		return err
+	}
+	path, err := dir.dxLookupPath(root, tree, hash)
+	if err != nil {
+		return err
+	}
+	n := path[len(path)-1]
+	leaf := n.block(n.at)
+	phys, b, err := dir.readLogicalBlock(leaf)
+	if err != nil {
+		return err
+	}
+	ok, err := addToDirBlock(inode, b, entry)
+	if err != nil {
+		return fmt.Errorf("directory inode %d block %d: %v", inode.num, leaf, err)
+	}
+	if ok {
+		return inode.fs.writeBlock(phys, b)
+	}
+
+	// make sure there will be room in the index before changing anything
+	room := tree.levels < dir.sb.dxMaxLevels()
+	for _, p := range path {
+		room = room || p.count() < p.limit()
+	}
+	if !room {
+		return fmt.Errorf("index of directory inode %d is full", inode.num)
+	}
+
+	entries, err := parseDirBlock(b)
+	if err != nil {
+		return fmt.Errorf("directory inode %d block %d: %v", inode.num, leaf, err)
+	}
+	type hashed struct {
+		entry *DirectoryEntry2
+		hash  uint32
+	}
+	live := []hashed{}
+	for _, e := range entries {
+		if e.inode == 0 {
+			continue
+		}
+		h, _, err := dir.dxHashName(tree, e.name)
+		if err != nil {
+			return err
+		}
+		live = append(live, hashed{&DirectoryEntry2{Inode: e.inode, Flags: e.ftype, Name: e.name}, h})
+	}
+	sort.SliceStable(live, func(i, j int) bool { return live[i].hash < live[j].hash })
+
+	// move the entries with the highest hashes, about half of the block, to the new block
+	split := len(live)
+	for moved := 0; split > 1; split-- {
+		size := dirEntryLen(len(live[split-1].entry.Name))
+		if moved+size/2 > len(b)/2 {
+			break
+		}
+		moved += size
+	}
+	splitHash := live[split].hash
+	if splitHash == live[split-1].hash {
+		// the hash continues in the new block
+		splitHash |= 1
+	}
+	lower, upper := []*DirectoryEntry2{}, []*DirectoryEntry2{}
+	for _, e := range live[:split] {
+		lower = append(lower, e.entry)
+	}
+	for _, e := range live[split:] {
+		upper = append(upper, e.entry)
+	}
+	if hash >= splitHash&^1 {
+		upper = append(upper, entry)
+	} else {
+		lower = append(lower, entry)
+	}
+
+	newLeaf, newPhys, err := dir.appendBlock()
+	if err != nil {
+		return err
+	}
+	if err := inode.fs.writeBlock(newPhys, packDirBlock(inode, upper)); err != nil {
+		return err
+	}
+	if err := inode.fs.writeBlock(phys, packDirBlock(inode, lower)); err != nil {
+		return err
+	}
+	return dir.dxInsert(path, tree, len(path)-1, splitHash, newLeaf)
+}
+
+// dxInsert adds an index entry for block right after the entry followed at the given level of
+// path, splitting nodes as needed
+func (dir *directory) dxInsert(path []*dxNode, tree *dxTree, level int, hash uint32, block int64) error {
+	n := path[level]
+	if n.count() < n.limit() {
+		n.insertEntry(n.at+1, hash, block)
+		return dir.writeDxNode(n)
+	}
+
+	blockSize := int(dir.sb.GetBlockSize())
+	newLblk, newPhys, err := dir.appendBlock()
+	if err != nil {
+		return err
+	}
+	node := &dxNode{lblk: newLblk, phys: newPhys, b: make([]byte, blockSize), offset: dxNodeEntries}
+	// the fake directory entry that hides the index from those that do not know about it
+	binary.LittleEndian.PutUint16(node.b[4:], uint16(blockSize))
+	binary.LittleEndian.PutUint16(node.b[node.offset:], uint16(dir.sb.dxLimit(node.offset)))
+
+	if level == 0 {
+		// move all entries of the full root into the new node, the root then only points at it
+		copy(node.b[node.offset+4:], n.b[n.offset+4:n.offset+8*n.count()])
+		node.setCount(n.count())
+		node.at = n.at
+		n.setCount(1)
+		binary.LittleEndian.PutUint32(n.b[n.offset+4:], uint32(newLblk))
+		n.at = 0
+		tree.levels++
+		n.b[dxRootInfo+6] = uint8(tree.levels)
+		if err := dir.writeDxNode(node); err != nil {
+			return err
+		}
+		if err := dir.writeDxNode(n); err != nil {
+			return err
+		}
+		path = append([]*dxNode{n, node}, path[1:]...)
+		return dir.dxInsert(path, tree, 1, hash, block)
+	}
+
+	// split the full interior node in half, the upper half going to the new node
+	half := n.count() / 2
+	splitHash := n.hash(half)
+	copy(node.b[node.offset+4:], n.b[n.offset+8*half+4:n.offset+8*n.count()])
+	node.setCount(n.count() - half)
+	n.setCount(half)
+	if err := dir.dxInsert(path, tree, level-1, splitHash, newLblk); err != nil {
+		return err
+	}
+	target := n
+	if n.at >= half {
+		target = node
+		node.at = n.at - half
+	}
+	target.insertEntry(target.at+1, hash, block)
+	if err := dir.writeDxNode(node); err != nil {
+		return err
+	}
+	return dir.writeDxNode(n)
+}
@@ -0,0 +1,342 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// inlineDataName is the name, in the system namespace, of the extended attribute holding the
+// part of inline data that does not fit in i_block
+const inlineDataName = "data"
+
+// inlineBlockSize is how much inline data i_block holds
+const inlineBlockSize = 60
+
+// isInline reports whether the contents of the inode are stored in the inode itself
+func (inode *Inode) isInline() bool {
+	return inode.Flags&INLINE_DATA_FL != 0
+}
+
+// isInlineData reports whether e is the extended attribute that continues inline data
+func (e *xattrEntry) isInlineData() bool {
+	return e.index == xattrIndexSystem && e.name == inlineDataName
+}
+
+// inlineData returns the inline data of the inode: i_block followed by the value of system.data
+func (inode *Inode) inlineData() ([]byte, error) {
+	entries, err := inode.ibodyXattrs()
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte{}, inode.BlockOrExtents[:]...)
+	for _, e := range entries {
+		if e.isInlineData() {
+			data = append(data, e.value...)
+		}
+	}
+	return data, nil
+}
+
+// inlineRoom returns the most inline data the inode can hold, given the other extended
+// attributes stored in it
+func (inode *Inode) inlineRoom() (int, error) {
+	entries, err := inode.ibodyXattrs()
+	if err != nil {
+		return 0, err
+	}
+	start, size := inode.ibodyXattrStart(), int(inode.fs.sb.Inode_size)
+	// the magic number, the end of the list and the entry for system.data itself
+	used := 4 + 4 + (xattrEntrySize+len(inlineDataName)+3)&^3
+	for _, e := range entries {
+		if e.isInlineData() {
+			continue
+		}
+		used += (xattrEntrySize + len(e.name) + 3) &^ 3
+		if e.valueInode == 0 {
+			used += (len(e.value) + 3) &^ 3
+		}
+	}
+	free := size - start - used
+	if free < 0 {
+		free = 0
+	}
+	return inlineBlockSize + free&^3, nil
+}
+
+// setInlineData stores data as the inline data of the inode, the first 60 bytes in i_block and
+// the rest in system.data. The inode still has to be written back.
+func (inode *Inode) setInlineData(data []byte) error {
+	for i := range inode.BlockOrExtents {
+		inode.BlockOrExtents[i] = 0
+	}
+	rest := []byte{}
+	if len(data) > inlineBlockSize {
+		rest = data[inlineBlockSize:]
+	}
+	copy(inode.BlockOrExtents[:], data)
+
+	entries, err := inode.ibodyXattrs()
+	if err != nil {
+		return err
+	}
+	found := false
+	for i := range entries {
+		if entries[i].isInlineData() {
+			entries[i].value = rest
+			found = true
+		}
+	}
+	if !found {
+		entries = append([]xattrEntry{{index: xattrIndexSystem, name: inlineDataName, value: rest}}, entries...)
+	}
+	return inode.setIbodyXattrs(entries)
+}
+
+// inlineDirRegions returns the parts of the inline data of a directory that hold its entries:
+// i_block after the parent inode number, and the value of system.data if there is one
+func inlineDirRegions(data []byte) [][]byte {
+	regions := [][]byte{data[4:inlineBlockSize]}
+	if len(data) > inlineBlockSize {
+		regions = append(regions, data[inlineBlockSize:])
+	}
+	return regions
+}
+
+// readInline reads from the inline data of the file
+func (f *File) readInline(p []byte) (int, error) {
+	data, err := f.inode.inlineData()
+	if err != nil {
+		return 0, err
+	}
+	size := f.inode.GetSize()
+	if f.pos >= size {
+		return 0, io.EOF
+	}
+	if size-f.pos < int64(len(p)) {
+		p = p[:size-f.pos]
+	}
+	// a file may be larger than its inline data, the rest reads as zeros like a hole
+	n := 0
+	if f.pos < int64(len(data)) {
+		n = copy(p, data[f.pos:])
+	}
+	for i := range p[n:] {
+		p[n+i] = 0
+	}
+	f.pos += int64(len(p))
+	return len(p), nil
+}
+
+// writeInline writes p to the inline data of the file, returning false without writing anything
+// if it does not fit in the inode
+func (f *File) writeInline(p []byte) (bool, error) {
+	inode := f.inode
+	room, err := inode.inlineRoom()
+	if err != nil {
+		return false, err
+	}
+	end := f.pos + int64(len(p))
+	if end > int64(room) || inode.GetSize() > int64(room) {
+		return false, nil
+	}
+	data, err := inode.inlineData()
+	if err != nil {
+		return false, err
+	}
+	size := inode.GetSize()
+	if end > size {
+		size = end
+	}
+	if int64(len(data)) < size {
+		data = append(data, make([]byte, size-int64(len(data)))...)
+	}
+	copy(data[f.pos:], p)
+	if size < inlineBlockSize {
+		size = inlineBlockSize
+	}
+	if err := inode.setInlineData(data[:size]); err != nil {
+		return false, err
+	}
+	f.pos = end
+	if end > inode.GetSize() {
+		inode.SetSize(end)
+	} else {
+		inode.UpdateCsumAndWriteback()
+	}
+	return true, nil
+}
+
+// uninline moves the inline data of the inode out to blocks, for when it no longer fits in the
+// inode. A directory gets a regular first block with "." and "..".
+func (inode *Inode) uninline() error {
+	fs := inode.fs
+	data, err := inode.inlineData()
+	if err != nil {
+		return err
+	}
+	// only what is inline is moved, past it the file is a hole
+	size := inode.GetSize()
+	if size > int64(len(data)) {
+		size = int64(len(data))
+	}
+
+	var dirEntries []*DirectoryEntry2
+	if inode.Mode&S_IFMT == S_IFDIR {
+		dirEntries = []*DirectoryEntry2{
+			{Inode: uint32(inode.num), Flags: FT_DIR, Name: "."},
+			{Inode: binary.LittleEndian.Uint32(data), Flags: FT_DIR, Name: ".."},
+		}
+		for _, region := range inlineDirRegions(data[:size]) {
+			entries, err := parseDirBlock(region)
+			if err != nil {
+				return fmt.Errorf("inline directory inode %d: %v", inode.num, err)
+			}
+			for _, e := range entries {
+				if e.inode != 0 {
+					dirEntries = append(dirEntries, &DirectoryEntry2{Inode: e.inode, Flags: e.ftype, Name: e.name})
+				}
+			}
+		}
+	}
+
+	entries, err := inode.ibodyXattrs()
+	if err != nil {
+		return err
+	}
+	kept := []xattrEntry{}
+	for _, e := range entries {
+		if !e.isInlineData() {
+			kept = append(kept, e)
+		}
+	}
+	if err := inode.setIbodyXattrs(kept); err != nil {
+		return err
+	}
+	inode.Flags &^= INLINE_DATA_FL
+	if fs.sb.FeatureIncompatExtents() {
+		inode.Flags |= EXTENTS_FL
+		inode.setLeafExtents(nil)
+	} else {
+		inode.BlockOrExtents = [60]byte{}
+	}
+
+	if dirEntries != nil {
+		phys, n, err := inode.AddBlocks(1)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return fmt.Errorf("no free blocks for directory inode %d", inode.num)
+		}
+		if err := fs.writeBlock(phys, packDirBlock(inode, dirEntries)); err != nil {
+			return err
+		}
+		inode.SetSize(fs.sb.GetBlockSize())
+		return nil
+	}
+
+	end := inode.GetSize()
+	inode.SetSize(0)
+	f := &File{extFile{fs: fs, inode: inode}}
+	if _, err := f.write(data[:size]); err != nil {
+		return err
+	}
+	if end > size {
+		inode.SetSize(end)
+	}
+	return nil
+}
+
+// inlineAddEntry places e in the inline directory, growing system.data when there is room for
+// that. It returns false if the entry does not fit in the inode.
+func (dir *directory) inlineAddEntry(e *DirectoryEntry2) (bool, error) {
+	inode := dir.f.inode
+	data, err := inode.inlineData()
+	if err != nil {
+		return false, err
+	}
+	if inode.GetSize() > int64(len(data)) {
+		return false, fmt.Errorf("inode %d has %d bytes of inline data for a size of %d", inode.num, len(data), inode.GetSize())
+	}
+	data = data[:inode.GetSize()]
+	for _, region := range inlineDirRegions(data) {
+		added, err := addToDirBlock(inode, region, e)
+		if err != nil {
+			return false, fmt.Errorf("inline directory inode %d: %v", inode.num, err)
+		}
+		if added {
+			if err := inode.setInlineData(data); err != nil {
+				return false, err
+			}
+			inode.UpdateCsumAndWriteback()
+			return true, nil
+		}
+	}
+
+	// take all the room left in the inode, like the kernel does
+	room, err := inode.inlineRoom()
+	if err != nil {
+		return false, err
+	}
+	grow := room - len(data)
+	if grow < dirEntryLen(len(e.Name)) {
+		return false, nil
+	}
+	if len(data) > inlineBlockSize {
+		region := data[inlineBlockSize:]
+		entries, err := parseDirBlock(region)
+		if err != nil {
+			return false, fmt.Errorf("inline directory inode %d: %v", inode.num, err)
+		}
+		last := entries[len(entries)-1]
+		binary.LittleEndian.PutUint16(region[last.pos+4:], uint16(last.recLen+grow))
+		data = append(data, make([]byte, grow)...)
+	} else {
+		data = append(data, make([]byte, grow)...)
+		binary.LittleEndian.PutUint16(data[inlineBlockSize+4:], uint16(grow))
+	}
+	if _, err := addToDirBlock(inode, data[inlineBlockSize:], e); err != nil {
+		return false, err
+	}
+	if err := inode.setInlineData(data); err != nil {
+		return false, err
+	}
+	inode.SetSize(int64(len(data)))
+	return true, nil
+}
+
+// readInlineDirectory is ReadDirectory for an inline directory, which has no entries for "." and
+// ".." of its own
+func (inode *Inode) readInlineDirectory() ([]DirectoryEntry2, error) {
+	return NewDirectory(inode).entries()
+}
+
+// truncateInline changes the size of an inline file, returning false without changing anything
+// if the new size does not fit in the inode
+func (f *File) truncateInline(size int64) (bool, error) {
+	inode := f.inode
+	room, err := inode.inlineRoom()
+	if err != nil || size > int64(room) {
+		return false, err
+	}
+	data, err := inode.inlineData()
+	if err != nil {
+		return false, err
+	}
+	if int64(len(data)) < size {
+		data = append(data, make([]byte, size-int64(len(data)))...)
+	}
+	for i := size; i < int64(len(data)); i++ {
+		data[i] = 0
+	}
+	keep := size
+	if keep < inlineBlockSize {
+		keep = inlineBlockSize
+	}
+	if err := inode.setInlineData(data[:keep]); err != nil {
+		return false, err
+	}
+	inode.SetSize(size)
+	return true, nil
+}
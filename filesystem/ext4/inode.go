@@ -1,21 +1,21 @@
 package ext4
 
 import (
-	"github.com/lunixbochs/struc"
+	"bytes"
 	"encoding/binary"
-	"log"
+	"fmt"
+	"github.com/lunixbochs/struc"
 	"io"
-	"bytes"
 )
 
 type MoveExtent struct {
-	Reserved    uint32  `struc:"uint32,little"`
-	Donor_fd    uint32  `struc:"uint32,little"`
+	Reserved    uint32 `struc:"uint32,little"`
+	Donor_fd    uint32 `struc:"uint32,little"`
 	Orig_start  uint64 `struc:"uint64,little"`
 	Donor_start uint64 `struc:"uint64,little"`
 	Len         uint64 `struc:"uint64,little"`
 	Moved_len   uint64 `struc:"uint64,little"`
-};
+}
 
 type ExtentHeader struct {
 	Magic      uint16 `struc:"uint16,little"`
@@ -40,19 +40,19 @@ type Extent struct {
 }
 
 type DirectoryEntry2 struct {
-	Inode uint32 `struc:"uint32,little"`
-	Rec_len uint16 `struc:"uint16,little"`
-	Name_len uint8 `struc:"uint8,sizeof=Name"`
-	Flags uint8 `struc:"uint8"`
-	Name string `struc:"[]byte"`
+	Inode    uint32 `struc:"uint32,little"`
+	Rec_len  uint16 `struc:"uint16,little"`
+	Name_len uint8  `struc:"uint8,sizeof=Name"`
+	Flags    uint8  `struc:"uint8"`
+	Name     string `struc:"[]byte"`
 }
 
 type DirectoryEntryCsum struct {
 	FakeInodeZero uint32 `struc:"uint32,little"`
-	Rec_len uint16 `struc:"uint16,little"`
-	FakeName_len uint8 `struc:"uint8"`
-	FakeFileType uint8 `struc:"uint8"`
-	Checksum uint32 `struc:"uint32,little"`
+	Rec_len       uint16 `struc:"uint16,little"`
+	FakeName_len  uint8  `struc:"uint8"`
+	FakeFileType  uint8  `struc:"uint8"`
+	Checksum      uint32 `struc:"uint32,little"`
 }
 
 type Inode struct {
@@ -74,27 +74,29 @@ type Inode struct {
 	Size_high      uint32   `struc:"uint32,little"`
 	Obso_faddr     uint32   `struc:"uint32,little"`
 	// OSD2 - linux only starts
-	Blocks_high    uint16   `struc:"uint16,little"`
-	File_acl_high  uint16   `struc:"uint16,little"`
-	Uid_high       uint16   `struc:"uint16,little"`
-	Gid_high       uint16   `struc:"uint16,little"`
-	Checksum_low   uint16   `struc:"uint16,little"`
-	Unused         uint16   `struc:"uint16,little"`
+	Blocks_high   uint16 `struc:"uint16,little"`
+	File_acl_high uint16 `struc:"uint16,little"`
+	Uid_high      uint16 `struc:"uint16,little"`
+	Gid_high      uint16 `struc:"uint16,little"`
+	Checksum_low  uint16 `struc:"uint16,little"`
+	Unused        uint16 `struc:"uint16,little"`
 	// OSD2 - linux only ends
-	Extra_isize    uint16   `struc:"uint16,little"`
-	Checksum_hi    uint16   `struc:"uint16,little"`
-	Ctime_extra    uint32   `struc:"uint32,little"`
-	Mtime_extra    uint32   `struc:"uint32,little"`
-	Atime_extra    uint32   `struc:"uint32,little"`
-	Crtime         uint32   `struc:"uint32,little"`
-	Crtime_extra   uint32   `struc:"uint32,little"`
-	Version_hi     uint32   `struc:"uint32,little"`
-	Projid         uint32   `struc:"uint32,little"`
-	fs             *FileSystem
-	address        int64
-	num            int64
-};
-
+	Extra_isize  uint16 `struc:"uint16,little"`
+	Checksum_hi  uint16 `struc:"uint16,little"`
+	Ctime_extra  uint32 `struc:"uint32,little"`
+	Mtime_extra  uint32 `struc:"uint32,little"`
+	Atime_extra  uint32 `struc:"uint32,little"`
+	Crtime       uint32 `struc:"uint32,little"`
+	Crtime_extra uint32 `struc:"uint32,little"`
+	Version_hi   uint32 `struc:"uint32,little"`
+	Projid       uint32 `struc:"uint32,little"`
+	fs           *FileSystem
+	address      int64
+	num          int64
+	// raw holds the on-disk bytes the inode was read from, so that whatever follows the fields
+	// above, such as in-inode extended attributes, survives being written back
+	raw []byte
+}
 
 func (inode *Inode) UsesExtents() bool {
 	return (inode.Flags & EXTENTS_FL) != 0
@@ -104,210 +106,127 @@ func (inode *Inode) UsesDirectoryHashTree() bool {
 	return (inode.Flags & INDEX_FL) != 0
 }
 
-func (inode *Inode) ReadDirectory() []DirectoryEntry2 {
-	if inode.UsesDirectoryHashTree() {
-		log.Fatalf("Not implemented")
+// ReadDirectory returns the entries of the directory in the order they are stored, unused ones
+// left out
+func (inode *Inode) ReadDirectory() ([]DirectoryEntry2, error) {
+	if inode.isInline() {
+		return inode.readInlineDirectory()
 	}
-
+	// the blocks of a hashed directory can be read like any other, as the index is hidden from
+	// those that do not know about it in entries without an inode
 	f := &File{extFile{
-		fs: inode.fs,
+		fs:    inode.fs,
 		inode: inode,
-		pos: 0,
+		pos:   0,
 	}}
 
 	ret := []DirectoryEntry2{}
 	for {
-		start, _ := f.Seek(0, 1)  //not dev file seek
+		start, _ := f.Seek(0, 1) //not dev file seek
 		dirEntry := DirectoryEntry2{}
 		err := struc.Unpack(f, &dirEntry)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			log.Fatalf(err.Error())
+			return nil, err
 		}
 		//log.Printf("dirEntry %s: %+v", string(dirEntry.Name), dirEntry)
-		f.Seek(int64(dirEntry.Rec_len) + start, 0)  //not dev file seek
+		f.Seek(int64(dirEntry.Rec_len)+start, 0) //not dev file seek
 		if dirEntry.Rec_len < 9 {
-			log.Fatalf("corrupt direntry")
+			return nil, fmt.Errorf("corrupt directory entry at %d in inode %d", start, inode.num)
+		}
+		// unused entries and checksum tails have no inode
+		if dirEntry.Inode == 0 {
+			continue
 		}
 		ret = append(ret, dirEntry)
 	}
-	return ret
+	return ret, nil
 }
 
-func (inode *Inode) AddBlocks(n int64) (blockNum int64, contiguousBlocks int64) {
-	if !inode.UsesExtents() {
-		log.Fatalf("Not implemented")
-	}
-
-	r := inode.fs.dev
-	r.Seek(inode.fs.start + inode.address + 40, 0)
-
-	for {
-		headerPos, _ := r.Seek(0,1) //headerPos is the new offset includes inode.fs.start
-		extentHeader := &ExtentHeader{}
-		struc.Unpack(r, &extentHeader)
-		//log.Printf("extent header: %+v", extentHeader)
-		if extentHeader.Depth == 0 { // Leaf
-			max := int64(0)
-			for i := uint16(0); i < extentHeader.Entries; i++ {
-				extent := &Extent{}
-				struc.Unpack(r, &extent)
-				upper := int64(extent.Block) + int64(extent.Len)
-				if upper > max {
-					max = upper
-				}
-			}
-			if extentHeader.Entries < extentHeader.Max {
-				savePos, _ := r.Seek(0, 1)  //savePos is the new offset includes inode.fs.start
-				blockNum, numBlocks := inode.fs.GetFreeBlocks(int(n))
-				newExtent := &Extent{
-					Block: uint32(max),
-					Len: uint16(numBlocks),
-					Start_hi: uint16(blockNum >> 32),
-					Start_lo: uint32(blockNum & 0xFFFFFFFF),
-				}
-				r.Seek(savePos, 0)  //savePos is the new offset includes inode.fs.start
-				struc.Pack(r, &newExtent)
-				extentHeader.Entries++
-				//log.Println("Extended to", extentHeader.Entries, headerPos)
-				r.Seek(headerPos, 0)  //headerPos is the new offset includes inode.fs.start
-				struc.Pack(r, extentHeader)
-				r.Seek(inode.fs.start + inode.address, 0)
-				struc.Unpack(r, inode)
-				inode.Blocks_lo += uint32(numBlocks*inode.fs.sb.GetBlockSize()/512)
-				inode.UpdateCsumAndWriteback()
-
-				//log.Println("AddBlocks", n, numBlocks)
-
-				return blockNum, numBlocks
-			} else {
-				log.Fatalf("Unable to extend no room")
-			}
-		} else {
-			max := uint32(0)
-			var best *ExtentInternal
-			for i := uint16(0); i < extentHeader.Entries; i++ {
-				extent := &ExtentInternal{}
-				struc.Unpack(r, &extent)
-				//log.Printf("extent internal: %+v", extent)
-				if extent.Block > max {
-					best = extent
-				}
-			}
-
-			newBlock := int64(best.Leaf_high<<32) + int64(best.Leaf_low)
-			r.Seek(inode.fs.start + newBlock*inode.fs.sb.GetBlockSize(), 0)
+// AddBlocks allocates up to n more blocks for the inode, mapped right after its last block.
+// It returns the first newly allocated block and how many were allocated.
+func (inode *Inode) AddBlocks(n int64) (blockNum int64, contiguousBlocks int64, err error) {
+	var end int64
+	if inode.UsesExtents() {
+		if end, err = inode.extentEnd(); err != nil {
+			return 0, 0, err
 		}
+	} else {
+		bs := inode.fs.sb.GetBlockSize()
+		end = (inode.GetSize() + bs - 1) / bs
 	}
-
-	//log.Println("AddBlocks", n, 0)
-	return 0,0
+	return inode.mapBlocks(end, n, false)
 }
 
-func (inode *Inode) UpdateCsumAndWriteback() {
-	if inode.fs.sb.Checksum_type == 0 {
-		return
+// GetBlockCount returns the number of 512 byte sectors in use by the inode, counting the blocks
+// of its extent tree or indirect blocks as well as its data
+func (inode *Inode) GetBlockCount() int64 {
+	count := int64(inode.Blocks_high)<<32 | int64(inode.Blocks_lo)
+	if inode.Flags&HUGE_FILE_FL != 0 {
+		count *= inode.fs.sb.GetBlockSize() / 512
 	}
+	return count
+}
 
-	if inode.fs.sb.Inode_size != 128 {
-		log.Fatalln("Unsupported inode size", inode.fs.sb.Inode_size)
+// addBlockCount accounts for n more filesystem blocks in use by the inode, which may be negative
+func (inode *Inode) addBlockCount(n int64) {
+	count := int64(inode.Blocks_high)<<32 | int64(inode.Blocks_lo)
+	if inode.Flags&HUGE_FILE_FL != 0 {
+		count += n
+	} else {
+		count += n * inode.fs.sb.GetBlockSize() / 512
 	}
+	inode.Blocks_lo = uint32(count)
+	inode.Blocks_high = uint16(count >> 32)
+}
 
-	cs := NewChecksummer(inode.fs.sb)
-
-	cs.Write(inode.fs.sb.Uuid[:])
-	cs.WriteUint32(uint32(inode.num))
-	cs.WriteUint32(uint32(inode.Generation))
-	inode.Checksum_low = 0
-	struc.Pack(LimitWriter(cs, 128), inode)
-	inode.Checksum_low = uint16(cs.Get() & 0xFFFF)
-
-	inode.fs.dev.Seek(inode.fs.start + inode.address, 0)
-	struc.Pack(LimitWriter(inode.fs.dev, 128), inode)
+func (inode *Inode) UpdateCsumAndWriteback() {
+	inode.fs.dev.WriteAt(inode.toBytes(), inode.fs.start+inode.address)
 }
 
 // Returns the blockId of the file block, and the number of contiguous blocks
 func (inode *Inode) GetBlockPtr(num int64) (int64, int64, bool) {
 	if inode.UsesExtents() {
 		//log.Println("Finding", num)
-		r := io.Reader(bytes.NewReader(inode.BlockOrExtents[:]))
-
-		for {
-			extentHeader := &ExtentHeader{}
-			struc.Unpack(r, &extentHeader)
-			//log.Printf("extent header: %+v", extentHeader)
-			if extentHeader.Depth == 0 { // Leaf
-				for i := uint16(0); i < extentHeader.Entries; i++ {
-					extent := &Extent{}
-					struc.Unpack(r, &extent)
-					//log.Printf("extent leaf: %+v", extent)
-					if int64(extent.Block) <= num && int64(extent.Block)+int64(extent.Len) > num {
-						//log.Println("Found")
-						return int64(extent.Start_hi<<32) + int64(extent.Start_lo) + num - int64(extent.Block), int64(extent.Block) + int64(extent.Len) - num, true
-					}
-				}
-				return 0, 0, false
-			} else {
-				found := false
-				for i := uint16(0); i < extentHeader.Entries; i++ {
-					extent := &ExtentInternal{}
-					struc.Unpack(r, &extent)
-					//log.Printf("extent internal: %+v", extent)
-					if int64(extent.Block) <= num {
-						newBlock := int64(extent.Leaf_high<<32) + int64(extent.Leaf_low)
-						inode.fs.dev.Seek(inode.fs.start + newBlock * inode.fs.sb.GetBlockSize(), 0)
-						r = inode.fs.dev
-						found = true
-						break
-					}
-				}
-				if !found {
-					return 0,0, false
-				}
-			}
+		extent, found, err := inode.lookupExtent(num)
+		if err != nil || !found {
+			return 0, 0, false
 		}
-
-	}
-
-	if num < 12 {
-		return int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*num:])), 1, true
+		offset := num - int64(extent.Block)
+		return extent.start() + offset, extent.length() - offset, true
 	}
 
-	num -= 12
-
-	indirectsPerBlock := inode.fs.sb.GetBlockSize() / 4
-	if num < indirectsPerBlock {
-		ptr := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*12:]))
-		return inode.getIndirectBlockPtr(ptr, num),1, true
+	// holes in the block map are blocks numbered 0
+	ptr, err := inode.indirectBlockPtr(num)
+	if err != nil || ptr == 0 {
+		return 0, 0, false
 	}
-	num -= indirectsPerBlock
+	return ptr, 1, true
+}
 
-	if num < indirectsPerBlock * indirectsPerBlock {
-		ptr := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*13:]))
-		l1 := inode.getIndirectBlockPtr(ptr, num / indirectsPerBlock)
-		return inode.getIndirectBlockPtr(l1, num % indirectsPerBlock),1, true
+// blockMapping is GetBlockPtr that also reports whether the blocks belong to an uninitialized
+// extent, whose contents read as zeros, and fails if the blocks mapping them cannot be read
+func (inode *Inode) blockMapping(num int64) (ptr, count int64, uninit, found bool, err error) {
+	if !inode.UsesExtents() {
+		// holes in the block map are blocks numbered 0
+		ptr, err := inode.indirectBlockPtr(num)
+		if err != nil || ptr == 0 {
+			return 0, 0, false, false, err
+		}
+		return ptr, 1, false, true, nil
 	}
-
-	num -= indirectsPerBlock * indirectsPerBlock
-
-	if num < indirectsPerBlock * indirectsPerBlock * indirectsPerBlock {
-		log.Println("Triple indirection")
-
-		ptr := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*14:]))
-		l1 := inode.getIndirectBlockPtr(ptr, num / (indirectsPerBlock * indirectsPerBlock))
-		l2 := inode.getIndirectBlockPtr(l1, (num / indirectsPerBlock) % indirectsPerBlock)
-		return inode.getIndirectBlockPtr(l2, num % (indirectsPerBlock * indirectsPerBlock)),1, true
+	extent, found, err := inode.lookupExtent(num)
+	if err != nil || !found {
+		return 0, 0, false, false, err
 	}
-
-	log.Fatalf("Exceeded maximum possible block count")
-	return 0,0,false
+	offset := num - int64(extent.Block)
+	return extent.start() + offset, extent.length() - offset, extent.uninitialized(), true, nil
 }
 
 func (inode *Inode) getIndirectBlockPtr(blockNum int64, offset int64) int64 {
-	inode.fs.dev.Seek(inode.fs.start + blockNum * inode.fs.sb.GetBlockSize() + offset * 4, 0)
 	x := make([]byte, 4)
-	inode.fs.dev.Read(x)
+	inode.fs.dev.ReadAt(x, inode.fs.start+blockNum*inode.fs.sb.GetBlockSize()+offset*4)
 	return int64(binary.LittleEndian.Uint32(x))
 }
 
@@ -342,4 +261,213 @@ func (lw *limitedWriter) Write(p []byte) (n int, err error) {
 	n, err = lw.W.Write(p)
 	lw.N -= int64(n)
 	return
-}
\ No newline at end of file
+}
+
+// toBytes serializes the inode into its on-disk form of sb.Inode_size bytes, computing the
+// metadata checksum when enabled
+func (inode *Inode) toBytes() []byte {
+	sb := inode.fs.sb
+	buf := new(bytes.Buffer)
+	struc.Pack(buf, inode)
+	// only the extra fields covered by Extra_isize are really part of the inode, with 128 byte
+	// inodes there are none
+	b := make([]byte, sb.Inode_size)
+	copy(b, inode.raw)
+	n := 128
+	if sb.Inode_size > 128 {
+		n += int(inode.Extra_isize)
+		if n > buf.Len() {
+			n = buf.Len()
+		}
+		if n > len(b) {
+			n = len(b)
+		}
+	}
+	copy(b, buf.Bytes()[:n])
+
+	if sb.FeatureRoCompatMetadata_csum() {
+		crc := inode.csum(b)
+		inode.Checksum_low = uint16(crc)
+		binary.LittleEndian.PutUint16(b[0x7C:], inode.Checksum_low)
+		if inode.hasCsumHi() {
+			inode.Checksum_hi = uint16(crc >> 16)
+			binary.LittleEndian.PutUint16(b[0x82:], inode.Checksum_hi)
+		}
+	}
+	return b
+}
+
+// hasCsumHi reports whether the inode is large enough to hold the upper half of its checksum
+func (inode *Inode) hasCsumHi() bool {
+	return inode.fs.sb.Inode_size > 128 && inode.Extra_isize >= 4
+}
+
+// csum computes the metadata_csum checksum of the on-disk inode b, ignoring the checksum fields
+// in it
+func (inode *Inode) csum(b []byte) uint32 {
+	b = append([]byte{}, b...)
+	b[0x7C], b[0x7D] = 0, 0
+	if inode.hasCsumHi() {
+		b[0x82], b[0x83] = 0, 0
+	}
+	cs := newMetadataChecksummer(inode.fs.sb)
+	cs.WriteUint32(uint32(inode.num))
+	cs.WriteUint32(inode.Generation)
+	cs.Write(b)
+	return cs.Get()
+}
+
+// setLeafExtents replaces the extent tree stored in the inode with a single leaf holding extents
+func (inode *Inode) setLeafExtents(extents []Extent) {
+	b := inode.BlockOrExtents[:]
+	for i := range b {
+		b[i] = 0
+	}
+	binary.LittleEndian.PutUint16(b[0:], EXT_MAGIC)
+	binary.LittleEndian.PutUint16(b[2:], uint16(len(extents)))
+	binary.LittleEndian.PutUint16(b[4:], 4)
+	binary.LittleEndian.PutUint16(b[6:], 0)
+	for i, e := range extents {
+		p := b[12+12*i:]
+		binary.LittleEndian.PutUint32(p[0:], e.Block)
+		binary.LittleEndian.PutUint16(p[4:], e.Len)
+		binary.LittleEndian.PutUint16(p[6:], e.Start_hi)
+		binary.LittleEndian.PutUint32(p[8:], e.Start_lo)
+	}
+}
+
+// clearExtraFields zeroes the extra fields that lie beyond Extra_isize, whose bytes on disk are
+// not really part of the inode
+func (inode *Inode) clearExtraFields() {
+	n := inode.Extra_isize
+	if inode.fs.sb.Inode_size == 128 {
+		n = 0
+		inode.Extra_isize = 0
+	}
+	fields := []*uint32{&inode.Ctime_extra, &inode.Mtime_extra, &inode.Atime_extra, &inode.Crtime, &inode.Crtime_extra, &inode.Version_hi, &inode.Projid}
+	if n < 4 {
+		inode.Checksum_hi = 0
+	}
+	for i, f := range fields {
+		if n < uint16(8+4*i) {
+			*f = 0
+		}
+	}
+}
+
+// checkUnencrypted refuses changes to the inode if it is encrypted: the names in an encrypted
+// directory and the contents of an encrypted file can only be written with its key
+func (inode *Inode) checkUnencrypted() error {
+	if inode.Flags&ENCRYPT_FL != 0 {
+		return fmt.Errorf("inode %d is encrypted", inode.num)
+	}
+	return nil
+}
+
+// isFastSymlink reports whether the inode is a symbolic link whose target is stored in i_block
+func (inode *Inode) isFastSymlink() bool {
+	size := inode.GetSize()
+	return inode.Mode&S_IFMT == S_IFLNK && size > 0 && size < int64(len(inode.BlockOrExtents)) && inode.Flags&EXTENTS_FL == 0
+}
+
+// hasBlockMap reports whether i_block holds an extent tree or a block map, rather than a device
+// number, a fast symlink or inline data
+func (inode *Inode) hasBlockMap() bool {
+	switch inode.Mode & S_IFMT {
+	case S_IFCHR, S_IFBLK, S_IFIFO, S_IFSOCK:
+		return false
+	case S_IFLNK:
+		if inode.isFastSymlink() {
+			return false
+		}
+	}
+	return inode.Flags&INLINE_DATA_FL == 0
+}
+
+// ownedBlocks returns every block belonging to the inode: its data blocks as well as the extent
+// tree nodes or indirect blocks that map them
+func (inode *Inode) ownedBlocks() ([]blockRange, error) {
+	ranges := []blockRange{}
+	if !inode.hasBlockMap() {
+		return ranges, nil
+	}
+	if inode.UsesExtents() {
+		return inode.fs.extentNodeBlocks(inode.BlockOrExtents[:], ranges)
+	}
+
+	var err error
+	for i := 0; i < 15; i++ {
+		ptr := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*i:]))
+		if ptr == 0 {
+			continue
+		}
+		level := 0
+		if i >= 12 {
+			level = i - 11
+		}
+		if ranges, err = inode.fs.indirectBlocks(ptr, level, ranges); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
+// extentNodeBlocks adds to ranges the blocks referenced by the extent tree node in b, and those
+// of all of its children
+func (fs *FileSystem) extentNodeBlocks(b []byte, ranges []blockRange) ([]blockRange, error) {
+	magic := binary.LittleEndian.Uint16(b[0:])
+	entries := int(binary.LittleEndian.Uint16(b[2:]))
+	depth := binary.LittleEndian.Uint16(b[6:])
+	if magic != EXT_MAGIC {
+		return nil, fmt.Errorf("invalid extent header magic %x", magic)
+	}
+	if 12+12*entries > len(b) {
+		return nil, fmt.Errorf("extent node has too many entries: %d", entries)
+	}
+	for i := 0; i < entries; i++ {
+		e := b[12+12*i:]
+		if depth == 0 {
+			length := int64(binary.LittleEndian.Uint16(e[4:]))
+			if length > 32768 {
+				// uninitialized extent
+				length -= 32768
+			}
+			start := int64(binary.LittleEndian.Uint16(e[6:]))<<32 | int64(binary.LittleEndian.Uint32(e[8:]))
+			ranges = appendRange(ranges, start, length)
+			continue
+		}
+		leaf := int64(binary.LittleEndian.Uint16(e[8:]))<<32 | int64(binary.LittleEndian.Uint32(e[4:]))
+		ranges = appendRange(ranges, leaf, 1)
+		child, err := fs.readBlock(leaf)
+		if err != nil {
+			return nil, err
+		}
+		if ranges, err = fs.extentNodeBlocks(child, ranges); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
+
+// indirectBlocks adds to ranges block ptr and, for an indirect block of the given level, all of
+// the blocks it maps
+func (fs *FileSystem) indirectBlocks(ptr int64, level int, ranges []blockRange) ([]blockRange, error) {
+	ranges = appendRange(ranges, ptr, 1)
+	if level == 0 {
+		return ranges, nil
+	}
+	b, err := fs.readBlock(ptr)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(b); i += 4 {
+		child := int64(binary.LittleEndian.Uint32(b[i:]))
+		if child == 0 {
+			continue
+		}
+		if ranges, err = fs.indirectBlocks(child, level-1, ranges); err != nil {
+			return nil, err
+		}
+	}
+	return ranges, nil
+}
@@ -0,0 +1,183 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Inspection is what Inspect finds out about an inode, much like the stat, ex and ls commands of
+// debugfs show
+type Inspection struct {
+	// Num is the number of the inode and Group its block group
+	Num   int64
+	Group int64
+	// Address is where the inode is on the device, in bytes, the start of the filesystem included
+	Address int64
+	// Inode holds the fields of the inode, as GetInode returns them
+	Inode *Inode
+	// Raw is the inode as it is stored, Inode_size bytes
+	Raw []byte
+	// ExtentNodes are the nodes of the extent tree of the inode, the root in the inode first and
+	// the rest in depth-first order; none if it has no extent tree
+	ExtentNodes []InspectedExtentNode
+	// Entries are the entries of a directory in the order they are stored, unused ones included;
+	// none for anything else
+	Entries []InspectedEntry
+}
+
+// InspectedExtentNode is a node of an extent tree as Inspect finds it
+type InspectedExtentNode struct {
+	// Block is where the node is stored, 0 for the root, which is in the inode
+	Block  int64
+	Header ExtentHeader
+	// Index holds the entries of an interior node, which point to the nodes below it, and
+	// Extents those of a leaf
+	Index   []ExtentInternal
+	Extents []Extent
+}
+
+// InspectedEntry is a directory entry as Inspect finds it
+type InspectedEntry struct {
+	DirectoryEntry2
+	// Block is the block of the directory holding the entry, and Offset where in it the entry
+	// is. For an inline directory Block is -1 for the entries in i_block, after the inode number
+	// of the parent, and -2 for those in the system.data extended attribute.
+	Block  int64
+	Offset int
+}
+
+// Inspect returns the raw fields of the inode at p, the nodes of its extent tree and, for a
+// directory, its entries, for looking into how a file is stored. A symbolic link at p is not
+// followed.
+func (fs *FileSystem) Inspect(p string) (*Inspection, error) {
+	inode, err := fs.lookup(path.Clean("/" + p))
+	if err != nil {
+		return nil, err
+	}
+	return inode.inspect()
+}
+
+// InspectInode is Inspect for the inode numbered num, which need not be in use. The inode is
+// taken as it is stored, without verifying its checksum.
+func (fs *FileSystem) InspectInode(num int64) (*Inspection, error) {
+	if num < 1 || num > int64(fs.sb.InodeCount) {
+		return nil, fmt.Errorf("invalid inode number %d", num)
+	}
+	return fs.getInode(num).inspect()
+}
+
+func (inode *Inode) inspect() (*Inspection, error) {
+	fs := inode.fs
+	in := &Inspection{
+		Num:     inode.num,
+		Group:   (inode.num - 1) / int64(fs.sb.InodePer_group),
+		Address: fs.start + inode.address,
+		Inode:   inode,
+		Raw:     append([]byte{}, inode.raw...),
+	}
+	if inode.UsesExtents() && inode.hasBlockMap() {
+		root, err := inode.extentRoot()
+		if err != nil {
+			return nil, err
+		}
+		if err := inode.inspectExtentNode(root, in); err != nil {
+			return nil, err
+		}
+	}
+	if inode.Mode&S_IFMT == S_IFDIR {
+		dir := NewDirectory(inode)
+		err := dir.walkBlocks(func(phys int64, b []byte) (bool, error) {
+			entries, err := parseDirBlock(b)
+			if err != nil {
+				return false, err
+			}
+			for _, e := range entries {
+				in.Entries = append(in.Entries, InspectedEntry{
+					DirectoryEntry2: DirectoryEntry2{Inode: e.inode, Rec_len: uint16(e.recLen), Name_len: uint8(len(e.name)), Flags: e.ftype, Name: e.name},
+					Block:           phys,
+					Offset:          e.pos,
+				})
+			}
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return in, nil
+}
+
+// inspectExtentNode adds extent tree node n and all below it to the inspection
+func (inode *Inode) inspectExtentNode(n *extentNode, in *Inspection) error {
+	node := InspectedExtentNode{
+		Block: n.block,
+		Header: ExtentHeader{
+			Magic:      binary.LittleEndian.Uint16(n.b[0:]),
+			Entries:    binary.LittleEndian.Uint16(n.b[2:]),
+			Max:        binary.LittleEndian.Uint16(n.b[4:]),
+			Depth:      binary.LittleEndian.Uint16(n.b[6:]),
+			Generation: binary.LittleEndian.Uint32(n.b[8:]),
+		},
+	}
+	for i := 0; i < n.entries(); i++ {
+		if n.depth() == 0 {
+			node.Extents = append(node.Extents, n.extent(i))
+		} else {
+			node.Index = append(node.Index, n.index(i))
+		}
+	}
+	in.ExtentNodes = append(in.ExtentNodes, node)
+	for _, idx := range node.Index {
+		child, err := inode.readExtentNode(idx.leaf())
+		if err != nil {
+			return err
+		}
+		if child.depth() != n.depth()-1 {
+			return fmt.Errorf("extent node in block %d of inode %d has depth %d under depth %d", child.block, inode.num, child.depth(), n.depth())
+		}
+		if err := inode.inspectExtentNode(child, in); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String formats the inspection much as debugfs shows an inode, its extent tree and its
+// directory entries
+func (in *Inspection) String() string {
+	inode := in.Inode
+	var b strings.Builder
+	fmt.Fprintf(&b, "Inode: %d   Group: %d   Address: %d   Mode: %#o   Flags: %#x\n", in.Num, in.Group, in.Address, inode.Mode, inode.Flags)
+	fmt.Fprintf(&b, "Links: %d   User: %d   Group: %d   Size: %d   Blocks: %d\n", inode.Links_count, inode.uid(), inode.gid(), inode.GetSize(), inode.GetBlockCount())
+	for _, t := range []struct {
+		name  string
+		which inodeTime
+	}{{"ctime", timeChange}, {"atime", timeAccess}, {"mtime", timeModify}, {"crtime", timeCreate}} {
+		if tm := inode.getTime(t.which); !tm.IsZero() {
+			fmt.Fprintf(&b, "%s: %s\n", t.name, tm.UTC().Format(time.RFC3339Nano))
+		}
+	}
+	if inode.Dtime != 0 {
+		fmt.Fprintf(&b, "dtime: %d\n", inode.Dtime)
+	}
+	for _, n := range in.ExtentNodes {
+		fmt.Fprintf(&b, "Extent node at block %d: depth %d, %d/%d entries\n", n.Block, n.Header.Depth, n.Header.Entries, n.Header.Max)
+		for _, idx := range n.Index {
+			fmt.Fprintf(&b, "  (%d-): index to block %d\n", idx.Block, idx.leaf())
+		}
+		for _, e := range n.Extents {
+			uninit := ""
+			if e.uninitialized() {
+				uninit = " [uninit]"
+			}
+			fmt.Fprintf(&b, "  (%d-%d): %d-%d%s\n", e.Block, int64(e.Block)+e.length()-1, e.start(), e.start()+e.length()-1, uninit)
+		}
+	}
+	for _, e := range in.Entries {
+		fmt.Fprintf(&b, "Entry at block %d offset %d: inode %d, rec_len %d, type %d, name %q\n", e.Block, e.Offset, e.Inode, e.Rec_len, e.Flags, e.Name)
+	}
+	return b.String()
+}
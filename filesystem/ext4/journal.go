@@ -0,0 +1,555 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+
+	"github.com/diskfs/go-diskfs/util"
+)
+
+// jbd2 on-disk constants, see include/linux/jbd2.h . Unlike the rest of ext4, the journal is
+// big endian.
+const (
+	journalMagic = 0xC03B3998
+
+	journalDescriptorBlock = 1
+	journalCommitBlock     = 2
+	journalSuperblockV1    = 3
+	journalSuperblockV2    = 4
+	journalRevokeBlock     = 5
+
+	journalHeaderSize = 12
+	// journalRevokeHeaderSize is the header of a revoke block followed by its byte count
+	journalRevokeHeaderSize = 16
+	// journalTailSize is the checksum at the end of descriptor and revoke blocks
+	journalTailSize = 4
+
+	journalFeatureIncompatRevoke      = 0x1
+	journalFeatureIncompat64bit       = 0x2
+	journalFeatureIncompatAsyncCommit = 0x4
+	journalFeatureIncompatCsumV2      = 0x8
+	journalFeatureIncompatCsumV3      = 0x10
+	journalKnownIncompat              = journalFeatureIncompatRevoke | journalFeatureIncompat64bit |
+		journalFeatureIncompatAsyncCommit | journalFeatureIncompatCsumV2 | journalFeatureIncompatCsumV3
+
+	journalFlagEscape   = 0x1
+	journalFlagSameUUID = 0x2
+	journalFlagLastTag  = 0x8
+)
+
+// journal is the jbd2 journal kept in the journal inode of a filesystem. The first block of the
+// journal holds its superblock, the rest is a circular log of transactions.
+type journal struct {
+	fs *FileSystem
+	// sb is the raw journal superblock, kept whole so that fields we do not know survive updates
+	sb []byte
+	// blocks maps each block of the journal to the filesystem block holding it
+	blocks []int64
+	seed   uint32
+}
+
+// journalTag is one filesystem block logged by a descriptor block
+type journalTag struct {
+	block    int64
+	log      int64
+	flags    uint32
+	checksum uint32
+}
+
+// journalTransaction is a committed transaction found in the log
+type journalTransaction struct {
+	sequence uint32
+	tags     []journalTag
+	revoked  []int64
+}
+
+// jbd2Csum is the crc32c of b continuing from crc, without the final inversion, as jbd2 does it
+func jbd2Csum(crc uint32, b []byte) uint32 {
+	return ^crc32.Update(^crc, crc32.MakeTable(crc32.Castagnoli), b)
+}
+
+// openJournal reads the superblock of the journal of fs and maps out its blocks
+func (fs *FileSystem) openJournal() (*journal, error) {
+	if fs.sb.FeatureIncompatJournal_dev() || fs.sb.Journal_inum == 0 {
+		return nil, fmt.Errorf("external journals are not supported")
+	}
+	inode := fs.getInode(int64(fs.sb.Journal_inum))
+	count := inode.GetSize() / fs.sb.GetBlockSize()
+	j := &journal{fs: fs, blocks: make([]int64, 0, count)}
+	for i := int64(0); i < count; {
+		start, length, found := inode.GetBlockPtr(i)
+		if !found || start == 0 {
+			return nil, fmt.Errorf("journal inode %d has a hole at block %d", fs.sb.Journal_inum, i)
+		}
+		for n := int64(0); n < length && i < count; n++ {
+			j.blocks = append(j.blocks, start+n)
+			i++
+		}
+	}
+	if count == 0 {
+		return nil, fmt.Errorf("journal inode %d is empty", fs.sb.Journal_inum)
+	}
+
+	b, err := fs.readBlock(j.blocks[0])
+	if err != nil {
+		return nil, err
+	}
+	j.sb = b[:SuperblockSize]
+	if magic := binary.BigEndian.Uint32(j.sb); magic != journalMagic {
+		return nil, fmt.Errorf("invalid journal superblock magic %#x", magic)
+	}
+	switch j.blockType(j.sb) {
+	case journalSuperblockV1:
+		// version 1 has no features, wipe whatever is in their place
+		for i := 0x24; i < 0x30; i++ {
+			j.sb[i] = 0
+		}
+	case journalSuperblockV2:
+	default:
+		return nil, fmt.Errorf("unknown journal superblock type %d", j.blockType(j.sb))
+	}
+	if bs := int64(j.field(0xC)); bs != fs.sb.GetBlockSize() {
+		return nil, fmt.Errorf("journal block size %d does not match filesystem block size %d", bs, fs.sb.GetBlockSize())
+	}
+	if max := int64(j.field(0x10)); max > count || j.first() == 0 || j.first() >= max {
+		return nil, fmt.Errorf("journal of %d blocks does not fit in the journal inode of %d blocks", max, count)
+	}
+	if unknown := j.incompat() &^ journalKnownIncompat; unknown != 0 {
+		return nil, fmt.Errorf("journal has unsupported incompatible features %#x", unknown)
+	}
+	if j.checksummed() {
+		if j.sb[0x50] != 4 {
+			return nil, fmt.Errorf("unsupported journal checksum type %d", j.sb[0x50])
+		}
+		if csum := j.superblockCsum(); csum != j.field(0xFC) {
+			return nil, fmt.Errorf("journal superblock checksum %#x does not match calculated %#x", j.field(0xFC), csum)
+		}
+		j.seed = jbd2Csum(^uint32(0), j.sb[0x30:0x40])
+	}
+	return j, nil
+}
+
+func (j *journal) field(offset int) uint32 {
+	return binary.BigEndian.Uint32(j.sb[offset:])
+}
+
+func (j *journal) setField(offset int, v uint32) {
+	binary.BigEndian.PutUint32(j.sb[offset:], v)
+}
+
+func (j *journal) blockType(b []byte) uint32 {
+	return binary.BigEndian.Uint32(b[4:])
+}
+
+// first is the first block of the log, maxLen the size of the journal in blocks
+func (j *journal) first() int64  { return int64(j.field(0x14)) }
+func (j *journal) maxLen() int64 { return int64(j.field(0x10)) }
+
+// start is the block of the log where the oldest transaction still needed begins, 0 when the
+// journal is empty, and sequence is the number of that transaction
+func (j *journal) start() int64     { return int64(j.field(0x1C)) }
+func (j *journal) sequence() uint32 { return j.field(0x18) }
+
+func (j *journal) incompat() uint32 { return j.field(0x28) }
+
+func (j *journal) checksummed() bool {
+	return j.incompat()&(journalFeatureIncompatCsumV2|journalFeatureIncompatCsumV3) != 0
+}
+
+func (j *journal) superblockCsum() uint32 {
+	b := make([]byte, len(j.sb))
+	copy(b, j.sb)
+	binary.BigEndian.PutUint32(b[0xFC:], 0)
+	return jbd2Csum(^uint32(0), b)
+}
+
+// next returns the block of the log after n, wrapping around at the end of the journal
+func (j *journal) next(n int64) int64 {
+	n++
+	if n >= j.maxLen() {
+		n = j.first()
+	}
+	return n
+}
+
+// readLog reads block n of the journal
+func (j *journal) readLog(n int64) ([]byte, error) {
+	return j.fs.readBlock(j.blocks[n])
+}
+
+// writeSuperblock writes the journal superblock back, with a fresh checksum if needed
+func (j *journal) writeSuperblock() error {
+	if j.checksummed() {
+		j.setField(0xFC, j.superblockCsum())
+	}
+	b, err := j.readLog(0)
+	if err != nil {
+		return err
+	}
+	copy(b, j.sb)
+	return j.fs.writeBlock(j.blocks[0], b)
+}
+
+// tagSize returns the size of a block tag in a descriptor block, not counting the UUID that
+// follows tags without journalFlagSameUUID
+func (j *journal) tagSize() int {
+	if j.incompat()&journalFeatureIncompatCsumV3 != 0 {
+		return 16
+	}
+	size := 12
+	if j.incompat()&journalFeatureIncompatCsumV2 != 0 {
+		size += 2
+	}
+	if j.incompat()&journalFeatureIncompat64bit == 0 {
+		size -= 4
+	}
+	return size
+}
+
+// blockTailOK verifies the checksum at the end of a descriptor or revoke block
+func (j *journal) blockTailOK(b []byte) bool {
+	if !j.checksummed() {
+		return true
+	}
+	tail := len(b) - journalTailSize
+	stored := binary.BigEndian.Uint32(b[tail:])
+	c := make([]byte, len(b))
+	copy(c, b)
+	binary.BigEndian.PutUint32(c[tail:], 0)
+	return jbd2Csum(j.seed, c) == stored
+}
+
+// commitOK verifies the checksum of a commit block
+func (j *journal) commitOK(b []byte) bool {
+	if !j.checksummed() {
+		return true
+	}
+	stored := binary.BigEndian.Uint32(b[0x10:])
+	c := make([]byte, len(b))
+	copy(c, b)
+	binary.BigEndian.PutUint32(c[0x10:], 0)
+	return jbd2Csum(j.seed, c) == stored
+}
+
+// dataCsum is the checksum of logged block b in the tag of transaction sequence, 0 if the
+// journal has no checksums
+func (j *journal) dataCsum(sequence uint32, b []byte) uint32 {
+	if !j.checksummed() {
+		return 0
+	}
+	seq := make([]byte, 4)
+	binary.BigEndian.PutUint32(seq, sequence)
+	csum := jbd2Csum(jbd2Csum(j.seed, seq), b)
+	if j.incompat()&journalFeatureIncompatCsumV3 == 0 {
+		csum &= 0xffff
+	}
+	return csum
+}
+
+// parseDescriptor returns the tags of descriptor block b, whose logged blocks start right after
+// log block n
+func (j *journal) parseDescriptor(b []byte, n int64) []journalTag {
+	tags := []journalTag{}
+	end := len(b)
+	if j.checksummed() {
+		end -= journalTailSize
+	}
+	size := j.tagSize()
+	v3 := j.incompat()&journalFeatureIncompatCsumV3 != 0
+	is64 := j.incompat()&journalFeatureIncompat64bit != 0
+	for pos := journalHeaderSize; pos+size <= end; {
+		tag := journalTag{block: int64(binary.BigEndian.Uint32(b[pos:]))}
+		if v3 {
+			tag.flags = binary.BigEndian.Uint32(b[pos+4:])
+			tag.checksum = binary.BigEndian.Uint32(b[pos+12:])
+		} else {
+			tag.checksum = uint32(binary.BigEndian.Uint16(b[pos+4:]))
+			tag.flags = uint32(binary.BigEndian.Uint16(b[pos+6:]))
+		}
+		if is64 {
+			tag.block |= int64(binary.BigEndian.Uint32(b[pos+8:])) << 32
+		}
+		n = j.next(n)
+		tag.log = n
+		tags = append(tags, tag)
+
+		pos += size
+		if tag.flags&journalFlagSameUUID == 0 {
+			pos += 16
+		}
+		if tag.flags&journalFlagLastTag != 0 {
+			break
+		}
+	}
+	return tags
+}
+
+// parseRevoke returns the blocks revoked by revoke block b
+func (j *journal) parseRevoke(b []byte) []int64 {
+	size := 4
+	if j.incompat()&journalFeatureIncompat64bit != 0 {
+		size = 8
+	}
+	count := int(binary.BigEndian.Uint32(b[journalHeaderSize:]))
+	if count > len(b) {
+		count = len(b)
+	}
+	revoked := []int64{}
+	for pos := journalRevokeHeaderSize; pos+size <= count; pos += size {
+		if size == 8 {
+			revoked = append(revoked, int64(binary.BigEndian.Uint64(b[pos:])))
+		} else {
+			revoked = append(revoked, int64(binary.BigEndian.Uint32(b[pos:])))
+		}
+	}
+	return revoked
+}
+
+// scan walks the log from its start and returns the transactions that were committed. The log
+// ends at the first block that does not continue the expected sequence, or fails its checksum;
+// a transaction that is cut short there was never committed and is left out.
+func (j *journal) scan() ([]journalTransaction, error) {
+	transactions := []journalTransaction{}
+	if j.start() == 0 {
+		return transactions, nil
+	}
+	if j.start() < j.first() || j.start() >= j.maxLen() {
+		return nil, fmt.Errorf("journal start %d is outside of the log", j.start())
+	}
+
+	current := journalTransaction{sequence: j.sequence()}
+	n := j.start()
+	for steps := int64(0); steps < j.maxLen(); steps++ {
+		b, err := j.readLog(n)
+		if err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint32(b) != journalMagic || binary.BigEndian.Uint32(b[8:]) != current.sequence {
+			break
+		}
+		switch j.blockType(b) {
+		case journalDescriptorBlock:
+			if !j.blockTailOK(b) {
+				return transactions, nil
+			}
+			tags := j.parseDescriptor(b, n)
+			current.tags = append(current.tags, tags...)
+			if len(tags) > 0 {
+				n = tags[len(tags)-1].log
+			}
+		case journalRevokeBlock:
+			if !j.blockTailOK(b) {
+				return transactions, nil
+			}
+			current.revoked = append(current.revoked, j.parseRevoke(b)...)
+		case journalCommitBlock:
+			if !j.commitOK(b) {
+				return transactions, nil
+			}
+			transactions = append(transactions, current)
+			current = journalTransaction{sequence: current.sequence + 1}
+		default:
+			return transactions, nil
+		}
+		n = j.next(n)
+	}
+	return transactions, nil
+}
+
+// replayBlocks works out what recovery has to do: for every filesystem block, the log block
+// holding its newest logged copy, and whether that copy is escaped. Blocks revoked by the same
+// or a later transaction than the one that logged them are not replayed.
+func (j *journal) replayBlocks(transactions []journalTransaction) (map[int64]journalTag, error) {
+	revoked := map[int64]uint32{}
+	for _, t := range transactions {
+		for _, b := range t.revoked {
+			revoked[b] = t.sequence
+		}
+	}
+
+	replay := map[int64]journalTag{}
+	for _, t := range transactions {
+		for _, tag := range t.tags {
+			if seq, ok := revoked[tag.block]; ok && seq >= t.sequence {
+				continue
+			}
+			if tag.block >= j.fs.sb.GetBlockCount() {
+				return nil, fmt.Errorf("journal transaction %d logs block %d beyond the end of the filesystem", t.sequence, tag.block)
+			}
+			b, err := j.readLog(tag.log)
+			if err != nil {
+				return nil, err
+			}
+			if j.dataCsum(t.sequence, b) != tag.checksum {
+				return nil, fmt.Errorf("journal transaction %d has a bad checksum for block %d", t.sequence, tag.block)
+			}
+			replay[tag.block] = tag
+		}
+	}
+	return replay, nil
+}
+
+// loggedBlock returns the contents of the filesystem block logged by tag
+func (j *journal) loggedBlock(tag journalTag) ([]byte, error) {
+	b, err := j.readLog(tag.log)
+	if err != nil {
+		return nil, err
+	}
+	if tag.flags&journalFlagEscape != 0 {
+		binary.BigEndian.PutUint32(b, journalMagic)
+	}
+	return b, nil
+}
+
+// recoverJournal replays the committed transactions of the journal. When writable, they are
+// written to the filesystem and the journal is marked empty; otherwise the replayed blocks are
+// only laid over the read-only device in memory. Either way the superblock is read again
+// afterwards, as the journal may well have held a newer copy of it.
+func (fs *FileSystem) recoverJournal(writable bool) error {
+	j, err := fs.openJournal()
+	if err != nil {
+		return fmt.Errorf("unable to recover journal: %v", err)
+	}
+	transactions, err := j.scan()
+	if err != nil {
+		return fmt.Errorf("unable to recover journal: %v", err)
+	}
+	replay, err := j.replayBlocks(transactions)
+	if err != nil {
+		return fmt.Errorf("unable to recover journal: %v", err)
+	}
+
+	order := make([]int64, 0, len(replay))
+	for block := range replay {
+		order = append(order, block)
+	}
+	sort.Slice(order, func(a, b int) bool { return order[a] < order[b] })
+	for _, block := range order {
+		b, err := j.loggedBlock(replay[block])
+		if err != nil {
+			return fmt.Errorf("unable to recover journal: %v", err)
+		}
+		if ro, ok := fs.dev.(*readOnlyFile); ok {
+			ro.blocks[block] = b
+		} else if err := fs.writeBlock(block, b); err != nil {
+			return fmt.Errorf("unable to recover journal: %v", err)
+		}
+	}
+
+	if writable {
+		// the journal is empty now, and the next transaction follows the last one replayed
+		next := j.sequence()
+		if len(transactions) > 0 {
+			next = transactions[len(transactions)-1].sequence + 1
+		}
+		j.setField(0x18, next)
+		j.setField(0x1C, 0)
+		if err := j.writeSuperblock(); err != nil {
+			return fmt.Errorf("unable to recover journal: %v", err)
+		}
+	}
+
+	sb, err := readSuperblock(fs.dev, fs.start)
+	if err != nil {
+		return err
+	}
+	sb.fs = fs
+	sb.Feature_incompat &^= FEATURE_INCOMPAT_RECOVER
+	fs.sb = sb
+	if writable {
+		sb.UpdateCsumAndWriteback()
+	}
+	return nil
+}
+
+var errOpenedReadOnly = errors.New("ext4 filesystem was opened read-only")
+
+// readOnly reports whether the filesystem was opened with ReadOnly, or has features it cannot
+// write
+func (fs *FileSystem) readOnly() bool {
+	_, ok := fs.dev.(*readOnlyFile)
+	return ok
+}
+
+// errReadOnly returns the error for an attempt to change a filesystem that is read-only
+func (fs *FileSystem) errReadOnly() error {
+	if r, ok := fs.dev.(*readOnlyFile); ok && r.err != nil {
+		return r.err
+	}
+	return errOpenedReadOnly
+}
+
+// readOnlyFile refuses all writes to the device it wraps. Blocks replayed from the journal are
+// laid over what is read, giving a view of the filesystem as it would be after recovery.
+type readOnlyFile struct {
+	dev util.File
+	// err is why writes are refused, if not because the filesystem was opened with ReadOnly
+	err error
+	// start is where the filesystem begins on dev, size its block size
+	start  int64
+	size   int64
+	blocks map[int64][]byte
+}
+
+func (r *readOnlyFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.dev.ReadAt(b, off)
+	overlayBlocks(b, off, r.start, r.size, r.blocks)
+	return n, err
+}
+
+// overlayBlocks copies the parts of blocks, of size bytes each and numbered from start on the
+// device, that overlap b into it, where b was read from device offset off
+func overlayBlocks(b []byte, off, start, size int64, blocks map[int64][]byte) {
+	if len(blocks) == 0 || len(b) == 0 {
+		return
+	}
+	first := (off - start) / size
+	last := (off + int64(len(b)) - 1 - start) / size
+	for block := first; block <= last; block++ {
+		data, ok := blocks[block]
+		if !ok {
+			continue
+		}
+		src, dst := int64(0), start+block*size-off
+		if dst < 0 {
+			src, dst = -dst, 0
+		}
+		copy(b[dst:], data[src:])
+	}
+}
+
+// Read reads from the current position of the device as ReadAt does; the filesystem itself only
+// uses ReadAt
+func (r *readOnlyFile) Read(b []byte) (int, error) {
+	off, err := r.dev.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.ReadAt(b, off)
+	if _, serr := r.dev.Seek(off+int64(n), io.SeekStart); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+func (r *readOnlyFile) WriteAt(b []byte, off int64) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, errOpenedReadOnly
+}
+
+func (r *readOnlyFile) Seek(offset int64, whence int) (int64, error) {
+	return r.dev.Seek(offset, whence)
+}
+
+func (r *readOnlyFile) Close() error {
+	if c, ok := r.dev.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+)
+
+// Link creates newname as a hard link to the file oldname, like os.Link. oldname is not
+// followed if it is a symbolic link, and it cannot be a directory.
+func (fs *FileSystem) Link(oldname, newname string) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	inode, err := fs.lookup(path.Clean("/" + oldname))
+	if err != nil {
+		return err
+	}
+	if inode.Mode&S_IFMT == S_IFDIR {
+		return fmt.Errorf("cannot link to directory %s", oldname)
+	}
+	if inode.Links_count >= maxLinks {
+		return fmt.Errorf("too many links to %s", oldname)
+	}
+	dir, name, err := fs.newEntry(newname)
+	if err != nil {
+		return err
+	}
+
+	return fs.transaction(func() error {
+		entry := &DirectoryEntry2{Inode: uint32(inode.num), Flags: fs.sb.dirEntryType(inode.Mode), Name: name}
+		if err := dir.AddEntry(entry); err != nil {
+			return err
+		}
+		inode.Links_count++
+		inode.touch(timeChange)
+		inode.UpdateCsumAndWriteback()
+		parent := dir.f.inode
+		parent.touch(timeModify, timeChange)
+		parent.UpdateCsumAndWriteback()
+		return nil
+	})
+}
+
+// Mknod creates a special file at p, like syscall.Mknod: a character or block device, a FIFO or
+// a socket, as given by the S_IFMT bits of mode, with the permissions in its low 12 bits. dev
+// is the device number of a device in the Linux encoding, as made by unix.Mkdev, and is
+// ignored for the other types.
+//
+// The device number is stored in i_block as the kernel does, in the old 16-bit format if major
+// and minor both fit in a byte.
+func (fs *FileSystem) Mknod(p string, mode uint32, dev uint64) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	switch mode & S_IFMT {
+	case S_IFCHR, S_IFBLK, S_IFIFO, S_IFSOCK:
+	default:
+		return fmt.Errorf("cannot create %s of type %#o with Mknod", p, mode&S_IFMT)
+	}
+	dir, name, err := fs.newEntry(p)
+	if err != nil {
+		return err
+	}
+	parent := dir.f.inode
+
+	return fs.transaction(func() error {
+		node, err := fs.newFile(parent, 0, false)
+		if err != nil {
+			return err
+		}
+		inode := node.inode
+		inode.Mode = uint16(mode & (S_IFMT | 0xFFF))
+		// like the kernel, only regular files, directories and symlinks get an extent tree
+		inode.Flags &^= EXTENTS_FL
+		inode.BlockOrExtents = [60]byte{}
+		if mode&S_IFMT == S_IFCHR || mode&S_IFMT == S_IFBLK {
+			inode.setDevice(devMajor(dev), devMinor(dev))
+		}
+		inode.UpdateCsumAndWriteback()
+
+		entry := &DirectoryEntry2{Inode: uint32(inode.num), Flags: fs.sb.dirEntryType(inode.Mode), Name: name}
+		if err := dir.AddEntry(entry); err != nil {
+			return err
+		}
+		parent.touch(timeModify, timeChange)
+		parent.UpdateCsumAndWriteback()
+		return nil
+	})
+}
+
+// newEntry returns the directory a new entry for p goes in and its name, failing if the
+// directory does not exist or already has an entry by that name
+func (fs *FileSystem) newEntry(p string) (*directory, string, error) {
+	p = path.Clean("/" + p)
+	dirName, name := path.Split(p)
+	if name == "" {
+		return nil, "", fmt.Errorf("cannot create %s", p)
+	}
+	parent, err := fs.lookup(dirName)
+	if err != nil {
+		return nil, "", err
+	}
+	if parent.Mode&S_IFMT != S_IFDIR {
+		return nil, "", fmt.Errorf("%s is not a directory", dirName)
+	}
+	if err := parent.checkUnencrypted(); err != nil {
+		return nil, "", err
+	}
+	dir := NewDirectory(parent)
+	num, err := dir.FindEntry(name)
+	if err != nil {
+		return nil, "", err
+	}
+	if num != 0 {
+		return nil, "", fmt.Errorf("file exists %s", p)
+	}
+	return dir, name, nil
+}
+
+// dirEntryType returns the file type recorded in a directory entry for an inode of the given
+// mode, which is 0 without the filetype feature
+func (sb *Superblock) dirEntryType(mode uint16) uint8 {
+	if !sb.FeatureIncompatFiletype() {
+		return 0
+	}
+	switch mode & S_IFMT {
+	case S_IFREG:
+		return FT_REG_FILE
+	case S_IFDIR:
+		return FT_DIR
+	case S_IFCHR:
+		return FT_CHRDEV
+	case S_IFBLK:
+		return FT_BLKDEV
+	case S_IFIFO:
+		return FT_FIFO
+	case S_IFSOCK:
+		return FT_SOCK
+	case S_IFLNK:
+		return FT_SYMLINK
+	}
+	return 0
+}
+
+// devMajor and devMinor split a device number in the Linux encoding
+func devMajor(dev uint64) uint32 {
+	return uint32((dev>>8)&0xfff) | uint32((dev>>32)&^0xfff)
+}
+
+func devMinor(dev uint64) uint32 {
+	return uint32(dev&0xff) | uint32((dev>>12)&^0xff)
+}
+
+// setDevice stores the device number of a device inode in i_block: in the first word in the old
+// format if it fits, otherwise in the second in the new one
+func (inode *Inode) setDevice(major, minor uint32) {
+	if major < 256 && minor < 256 {
+		binary.LittleEndian.PutUint32(inode.BlockOrExtents[0:], major<<8|minor)
+		binary.LittleEndian.PutUint32(inode.BlockOrExtents[4:], 0)
+		return
+	}
+	binary.LittleEndian.PutUint32(inode.BlockOrExtents[0:], 0)
+	binary.LittleEndian.PutUint32(inode.BlockOrExtents[4:], minor&0xff|major<<8|(minor&^0xff)<<12)
+}
+
+// device returns the device number of a device inode in the Linux encoding
+func (inode *Inode) device() uint64 {
+	var major, minor uint32
+	if old := binary.LittleEndian.Uint32(inode.BlockOrExtents[0:]); old != 0 {
+		major, minor = (old>>8)&0xff, old&0xff
+	} else {
+		dev := binary.LittleEndian.Uint32(inode.BlockOrExtents[4:])
+		major, minor = (dev&0xfff00)>>8, dev&0xff|(dev>>12)&0xfff00
+	}
+	return uint64(major&0xfff)<<8 | uint64(major&^0xfff)<<32 | uint64(minor&0xff) | uint64(minor&^0xff)<<12
+}
@@ -0,0 +1,612 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/diskfs/go-diskfs/util"
+	"github.com/google/uuid"
+)
+
+const (
+	// defaultFeatures are the features Create enables unless told otherwise, matching mkfs.ext4
+	// apart from the journal and resize inode
+	defaultFeatures = "sparse_super,large_file,filetype,extent,64bit,flex_bg,metadata_csum,dir_index,huge_file,dir_nlink,extra_isize,ext_attr"
+	// createFeatures are all of the features Create knows how to lay out
+	createFeatures = defaultFeatures + ",uninit_bg,inline_data,casefold"
+
+	defaultInodeSize        = 256
+	defaultLogGroupsPerFlex = 4
+	defaultReservedPercent  = 5
+	// filesystems smaller than this get the mke2fs "small" defaults
+	smallFilesystemSize = 512 * 1024 * 1024
+	lostAndFoundSize    = 16 * 1024
+	maxBlocksPerGroup   = 65536 - 8
+)
+
+// Params are the optional settings for Create. Any field left at its zero value is replaced by
+// the default mkfs.ext4 would choose for a filesystem of the requested size.
+type Params struct {
+	// UUID of the filesystem, randomly generated if nil
+	UUID *uuid.UUID
+	// VolumeName is the label of the filesystem, at most 16 bytes
+	VolumeName string
+	// BlockSize is the filesystem block size, a power of 2 from 1024 to 65536 bytes. The default
+	// is 1024 for filesystems under 512MB and 4096 otherwise.
+	BlockSize int64
+	// InodeSize is the size of each on-disk inode, a power of 2 from 128 to BlockSize; default 256
+	InodeSize uint16
+	// InodeRatio is the number of bytes of filesystem space per inode. The default is 4096 for
+	// filesystems under 512MB and 16384 otherwise. Ignored if InodeCount is set.
+	InodeRatio int64
+	// InodeCount is the number of inodes to create, rounded up to fill the inode tables
+	InodeCount uint32
+	// ReservedBlocksPercent is the share of blocks reserved for the super-user, default 5
+	ReservedBlocksPercent *uint8
+	// LogGroupsPerFlex is log2 of the number of block groups packed together by flex_bg, default 4
+	LogGroupsPerFlex uint8
+	// Features adjusts the default features in mke2fs -O syntax, e.g. "^metadata_csum,^64bit"
+	Features string
+}
+
+// mkfsLayout tracks the placement of all metadata while creating a filesystem
+type mkfsLayout struct {
+	sb          *Superblock
+	gdtBlocks   int64
+	itableSize  int64
+	used        []byte
+	blockBitmap []int64
+	inodeBitmap []int64
+	inodeTable  []int64
+}
+
+// Create creates an ext4 filesystem in a given file or device
+//
+// requires the util.File where to create the filesystem, size is the size of the filesystem in bytes,
+// start is how far in bytes from the beginning of the util.File to create the filesystem,
+// and blocksize is the logical blocksize of the underlying device, 512 or 4096. The block size of
+// the filesystem itself, like all of its other settings, is taken from p, which may be nil to use
+// the defaults.
+//
+// note that you are *not* required to create the filesystem on the entire disk. You could have a disk of size
+// 20GB, and create a small filesystem of size 50MB that begins 2GB into the disk.
+// This is extremely useful for creating filesystems on disk partitions.
+//
+// The new filesystem has an empty root directory and a lost+found directory, as mkfs.ext4 leaves it.
+func Create(f util.File, size int64, start int64, blocksize int64, p *Params) (*FileSystem, error) {
+	if blocksize == 0 {
+		blocksize = 512
+	}
+	if blocksize != 512 && blocksize != 4096 {
+		return nil, fmt.Errorf("blocksize for ext4 device must be 512 or 4096 bytes, not %d", blocksize)
+	}
+	if p == nil {
+		p = &Params{}
+	}
+
+	sb, err := newSuperblock(size, p)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FileSystem{
+		sb:    sb,
+		start: start,
+	}
+	sb.fs = fs
+
+	l, err := newMkfsLayout(sb, p)
+	if err != nil {
+		return nil, err
+	}
+	if err := l.write(fs, f); err != nil {
+		return nil, err
+	}
+
+	return Read(f, size, start, blocksize)
+}
+
+// newSuperblock works out the geometry of a new filesystem of size bytes and returns its
+// superblock, with everything but the free counts filled in
+func newSuperblock(size int64, p *Params) (*Superblock, error) {
+	blockSize := p.BlockSize
+	if blockSize == 0 {
+		blockSize = 4096
+		if size < smallFilesystemSize {
+			blockSize = 1024
+		}
+	}
+	if blockSize < 1024 || blockSize > 65536 || blockSize&(blockSize-1) != 0 {
+		return nil, fmt.Errorf("invalid ext4 block size %d, must be a power of 2 from 1024 to 65536", blockSize)
+	}
+
+	features, err := parseFeatures(p.Features, mustParseFeatures(defaultFeatures))
+	if err != nil {
+		return nil, err
+	}
+	if unsupported := features.clear(mustParseFeatures(createFeatures)); !unsupported.empty() {
+		return nil, fmt.Errorf("ext4 Create does not support features %v", unsupported.names())
+	}
+	if features.incompat&FEATURE_INCOMPAT_64BIT != 0 && features.incompat&FEATURE_INCOMPAT_EXTENTS == 0 {
+		return nil, fmt.Errorf("ext4 feature 64bit requires the extent feature")
+	}
+	if features.roCompat&FEATURE_RO_COMPAT_METADATA_CSUM != 0 {
+		// metadata_csum supersedes uninit_bg
+		features.roCompat &^= FEATURE_RO_COMPAT_GDT_CSUM
+	}
+
+	inodeSize := p.InodeSize
+	if inodeSize == 0 {
+		inodeSize = defaultInodeSize
+	}
+	if inodeSize < 128 || int64(inodeSize) > blockSize || inodeSize&(inodeSize-1) != 0 {
+		return nil, fmt.Errorf("invalid ext4 inode size %d, must be a power of 2 from 128 to the block size %d", inodeSize, blockSize)
+	}
+	if inodeSize == 128 {
+		features.roCompat &^= FEATURE_RO_COMPAT_EXTRA_ISIZE
+		if features.incompat&FEATURE_INCOMPAT_INLINE_DATA != 0 {
+			return nil, fmt.Errorf("ext4 feature inline_data requires inodes larger than 128 bytes")
+		}
+	}
+
+	if len(p.VolumeName) > 16 {
+		return nil, fmt.Errorf("ext4 volume name %q is longer than 16 bytes", p.VolumeName)
+	}
+
+	reservedPercent := int64(defaultReservedPercent)
+	if p.ReservedBlocksPercent != nil {
+		reservedPercent = int64(*p.ReservedBlocksPercent)
+	}
+	if reservedPercent > 50 {
+		return nil, fmt.Errorf("ext4 reserved blocks percentage %d is above 50", reservedPercent)
+	}
+
+	id := uuid.New()
+	if p.UUID != nil {
+		id = *p.UUID
+	}
+	hashSeed := uuid.New()
+
+	blocks := size / blockSize
+	firstDataBlock := int64(0)
+	if blockSize == 1024 {
+		firstDataBlock = 1
+	}
+	// one bitmap block per group, but no more than the 16 bit free counts can describe
+	blocksPerGroup := 8 * blockSize
+	if blocksPerGroup > maxBlocksPerGroup {
+		blocksPerGroup = maxBlocksPerGroup
+	}
+	if features.incompat&FEATURE_INCOMPAT_64BIT == 0 && blocks > 0xFFFFFFFF {
+		return nil, fmt.Errorf("ext4 filesystem of %d blocks requires the 64bit feature", blocks)
+	}
+	if blocks-firstDataBlock < 64 {
+		return nil, fmt.Errorf("ext4 filesystem of %d bytes is too small", size)
+	}
+	groups := (blocks - firstDataBlock + blocksPerGroup - 1) / blocksPerGroup
+
+	// inodes per group fill whole inode table blocks and whole bytes of the inode bitmap
+	inodeCount := int64(p.InodeCount)
+	if inodeCount == 0 {
+		ratio := p.InodeRatio
+		if ratio == 0 {
+			ratio = 16384
+			if size < smallFilesystemSize {
+				ratio = 4096
+			}
+		}
+		if ratio < 1024 {
+			return nil, fmt.Errorf("invalid ext4 inode ratio %d, must be at least 1024", ratio)
+		}
+		inodeCount = blocks * blockSize / ratio
+	}
+	inodesPerBlock := blockSize / int64(inodeSize)
+	align := inodesPerBlock
+	if align < 8 {
+		align = 8
+	}
+	inodesPerGroup := (inodeCount + groups - 1) / groups
+	if inodesPerGroup < 16 {
+		inodesPerGroup = 16
+	}
+	inodesPerGroup = (inodesPerGroup + align - 1) / align * align
+	maxInodesPerGroup := 8 * blockSize
+	if maxInodesPerGroup > 65536-inodesPerBlock {
+		maxInodesPerGroup = (65536 - inodesPerBlock) / align * align
+	}
+	if inodesPerGroup > maxInodesPerGroup {
+		inodesPerGroup = maxInodesPerGroup
+	}
+	if inodesPerGroup*groups > 0xFFFFFFFF {
+		return nil, fmt.Errorf("too many inodes for an ext4 filesystem: %d", inodesPerGroup*groups)
+	}
+
+	now := uint32(time.Now().Unix())
+	logBlockSize := uint32(0)
+	for 1024<<logBlockSize < blockSize {
+		logBlockSize++
+	}
+
+	sb := &Superblock{
+		address:            Superblock0Offset,
+		First_data_block:   uint32(firstDataBlock),
+		Log_block_size:     logBlockSize,
+		Log_cluster_size:   logBlockSize,
+		BlockPer_group:     uint32(blocksPerGroup),
+		ClusterPer_group:   uint32(blocksPerGroup),
+		InodePer_group:     uint32(inodesPerGroup),
+		Wtime:              now,
+		Max_mnt_count:      0xFFFF,
+		Magic:              Ext4Magic,
+		State:              STATE_VALID_FS,
+		Errors:             ERRORS_CONTINUE,
+		Lastcheck:          now,
+		Rev_level:          1,
+		First_ino:          11,
+		Inode_size:         inodeSize,
+		Def_hash_version:   HASH_HALF_MD4,
+		Default_mount_opts: DEFM_XATTR_USER | DEFM_ACL,
+		MkfTime:            now,
+		Flags:              FLAGS_SIGNED_HASH,
+	}
+	sb.setFeatures(features)
+	copy(sb.Uuid[:], id[:])
+	copy(sb.Volume_name[:], p.VolumeName)
+	for i := range sb.Hash_seed {
+		sb.Hash_seed[i] = binary.LittleEndian.Uint32(hashSeed[4*i:])
+	}
+	if sb.FeatureIncompat64bit() {
+		sb.Desc_size = 64
+	}
+	if sb.FeatureRoCompatExtra_isize() {
+		sb.Min_extra_isize = 32
+		sb.Want_extra_isize = 32
+	}
+	if sb.FeatureIncompatFlex_bg() {
+		sb.Log_groupPer_flex = defaultLogGroupsPerFlex
+		if p.LogGroupsPerFlex != 0 {
+			sb.Log_groupPer_flex = p.LogGroupsPerFlex
+		}
+		if sb.Log_groupPer_flex > 31 {
+			return nil, fmt.Errorf("invalid ext4 flex_bg size 2^%d", sb.Log_groupPer_flex)
+		}
+	}
+	if sb.FeatureRoCompatMetadata_csum() {
+		sb.Checksum_type = CRC32C_CHKSUM
+	}
+	if sb.FeatureIncompatCasefold() {
+		sb.Encoding = ENC_UTF8_12_1
+	}
+
+	// a last group too small to hold its own metadata and some data is dropped, like mke2fs does
+	sb.setBlockCount(blocks)
+	if groups > 1 {
+		lastBlocks := blocks - firstDataBlock - (groups-1)*blocksPerGroup
+		overhead := 2 + inodesPerGroup*int64(inodeSize)/blockSize
+		if sb.groupHasSuper(groups - 1) {
+			overhead += 1 + (groups*sb.descSize()+blockSize-1)/blockSize
+		}
+		if lastBlocks < overhead+50 {
+			blocks -= lastBlocks
+			groups--
+			sb.setBlockCount(blocks)
+		}
+	}
+	sb.InodeCount = uint32(inodesPerGroup * groups)
+	sb.setReservedBlockCount(blocks * reservedPercent / 100)
+
+	return sb, nil
+}
+
+func mustParseFeatures(spec string) featureFlags {
+	f, err := parseFeatures(spec, featureFlags{})
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// newMkfsLayout places the group descriptor tables, bitmaps and inode tables of all block groups
+func newMkfsLayout(sb *Superblock, p *Params) (*mkfsLayout, error) {
+	blockSize := sb.GetBlockSize()
+	blocks := sb.GetBlockCount()
+	groups := sb.BlockGroupCount()
+	l := &mkfsLayout{
+		sb:          sb,
+		gdtBlocks:   (groups*sb.descSize() + blockSize - 1) / blockSize,
+		itableSize:  int64(sb.InodePer_group) * int64(sb.Inode_size) / blockSize,
+		used:        make([]byte, (blocks+7)/8),
+		blockBitmap: make([]int64, groups),
+		inodeBitmap: make([]int64, groups),
+		inodeTable:  make([]int64, groups),
+	}
+
+	for i := int64(0); i < int64(sb.First_data_block); i++ {
+		l.mark(i, 1)
+	}
+	for g := int64(0); g < groups; g++ {
+		if sb.groupHasSuper(g) {
+			l.mark(sb.groupFirstBlock(g), 1+l.gdtBlocks)
+		}
+	}
+
+	groupEnd := func(g int64) int64 {
+		end := sb.groupFirstBlock(g + 1)
+		if end > blocks {
+			end = blocks
+		}
+		return end
+	}
+
+	if sb.FeatureIncompatFlex_bg() {
+		// all of the metadata of a flex group is packed together at the start of its first group,
+		// block bitmaps first, then inode bitmaps, then the inode tables
+		flexSize := sb.GetGroupsPerFlex()
+		for first := int64(0); first < groups; first += flexSize {
+			last := first + flexSize
+			if last > groups {
+				last = groups
+			}
+			goal := sb.groupFirstBlock(first)
+			for _, loc := range []struct {
+				where []int64
+				size  int64
+			}{{l.blockBitmap, 1}, {l.inodeBitmap, 1}, {l.inodeTable, l.itableSize}} {
+				for g := first; g < last; g++ {
+					b := l.alloc(goal, loc.size, blocks)
+					if b < 0 {
+						return nil, fmt.Errorf("not enough space in ext4 filesystem for the metadata of block group %d", g)
+					}
+					loc.where[g] = b
+					goal = b + loc.size
+				}
+			}
+		}
+	} else {
+		for g := int64(0); g < groups; g++ {
+			first, end := sb.groupFirstBlock(g), groupEnd(g)
+			l.blockBitmap[g] = l.alloc(first, 1, end)
+			l.inodeBitmap[g] = l.alloc(first, 1, end)
+			l.inodeTable[g] = l.alloc(first, l.itableSize, end)
+			if l.blockBitmap[g] < 0 || l.inodeBitmap[g] < 0 || l.inodeTable[g] < 0 {
+				return nil, fmt.Errorf("block group %d is too small to hold its own metadata", g)
+			}
+		}
+	}
+	return l, nil
+}
+
+func (l *mkfsLayout) isUsed(b int64) bool {
+	return l.used[b/8]&(1<<uint(b%8)) != 0
+}
+
+func (l *mkfsLayout) mark(b, n int64) {
+	for i := b; i < b+n; i++ {
+		l.used[i/8] |= 1 << uint(i%8)
+	}
+}
+
+// alloc finds and marks the first run of n free blocks at or after goal and before end, returning
+// -1 when there is none
+func (l *mkfsLayout) alloc(goal, n, end int64) int64 {
+	run := int64(0)
+	for b := goal; b < end; b++ {
+		if l.isUsed(b) {
+			run = 0
+			continue
+		}
+		run++
+		if run == n {
+			l.mark(b-n+1, n)
+			return b - n + 1
+		}
+	}
+	return -1
+}
+
+// write lays the whole filesystem out on f
+func (l *mkfsLayout) write(fs *FileSystem, f util.File) error {
+	sb := l.sb
+	blockSize := sb.GetBlockSize()
+	blocks := sb.GetBlockCount()
+	groups := sb.BlockGroupCount()
+	lazyItable := sb.FeatureRoCompatMetadata_csum() || sb.FeatureRoCompatGdt_csum()
+	now := uint32(time.Now().Unix())
+
+	writeBlocks := func(block int64, b []byte) error {
+		if _, err := f.WriteAt(b, fs.start+block*blockSize); err != nil {
+			return fmt.Errorf("unable to write ext4 block %d: %v", block, err)
+		}
+		return nil
+	}
+
+	// the root directory and lost+found get their blocks right after the metadata
+	lpfBlocks := int64(lostAndFoundSize) / blockSize
+	if lpfBlocks < 1 {
+		lpfBlocks = 1
+	}
+	if !sb.FeatureIncompatExtents() && lpfBlocks > 12 {
+		lpfBlocks = 12
+	}
+	rootBlock := l.alloc(sb.groupFirstBlock(0), 1, blocks)
+	lpfBlock := l.alloc(sb.groupFirstBlock(0), lpfBlocks, blocks)
+	if rootBlock < 0 || lpfBlock < 0 {
+		return fmt.Errorf("not enough space in ext4 filesystem for the root directory")
+	}
+
+	// inodes 1 up to and including lost+found are in use
+	usedInodes := int64(sb.First_ino)
+	ipg := int64(sb.InodePer_group)
+	if usedInodes > ipg {
+		return fmt.Errorf("ext4 filesystem needs at least %d inodes per group", usedInodes)
+	}
+
+	gds := make([]*GroupDescriptor, groups)
+	freeBlocks := int64(0)
+	for g := int64(0); g < groups; g++ {
+		bgd := &GroupDescriptor{
+			fs:  fs,
+			num: g,
+		}
+		bgd.setBlockBitmapLoc(l.blockBitmap[g])
+		bgd.setInodeBitmapLoc(l.inodeBitmap[g])
+		bgd.setInodeTableLoc(l.inodeTable[g])
+
+		// block bitmap, with the bits past the end of a short last group set
+		first := sb.groupFirstBlock(g)
+		bitmap := make([]byte, blockSize)
+		free := int64(0)
+		for i := int64(0); i < blockSize*8; i++ {
+			if b := first + i; b >= blocks || i >= int64(sb.BlockPer_group) || l.isUsed(b) {
+				bitmap[i/8] |= 1 << uint(i%8)
+			} else {
+				free++
+			}
+		}
+		bgd.setFreeBlocksCount(free)
+		bgd.setBlockBitmapCsum(bitmap)
+		freeBlocks += free
+		if err := writeBlocks(l.blockBitmap[g], bitmap); err != nil {
+			return err
+		}
+
+		// inode bitmap, with the padding past the last inode of the group set
+		bitmap = make([]byte, blockSize)
+		used := int64(0)
+		if g == 0 {
+			used = usedInodes
+		}
+		for i := int64(0); i < blockSize*8; i++ {
+			if i < used || i >= ipg {
+				bitmap[i/8] |= 1 << uint(i%8)
+			}
+		}
+		bgd.setFreeInodesCount(ipg - used)
+		bgd.setInodeBitmapCsum(bitmap)
+		if err := writeBlocks(l.inodeBitmap[g], bitmap); err != nil {
+			return err
+		}
+
+		// with group checksums the kernel knows to skip unused inode tables, so only zero the
+		// table that is actually in use
+		if lazyItable {
+			bgd.setItableUnused(ipg - used)
+			if g > 0 {
+				bgd.Flags |= BG_INODE_UNINIT
+			}
+		}
+		if !lazyItable || g == 0 {
+			zero := make([]byte, blockSize*64)
+			for b := int64(0); b < l.itableSize; b += 64 {
+				n := l.itableSize - b
+				if n > 64 {
+					n = 64
+				}
+				if err := writeBlocks(l.inodeTable[g]+b, zero[:n*blockSize]); err != nil {
+					return err
+				}
+			}
+			bgd.Flags |= BG_INODE_ZEROED
+		}
+		gds[g] = bgd
+	}
+	gds[0].setUsedDirsCount(2)
+
+	sb.setFreeBlockCount(freeBlocks)
+	sb.Free_inodeCount = sb.InodeCount - uint32(usedInodes)
+
+	// root and lost+found
+	root := newDirInode(fs, ROOT_INO, 0755, 3, now)
+	lpf := newDirInode(fs, int64(sb.First_ino), 0700, 2, now)
+	for _, d := range []struct {
+		inode  *Inode
+		block  int64
+		blocks int64
+		data   [][]*DirectoryEntry2
+	}{
+		{root, rootBlock, 1, [][]*DirectoryEntry2{{
+			{Inode: ROOT_INO, Flags: FT_DIR, Name: "."},
+			{Inode: ROOT_INO, Flags: FT_DIR, Name: ".."},
+			{Inode: sb.First_ino, Flags: FT_DIR, Name: "lost+found"},
+		}}},
+		{lpf, lpfBlock, lpfBlocks, [][]*DirectoryEntry2{{
+			{Inode: sb.First_ino, Flags: FT_DIR, Name: "."},
+			{Inode: ROOT_INO, Flags: FT_DIR, Name: ".."},
+		}}},
+	} {
+		d.inode.Size_lo = uint32(d.blocks * blockSize)
+		d.inode.Blocks_lo = uint32(d.blocks * blockSize / 512)
+		if sb.FeatureIncompatExtents() {
+			d.inode.Flags |= EXTENTS_FL
+			d.inode.setLeafExtents([]Extent{{
+				Block:    0,
+				Len:      uint16(d.blocks),
+				Start_hi: uint16(d.block >> 32),
+				Start_lo: uint32(d.block),
+			}})
+		} else {
+			for i := int64(0); i < d.blocks; i++ {
+				binary.LittleEndian.PutUint32(d.inode.BlockOrExtents[4*i:], uint32(d.block+i))
+			}
+		}
+		for i := int64(0); i < d.blocks; i++ {
+			var entries []*DirectoryEntry2
+			if i < int64(len(d.data)) {
+				entries = d.data[i]
+			}
+			if err := writeBlocks(d.block+i, packDirBlock(d.inode, entries)); err != nil {
+				return err
+			}
+		}
+		g := (d.inode.num - 1) / ipg
+		pos := l.inodeTable[g]*blockSize + ((d.inode.num-1)%ipg)*int64(sb.Inode_size)
+		if _, err := f.WriteAt(d.inode.toBytes(), fs.start+pos); err != nil {
+			return fmt.Errorf("unable to write ext4 inode %d: %v", d.inode.num, err)
+		}
+	}
+
+	// group descriptor tables and superblocks, the primaries and all backups
+	gdt := make([]byte, l.gdtBlocks*blockSize)
+	for g, bgd := range gds {
+		copy(gdt[int64(g)*sb.descSize():], bgd.toBytes())
+	}
+	for g := int64(0); g < groups; g++ {
+		if !sb.groupHasSuper(g) {
+			continue
+		}
+		if err := writeBlocks(sb.groupFirstBlock(g)+1, gdt); err != nil {
+			return err
+		}
+		sb.Block_group_nr = uint16(g)
+		pos := sb.groupFirstBlock(g) * blockSize
+		if g == 0 {
+			pos = Superblock0Offset
+		}
+		if _, err := f.WriteAt(sb.toBytes(), fs.start+pos); err != nil {
+			return fmt.Errorf("unable to write ext4 superblock for block group %d: %v", g, err)
+		}
+	}
+	sb.Block_group_nr = 0
+	sb.toBytes()
+	return nil
+}
+
+// newDirInode returns a new in-memory directory inode with no blocks
+func newDirInode(fs *FileSystem, num int64, perm uint16, links uint16, now uint32) *Inode {
+	inode := &Inode{
+		Mode:        S_IFDIR | perm,
+		Links_count: links,
+		Atime:       now,
+		Ctime:       now,
+		Mtime:       now,
+		fs:          fs,
+		num:         num,
+	}
+	if fs.sb.Inode_size > 128 {
+		inode.Extra_isize = fs.sb.Want_extra_isize
+	}
+	if inode.Extra_isize >= 24 {
+		inode.Crtime = now
+	}
+	return inode
+}
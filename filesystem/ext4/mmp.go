@@ -0,0 +1,225 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/diskfs/go-diskfs/util"
+)
+
+// With the mmp feature, multi-mount protection, whoever has the filesystem open for writing keeps
+// updating a sequence number and time in the MMP block, so that it is not opened for writing
+// twice, say from two hosts sharing a disk. A clean or stale MMP block can be taken over.
+
+const (
+	mmpMagic = 0x004D4D50
+	// mmpSeqClean marks an MMP block of a filesystem nobody has open
+	mmpSeqClean = 0xFF4D4D50
+	// mmpSeqFsck marks an MMP block of a filesystem being checked by e2fsck
+	mmpSeqFsck = 0xE24D4D50
+	// mmpSeqMax is the largest sequence number of a filesystem in use
+	mmpSeqMax = 0xE24D4D4F
+	// mmpMinInterval is the shortest interval, in seconds, between updates of the MMP block
+	mmpMinInterval = 5
+	// mmpCsumOffset is where the checksum of the MMP block is, covering all before it
+	mmpCsumOffset = 1020
+)
+
+// mmpBlock is the MMP block, of which only the first 1024 bytes are used
+type mmpBlock struct {
+	Magic          uint32
+	Seq            uint32
+	Time           uint64
+	Nodename       [64]byte
+	Bdevname       [32]byte
+	Check_interval uint16
+}
+
+func mmpBlockFromBytes(b []byte) *mmpBlock {
+	m := &mmpBlock{
+		Magic:          binary.LittleEndian.Uint32(b[0:]),
+		Seq:            binary.LittleEndian.Uint32(b[4:]),
+		Time:           binary.LittleEndian.Uint64(b[8:]),
+		Check_interval: binary.LittleEndian.Uint16(b[112:]),
+	}
+	copy(m.Nodename[:], b[16:80])
+	copy(m.Bdevname[:], b[80:112])
+	return m
+}
+
+// toBytes serializes the MMP block into a block of size bytes, computing the checksum under
+// metadata_csum
+func (m *mmpBlock) toBytes(sb *Superblock, size int64) []byte {
+	b := make([]byte, size)
+	binary.LittleEndian.PutUint32(b[0:], m.Magic)
+	binary.LittleEndian.PutUint32(b[4:], m.Seq)
+	binary.LittleEndian.PutUint64(b[8:], m.Time)
+	copy(b[16:80], m.Nodename[:])
+	copy(b[80:112], m.Bdevname[:])
+	binary.LittleEndian.PutUint16(b[112:], m.Check_interval)
+	if sb.FeatureRoCompatMetadata_csum() {
+		binary.LittleEndian.PutUint32(b[mmpCsumOffset:], mmpCsum(sb, b))
+	}
+	return b
+}
+
+// mmpCsum returns the metadata_csum checksum of the MMP block b
+func mmpCsum(sb *Superblock, b []byte) uint32 {
+	cs := newMetadataChecksummer(sb)
+	cs.Write(b[:mmpCsumOffset])
+	return cs.Get()
+}
+
+// mmp holds the MMP block of a filesystem open for writing, updating it in the background until
+// released
+type mmp struct {
+	dev util.File
+	// sb is a copy of the superblock taken with the block, for the block size and checksum seed,
+	// neither of which changes while the filesystem is open; the superblock itself can be
+	// rewritten meanwhile
+	sb    *Superblock
+	addr  int64
+	block *mmpBlock
+	stop  chan struct{}
+	done  chan struct{}
+	// err is why run gave up, read only once it is done
+	err error
+}
+
+// mmpInterval returns how many seconds apart the MMP block of the filesystem is updated
+func (sb *Superblock) mmpInterval(m *mmpBlock) int64 {
+	interval := int64(sb.Mmp_update_interval)
+	if int64(m.Check_interval) > interval {
+		interval = int64(m.Check_interval)
+	}
+	if interval < mmpMinInterval {
+		interval = mmpMinInterval
+	}
+	return interval
+}
+
+// readMMP reads and verifies the MMP block of the filesystem from dev
+func (fs *FileSystem) readMMP(dev util.File) (*mmpBlock, int64, error) {
+	sb := fs.sb
+	bs := sb.GetBlockSize()
+	if sb.Mmp_block < uint64(sb.First_data_block) || int64(sb.Mmp_block) >= sb.GetBlockCount() {
+		return nil, 0, fmt.Errorf("invalid ext4 MMP block %d", sb.Mmp_block)
+	}
+	addr := fs.start + int64(sb.Mmp_block)*bs
+	b := make([]byte, bs)
+	if _, err := dev.ReadAt(b, addr); err != nil {
+		return nil, 0, fmt.Errorf("unable to read ext4 MMP block %d: %v", sb.Mmp_block, err)
+	}
+	m := mmpBlockFromBytes(b)
+	if m.Magic != mmpMagic {
+		return nil, 0, fmt.Errorf("invalid ext4 MMP block %d magic %#x", sb.Mmp_block, m.Magic)
+	}
+	if sb.FeatureRoCompatMetadata_csum() {
+		if stored, computed := binary.LittleEndian.Uint32(b[mmpCsumOffset:]), mmpCsum(sb, b); stored != computed {
+			if err := fs.corrupted("MMP block", -1, -1, int64(sb.Mmp_block), stored, computed); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	return m, addr, nil
+}
+
+// startMMP takes the MMP block of the filesystem for writing through dev, refusing if it shows
+// the filesystem is being checked or was updated too recently for whoever has it open to have
+// gone away, and keeps updating it until releaseMMP
+func (fs *FileSystem) startMMP(dev util.File) error {
+	m, addr, err := fs.readMMP(dev)
+	if err != nil {
+		return err
+	}
+	interval := fs.sb.mmpInterval(m)
+	// how long the kernel waits to see whether the block is still being updated
+	wait := 2*interval + 1
+	if wait > interval+60 {
+		wait = interval + 60
+	}
+	node := strings.TrimRight(string(m.Nodename[:]), "\x00")
+	switch age := time.Now().Unix() - int64(m.Time); {
+	case m.Seq == mmpSeqFsck:
+		return fmt.Errorf("ext4 filesystem is being checked by e2fsck on %q", node)
+	case m.Seq != mmpSeqClean && age < wait:
+		return fmt.Errorf("ext4 filesystem is in use on %q, its MMP block was updated %ds ago", node, age)
+	}
+
+	m.Seq = uint32(rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(mmpSeqMax) + 1)
+	m.Time = uint64(time.Now().Unix())
+	m.Nodename = [64]byte{}
+	if host, err := os.Hostname(); err == nil {
+		copy(m.Nodename[:len(m.Nodename)-1], host)
+	}
+	m.Check_interval = uint16(interval)
+	bs := fs.sb.GetBlockSize()
+	if _, err := dev.WriteAt(m.toBytes(fs.sb, bs), addr); err != nil {
+		return fmt.Errorf("unable to write ext4 MMP block: %v", err)
+	}
+	sb := *fs.sb
+	fs.mmp = &mmp{dev: dev, sb: &sb, addr: addr, block: m, stop: make(chan struct{}), done: make(chan struct{})}
+	go fs.mmp.run(time.Duration(sb.Mmp_update_interval) * time.Second)
+	return nil
+}
+
+// run updates the MMP block every interval until stopped, like the kmmpd thread of the kernel.
+// Should anyone else have written the block, it gives up.
+func (h *mmp) run(interval time.Duration) {
+	defer close(h.done)
+	if interval <= 0 {
+		interval = mmpMinInterval * time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	bs := h.sb.GetBlockSize()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		b := make([]byte, bs)
+		if _, err := h.dev.ReadAt(b, h.addr); err != nil {
+			h.err = fmt.Errorf("unable to read ext4 MMP block: %v", err)
+			return
+		}
+		if seq := binary.LittleEndian.Uint32(b[4:]); seq != h.block.Seq {
+			h.err = fmt.Errorf("ext4 MMP block was changed by someone else, sequence %#x instead of %#x", seq, h.block.Seq)
+			return
+		}
+		h.block.Seq++
+		if h.block.Seq > mmpSeqMax {
+			h.block.Seq = 1
+		}
+		h.block.Time = uint64(time.Now().Unix())
+		if _, err := h.dev.WriteAt(h.block.toBytes(h.sb, bs), h.addr); err != nil {
+			h.err = fmt.Errorf("unable to write ext4 MMP block: %v", err)
+			return
+		}
+	}
+}
+
+// releaseMMP stops updating the MMP block and marks it clean, returning any error met updating it
+func (fs *FileSystem) releaseMMP() error {
+	h := fs.mmp
+	if h == nil {
+		return nil
+	}
+	fs.mmp = nil
+	close(h.stop)
+	<-h.done
+	if h.err != nil {
+		return h.err
+	}
+	h.block.Seq = mmpSeqClean
+	h.block.Time = uint64(time.Now().Unix())
+	if _, err := h.dev.WriteAt(h.block.toBytes(h.sb, h.sb.GetBlockSize()), h.addr); err != nil {
+		return fmt.Errorf("unable to write ext4 MMP block: %v", err)
+	}
+	return nil
+}
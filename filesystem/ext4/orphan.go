@@ -0,0 +1,50 @@
+package ext4
+
+// An inode that was unlinked or truncated while still open is put on the orphan list, so that
+// its blocks are released should the system go down before it is closed. The list starts at
+// Last_orphan in the superblock and continues through the Dtime of each inode on it.
+
+// processOrphans completes what was left pending by the inodes on the orphan list, as the kernel
+// does on mount: those with no links left are deleted, the others have the blocks past their
+// end freed. The list is emptied. An inode that cannot be on the list ends it, as in the kernel.
+func (fs *FileSystem) processOrphans() error {
+	sb := fs.sb
+	return fs.transaction(func() error {
+		seen := map[int64]bool{}
+		for sb.Last_orphan != 0 {
+			num := int64(sb.Last_orphan)
+			if num < int64(sb.First_ino) || num > int64(sb.InodeCount) || seen[num] {
+				break
+			}
+			seen[num] = true
+			inode, err := fs.readInode(num)
+			if err != nil {
+				return err
+			}
+			sb.Last_orphan = inode.Dtime
+			if inode.Links_count == 0 {
+				if err := fs.freeInode(inode); err != nil {
+					return err
+				}
+				continue
+			}
+			inode.Dtime = 0
+			if err := inode.truncateBlocks(); err != nil {
+				return err
+			}
+			inode.UpdateCsumAndWriteback()
+		}
+		sb.Last_orphan = 0
+		sb.UpdateCsumAndWriteback()
+		return nil
+	})
+}
+
+// truncateBlocks frees the blocks of the inode past the end of the file
+func (inode *Inode) truncateBlocks() error {
+	if !inode.hasBlockMap() {
+		return nil
+	}
+	bs := inode.fs.sb.GetBlockSize()
+	return inode.unmapBlocks((inode.GetSize()+bs-1)/bs, 1<<32)
+}
@@ -0,0 +1,378 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Grow enlarges the filesystem to newSize bytes, which the device must already have room for,
+// much like resize2fs does while the filesystem is mounted. The last block group is filled up
+// and new ones are added after it, their bitmaps and inode tables left uninitialized where group
+// checksums allow. The group descriptor table grows into the blocks reserved for it, and once
+// there are none left it is converted to meta_bg, which keeps each further block of descriptors
+// in the groups it describes. The superblock and group descriptor backups, those in the new
+// groups included, are all brought up to date.
+//
+// newSize is rounded down to whole blocks, and a last group too small to hold its own metadata
+// and some data is left out, as mkfs does.
+func (fs *FileSystem) Grow(newSize int64) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	sb := fs.sb
+	bs := sb.GetBlockSize()
+	bpg, ipg := int64(sb.BlockPer_group), int64(sb.InodePer_group)
+	oldBlocks, oldGroups := sb.GetBlockCount(), sb.BlockGroupCount()
+	newBlocks := newSize / bs
+	switch {
+	case newBlocks < oldBlocks:
+		return fmt.Errorf("cannot shrink ext4 filesystem of %d blocks to %d blocks", oldBlocks, newBlocks)
+	case newBlocks > 0xFFFFFFFF && !sb.FeatureIncompat64bit():
+		return fmt.Errorf("ext4 filesystem of %d blocks requires the 64bit feature", newBlocks)
+	case sb.Log_cluster_size != sb.Log_block_size:
+		return fmt.Errorf("cannot grow ext4 filesystem with bigalloc")
+	}
+	newGroups := (newBlocks - int64(sb.First_data_block) + bpg - 1) / bpg
+	if newGroups > oldGroups {
+		last := newBlocks - sb.groupFirstBlock(newGroups-1)
+		overhead := 2 + (ipg*int64(sb.Inode_size)+bs-1)/bs
+		if sb.groupHasSuper(newGroups - 1) {
+			overhead += 1 + sb.oldDescBlocks() + 1 + int64(sb.Reserved_gdt_blocks)
+		}
+		if last < overhead+50 {
+			newGroups--
+			newBlocks = sb.groupFirstBlock(newGroups)
+		}
+	}
+	if newGroups*ipg > 0xFFFFFFFF {
+		return fmt.Errorf("too many inodes for an ext4 filesystem: %d", newGroups*ipg)
+	}
+	if newBlocks <= oldBlocks {
+		return nil
+	}
+	if _, err := fs.dev.ReadAt(make([]byte, 1), fs.start+newBlocks*bs-1); err != nil {
+		return fmt.Errorf("device is too small for an ext4 filesystem of %d blocks: %v", newBlocks, err)
+	}
+
+	err := fs.transaction(func() error {
+		if err := fs.growDescTable(oldGroups, newGroups); err != nil {
+			return err
+		}
+		sb.setBlockCount(newBlocks)
+		sb.InodeCount = uint32(newGroups * ipg)
+
+		free, err := fs.extendGroup(oldGroups-1, oldBlocks)
+		if err != nil {
+			return err
+		}
+		for g := oldGroups; g < newGroups; g++ {
+			n, err := fs.addGroup(g)
+			if err != nil {
+				return err
+			}
+			free += n
+		}
+		if err := fs.addResizeBackups(oldGroups); err != nil {
+			return err
+		}
+
+		reserved := sb.GetReservedBlockCount()
+		sb.setReservedBlockCount(reserved + (newBlocks-oldBlocks)*reserved/oldBlocks)
+		sb.setFreeBlockCount(sb.GetFreeBlockCount() + free)
+		sb.Free_inodeCount += uint32((newGroups - oldGroups) * ipg)
+		sb.UpdateCsumAndWriteback()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fs.writeBackups()
+}
+
+// growDescTable makes room for the descriptors of the groups from oldGroups up to newGroups,
+// taking a reserved block for each new block of the table, or, when there are none, converting
+// the filesystem to meta_bg
+func (fs *FileSystem) growDescTable(oldGroups, newGroups int64) error {
+	sb := fs.sb
+	dpb := sb.descPerBlock()
+	for d := (oldGroups + dpb - 1) / dpb; d < (newGroups+dpb-1)/dpb; d++ {
+		switch {
+		case sb.FeatureIncompatMeta_bg() && d >= int64(sb.First_meta_bg):
+			// the block goes in the first group it describes
+		case sb.Reserved_gdt_blocks > 0:
+			if sb.FeatureCompatResize_inode() {
+				if err := fs.takeReservedDescBlock(d); err != nil {
+					return err
+				}
+			}
+			sb.Reserved_gdt_blocks--
+		default:
+			if err := fs.convertToMetaBG(d); err != nil {
+				return err
+			}
+		}
+		// descriptors of groups yet to be added read as zeros
+		if err := fs.writeBlock(sb.descBlockLoc(d), make([]byte, sb.GetBlockSize())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// takeReservedDescBlock hands the first reserved descriptor block, and its backups, over to
+// block d of the group descriptor table, removing them from the resize inode
+func (fs *FileSystem) takeReservedDescBlock(d int64) error {
+	sb := fs.sb
+	inode := fs.getInode(RESIZE_INO)
+	dind := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*(directBlocks+1):]))
+	if dind == 0 {
+		return fmt.Errorf("resize inode has no double indirect block")
+	}
+	b, err := fs.readBlock(dind)
+	if err != nil {
+		return err
+	}
+	slot := b[4*(d%(sb.GetBlockSize()/4)):]
+	primary := sb.descBlockLoc(d)
+	if ptr := int64(binary.LittleEndian.Uint32(slot)); ptr != primary {
+		return fmt.Errorf("resize inode maps block %d instead of reserved group descriptor block %d", ptr, primary)
+	}
+	// the reserved block lists its backups
+	list, err := fs.readBlock(primary)
+	if err != nil {
+		return err
+	}
+	backups := int64(0)
+	for i := 0; i < len(list); i += 4 {
+		if binary.LittleEndian.Uint32(list[i:]) != 0 {
+			backups++
+		}
+	}
+	binary.LittleEndian.PutUint32(slot, 0)
+	if err := fs.writeBlock(dind, b); err != nil {
+		return err
+	}
+	inode.addBlockCount(-(backups + 1))
+	inode.UpdateCsumAndWriteback()
+	return nil
+}
+
+// convertToMetaBG switches the filesystem to meta_bg from block d of the group descriptor table
+// on, releasing the resize inode, which has nothing left to reserve
+func (fs *FileSystem) convertToMetaBG(d int64) error {
+	sb := fs.sb
+	if sb.FeatureCompatResize_inode() {
+		inode := fs.getInode(RESIZE_INO)
+		if dind := int64(binary.LittleEndian.Uint32(inode.BlockOrExtents[4*(directBlocks+1):])); dind != 0 {
+			if err := fs.freeBlocks([]blockRange{{start: dind, count: 1}}); err != nil {
+				return err
+			}
+		}
+		inode.BlockOrExtents = [60]byte{}
+		inode.Blocks_lo, inode.Blocks_high = 0, 0
+		inode.SetSize(0)
+		sb.Feature_compat &^= FEATURE_COMPAT_RESIZE_INODE
+	}
+	sb.Feature_incompat |= FEATURE_INCOMPAT_META_BG
+	sb.First_meta_bg = uint32(d)
+	return nil
+}
+
+// extendGroup frees the blocks that the group gains from the filesystem growing past oldBlocks,
+// if it was the last one and not full, returning how many there are
+func (fs *FileSystem) extendGroup(g, oldBlocks int64) (int64, error) {
+	sb := fs.sb
+	first := sb.groupFirstBlock(g)
+	end := sb.groupFirstBlock(g + 1)
+	if end > sb.GetBlockCount() {
+		end = sb.GetBlockCount()
+	}
+	if end <= oldBlocks {
+		return 0, nil
+	}
+	bgd := fs.getBlockGroupDescriptor(g)
+	var bitmap []byte
+	if bgd.Flags&BG_BLOCK_UNINIT != 0 {
+		bitmap = bgd.initBlockBitmap()
+		bgd.Flags &^= BG_BLOCK_UNINIT
+	} else {
+		var err error
+		if bitmap, err = fs.readBlock(bgd.GetBlockBitmapLoc()); err != nil {
+			return 0, err
+		}
+	}
+	for b := oldBlocks; b < end; b++ {
+		i := b - first
+		bitmap[i/8] &^= 1 << uint(i%8)
+	}
+	if err := fs.writeBlock(bgd.GetBlockBitmapLoc(), bitmap); err != nil {
+		return 0, err
+	}
+	bgd.setBlockBitmapCsum(bitmap)
+	bgd.setFreeBlocksCount(bgd.GetFreeBlocksCount() + end - oldBlocks)
+	bgd.UpdateCsumAndWriteback()
+	return end - oldBlocks, nil
+}
+
+// addGroup sets up new block group g with its bitmaps and inode table at its start, after its
+// copy of the superblock and group descriptors if it has one, returning how many of its blocks
+// are free. The group is empty; with group checksums its inode table is left to be zeroed when
+// first used.
+func (fs *FileSystem) addGroup(g int64) (int64, error) {
+	sb := fs.sb
+	bs := sb.GetBlockSize()
+	ipg := int64(sb.InodePer_group)
+	first := sb.groupFirstBlock(g)
+	n := sb.GetBlockCount() - first
+	if n > int64(sb.BlockPer_group) {
+		n = int64(sb.BlockPer_group)
+	}
+	dpb := sb.descPerBlock()
+	bgd := &GroupDescriptor{
+		fs:      fs,
+		num:     g,
+		address: sb.descBlockLoc(g/dpb)*bs + sb.descSize()*(g%dpb),
+	}
+	loc := first + sb.groupSuperBlocks(g)
+	itableSize := (ipg*int64(sb.Inode_size) + bs - 1) / bs
+	if loc+2+itableSize > first+n {
+		return 0, fmt.Errorf("block group %d is too small to hold its own metadata", g)
+	}
+	bgd.setBlockBitmapLoc(loc)
+	bgd.setInodeBitmapLoc(loc + 1)
+	bgd.setInodeTableLoc(loc + 2)
+
+	// block bitmap, with the bits past the end of a short last group set
+	bitmap := make([]byte, bs)
+	used := int64(0)
+	for _, r := range bgd.metadataBlocks() {
+		for b := r.start; b < r.start+r.count; b++ {
+			bitmap[(b-first)/8] |= 1 << uint((b-first)%8)
+			used++
+		}
+	}
+	for i := n; i < bs*8; i++ {
+		bitmap[i/8] |= 1 << uint(i%8)
+	}
+	if _, err := fs.writeData(bitmap, fs.start+loc*bs); err != nil {
+		return 0, fmt.Errorf("unable to write block bitmap of block group %d: %v", g, err)
+	}
+	bgd.setBlockBitmapCsum(bitmap)
+	bgd.setFreeBlocksCount(n - used)
+
+	// inode bitmap, with the padding past the last inode of the group set
+	bitmap = make([]byte, bs)
+	for i := ipg; i < bs*8; i++ {
+		bitmap[i/8] |= 1 << uint(i%8)
+	}
+	if _, err := fs.writeData(bitmap, fs.start+(loc+1)*bs); err != nil {
+		return 0, fmt.Errorf("unable to write inode bitmap of block group %d: %v", g, err)
+	}
+	bgd.setInodeBitmapCsum(bitmap)
+	bgd.setFreeInodesCount(ipg)
+
+	if sb.FeatureRoCompatMetadata_csum() || sb.FeatureRoCompatGdt_csum() {
+		bgd.Flags |= BG_INODE_UNINIT
+		bgd.setItableUnused(ipg)
+		// e2fsck insists on the bitmap of the last group being initialized
+		if g != sb.BlockGroupCount()-1 {
+			bgd.Flags |= BG_BLOCK_UNINIT
+		}
+	} else {
+		zero := make([]byte, bs*64)
+		for b := int64(0); b < itableSize; b += 64 {
+			c := itableSize - b
+			if c > 64 {
+				c = 64
+			}
+			if _, err := fs.writeData(zero[:c*bs], fs.start+(loc+2+b)*bs); err != nil {
+				return 0, fmt.Errorf("unable to write inode table of block group %d: %v", g, err)
+			}
+		}
+		bgd.Flags |= BG_INODE_ZEROED
+	}
+	bgd.UpdateCsumAndWriteback()
+	return n - used, nil
+}
+
+// addResizeBackups adds the backups of the reserved group descriptor blocks in the groups from
+// oldGroups on to the lists of them kept by the resize inode
+func (fs *FileSystem) addResizeBackups(oldGroups int64) error {
+	sb := fs.sb
+	if !sb.FeatureCompatResize_inode() || sb.Reserved_gdt_blocks == 0 {
+		return nil
+	}
+	inode := fs.getInode(RESIZE_INO)
+	added := int64(0)
+	for j := int64(0); j < int64(sb.Reserved_gdt_blocks); j++ {
+		primary := sb.superblockLoc(0) + 1 + sb.oldDescBlocks() + j
+		list, err := fs.readBlock(primary)
+		if err != nil {
+			return err
+		}
+		// the backups are listed in the order of their groups
+		i := 0
+		for g := int64(1); g < sb.BlockGroupCount() && i < len(list); g++ {
+			if !sb.groupHasSuper(g) {
+				continue
+			}
+			if g >= oldGroups {
+				binary.LittleEndian.PutUint32(list[i:], uint32(primary+g*int64(sb.BlockPer_group)))
+				added++
+			}
+			i += 4
+		}
+		if err := fs.writeBlock(primary, list); err != nil {
+			return err
+		}
+	}
+	inode.addBlockCount(added)
+	inode.UpdateCsumAndWriteback()
+	return nil
+}
+
+// writeBackups copies the superblock and the group descriptor table to all of their backups
+func (fs *FileSystem) writeBackups() error {
+	sb := fs.sb
+	bs := sb.GetBlockSize()
+	groups := sb.BlockGroupCount()
+	dpb := sb.descPerBlock()
+	for d := int64(0); d < (groups+dpb-1)/dpb; d++ {
+		b, err := fs.readBlock(sb.descBlockLoc(d))
+		if err != nil {
+			return err
+		}
+		backups := []int64{}
+		if !sb.FeatureIncompatMeta_bg() || d < int64(sb.First_meta_bg) {
+			for g := int64(1); g < groups; g++ {
+				if sb.groupHasSuper(g) && (!sb.FeatureIncompatMeta_bg() || g/dpb < int64(sb.First_meta_bg)) {
+					backups = append(backups, sb.groupFirstBlock(g)+1+d)
+				}
+			}
+		} else {
+			for _, g := range []int64{d*dpb + 1, d*dpb + dpb - 1} {
+				if g < groups {
+					backups = append(backups, sb.groupFirstBlock(g)+sb.groupSuperBlocks(g)-1)
+				}
+			}
+		}
+		for _, backup := range backups {
+			if err := fs.writeBlock(backup, b); err != nil {
+				return err
+			}
+		}
+	}
+
+	for g := int64(1); g < groups; g++ {
+		if !sb.groupHasSuper(g) {
+			continue
+		}
+		sb.Block_group_nr = uint16(g)
+		if _, err := fs.dev.WriteAt(sb.toBytes(), fs.start+sb.groupFirstBlock(g)*bs); err != nil {
+			return fmt.Errorf("unable to write ext4 superblock backup in block group %d: %v", g, err)
+		}
+	}
+	sb.Block_group_nr = 0
+	sb.toBytes()
+	return nil
+}
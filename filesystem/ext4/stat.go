@@ -0,0 +1,176 @@
+package ext4
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Chmod changes the permissions of p to those of mode, with the setuid, setgid and sticky bits,
+// like os.Chmod. Unlike os.Chmod, a symbolic link at p is not followed and cannot be changed.
+func (fs *FileSystem) Chmod(p string, mode os.FileMode) error {
+	return fs.changeInode(p, func(inode *Inode) error {
+		if inode.Mode&S_IFMT == S_IFLNK {
+			return fmt.Errorf("cannot change the mode of symbolic link %s", p)
+		}
+		perm := uint16(mode.Perm())
+		if mode&os.ModeSetuid != 0 {
+			perm |= S_ISUID
+		}
+		if mode&os.ModeSetgid != 0 {
+			perm |= S_ISGID
+		}
+		if mode&os.ModeSticky != 0 {
+			perm |= S_ISVTX
+		}
+		inode.Mode = inode.Mode&S_IFMT | perm
+		return nil
+	})
+}
+
+// Chown changes the owner and group of p, like os.Lchown: a uid or gid of -1 leaves it as it
+// is, and a symbolic link at p is changed rather than what it points to. Ids take 32 bits, the
+// upper 16 of them in Uid_high and Gid_high.
+func (fs *FileSystem) Chown(p string, uid, gid int) error {
+	if uid < -1 || int64(uid) > 0xFFFFFFFF || gid < -1 || int64(gid) > 0xFFFFFFFF {
+		return fmt.Errorf("invalid owner %d:%d", uid, gid)
+	}
+	return fs.changeInode(p, func(inode *Inode) error {
+		if uid != -1 {
+			inode.setUid(uint32(uid))
+		}
+		if gid != -1 {
+			inode.setGid(uint32(gid))
+		}
+		return nil
+	})
+}
+
+// Chtimes changes the access and modification times of p, like os.Chtimes, but without
+// following a symbolic link at p. The times are kept to the nanosecond if the inodes are large
+// enough, and from 1901 to 2446, otherwise to the second and until 2038.
+func (fs *FileSystem) Chtimes(p string, atime, mtime time.Time) error {
+	return fs.changeInode(p, func(inode *Inode) error {
+		inode.setTime(timeAccess, atime)
+		inode.setTime(timeModify, mtime)
+		return nil
+	})
+}
+
+// changeInode runs fn as a transaction changing the inode at p, and updates its change time
+func (fs *FileSystem) changeInode(p string, fn func(*Inode) error) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return err
+	}
+	return fs.transaction(func() error {
+		if err := fn(inode); err != nil {
+			return err
+		}
+		inode.touch(timeChange)
+		inode.UpdateCsumAndWriteback()
+		return nil
+	})
+}
+
+// StatT is what FileInfo.Sys returns for a file of an ext4 filesystem: what os.FileInfo has no
+// room for, much like syscall.Stat_t
+type StatT struct {
+	Ino   uint64
+	Nlink uint32
+	Uid   uint32
+	Gid   uint32
+	// Rdev is the device number of a device, in the Linux encoding as made by unix.Mkdev
+	Rdev  uint64
+	Atime time.Time
+	Mtime time.Time
+	Ctime time.Time
+	// Crtime is when the file was created, the zero time if the inode has no room for it
+	Crtime time.Time
+}
+
+// uid returns the owner of the inode, 32 bits split over Uid and Uid_high
+func (inode *Inode) uid() uint32 {
+	return uint32(inode.Uid_high)<<16 | uint32(inode.Uid)
+}
+
+func (inode *Inode) setUid(uid uint32) {
+	inode.Uid, inode.Uid_high = uint16(uid), uint16(uid>>16)
+}
+
+// gid returns the group of the inode, 32 bits split over Gid and Gid_high
+func (inode *Inode) gid() uint32 {
+	return uint32(inode.Gid_high)<<16 | uint32(inode.Gid)
+}
+
+func (inode *Inode) setGid(gid uint32) {
+	inode.Gid, inode.Gid_high = uint16(gid), uint16(gid>>16)
+}
+
+// inodeTime names one of the timestamps of an inode
+type inodeTime int
+
+const (
+	timeAccess inodeTime = iota
+	timeModify
+	timeChange
+	timeCreate
+)
+
+// timeFields returns the seconds and extra fields of a timestamp of the inode, and how large
+// Extra_isize must be for the inode to have the extra field, or for a creation time at all
+func (inode *Inode) timeFields(which inodeTime) (sec, extra *uint32, size uint16) {
+	switch which {
+	case timeAccess:
+		return &inode.Atime, &inode.Atime_extra, 16
+	case timeModify:
+		return &inode.Mtime, &inode.Mtime_extra, 12
+	case timeChange:
+		return &inode.Ctime, &inode.Ctime_extra, 8
+	}
+	return &inode.Crtime, &inode.Crtime_extra, 24
+}
+
+// hasExtra reports whether the extra fields of the inode reach size bytes
+func (inode *Inode) hasExtra(size uint16) bool {
+	return inode.fs.sb.Inode_size > 128 && inode.Extra_isize >= size
+}
+
+// getTime returns a timestamp of the inode. As in the kernel, the seconds are signed and the
+// low two bits of the extra field extend them beyond 2038, the rest holding nanoseconds.
+func (inode *Inode) getTime(which inodeTime) time.Time {
+	sec, extra, size := inode.timeFields(which)
+	if which == timeCreate && !inode.hasExtra(size-4) {
+		return time.Time{}
+	}
+	s := int64(int32(*sec))
+	if !inode.hasExtra(size) {
+		return time.Unix(s, 0)
+	}
+	s += int64(*extra&3) << 32
+	return time.Unix(s, int64(*extra>>2))
+}
+
+// setTime sets a timestamp of the inode, only to the second if it has no extra field for it
+func (inode *Inode) setTime(which inodeTime, t time.Time) {
+	sec, extra, size := inode.timeFields(which)
+	if which == timeCreate && !inode.hasExtra(size-4) {
+		return
+	}
+	s := t.Unix()
+	*sec = uint32(s)
+	if inode.hasExtra(size) {
+		*extra = uint32((s-int64(int32(s)))>>32)&3 | uint32(t.Nanosecond())<<2
+	}
+}
+
+// touch sets the given timestamps of the inode to the current time
+func (inode *Inode) touch(which ...inodeTime) {
+	now := time.Now()
+	for _, w := range which {
+		inode.setTime(w, now)
+	}
+}
@@ -1,6 +1,9 @@
 package ext4
 
 import (
+	"bytes"
+	"encoding/binary"
+
 	"github.com/lunixbochs/struc"
 )
 
@@ -126,35 +129,38 @@ type Superblock struct {
 	First_error_time  uint32   `struc:"uint32,little"`
 	First_error_ino   uint32   `struc:"uint32,little"`
 	First_error_block uint64   `struc:"uint64,little"`
-	First_error_func  [32]byte `struc:"[32]pad"`
+	First_error_func  [32]byte `struc:"[32]byte"`
 	First_error_line  uint32   `struc:"uint32,little"`
 	Last_error_time   uint32   `struc:"uint32,little"`
 	Last_error_ino    uint32   `struc:"uint32,little"`
 	Last_error_line   uint32   `struc:"uint32,little"`
 	Last_error_block  uint64   `struc:"uint64,little"`
-	Last_error_func   [32]byte `struc:"[32]pad"`
+	Last_error_func   [32]byte `struc:"[32]byte"`
 
-	Mount_opts        [64]byte  `struc:"[64]pad"`
+	Mount_opts        [64]byte  `struc:"[64]byte"`
 	Usr_quota_inum    uint32    `struc:"uint32,little"`
 	Grp_quota_inum    uint32    `struc:"uint32,little"`
 	Overhead_clusters uint32    `struc:"uint32,little"`
 	Backup_bgs        [2]uint32 `struc:"[2]uint32,little"`
-	Encrypt_algos     [4]byte   `struc:"[4]pad"`
-	Encrypt_pw_salt   [16]byte  `struc:"[16]pad"`
+	Encrypt_algos     [4]byte   `struc:"[4]byte"`
+	Encrypt_pw_salt   [16]byte  `struc:"[16]byte"`
 	Lpf_ino           uint32    `struc:"uint32,little"`
 	Prj_quota_inum    uint32    `struc:"uint32,little"`
 	Checksum_seed     uint32    `struc:"uint32,little"`
 
-	/*
-		SWtimeHi          uint8
-		SMtimeHi          uint8
-		SMkfsTimeHi       uint8
-		SLastcheckHi      uint8
-		SFirstErrorTimeHi uint8
-		SLastErrorTimeHi  uint8
-	*/
-
-	Reserved [98]uint32 `struc:"[98]uint32,little"`
+	Wtime_hi            uint8  `struc:"uint8"`
+	Mtime_hi            uint8  `struc:"uint8"`
+	Mkfs_time_hi        uint8  `struc:"uint8"`
+	Lastcheck_hi        uint8  `struc:"uint8"`
+	First_error_time_hi uint8  `struc:"uint8"`
+	Last_error_time_hi  uint8  `struc:"uint8"`
+	First_error_errcode uint8  `struc:"uint8"`
+	Last_error_errcode  uint8  `struc:"uint8"`
+	Encoding            uint16 `struc:"uint16,little"`
+	Encoding_flags      uint16 `struc:"uint16,little"`
+	Orphan_file_inum    uint32 `struc:"uint32,little"`
+
+	Reserved [94]uint32 `struc:"[94]uint32,little"`
 	Checksum uint32     `struc:"uint32,little"`
 
 	address        int64
@@ -266,6 +272,9 @@ func (sb *Superblock) FeatureIncompatInline_data() bool {
 func (sb *Superblock) FeatureIncompatEncrypt() bool {
 	return (sb.Feature_incompat&FEATURE_INCOMPAT_ENCRYPT != 0)
 }
+func (sb *Superblock) FeatureIncompatCasefold() bool {
+	return (sb.Feature_incompat&FEATURE_INCOMPAT_CASEFOLD != 0)
+}
 
 func (sb *Superblock) GetBlockCount() int64 {
 	if sb.FeatureIncompat64bit() {
@@ -279,8 +288,36 @@ func (sb *Superblock) GetBlockSize() int64 {
 	return int64(1024 << uint(sb.Log_block_size))
 }
 
+// GetClusterSize returns the size in bytes of a cluster, the unit in which blocks are allocated:
+// a power of two blocks with bigalloc, otherwise just one
+func (sb *Superblock) GetClusterSize() int64 {
+	return sb.GetBlockSize() << sb.clusterBits()
+}
+
+// clusterBits returns the log2 of the number of blocks in a cluster
+func (sb *Superblock) clusterBits() uint {
+	if !sb.FeatureRoCompatBigalloc() || sb.Log_cluster_size < sb.Log_block_size {
+		return 0
+	}
+	return uint(sb.Log_cluster_size - sb.Log_block_size)
+}
+
+// groupClusters returns how many clusters of block group num lie within the filesystem, which is
+// ClusterPer_group for all but a last group cut short. Block bitmaps have a bit for each cluster,
+// and the free block counts of the group descriptors count clusters too.
+func (sb *Superblock) groupClusters(num int64) int64 {
+	ratio := int64(1) << sb.clusterBits()
+	n := (sb.GetBlockCount() - sb.groupFirstBlock(num) + ratio - 1) >> sb.clusterBits()
+	if n > int64(sb.ClusterPer_group) {
+		n = int64(sb.ClusterPer_group)
+	}
+	return n
+}
+
 func (sb *Superblock) BlockGroupCount() (blockGroups int64) {
-	blockGroups = sb.GetBlockCount() / int64(sb.BlockPer_group)
+	// the last group may be only partially filled
+	blocks := sb.GetBlockCount() - int64(sb.First_data_block)
+	blockGroups = (blocks + int64(sb.BlockPer_group) - 1) / int64(sb.BlockPer_group)
 
 	// If we have less than one block-group's worth of blocks.
 	if blockGroups == 0 {
@@ -290,21 +327,164 @@ func (sb *Superblock) BlockGroupCount() (blockGroups int64) {
 	return blockGroups
 }
 
-func (sb *Superblock) UpdateCsumAndWriteback() {
-	if sb.Checksum_type == 0 {
-		return
+// descSize returns the on-disk size of a single group descriptor
+func (sb *Superblock) descSize() int64 {
+	if sb.FeatureIncompat64bit() && sb.Desc_size >= 64 {
+		return int64(sb.Desc_size)
+	}
+	return 32
+}
+
+// descPerBlock returns how many group descriptors fit in a block, which is also the number of
+// groups in a meta_bg group
+func (sb *Superblock) descPerBlock() int64 {
+	return sb.GetBlockSize() / sb.descSize()
+}
+
+// oldDescBlocks returns the number of blocks of the group descriptor table right after the
+// superblock and its backups: the whole table, or with meta_bg only its first First_meta_bg
+// blocks, the rest being spread over the meta_bg groups they describe
+func (sb *Superblock) oldDescBlocks() int64 {
+	if sb.FeatureIncompatMeta_bg() {
+		return int64(sb.First_meta_bg)
+	}
+	return (sb.BlockGroupCount() + sb.descPerBlock() - 1) / sb.descPerBlock()
+}
+
+// descBlockLoc returns where the primary copy of block d of the group descriptor table is
+func (sb *Superblock) descBlockLoc(d int64) int64 {
+	if !sb.FeatureIncompatMeta_bg() || d < int64(sb.First_meta_bg) {
+		return sb.superblockLoc(0) + 1 + d
 	}
+	// with meta_bg the block follows the superblock, if any, of the first group it describes
+	g := d * sb.descPerBlock()
+	return sb.groupFirstBlock(g) + sb.groupSuperBlocks(g) - 1
+}
+
+// superblockLoc returns the block holding the copy of the superblock in block group num: the
+// first block of the group, except for the primary on a filesystem of 1k blocks with bigalloc,
+// where the first data block is 0 and the superblock, 1024 bytes in, is block 1
+func (sb *Superblock) superblockLoc(num int64) int64 {
+	return sb.groupFirstBlock(num) + sb.bootBlocks(num)
+}
+
+// bootBlocks returns how many blocks of group num come before its copy of the superblock, which
+// is the boot block ahead of the primary if it has a block of its own
+func (sb *Superblock) bootBlocks(num int64) int64 {
+	if num == 0 && sb.First_data_block == 0 && sb.GetBlockSize() == 1024 {
+		return 1
+	}
+	return 0
+}
+
+// groupSuperBlocks returns how many blocks at the start of block group num hold a copy of the
+// superblock and group descriptors, including the blocks reserved for the table to grow into and
+// any boot block ahead of them
+func (sb *Superblock) groupSuperBlocks(num int64) int64 {
+	n := sb.bootBlocks(num)
+	hasSuper := sb.groupHasSuper(num)
+	if hasSuper {
+		n++
+	}
+	dpb := sb.descPerBlock()
+	switch meta := num / dpb; {
+	case !sb.FeatureIncompatMeta_bg():
+		if hasSuper {
+			n += sb.oldDescBlocks() + int64(sb.Reserved_gdt_blocks)
+		}
+	case meta < int64(sb.First_meta_bg):
+		if hasSuper {
+			n += sb.oldDescBlocks()
+		}
+	case num%dpb == 0 || num%dpb == 1 || num%dpb == dpb-1:
+		n++
+	}
+	return n
+}
 
-	cs := NewChecksummer(sb)
+// groupHasSuper reports whether block group num holds a copy of the superblock and group descriptors
+func (sb *Superblock) groupHasSuper(num int64) bool {
+	if num == 0 {
+		return true
+	}
+	if sb.FeatureCompatSparse_super2() {
+		return num == int64(sb.Backup_bgs[0]) || num == int64(sb.Backup_bgs[1])
+	}
+	if num == 1 || !sb.FeatureRoCompatSparse_super() {
+		return true
+	}
+	for _, base := range []int64{3, 5, 7} {
+		n := base
+		for n < num {
+			n *= base
+		}
+		if n == num {
+			return true
+		}
+	}
+	return false
+}
 
-	size, _ := struc.Sizeof(sb)
-	struc.Pack(LimitWriter(cs, int64(size)-4), sb)
-	sb.Checksum = cs.Get()
+// groupFirstBlock returns the number of the first block in block group num
+func (sb *Superblock) groupFirstBlock(num int64) int64 {
+	return int64(sb.First_data_block) + num*int64(sb.BlockPer_group)
+}
 
-	sb.fs.dev.Seek(sb.fs.start+sb.address, 0)
-	struc.Pack(sb.fs.dev, sb)
+func (sb *Superblock) UpdateCsumAndWriteback() {
+	sb.fs.dev.WriteAt(sb.toBytes(), sb.fs.start+sb.address)
 }
 
 func (sb *Superblock) GetGroupsPerFlex() int64 {
 	return 1 << sb.Log_groupPer_flex
 }
+
+// toBytes serializes the superblock into its 1024 on-disk bytes, computing the checksum when
+// metadata_csum is enabled
+func (sb *Superblock) toBytes() []byte {
+	buf := new(bytes.Buffer)
+	sb.Checksum = 0
+	struc.Pack(buf, sb)
+	b := buf.Bytes()
+	if sb.FeatureRoCompatMetadata_csum() {
+		cs := NewChecksummer(sb)
+		cs.Write(b[:SuperblockSize-4])
+		sb.Checksum = cs.Get()
+		binary.LittleEndian.PutUint32(b[SuperblockSize-4:], sb.Checksum)
+	}
+	return b
+}
+
+func (sb *Superblock) setBlockCount(n int64) {
+	sb.BlockCount_lo = uint32(n)
+	if sb.FeatureIncompat64bit() {
+		sb.BlockCount_hi = uint32(n >> 32)
+	}
+}
+
+func (sb *Superblock) GetReservedBlockCount() int64 {
+	if sb.FeatureIncompat64bit() {
+		return (int64(sb.R_blockCount_hi) << 32) | int64(sb.R_blockCount_lo)
+	}
+	return int64(sb.R_blockCount_lo)
+}
+
+func (sb *Superblock) setReservedBlockCount(n int64) {
+	sb.R_blockCount_lo = uint32(n)
+	if sb.FeatureIncompat64bit() {
+		sb.R_blockCount_hi = uint32(n >> 32)
+	}
+}
+
+func (sb *Superblock) GetFreeBlockCount() int64 {
+	if sb.FeatureIncompat64bit() {
+		return (int64(sb.Free_blockCount_hi) << 32) | int64(sb.Free_blockCount_lo)
+	}
+	return int64(sb.Free_blockCount_lo)
+}
+
+func (sb *Superblock) setFreeBlockCount(n int64) {
+	sb.Free_blockCount_lo = uint32(n)
+	if sb.FeatureIncompat64bit() {
+		sb.Free_blockCount_hi = uint32(n >> 32)
+	}
+}
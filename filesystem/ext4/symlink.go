@@ -0,0 +1,114 @@
+package ext4
+
+import (
+	"fmt"
+	"os"
+)
+
+// maxSymlinkFollow is how many symbolic links are followed opening a file before giving up,
+// as Linux does
+const maxSymlinkFollow = 40
+
+// Symlink creates a symbolic link at p that points to target, like os.Symlink.
+//
+// Targets shorter than 60 bytes are stored in the inode itself as a fast symlink, longer ones
+// in a data block. The target can be at most one block long.
+func (fs *FileSystem) Symlink(target, p string) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	if target == "" {
+		return fmt.Errorf("cannot create symlink %s to an empty target", p)
+	}
+	if int64(len(target)) >= fs.sb.GetBlockSize() {
+		return fmt.Errorf("symlink target of %d bytes is too long", len(target))
+	}
+
+	dir, name, err := fs.newEntry(p)
+	if err != nil {
+		return err
+	}
+	parent := dir.f.inode
+
+	return fs.transaction(func() error {
+		link, err := fs.newFile(parent, 0777, false)
+		if err != nil {
+			return err
+		}
+		inode := link.inode
+		inode.Mode = S_IFLNK | 0777
+		if len(target) < len(inode.BlockOrExtents) {
+			inode.Flags &^= EXTENTS_FL
+			inode.BlockOrExtents = [60]byte{}
+			copy(inode.BlockOrExtents[:], target)
+			inode.SetSize(int64(len(target)))
+		} else if _, err := link.write([]byte(target)); err != nil {
+			return err
+		}
+
+		if err := dir.AddEntry(&DirectoryEntry2{Inode: uint32(inode.num), Flags: fs.sb.dirEntryType(inode.Mode), Name: name}); err != nil {
+			return err
+		}
+		parent.touch(timeModify, timeChange)
+		parent.UpdateCsumAndWriteback()
+		return nil
+	})
+}
+
+// Readlink returns the target of the symbolic link p, like os.Readlink
+func (fs *FileSystem) Readlink(p string) (string, error) {
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return "", err
+	}
+	if inode.Mode&S_IFMT != S_IFLNK {
+		return "", fmt.Errorf("%s is not a symbolic link", p)
+	}
+	return inode.readlink()
+}
+
+// readlink returns the target of the symbolic link inode
+func (inode *Inode) readlink() (string, error) {
+	size := inode.GetSize()
+	if inode.isFastSymlink() {
+		return string(inode.BlockOrExtents[:size]), nil
+	}
+	if size >= inode.fs.sb.GetBlockSize() {
+		return "", fmt.Errorf("symlink inode %d has a target of %d bytes", inode.num, size)
+	}
+	b := make([]byte, size)
+	f := &File{extFile{fs: inode.fs, inode: inode}}
+	if _, err := f.Read(b); err != nil {
+		return "", fmt.Errorf("unable to read target of symlink inode %d: %v", inode.num, err)
+	}
+	return string(b), nil
+}
+
+// fileMode converts the mode of an inode to an os.FileMode
+func fileMode(mode uint16) os.FileMode {
+	m := os.FileMode(mode & 0777)
+	switch mode & S_IFMT {
+	case S_IFDIR:
+		m |= os.ModeDir
+	case S_IFLNK:
+		m |= os.ModeSymlink
+	case S_IFIFO:
+		m |= os.ModeNamedPipe
+	case S_IFSOCK:
+		m |= os.ModeSocket
+	case S_IFBLK:
+		m |= os.ModeDevice
+	case S_IFCHR:
+		m |= os.ModeDevice | os.ModeCharDevice
+	}
+	if mode&S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
@@ -0,0 +1,346 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/diskfs/go-diskfs/util"
+)
+
+// journalFile sits between a filesystem open for writing and its device. Outside of a
+// transaction it passes everything straight through; inside one it holds back the metadata
+// blocks written, so that they can be committed to the journal together before any of them is
+// written in place, or dropped should the transaction fail.
+type journalFile struct {
+	fs  *FileSystem
+	dev util.File
+	// j is the journal, nil for a filesystem without one
+	j *journal
+	// err is why the journal cannot be used, if it cannot; writes are refused then
+	err error
+	// blocks are the filesystem blocks changed by the running transaction, nil outside of one
+	blocks map[int64][]byte
+}
+
+// transaction runs fn as a single journal transaction: every metadata block fn writes is logged
+// to the journal and committed before it is written in place, so a crash at any point leaves
+// either all or none of the changes once the journal is recovered. Without a journal the blocks
+// are written in place once fn is done. Should fn fail, none of them are written, nor is the
+// superblock kept in memory changed, so that what it allocated is free again. Within a running
+// transaction, fn just runs.
+//
+// File contents are written directly, as in the data=ordered mode of the kernel, so they are on
+// the device before the metadata that refers to them is committed.
+func (fs *FileSystem) transaction(fn func() error) error {
+	jf, ok := fs.dev.(*journalFile)
+	if !ok || jf.blocks != nil {
+		return fn()
+	}
+	if jf.err != nil {
+		return jf.err
+	}
+	jf.blocks = map[int64][]byte{}
+	sb := *fs.sb
+	if err := fn(); err != nil {
+		jf.blocks = nil
+		*fs.sb = sb
+		return err
+	}
+	err := jf.commit()
+	jf.blocks = nil
+	return err
+}
+
+// writeData writes file contents at device offset off. They never go through the journal, but
+// a copy of the same blocks held back by the running transaction is kept up to date.
+func (fs *FileSystem) writeData(b []byte, off int64) (int, error) {
+	jf, ok := fs.dev.(*journalFile)
+	if !ok {
+		return fs.dev.WriteAt(b, off)
+	}
+	n, err := jf.dev.WriteAt(b, off)
+	if err == nil {
+		jf.each(b, off, false, func(data, p []byte) { copy(data, p) })
+	}
+	return n, err
+}
+
+func (jf *journalFile) size() int64 {
+	return jf.fs.sb.GetBlockSize()
+}
+
+// each calls fn for every block touched by writing b at off, with the held back copy of the
+// block and the part of b that goes into it, starting at the same offset in both. Blocks that
+// are not held back are skipped, or read from the device and held back when add is set.
+func (jf *journalFile) each(b []byte, off int64, add bool, fn func(data, p []byte)) error {
+	size, start := jf.size(), jf.fs.start
+	for len(b) > 0 {
+		block := (off - start) / size
+		pos := (off - start) % size
+		n := size - pos
+		if n > int64(len(b)) {
+			n = int64(len(b))
+		}
+		data, ok := jf.blocks[block]
+		if !ok && add {
+			if jf.j != nil && int64(len(jf.blocks)) >= jf.j.capacity()-1 {
+				// too big for the journal, commit what is there and carry on in a new transaction
+				if err := jf.commit(); err != nil {
+					return err
+				}
+				jf.blocks = map[int64][]byte{}
+			}
+			var err error
+			if data, err = jf.hold(block); err != nil {
+				return err
+			}
+			ok = true
+		}
+		if ok {
+			fn(data[pos:], b[:n])
+		}
+		b = b[n:]
+		off += n
+	}
+	return nil
+}
+
+// hold reads block from the device into the running transaction
+func (jf *journalFile) hold(block int64) ([]byte, error) {
+	data := make([]byte, jf.size())
+	if _, err := jf.dev.ReadAt(data, jf.fs.start+block*jf.size()); err != nil && err != io.EOF {
+		return nil, err
+	}
+	jf.blocks[block] = data
+	return data, nil
+}
+
+func (jf *journalFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := jf.dev.ReadAt(b, off)
+	overlayBlocks(b, off, jf.fs.start, jf.size(), jf.blocks)
+	return n, err
+}
+
+// Read reads from the current position of the device as ReadAt does; the filesystem itself only
+// uses ReadAt
+func (jf *journalFile) Read(b []byte) (int, error) {
+	off, err := jf.dev.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	n, err := jf.ReadAt(b, off)
+	if _, serr := jf.dev.Seek(off+int64(n), io.SeekStart); err == nil {
+		err = serr
+	}
+	return n, err
+}
+
+func (jf *journalFile) WriteAt(b []byte, off int64) (int, error) {
+	if jf.blocks == nil {
+		return jf.dev.WriteAt(b, off)
+	}
+	if err := jf.each(b, off, true, func(data, p []byte) { copy(data, p) }); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (jf *journalFile) Seek(offset int64, whence int) (int64, error) {
+	return jf.dev.Seek(offset, whence)
+}
+
+func (jf *journalFile) Close() error {
+	if c, ok := jf.dev.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// sync flushes the device, if it is something that can be flushed, so that what was written
+// before really is on it before anything after
+func (jf *journalFile) sync() error {
+	if s, ok := jf.dev.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// commit logs the blocks of the running transaction to the journal, then checkpoints them by
+// writing them in place, and empties the journal again. The superblock is part of every
+// transaction and flags the filesystem as needing recovery until the checkpoint is complete.
+// Without a journal the blocks are just written in place.
+func (jf *journalFile) commit() error {
+	if len(jf.blocks) == 0 {
+		return nil
+	}
+	fs, j := jf.fs, jf.j
+	if j == nil {
+		blocks := jf.blocks
+		jf.blocks = nil
+		for block, data := range blocks {
+			if err := fs.writeBlock(block, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	sb := fs.sb
+	sbBlock := sb.address / jf.size()
+	if _, ok := jf.blocks[sbBlock]; !ok {
+		// room for it was kept
+		if _, err := jf.hold(sbBlock); err != nil {
+			return err
+		}
+	}
+	sb.Feature_incompat |= FEATURE_INCOMPAT_RECOVER
+	sb.UpdateCsumAndWriteback()
+	blocks := jf.blocks
+	jf.blocks = nil
+
+	order := make([]int64, 0, len(blocks))
+	for block := range blocks {
+		order = append(order, block)
+	}
+	sort.Slice(order, func(a, b int) bool { return order[a] < order[b] })
+
+	sequence := j.sequence()
+	if err := j.writeTransaction(sequence, order, blocks); err != nil {
+		return err
+	}
+	if err := jf.sync(); err != nil {
+		return err
+	}
+	j.setField(0x1C, uint32(j.first()))
+	if err := j.writeSuperblock(); err != nil {
+		return err
+	}
+	if err := jf.sync(); err != nil {
+		return err
+	}
+
+	// the superblock goes first, so a crash during the checkpoint leaves it flagged
+	if err := fs.writeBlock(sbBlock, blocks[sbBlock]); err != nil {
+		return err
+	}
+	for _, block := range order {
+		if block == sbBlock {
+			continue
+		}
+		if err := fs.writeBlock(block, blocks[block]); err != nil {
+			return err
+		}
+	}
+	if err := jf.sync(); err != nil {
+		return err
+	}
+
+	j.setField(0x18, sequence+1)
+	j.setField(0x1C, 0)
+	if err := j.writeSuperblock(); err != nil {
+		return err
+	}
+	sb.Feature_incompat &^= FEATURE_INCOMPAT_RECOVER
+	sb.UpdateCsumAndWriteback()
+	return jf.sync()
+}
+
+// tagsPerDescriptor is how many blocks one descriptor block can log
+func (j *journal) tagsPerDescriptor() int64 {
+	space := j.fs.sb.GetBlockSize() - journalHeaderSize - 16
+	if j.checksummed() {
+		space -= journalTailSize
+	}
+	return space / int64(j.tagSize())
+}
+
+// capacity is the most blocks a single transaction can log, with room for its descriptor and
+// commit blocks
+func (j *journal) capacity() int64 {
+	per := j.tagsPerDescriptor()
+	return (j.maxLen() - j.first() - 1) * per / (per + 1)
+}
+
+// putJournalHeader fills in the common header of journal blocks
+func putJournalHeader(b []byte, blockType, sequence uint32) {
+	binary.BigEndian.PutUint32(b, journalMagic)
+	binary.BigEndian.PutUint32(b[4:], blockType)
+	binary.BigEndian.PutUint32(b[8:], sequence)
+}
+
+// putTag writes the descriptor block tag for tag into b
+func (j *journal) putTag(b []byte, tag journalTag) {
+	binary.BigEndian.PutUint32(b, uint32(tag.block))
+	if j.incompat()&journalFeatureIncompatCsumV3 != 0 {
+		binary.BigEndian.PutUint32(b[4:], tag.flags)
+		binary.BigEndian.PutUint32(b[12:], tag.checksum)
+	} else {
+		binary.BigEndian.PutUint16(b[4:], uint16(tag.checksum))
+		binary.BigEndian.PutUint16(b[6:], uint16(tag.flags))
+	}
+	if j.incompat()&journalFeatureIncompat64bit != 0 {
+		binary.BigEndian.PutUint32(b[8:], uint32(tag.block>>32))
+	}
+}
+
+// writeTransaction writes the given blocks to the log as transaction sequence, from the start of
+// the log, followed by the commit block. The journal must be empty.
+func (j *journal) writeTransaction(sequence uint32, order []int64, blocks map[int64][]byte) error {
+	bs := j.fs.sb.GetBlockSize()
+	per := int(j.tagsPerDescriptor())
+	n := j.first()
+	for len(order) > 0 {
+		chunk := order
+		if len(chunk) > per {
+			chunk = chunk[:per]
+		}
+		order = order[len(chunk):]
+
+		desc := make([]byte, bs)
+		putJournalHeader(desc, journalDescriptorBlock, sequence)
+		pos := journalHeaderSize
+		for i, block := range chunk {
+			logged := blocks[block]
+			tag := journalTag{block: block}
+			if binary.BigEndian.Uint32(logged) == journalMagic {
+				// the logged copy must not look like a journal block, replay puts the magic back
+				logged = append([]byte{0, 0, 0, 0}, logged[4:]...)
+				tag.flags |= journalFlagEscape
+			}
+			if i > 0 {
+				tag.flags |= journalFlagSameUUID
+			}
+			if i == len(chunk)-1 {
+				tag.flags |= journalFlagLastTag
+			}
+			tag.checksum = j.dataCsum(sequence, logged)
+			j.putTag(desc[pos:], tag)
+			pos += j.tagSize()
+			if i == 0 {
+				copy(desc[pos:], j.sb[0x30:0x40])
+				pos += 16
+			}
+			if err := j.fs.writeBlock(j.blocks[n+1+int64(i)], logged); err != nil {
+				return err
+			}
+		}
+		if j.checksummed() {
+			binary.BigEndian.PutUint32(desc[bs-journalTailSize:], jbd2Csum(j.seed, desc))
+		}
+		if err := j.fs.writeBlock(j.blocks[n], desc); err != nil {
+			return err
+		}
+		n += 1 + int64(len(chunk))
+	}
+
+	commit := make([]byte, bs)
+	putJournalHeader(commit, journalCommitBlock, sequence)
+	now := time.Now()
+	binary.BigEndian.PutUint64(commit[0x30:], uint64(now.Unix()))
+	binary.BigEndian.PutUint32(commit[0x38:], uint32(now.Nanosecond()))
+	if j.checksummed() {
+		binary.BigEndian.PutUint32(commit[0x10:], jbd2Csum(j.seed, commit))
+	}
+	return j.fs.writeBlock(j.blocks[n], commit)
+}
@@ -0,0 +1,210 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TuneOptions are the settings Tune changes, much like the options of tune2fs. A nil or empty
+// field leaves the setting as it is.
+type TuneOptions struct {
+	// VolumeName is the new label of the filesystem, at most 16 bytes (tune2fs -L)
+	VolumeName *string
+	// UUID is the new UUID of the filesystem (tune2fs -U). With metadata_csum the checksums are
+	// kept valid by turning on metadata_csum_seed, which stores the seed they were computed
+	// from; with uninit_bg the group descriptor checksums are recomputed.
+	UUID *uuid.UUID
+	// ReservedBlocksPercent is the share of blocks reserved for the super-user, at most 50
+	// (tune2fs -m)
+	ReservedBlocksPercent *uint8
+	// MountCount is the number of times the filesystem has been mounted (tune2fs -C)
+	MountCount *uint16
+	// MaxMountCount is how many mounts are allowed before a check, -1 for no limit (tune2fs -c)
+	MaxMountCount *int16
+	// CheckInterval is the longest time allowed between checks, 0 for no limit, in whole
+	// seconds (tune2fs -i)
+	CheckInterval *time.Duration
+	// DefaultMountOptions adjusts the default mount options in tune2fs -o syntax, e.g.
+	// "acl,^user_xattr,journal_data_writeback"
+	DefaultMountOptions string
+	// Features adjusts the features in tune2fs -O syntax, e.g. "dir_nlink,^metadata_csum_seed".
+	// Only the features that need nothing on disk to change can be turned on or off; changing
+	// any other is refused. Once read-only is turned on, the filesystem can only be read, so it
+	// cannot be turned off again with Tune.
+	Features string
+}
+
+var (
+	// tuneSetFeatures are the features Tune can turn on: they take effect for whatever is
+	// written from then on, or change nothing that is already there
+	tuneSetFeatures = mustParseFeatures("ext_attr,dir_index,large_file,huge_file,dir_nlink,extra_isize,read-only,extent,large_dir,encrypt,metadata_csum_seed")
+	// tuneClearFeatures are the features Tune can turn off: nothing on disk depends on them
+	tuneClearFeatures = mustParseFeatures("extra_isize,metadata_csum_seed")
+)
+
+// mountOptionList are the default mount options in the order and spelling of e2fsprogs. The
+// journal modes share a field and so are values rather than bits.
+var mountOptionList = []struct {
+	name  string
+	value uint32
+}{
+	{"debug", DEFM_DEBUG},
+	{"bsdgroups", DEFM_BSDGROUPS},
+	{"user_xattr", DEFM_XATTR_USER},
+	{"acl", DEFM_ACL},
+	{"uid16", DEFM_UID16},
+	{"journal_data", DEFM_JMODE_DATA},
+	{"journal_data_ordered", DEFM_JMODE_ORDERED},
+	{"journal_data_writeback", DEFM_JMODE_WBACK},
+	{"nobarrier", DEFM_NOBARRIER},
+	{"block_validity", DEFM_BLOCK_VALIDITY},
+	{"discard", DEFM_DISCARD},
+	{"nodelalloc", DEFM_NODELALLOC},
+}
+
+// defmJournalMode masks the journal mode among the default mount options
+const defmJournalMode = DEFM_JMODE_WBACK
+
+// parseMountOptions applies a specification of default mount options in the syntax of
+// tune2fs -o to a starting set: a comma or space separated list of option names, each
+// optionally prefixed with '^' to clear it rather than set it
+func parseMountOptions(spec string, base uint32) (uint32, error) {
+	ret := base
+	for _, word := range strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		word = strings.ToLower(word)
+		disable := strings.HasPrefix(word, "^")
+		if disable {
+			word = word[1:]
+		}
+		value, ok := uint32(0), false
+		for _, o := range mountOptionList {
+			if o.name == word {
+				value, ok = o.value, true
+				break
+			}
+		}
+		switch {
+		case !ok:
+			return ret, fmt.Errorf("unknown ext4 mount option %q", word)
+		case value&defmJournalMode == 0:
+			if disable {
+				ret &^= value
+			} else {
+				ret |= value
+			}
+		case !disable:
+			ret = ret&^defmJournalMode | value
+		case ret&defmJournalMode == value:
+			ret &^= defmJournalMode
+		}
+	}
+	return ret, nil
+}
+
+// Tune changes settings kept in the superblock of the filesystem, like tune2fs does, and
+// writes it along with all of its backups. All of the options are checked before anything is
+// changed.
+func (fs *FileSystem) Tune(opts TuneOptions) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	sb := fs.sb
+
+	if opts.VolumeName != nil && len(*opts.VolumeName) > 16 {
+		return fmt.Errorf("ext4 volume name %q is longer than 16 bytes", *opts.VolumeName)
+	}
+	if opts.ReservedBlocksPercent != nil && *opts.ReservedBlocksPercent > 50 {
+		return fmt.Errorf("ext4 reserved blocks percentage %d is above 50", *opts.ReservedBlocksPercent)
+	}
+	if i := opts.CheckInterval; i != nil && (*i < 0 || *i/time.Second > 0xFFFFFFFF) {
+		return fmt.Errorf("invalid ext4 check interval %v", *i)
+	}
+	mountOpts, err := parseMountOptions(opts.DefaultMountOptions, sb.Default_mount_opts)
+	if err != nil {
+		return err
+	}
+
+	old := sb.features()
+	features, err := parseFeatures(opts.Features, old)
+	if err != nil {
+		return err
+	}
+	if set := features.clear(old); !set.clear(tuneSetFeatures).empty() {
+		return fmt.Errorf("cannot turn on ext4 features %v with Tune", set.clear(tuneSetFeatures).names())
+	}
+	if cleared := old.clear(features); !cleared.clear(tuneClearFeatures).empty() {
+		return fmt.Errorf("cannot turn off ext4 features %v with Tune", cleared.clear(tuneClearFeatures).names())
+	}
+	id := sb.Uuid
+	if opts.UUID != nil {
+		copy(id[:], opts.UUID[:])
+	}
+	seed := sb.csumSeed()
+	if features.roCompat&FEATURE_RO_COMPAT_METADATA_CSUM != 0 && id != sb.Uuid {
+		// the checksums stay valid only if they go on being seeded as they were
+		features.incompat |= FEATURE_INCOMPAT_CSUM_SEED
+	}
+	if features.incompat&FEATURE_INCOMPAT_CSUM_SEED == 0 && old.incompat&FEATURE_INCOMPAT_CSUM_SEED != 0 &&
+		seed != ^crc32.Update(0, crc32.MakeTable(crc32.Castagnoli), id[:]) {
+		return fmt.Errorf("cannot turn off ext4 feature metadata_csum_seed, the checksums are not seeded from the UUID")
+	}
+	if features.roCompat&FEATURE_RO_COMPAT_EXTRA_ISIZE != 0 && sb.Inode_size == 128 {
+		return fmt.Errorf("ext4 feature extra_isize requires inodes larger than 128 bytes")
+	}
+
+	err = fs.transaction(func() error {
+		if opts.VolumeName != nil {
+			sb.Volume_name = [16]byte{}
+			copy(sb.Volume_name[:], *opts.VolumeName)
+		}
+		if opts.ReservedBlocksPercent != nil {
+			sb.setReservedBlockCount(sb.GetBlockCount() * int64(*opts.ReservedBlocksPercent) / 100)
+		}
+		if opts.MountCount != nil {
+			sb.Mnt_count = *opts.MountCount
+		}
+		if opts.MaxMountCount != nil {
+			sb.Max_mnt_count = uint16(*opts.MaxMountCount)
+		}
+		if opts.CheckInterval != nil {
+			sb.Checkinterval = uint32(*opts.CheckInterval / time.Second)
+		}
+		sb.Default_mount_opts = mountOpts
+
+		if features.incompat&FEATURE_INCOMPAT_CSUM_SEED != 0 && old.incompat&FEATURE_INCOMPAT_CSUM_SEED == 0 {
+			sb.Checksum_seed = seed
+		}
+		if features.incompat&FEATURE_INCOMPAT_CSUM_SEED == 0 {
+			sb.Checksum_seed = 0
+		}
+		if features.compat&FEATURE_COMPAT_DIR_INDEX != 0 && sb.Hash_seed == [4]uint32{} {
+			hashSeed := uuid.New()
+			for i := range sb.Hash_seed {
+				sb.Hash_seed[i] = binary.LittleEndian.Uint32(hashSeed[4*i:])
+			}
+		}
+		if features.roCompat&FEATURE_RO_COMPAT_EXTRA_ISIZE != 0 && sb.Want_extra_isize == 0 {
+			sb.Min_extra_isize, sb.Want_extra_isize = 32, 32
+		}
+		sb.setFeatures(features)
+		sb.Uuid = id
+		sb.UpdateCsumAndWriteback()
+
+		// group descriptor checksums without metadata_csum are seeded with the UUID itself
+		if sb.FeatureRoCompatGdt_csum() && !sb.FeatureRoCompatMetadata_csum() && opts.UUID != nil {
+			for g := int64(0); g < sb.BlockGroupCount(); g++ {
+				fs.getBlockGroupDescriptor(g).UpdateCsumAndWriteback()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return fs.writeBackups()
+}
@@ -0,0 +1,164 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// CorruptionError is returned when metadata read from the filesystem does not match its
+// checksum, unless the filesystem was read with IgnoreChecksums
+type CorruptionError struct {
+	// Structure names what is damaged: "superblock", "group descriptor", "inode",
+	// "extent block", "directory block" or "directory index block"
+	Structure string
+	// Group is the block group of a group descriptor, Inode the inode a structure is or belongs
+	// to, and Block the filesystem block holding it; each is -1 where it does not apply
+	Group, Inode, Block int64
+	// Stored is the checksum found on disk, Computed what it should have been
+	Stored, Computed uint32
+}
+
+func (e *CorruptionError) Error() string {
+	where := []string{}
+	if e.Group >= 0 {
+		where = append(where, fmt.Sprintf("group %d", e.Group))
+	}
+	if e.Inode >= 0 {
+		where = append(where, fmt.Sprintf("inode %d", e.Inode))
+	}
+	if e.Block >= 0 {
+		where = append(where, fmt.Sprintf("block %d", e.Block))
+	}
+	s := "ext4 " + e.Structure
+	if len(where) > 0 {
+		s += " (" + strings.Join(where, ", ") + ")"
+	}
+	return fmt.Sprintf("%s checksum is %#x, should be %#x", s, e.Stored, e.Computed)
+}
+
+// corrupted returns a *CorruptionError for the given structure, or nil if the filesystem is
+// read ignoring checksums
+func (fs *FileSystem) corrupted(structure string, group, inode, block int64, stored, computed uint32) error {
+	if fs.ignoreChecksums {
+		return nil
+	}
+	return &CorruptionError{
+		Structure: structure,
+		Group:     group,
+		Inode:     inode,
+		Block:     block,
+		Stored:    stored,
+		Computed:  computed,
+	}
+}
+
+// checksums returns the checksum stored in the superblock and the one computed from it
+func (sb *Superblock) checksums() (stored, computed uint32) {
+	c := *sb
+	c.toBytes()
+	return sb.Checksum, c.Checksum
+}
+
+// verify checks the checksum of the superblock under metadata_csum
+func (sb *Superblock) verify() error {
+	if !sb.FeatureRoCompatMetadata_csum() {
+		return nil
+	}
+	if stored, computed := sb.checksums(); stored != computed {
+		return sb.fs.corrupted("superblock", -1, -1, -1, stored, computed)
+	}
+	return nil
+}
+
+// checksums returns the checksum stored in the group descriptor and the one computed from it
+func (bgd *GroupDescriptor) checksums() (stored, computed uint16) {
+	c := *bgd
+	return bgd.Checksum, binary.LittleEndian.Uint16(c.toBytes()[0x1E:])
+}
+
+// verify checks the checksum of the group descriptor under metadata_csum or gdt_csum
+func (bgd *GroupDescriptor) verify() error {
+	sb := bgd.fs.sb
+	if !sb.FeatureRoCompatMetadata_csum() && !sb.FeatureRoCompatGdt_csum() {
+		return nil
+	}
+	if stored, computed := bgd.checksums(); stored != computed {
+		return bgd.fs.corrupted("group descriptor", bgd.num, -1, bgd.address/sb.GetBlockSize(), uint32(stored), uint32(computed))
+	}
+	return nil
+}
+
+// checksums returns the checksum stored in the inode and the one computed from it, only the low
+// 16 bits of either if the inode has no room for the high ones
+func (inode *Inode) checksums() (stored, computed uint32) {
+	computed = inode.csum(inode.raw)
+	stored = uint32(inode.Checksum_low)
+	if inode.hasCsumHi() {
+		stored |= uint32(inode.Checksum_hi) << 16
+	} else {
+		computed &= 0xFFFF
+	}
+	return stored, computed
+}
+
+// verify checks the checksum of the inode under metadata_csum. An inode that was never written
+// is all zeros and has none.
+func (inode *Inode) verify() error {
+	fs := inode.fs
+	if !fs.sb.FeatureRoCompatMetadata_csum() || isZero(inode.raw) {
+		return nil
+	}
+	if stored, computed := inode.checksums(); stored != computed {
+		return fs.corrupted("inode", -1, inode.num, inode.address/fs.sb.GetBlockSize(), stored, computed)
+	}
+	return nil
+}
+
+// verifyBlock checks the checksum of block lblk of the directory, stored in phys: that of its
+// tail for a leaf, or that after the entries of an index node of a hashed directory. Like the
+// kernel, a leaf without room for a checksum is accepted, and so is an index node too damaged to
+// find its checksum, which is left for reading it to fail.
+func (dir *directory) verifyBlock(lblk, phys int64, b []byte) error {
+	if !dir.sb.hasDirCsum() {
+		return nil
+	}
+	fs := dir.f.fs
+	inode := dir.f.inode
+	if hasCsumTail(b) {
+		if stored, computed := binary.LittleEndian.Uint32(b[len(b)-4:]), dirBlockCsum(inode, b); stored != computed {
+			return fs.corrupted("directory block", -1, inode.num, phys, stored, computed)
+		}
+		return nil
+	}
+	if !dir.isHashed() {
+		return nil
+	}
+	offset := dxRootEntries
+	if lblk != 0 {
+		// an interior node starts with a fake entry spanning the whole block
+		if binary.LittleEndian.Uint32(b[0:]) != 0 || int(binary.LittleEndian.Uint16(b[4:])) != len(b) {
+			return nil
+		}
+		offset = dxNodeEntries
+	}
+	n := &dxNode{lblk: lblk, phys: phys, b: b, offset: offset}
+	tail := offset + 8*n.limit()
+	if n.limit() != dir.sb.dxLimit(offset) || n.count() > n.limit() || tail+8 > len(b) {
+		return nil
+	}
+	if stored, computed := binary.LittleEndian.Uint32(b[tail+4:]), dir.dxNodeCsum(n); stored != computed {
+		return fs.corrupted("directory index block", -1, inode.num, phys, stored, computed)
+	}
+	return nil
+}
+
+// isZero reports whether b holds nothing but zeros
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
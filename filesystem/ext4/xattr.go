@@ -0,0 +1,519 @@
+package ext4
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	// XattrMagic identifies an extended attribute block
+	XattrMagic = 0xEA020000
+)
+
+// getFileACL returns the block holding the inode's extended attributes, or 0 if it has none
+func (inode *Inode) getFileACL() int64 {
+	return (int64(inode.File_acl_high) << 32) | int64(inode.File_acl_lo)
+}
+
+// xattrBlockCsum computes the checksum of an extended attribute block stored at block n
+func (fs *FileSystem) xattrBlockCsum(n int64, b []byte) uint32 {
+	num := make([]byte, 8)
+	binary.LittleEndian.PutUint64(num, uint64(n))
+	cs := newMetadataChecksummer(fs.sb)
+	cs.Write(num)
+	cs.Write(b[:16])
+	cs.Write([]byte{0, 0, 0, 0})
+	cs.Write(b[20:])
+	return cs.Get()
+}
+
+// releaseXattrBlock drops one reference to a shared extended attribute block, freeing it when
+// the last reference goes
+func (fs *FileSystem) releaseXattrBlock(n int64) error {
+	b, err := fs.readBlock(n)
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint32(b[0:]) != XattrMagic {
+		return fmt.Errorf("block %d is not an extended attribute block", n)
+	}
+	refcount := binary.LittleEndian.Uint32(b[4:])
+	if refcount <= 1 {
+		return fs.freeBlocks([]blockRange{{start: n, count: 1}})
+	}
+	binary.LittleEndian.PutUint32(b[4:], refcount-1)
+	if fs.sb.FeatureRoCompatMetadata_csum() {
+		binary.LittleEndian.PutUint32(b[16:], fs.xattrBlockCsum(n, b))
+	}
+	return fs.writeBlock(n, b)
+}
+
+// extended attribute name indexes, standing for the prefix of the name
+const (
+	xattrIndexUser           = 1
+	xattrIndexPosixACLAccess = 2
+	xattrIndexPosixACLDflt   = 3
+	xattrIndexTrusted        = 4
+	xattrIndexSecurity       = 6
+	xattrIndexSystem         = 7
+	xattrIndexRichACL        = 8
+)
+
+// xattrPrefixes are the prefixes of extended attribute names that ext4 can store, with the
+// name index standing for each. The ACLs are whole names.
+var xattrPrefixes = []struct {
+	index  uint8
+	prefix string
+}{
+	{xattrIndexPosixACLAccess, "system.posix_acl_access"},
+	{xattrIndexPosixACLDflt, "system.posix_acl_default"},
+	{xattrIndexRichACL, "system.richacl"},
+	{xattrIndexUser, "user."},
+	{xattrIndexTrusted, "trusted."},
+	{xattrIndexSecurity, "security."},
+	{xattrIndexSystem, "system."},
+}
+
+// xattrBlockHeaderSize is the size of the header of an extended attribute block, after which
+// its entries start
+const xattrBlockHeaderSize = 32
+
+// xattrEntrySize is the size of an extended attribute entry without its name
+const xattrEntrySize = 16
+
+// xattrEntry is a single extended attribute, with the prefix of its name given by index
+type xattrEntry struct {
+	index uint8
+	name  string
+	value []byte
+	// valueInode is the inode holding the value instead, with the ea_inode feature
+	valueInode uint32
+	// storedHash is the hash found on disk, kept for values in an inode, whose hash covers the
+	// hash of that inode
+	storedHash uint32
+}
+
+// hash is the hash of the entry stored alongside it
+func (e *xattrEntry) hash() uint32 {
+	if e.valueInode != 0 {
+		return e.storedHash
+	}
+	var hash uint32
+	for _, c := range []byte(e.name) {
+		hash = (hash << 5) ^ (hash >> 27) ^ uint32(c)
+	}
+	if len(e.value) > 0 {
+		v := make([]byte, (len(e.value)+3)&^3)
+		copy(v, e.value)
+		for i := 0; i < len(v); i += 4 {
+			hash = (hash << 16) ^ (hash >> 16) ^ binary.LittleEndian.Uint32(v[i:])
+		}
+	}
+	return hash
+}
+
+// parseXattrEntries parses the list of extended attribute entries that starts at first in b,
+// whose values lie at offsets from the start of b
+func parseXattrEntries(b []byte, first int) ([]xattrEntry, error) {
+	entries := []xattrEntry{}
+	pos := first
+	for pos+4 <= len(b) && binary.LittleEndian.Uint32(b[pos:]) != 0 {
+		if pos+xattrEntrySize > len(b) {
+			return nil, fmt.Errorf("extended attribute entry at %d overruns its space", pos)
+		}
+		nameLen := int(b[pos])
+		offset := int(binary.LittleEndian.Uint16(b[pos+2:]))
+		size := int(binary.LittleEndian.Uint32(b[pos+8:]))
+		if pos+xattrEntrySize+nameLen > len(b) {
+			return nil, fmt.Errorf("extended attribute name at %d overruns its space", pos)
+		}
+		e := xattrEntry{
+			index:      b[pos+1],
+			name:       string(b[pos+xattrEntrySize : pos+xattrEntrySize+nameLen]),
+			valueInode: binary.LittleEndian.Uint32(b[pos+4:]),
+			storedHash: binary.LittleEndian.Uint32(b[pos+12:]),
+		}
+		if e.valueInode == 0 {
+			if offset+size > len(b) {
+				return nil, fmt.Errorf("extended attribute value of %d bytes at %d overruns its space", size, offset)
+			}
+			e.value = append([]byte{}, b[offset:offset+size]...)
+		}
+		entries = append(entries, e)
+		pos += (xattrEntrySize + nameLen + 3) &^ 3
+	}
+	return entries, nil
+}
+
+// packXattrEntries lays out entries from first in b, with their values packed at the end of b,
+// followed by the four zero bytes that end the list. It returns false if they do not fit.
+func packXattrEntries(b []byte, first int, entries []xattrEntry) bool {
+	for i := first; i < len(b); i++ {
+		b[i] = 0
+	}
+	pos, end := first, len(b)
+	for _, e := range entries {
+		size := (xattrEntrySize + len(e.name) + 3) &^ 3
+		valueSize := 0
+		if e.valueInode == 0 {
+			valueSize = (len(e.value) + 3) &^ 3
+		}
+		if pos+size+4 > end-valueSize {
+			return false
+		}
+		offset := 0
+		if valueSize > 0 {
+			end -= valueSize
+			offset = end
+			copy(b[end:], e.value)
+		}
+		b[pos] = uint8(len(e.name))
+		b[pos+1] = e.index
+		binary.LittleEndian.PutUint16(b[pos+2:], uint16(offset))
+		binary.LittleEndian.PutUint32(b[pos+4:], e.valueInode)
+		binary.LittleEndian.PutUint32(b[pos+8:], uint32(len(e.value)))
+		binary.LittleEndian.PutUint32(b[pos+12:], e.hash())
+		copy(b[pos+xattrEntrySize:], e.name)
+		pos += size
+	}
+	return true
+}
+
+// ibodyXattrStart is the offset within the inode of the extended attributes stored in it, which
+// begin with a magic number. The kernel ignores the space after an inode without extra fields, so
+// it gets them when attributes are stored there.
+func (inode *Inode) ibodyXattrStart() int {
+	n := inode.Extra_isize
+	if n == 0 {
+		n = inode.fs.sb.Want_extra_isize
+	}
+	if n == 0 {
+		n = 32
+	}
+	return 128 + int(n)
+}
+
+// ibodyXattrs returns the extended attributes stored in the inode itself
+func (inode *Inode) ibodyXattrs() ([]xattrEntry, error) {
+	start, size := inode.ibodyXattrStart(), int(inode.fs.sb.Inode_size)
+	if inode.Extra_isize == 0 || start+4 > size || len(inode.raw) < size || binary.LittleEndian.Uint32(inode.raw[start:]) != XattrMagic {
+		return []xattrEntry{}, nil
+	}
+	entries, err := parseXattrEntries(inode.raw[start+4:size], 0)
+	if err != nil {
+		return nil, fmt.Errorf("inode %d: %v", inode.num, err)
+	}
+	return entries, nil
+}
+
+// setIbodyXattrs replaces the extended attributes stored in the inode itself, failing if there
+// is not enough room for them. The inode still has to be written back.
+func (inode *Inode) setIbodyXattrs(entries []xattrEntry) error {
+	start, size := inode.ibodyXattrStart(), int(inode.fs.sb.Inode_size)
+	raw := make([]byte, size)
+	copy(raw, inode.raw)
+	switch {
+	case len(entries) == 0:
+		if start+4 <= size {
+			for i := start; i < size; i++ {
+				raw[i] = 0
+			}
+		}
+	case start+4 > size || !packXattrEntries(raw[start+4:], 0, entries):
+		return fmt.Errorf("not enough room for extended attributes in inode %d", inode.num)
+	default:
+		binary.LittleEndian.PutUint32(raw[start:], XattrMagic)
+		inode.Extra_isize = uint16(start - 128)
+	}
+	inode.raw = raw
+	return nil
+}
+
+// splitXattrName splits a full extended attribute name into its name index and the rest
+func splitXattrName(name string) (uint8, string, error) {
+	for _, p := range xattrPrefixes {
+		if strings.HasPrefix(name, p.prefix) {
+			rest := name[len(p.prefix):]
+			if len(rest) > 255 {
+				return 0, "", fmt.Errorf("extended attribute name %s is too long", name)
+			}
+			return p.index, rest, nil
+		}
+	}
+	return 0, "", fmt.Errorf("unsupported extended attribute namespace in %s", name)
+}
+
+// fullName is the name of the entry with its prefix
+func (e *xattrEntry) fullName() string {
+	for _, p := range xattrPrefixes {
+		if p.index == e.index {
+			return p.prefix + e.name
+		}
+	}
+	return fmt.Sprintf("unknown%d.%s", e.index, e.name)
+}
+
+// xattrLess is the order of entries in an extended attribute block
+func xattrLess(a, b *xattrEntry) bool {
+	if a.index != b.index {
+		return a.index < b.index
+	}
+	if len(a.name) != len(b.name) {
+		return len(a.name) < len(b.name)
+	}
+	return a.name < b.name
+}
+
+// xattrs returns the extended attributes of the inode, those stored in the inode itself and
+// those in its extended attribute block
+func (inode *Inode) xattrs() (ibody, block []xattrEntry, err error) {
+	if ibody, err = inode.ibodyXattrs(); err != nil {
+		return nil, nil, err
+	}
+	block = []xattrEntry{}
+	if n := inode.getFileACL(); n != 0 {
+		b, err := inode.fs.readBlock(n)
+		if err != nil {
+			return nil, nil, err
+		}
+		if binary.LittleEndian.Uint32(b[0:]) != XattrMagic || binary.LittleEndian.Uint32(b[8:]) != 1 {
+			return nil, nil, fmt.Errorf("block %d of inode %d is not an extended attribute block", n, inode.num)
+		}
+		if block, err = parseXattrEntries(b, xattrBlockHeaderSize); err != nil {
+			return nil, nil, fmt.Errorf("extended attribute block %d: %v", n, err)
+		}
+	}
+	return ibody, block, nil
+}
+
+// setXattrBlock replaces the extended attribute block of the inode with one holding entries. A
+// block shared with other inodes is left to them and the inode gets a block of its own. The
+// inode still has to be written back.
+func (inode *Inode) setXattrBlock(entries []xattrEntry) error {
+	fs := inode.fs
+	old := inode.getFileACL()
+	if len(entries) == 0 {
+		if old != 0 {
+			if err := fs.releaseXattrBlock(old); err != nil {
+				return err
+			}
+			inode.File_acl_lo, inode.File_acl_high = 0, 0
+			inode.addBlockCount(-1)
+		}
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return xattrLess(&entries[i], &entries[j]) })
+	b := make([]byte, fs.sb.GetBlockSize())
+	if !packXattrEntries(b, xattrBlockHeaderSize, entries) {
+		return fmt.Errorf("not enough room for extended attributes of inode %d", inode.num)
+	}
+	var hash uint32
+	for _, e := range entries {
+		hash = (hash << 16) ^ (hash >> 16) ^ e.hash()
+	}
+	binary.LittleEndian.PutUint32(b[0:], XattrMagic)
+	binary.LittleEndian.PutUint32(b[4:], 1)
+	binary.LittleEndian.PutUint32(b[8:], 1)
+	binary.LittleEndian.PutUint32(b[12:], hash)
+
+	n := old
+	if old != 0 {
+		ob, err := fs.readBlock(old)
+		if err != nil {
+			return err
+		}
+		if binary.LittleEndian.Uint32(ob[4:]) > 1 {
+			if err := fs.releaseXattrBlock(old); err != nil {
+				return err
+			}
+			n = 0
+		}
+	}
+	if n == 0 {
+		var count int64
+		var err error
+		// like the kernel, at the start of the group of the inode
+		if n, count, err = fs.allocBlocks(fs.sb.groupFirstBlock((inode.num-1)/int64(fs.sb.InodePer_group)), 1); err != nil {
+			return err
+		}
+		if count == 0 {
+			return fmt.Errorf("no free block for extended attributes of inode %d", inode.num)
+		}
+		if old == 0 {
+			inode.addBlockCount(1)
+		}
+		inode.File_acl_lo = uint32(n)
+		inode.File_acl_high = uint16(n >> 32)
+	}
+	if fs.sb.FeatureRoCompatMetadata_csum() {
+		binary.LittleEndian.PutUint32(b[16:], fs.xattrBlockCsum(n, b))
+	}
+	return fs.writeBlock(n, b)
+}
+
+// xattrValue returns the value of e, reading it from its own inode if it is stored in one
+func (fs *FileSystem) xattrValue(e *xattrEntry) ([]byte, error) {
+	if e.valueInode == 0 {
+		return e.value, nil
+	}
+	inode, err := fs.readInode(int64(e.valueInode))
+	if err != nil {
+		return nil, err
+	}
+	value := make([]byte, inode.GetSize())
+	f := &File{extFile{fs: fs, inode: inode}}
+	if _, err := io.ReadFull(f, value); err != nil {
+		return nil, fmt.Errorf("error reading extended attribute %s from inode %d: %v", e.fullName(), e.valueInode, err)
+	}
+	return value, nil
+}
+
+// GetXattr returns the value of the named extended attribute of the file at p, such as
+// "user.comment" or "security.selinux", without following a final symbolic link. POSIX ACLs are
+// returned in the form used by getxattr(2), see DecodePosixACL.
+func (fs *FileSystem) GetXattr(p, name string) ([]byte, error) {
+	index, short, err := splitXattrName(name)
+	if err != nil {
+		return nil, err
+	}
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	ibody, block, err := inode.xattrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range append(ibody, block...) {
+		if e.index != index || e.name != short || e.isInlineData() {
+			continue
+		}
+		value, err := fs.xattrValue(&e)
+		if err != nil {
+			return nil, err
+		}
+		if index == xattrIndexPosixACLAccess || index == xattrIndexPosixACLDflt {
+			return aclFromDisk(value)
+		}
+		return value, nil
+	}
+	return nil, fmt.Errorf("no extended attribute %s on %s", name, p)
+}
+
+// ListXattr returns the names of all extended attributes of the file at p, without following a
+// final symbolic link
+func (fs *FileSystem) ListXattr(p string) ([]string, error) {
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	ibody, block, err := inode.xattrs()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range append(ibody, block...) {
+		if !e.isInlineData() {
+			names = append(names, e.fullName())
+		}
+	}
+	return names, nil
+}
+
+// SetXattr sets the named extended attribute of the file at p, without following a final
+// symbolic link, replacing any previous value. It is stored in the inode when there is room for
+// it and in the extended attribute block of the inode otherwise. POSIX ACLs are given in the form
+// used by setxattr(2), see EncodePosixACL.
+func (fs *FileSystem) SetXattr(p, name string, value []byte) error {
+	index, short, err := splitXattrName(name)
+	if err != nil {
+		return err
+	}
+	if index == xattrIndexPosixACLAccess || index == xattrIndexPosixACLDflt {
+		if value, err = aclToDisk(value); err != nil {
+			return err
+		}
+	}
+	if value == nil {
+		value = []byte{}
+	}
+	return fs.changeXattr(p, &xattrEntry{index: index, name: short, value: value})
+}
+
+// RemoveXattr removes the named extended attribute from the file at p, without following a final
+// symbolic link
+func (fs *FileSystem) RemoveXattr(p, name string) error {
+	index, short, err := splitXattrName(name)
+	if err != nil {
+		return err
+	}
+	return fs.changeXattr(p, &xattrEntry{index: index, name: short, value: nil})
+}
+
+// changeXattr replaces the extended attribute of the file at p with the name of e by e, or
+// removes it when e has no value
+func (fs *FileSystem) changeXattr(p string, e *xattrEntry) error {
+	if fs.readOnly() {
+		return fs.errReadOnly()
+	}
+	if !fs.sb.FeatureCompatExt_attr() {
+		return fmt.Errorf("filesystem does not have the ext_attr feature")
+	}
+	if e.isInlineData() {
+		return fmt.Errorf("extended attribute system.data holds inline data and cannot be changed")
+	}
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return err
+	}
+	return fs.transaction(func() error {
+		ibody, block, err := inode.xattrs()
+		if err != nil {
+			return err
+		}
+		found := false
+		remove := func(entries []xattrEntry) ([]xattrEntry, error) {
+			kept := []xattrEntry{}
+			for _, old := range entries {
+				if old.index != e.index || old.name != e.name {
+					kept = append(kept, old)
+					continue
+				}
+				if old.valueInode != 0 {
+					return nil, fmt.Errorf("cannot change extended attribute %s stored in inode %d", e.fullName(), old.valueInode)
+				}
+				found = true
+			}
+			return kept, nil
+		}
+		if ibody, err = remove(ibody); err != nil {
+			return err
+		}
+		if block, err = remove(block); err != nil {
+			return err
+		}
+		if e.value == nil && !found {
+			return fmt.Errorf("no extended attribute %s on %s", e.fullName(), p)
+		}
+
+		// the inode is tried first, as the kernel does
+		if e.value == nil || inode.setIbodyXattrs(append(ibody, *e)) != nil {
+			if e.value != nil {
+				block = append(block, *e)
+			}
+			if err := inode.setIbodyXattrs(ibody); err != nil {
+				return err
+			}
+		}
+		if err := inode.setXattrBlock(block); err != nil {
+			return err
+		}
+		inode.touch(timeChange)
+		inode.UpdateCsumAndWriteback()
+		return nil
+	})
+}
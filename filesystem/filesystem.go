@@ -33,4 +33,8 @@ const (
 	TypeSquashfs
 	// TypeExt4 is a ext4 filesystem
 	TypeExt4
+	// TypeExt2 is an ext2 filesystem, read and written by the ext4 package
+	TypeExt2
+	// TypeExt3 is an ext3 filesystem, read and written by the ext4 package
+	TypeExt3
 )
@@ -26,3 +26,8 @@ func (f *FileImpl) WriteAt(b []byte, offset int64) (int, error) {
 func (f *FileImpl) Seek(offset int64, whence int) (int64, error) {
 	return 0, fmt.Errorf("FileImpl does not implement Seek()")
 }
+
+// Read read from the current position - does not actually work
+func (f *FileImpl) Read(b []byte) (int, error) {
+	return 0, fmt.Errorf("FileImpl does not implement Read()")
+}